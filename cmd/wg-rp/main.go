@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/internal/clientcmd"
+	"github.com/DevonTM/wg-rp/internal/servercmd"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  server    Run the reverse proxy server (same flags as rps)\n")
+	fmt.Fprintf(os.Stderr, "  client    Run the reverse proxy client and its subcommands (same flags as rpc)\n\n")
+	fmt.Fprintf(os.Stderr, "Run %s <command> -h for the flags of a command, or %s -V for the version.\n", os.Args[0], os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "server":
+		servercmd.Run("wg-rp server", os.Args[2:])
+	case "client":
+		clientcmd.Run("wg-rp client", os.Args[2:])
+	case "-V", "--version", "version":
+		cli.PrintVersion("")
+	case "-h", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
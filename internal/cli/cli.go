@@ -0,0 +1,159 @@
+// Package cli holds the startup code shared by the wg-rp, rps and rpc commands
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	wgrp "github.com/DevonTM/wg-rp"
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/config"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// EnvPrefix prefixes the environment variables flags fall back to, e.g. WGRP_API_PORT for -api-port
+const EnvPrefix = "WGRP_"
+
+// PrintVersion prints the version of a mode ("server" or "client", empty for the combined
+// command) and exits
+func PrintVersion(mode string) {
+	if mode == "" {
+		fmt.Printf("wg-rp version %s\n", wgrp.VERSION)
+	} else {
+		fmt.Printf("wg-rp %s version %s\n", mode, wgrp.VERSION)
+	}
+	os.Exit(0)
+}
+
+// ApplyEnv sets the flags of fs that weren't given from the environment and returns what was set
+func ApplyEnv(fs *flag.FlagSet, fallbacks map[string]utils.EnvFallback) []string {
+	applied, err := utils.ApplyEnv(fs, EnvPrefix, fallbacks)
+	if err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+	return applied
+}
+
+// LogEnv logs the settings taken from the environment
+func LogEnv(applied []string) {
+	for _, setting := range applied {
+		log.Printf("Using %s", setting)
+	}
+}
+
+// StartDevice logs the startup of a mode, reads the WireGuard configuration and brings up the
+// device. It exits if either fails. Hook commands see the file name without .conf as %i, as
+// with wg-quick.
+func StartDevice(mode, configFile string, strictPerms, verbose bool, opts ...wireguard.DeviceOption) *wireguard.WireGuardDevice {
+	// Print version on startup
+	log.Printf("wg-rp %s version %s starting...", mode, wgrp.VERSION)
+
+	// Read WireGuard config
+	configData, err := config.ReadSecretFile(configFile, strictPerms)
+	if err != nil {
+		log.Fatalf("Failed to read config file %s: %v", configFile, err)
+	}
+
+	// Initialize WireGuard device
+	name := strings.TrimSuffix(filepath.Base(configFile), ".conf")
+	wgDevice, err := wireguard.NewWireGuardDevice(string(configData), verbose,
+		append([]wireguard.DeviceOption{wireguard.WithName(name)}, opts...)...)
+	if err != nil {
+		log.Fatalf("Failed to initialize WireGuard device: %v", err)
+	}
+	return wgDevice
+}
+
+// TCPTuningOptions returns the device option sizing the netstack TCP buffers to sendKB and recvKB,
+// or none if both are 0 for gVisor's defaults
+func TCPTuningOptions(sendKB, recvKB int) []wireguard.DeviceOption {
+	if sendKB == 0 && recvKB == 0 {
+		return nil
+	}
+	return []wireguard.DeviceOption{wireguard.WithTCPTuning(wireguard.TCPTuning{
+		SendBuffer:    sendKB * 1024,
+		ReceiveBuffer: recvKB * 1024,
+	})}
+}
+
+// ShutdownSignals returns a channel that receives interrupt and termination signals
+func ShutdownSignals() <-chan os.Signal {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	return sigChan
+}
+
+// HookOptions returns the device options for the -allow-hooks and -hook-timeout flags
+func HookOptions(allowHooks bool, hookTimeout time.Duration) []wireguard.DeviceOption {
+	if !allowHooks {
+		return nil
+	}
+	log.Printf("WARNING: running the PreUp/PostUp/PreDown/PostDown hooks of the WireGuard config")
+	return []wireguard.DeviceOption{wireguard.WithHooks(hookTimeout)}
+}
+
+// StartHandshakeMonitor starts tracking the health of the tunnel to each peer of wgDevice and logs
+// every change once: the process stays healthy when the tunnel goes down, so this is often the only
+// sign of it
+func StartHandshakeMonitor(wgDevice *wireguard.WireGuardDevice) *wireguard.HandshakeMonitor {
+	monitor := wireguard.NewHandshakeMonitor(wgDevice.Device, func(publicKey string, health wireguard.TunnelHealth, age time.Duration) {
+		switch health {
+		case wireguard.TunnelUp:
+			log.Printf("WireGuard tunnel to peer %s is up again", publicKey)
+		case wireguard.TunnelDegraded:
+			log.Printf("WARNING: WireGuard tunnel to peer %s is degraded, no handshake for %s", publicKey, utils.FormatDuration(age))
+		case wireguard.TunnelDown:
+			log.Printf("WARNING: WireGuard tunnel to peer %s is down, no handshake for %s; check that the peer is running and its endpoint is reachable",
+				publicKey, utils.FormatDuration(age))
+		}
+	})
+	monitor.Start()
+	return monitor
+}
+
+// PeerStats returns a function reporting the WireGuard peers of wgDevice to the status APIs, with
+// the health of the tunnel to each as monitor last saw it
+func PeerStats(wgDevice *wireguard.WireGuardDevice, monitor *wireguard.HandshakeMonitor) func() []api.PeerStats {
+	return func() []api.PeerStats {
+		peers, err := wgDevice.Stats()
+		if err != nil {
+			log.Printf("Failed to read WireGuard peer stats: %v", err)
+			return nil
+		}
+
+		now := time.Now()
+		health := monitor.Peers()
+		stats := make([]api.PeerStats, 0, len(peers))
+		for _, peer := range peers {
+			s := api.PeerStats{
+				PublicKey:      peer.PublicKey,
+				Endpoint:       peer.Endpoint,
+				HandshakeStale: peer.HandshakeStale(now),
+				Health:         string(health[peer.PublicKey]),
+				RxBytes:        peer.RxBytes,
+				TxBytes:        peer.TxBytes,
+			}
+			if !peer.LastHandshake.IsZero() {
+				s.LastHandshake = peer.LastHandshake.Unix()
+			}
+			stats = append(stats, s)
+		}
+		return stats
+	}
+}
+
+// LastHandshake describes when a peer last completed a handshake, e.g. "2m5s ago" or "never"
+func LastHandshake(peer api.PeerStats) string {
+	if peer.LastHandshake == 0 {
+		return "never"
+	}
+	return utils.FormatDuration(time.Since(time.Unix(peer.LastHandshake, 0))) + " ago"
+}
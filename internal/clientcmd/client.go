@@ -0,0 +1,528 @@
+// Package clientcmd implements the wg-rp client command, run as rpc or wg-rp client
+package clientcmd
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/client"
+	"github.com/DevonTM/wg-rp/pkg/compress"
+	"github.com/DevonTM/wg-rp/pkg/logger"
+	"github.com/DevonTM/wg-rp/pkg/socks"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// clientOptions holds the flags shared by every client mode
+type clientOptions struct {
+	configFile   string
+	verbose      logger.VerboseLevel
+	bufferSizeKB int
+	maxBufferMB  int
+	serverPort   int
+	rttWarn      time.Duration
+	heartbeat    time.Duration // fixed heartbeat interval, 0 to follow the server
+	dialTimeout  time.Duration
+	resolve      string
+	resolveTTL   time.Duration
+	checkLocal   localCheckFlag
+	authToken    string
+	outputFormat string
+	logLevel     string
+	strictPerms  bool
+	allowHooks   bool
+	hookTimeout  time.Duration
+
+	tcpSendBufferKB int
+	tcpRecvBufferKB int
+	wgBatch         int
+
+	mtu          string
+	autoMTUProbe bool
+	checkMTU     bool
+
+	reresolveAfter  time.Duration // re-resolve peer endpoint hostnames after this long without a handshake, 0 to disable
+	resolveInterval time.Duration // re-resolve them this often regardless, 0 to disable
+
+	reregisterRetries int
+	reregisterDelay   time.Duration
+	tunnelWait        time.Duration
+	fallbackServers   utils.ArrayFlags
+	serverIP          string // overrides the server IP detected from the WireGuard config
+
+	controlSocket string
+	stateFile     string
+
+	maxConnsPerSecond float64
+	maxConnsBurst     int
+	localProbe        string
+	compression       string
+
+	schedules           utils.ArrayFlags
+	scheduleCloseActive bool
+
+	routesFile string                // watched for route changes while running
+	fileRoutes []client.RouteMapping // routes loaded from routesFile at startup
+
+	localForwards []client.LocalForward // ports on the host network forwarded to targets of the server
+	socksAddr     string
+	socksAuth     string // user:password SOCKS5 clients must send, empty for none
+}
+
+// register adds the shared client flags to a flag set
+func (o *clientOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.configFile, "c", "wg-client.conf", "WireGuard configuration file")
+	o.verbose.Register(fs)
+	fs.IntVar(&o.bufferSizeKB, "b", 32, "Buffer size for i/o operations (in KB, minimum 1KB)")
+	fs.IntVar(&o.maxBufferMB, "max-buffer-mem", 0, "Memory the relay buffers may hold, pooled or in use (in MB, 0 = unlimited); beyond it connections use throwaway buffers")
+	fs.IntVar(&o.serverPort, "api-port", client.DefaultServerPort, "Port of the server REST API within the WireGuard netstack")
+	fs.DurationVar(&o.heartbeat, "heartbeat-interval", 0, "Send heartbeats at this interval instead of the server's (default: the server's, 20s until it advertises one)")
+	fs.DurationVar(&o.rttWarn, "rtt-warn", time.Second, "Log a warning when the heartbeat round-trip time exceeds this")
+	fs.DurationVar(&o.dialTimeout, "dial-timeout", client.DefaultDialTimeout, "How long to wait when connecting to a local service")
+	fs.StringVar(&o.resolve, "resolve", string(client.ResolveOnce), "When hostnames of local targets are resolved: once (at startup) or per-connection")
+	fs.DurationVar(&o.resolveTTL, "resolve-ttl", client.DefaultResolveTTL, "How long a per-connection lookup of a local hostname is reused")
+	fs.Var(&o.checkLocal, "check-local", "Dial each local service before registering its route and warn about routes that point at nothing; -check-local=strict refuses to start instead")
+	fs.StringVar(&o.authToken, "auth-token", "", "Bearer token sent with every request to the server API (prefer WGRP_AUTH_TOKEN, arguments are visible to other users)")
+	fs.StringVar(&o.serverIP, "server-ip", "", "Server IP within the WireGuard network, instead of detecting it from the host routes in the peers' AllowedIPs")
+	fs.Var(&o.fallbackServers, "fallback-server", "Server IP within the WireGuard network to switch to when the server stops answering heartbeats, tried in the order given (can be used multiple times)")
+	fs.IntVar(&o.reregisterRetries, "reregister-retries", client.DefaultReregisterRetries, "Retries of a mapping that fails to re-register after a server restart")
+	fs.DurationVar(&o.reregisterDelay, "reregister-delay", client.DefaultReregisterDelay, "Delay before the first re-registration retry, doubled for each further retry")
+	fs.DurationVar(&o.tunnelWait, "tunnel-wait", client.DefaultTunnelWait, "How long to wait for the WireGuard tunnel once heartbeats fail because no handshake completes, before shutting down (0 = wait forever)")
+	fs.Float64Var(&o.maxConnsPerSecond, "max-conns-per-second", 0, "Ask the server to accept at most this many new connections per second on each mapping (0 = unlimited)")
+	fs.IntVar(&o.maxConnsBurst, "max-conns-burst", 0, "Connections accepted at once above the rate limit (0 = one second's worth)")
+	fs.StringVar(&o.compression, "compression", api.CompressionNone, "Compress the tunnel leg of mappings without their own setting: none, snappy (fast) or zstd (smaller), if the server supports it")
+	fs.StringVar(&o.localProbe, "local-probe", "", "Have the server answer health checks from its own host instead of relaying them: accept (accept and close) or http (HTTP 200)")
+	fs.BoolVar(&o.allowHooks, "allow-hooks", false, "Run the PreUp, PostUp, PreDown and PostDown commands of the WireGuard config")
+	fs.DurationVar(&o.hookTimeout, "hook-timeout", wireguard.DefaultHookTimeout, "How long each hook command may run")
+	fs.IntVar(&o.tcpSendBufferKB, "tcp-send-buffer", 0, "Send buffer of each TCP connection in the WireGuard netstack, the data it may have in flight (in KB, 0 = 1024); raise it for links with a large bandwidth-delay product")
+	fs.IntVar(&o.tcpRecvBufferKB, "tcp-recv-buffer", 0, "Initial receive window of each TCP connection in the WireGuard netstack, grown as needed up to 4096KB or this size (in KB, 0 = 1024)")
+	fs.IntVar(&o.wgBatch, "wg-batch", 0, "Packets WireGuard sends and hands on per batch, 1 to 128 (0 = wireguard-go's own: up to 128 per system call with GSO and GRO on Linux, 1 elsewhere)")
+	fs.StringVar(&o.mtu, "mtu", "", "MTU of the WireGuard device in place of the config's, or auto to probe the path to the server with pings of 576 to 1500 bytes at startup and use the largest that gets through (default: the config's, or detected)")
+	fs.BoolVar(&o.autoMTUProbe, "auto-mtu-probe", false, "Same as -mtu auto")
+	fs.BoolVar(&o.checkMTU, "check-mtu", true, "Check in the background after startup that packets of the full MTU get through to the server, and warn with the largest that does if not")
+	fs.DurationVar(&o.reresolveAfter, "reresolve-after", wireguard.DefaultReresolveAfter, "Look up the hostname of a peer's Endpoint again when it goes this long without a handshake, and switch to the new address if it changed (0 = never)")
+	fs.DurationVar(&o.resolveInterval, "resolve-interval", 0, "Also look up the hostnames of the peers' Endpoints again at this interval, whatever the handshakes (0 = disabled)")
+	fs.BoolVar(&o.strictPerms, "strict-perms", false, "Refuse to start if the configuration file is readable by group or others")
+	fs.StringVar(&o.stateFile, "state-file", client.DefaultStateFile(), "File remembering the client port of each remote port across restarts (empty to disable)")
+	fs.StringVar(&o.controlSocket, "control-socket", defaultControlSocket(), "Control socket for rpc add, rm, status and server-status (empty to disable)")
+	fs.StringVar(&o.outputFormat, "output-format", "text", "Log output format: text (stderr) or json (stdout)")
+	fs.StringVar(&o.logLevel, "log-level", "info", "Log level: trace, debug, info, warn or error")
+}
+
+// validate checks the shared client flags and configures logging
+func (o *clientOptions) validate() {
+	if _, err := logger.Setup(o.outputFormat, o.logLevel, o.verbose); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	// Validate buffer size
+	if o.bufferSizeKB < 1 {
+		log.Fatal("Buffer size must be at least 1KB")
+	}
+
+	// Validate buffer memory limit
+	if o.maxBufferMB < 0 || (o.maxBufferMB > 0 && o.maxBufferMB*1024 < o.bufferSizeKB) {
+		log.Fatal("Buffer memory limit must not be negative and must hold at least one buffer")
+	}
+
+	// Validate dial timeout
+	if o.dialTimeout <= 0 {
+		log.Fatal("Dial timeout must be positive")
+	}
+
+	// Validate heartbeat interval
+	if o.heartbeat != 0 && (o.heartbeat < client.MinHeartbeatInterval || o.heartbeat > client.MaxHeartbeatInterval) {
+		log.Fatalf("Heartbeat interval must be between %s and %s", client.MinHeartbeatInterval, client.MaxHeartbeatInterval)
+	}
+
+	// Validate hook timeout
+	if o.hookTimeout <= 0 {
+		log.Fatal("Hook timeout must be positive")
+	}
+
+	// Validate endpoint re-resolution
+	if o.reresolveAfter != 0 && o.reresolveAfter < wireguard.DefaultMaxHandshakeAge {
+		log.Fatalf("Re-resolve age must be 0 or at least %s, handshakes are only renewed every 2 minutes", wireguard.DefaultMaxHandshakeAge)
+	}
+	if o.resolveInterval != 0 && o.resolveInterval < time.Minute {
+		log.Fatal("Resolve interval must be 0 or at least 1m")
+	}
+
+	// Validate netstack TCP buffers
+	for _, kb := range []int{o.tcpSendBufferKB, o.tcpRecvBufferKB} {
+		if kb < 0 || (kb > 0 && kb*1024 < wireguard.MinTCPBuffer) {
+			log.Fatalf("TCP buffer sizes must be 0 or at least %dKB", wireguard.MinTCPBuffer/1024)
+		}
+	}
+
+	// Validate MTU
+	if _, _, err := parseMTU(o.mtu); err != nil {
+		log.Fatal(err)
+	}
+
+	// Validate WireGuard batch size
+	if o.wgBatch < 0 || o.wgBatch > wireguard.MaxBatchSize {
+		log.Fatalf("WireGuard batch size must be between 0 and %d", wireguard.MaxBatchSize)
+	}
+
+	// Validate resolve mode
+	if _, err := client.ParseResolveMode(o.resolve); err != nil {
+		log.Fatal(err)
+	}
+	if o.resolveTTL <= 0 {
+		log.Fatal("Resolve TTL must be positive")
+	}
+
+	// Validate re-registration retries
+	if o.reregisterRetries < 0 || o.reregisterDelay <= 0 {
+		log.Fatal("Re-registration retries must not be negative and the delay must be positive")
+	}
+
+	// Validate tunnel wait
+	if o.tunnelWait < 0 {
+		log.Fatal("Tunnel wait must not be negative")
+	}
+
+	// Validate connection rate limit
+	if o.maxConnsPerSecond < 0 || o.maxConnsBurst < 0 {
+		log.Fatal("Connection rate limit and burst must not be negative")
+	}
+
+	// Validate local probe mode
+	if o.localProbe != "" && o.localProbe != api.LocalProbeAccept && o.localProbe != api.LocalProbeHTTP {
+		log.Fatalf("Invalid local probe mode %q (use %s or %s)", o.localProbe, api.LocalProbeAccept, api.LocalProbeHTTP)
+	}
+
+	// Validate compression
+	if !compress.Supported(o.compression) {
+		log.Fatalf("Invalid compression %q (use %s, %s or %s)", o.compression, api.CompressionNone, api.CompressionSnappy, api.CompressionZstd)
+	}
+
+	// Validate server IP
+	if o.serverIP != "" {
+		if _, err := netip.ParseAddr(strings.Trim(o.serverIP, "[]")); err != nil {
+			log.Fatalf("Invalid server IP %q: %v", o.serverIP, err)
+		}
+	}
+
+	// Validate fallback servers
+	for _, s := range o.fallbackServers {
+		if _, err := netip.ParseAddr(strings.Trim(s, "[]")); err != nil {
+			log.Fatalf("Invalid fallback server %q: %v", s, err)
+		}
+	}
+
+	// Validate server API port
+	if o.serverPort < 1 || o.serverPort > 65535 {
+		log.Fatal("API port must be between 1-65535")
+	}
+}
+
+// command is how the client was invoked, e.g. "rpc" or "wg-rp client", for usage messages
+var command = "rpc"
+
+// Run runs the client with the arguments following the command name. name is how the client
+// was invoked and is used in usage messages.
+func Run(name string, args []string) {
+	command = name
+
+	// Dispatch subcommands
+	if len(args) > 0 {
+		switch args[0] {
+		case "expose-local":
+			exposeLocal(args[1:])
+			return
+		case "add":
+			addRoute(args[1:])
+			return
+		case "rm":
+			removeRoute(args[1:])
+			return
+		case "status":
+			showStatus(args[1:])
+			return
+		case "server-status":
+			showServerStatus(args[1:])
+			return
+		case "list":
+			listMappings(args[1:])
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	var opts clientOptions
+	var showVersion bool
+
+	opts.register(fs)
+	fs.BoolVar(&showVersion, "V", false, "Show version and exit")
+
+	// Custom flag for route mappings
+	var routeFlags utils.ArrayFlags
+	fs.Var(&routeFlags, "r", "Route mapping in format [name=service:][visibility=tunnel:][host=hostname:|sni=hostname:][local_ip:]local_port[-remote_port][@client_port], client_port also as client_port=N (can be used multiple times)")
+
+	// Custom flag for route schedules
+	fs.Var(&opts.schedules, "schedule", `Only accept connections to a remote port within daily windows, e.g. "8080=Mon-Fri 09:00-17:00 Europe/Berlin" (can be used multiple times)`)
+	fs.BoolVar(&opts.scheduleCloseActive, "schedule-close-active", false, "Close open connections when a schedule window closes")
+
+	// Custom flag for local forwards
+	var forwardFlags utils.ArrayFlags
+	fs.Var(&forwardFlags, "L", "Local forward in format [bind_addr:]local_port:target_host:target_port, connecting through the server to a target reachable from it (bind_addr defaults to 127.0.0.1; can be used multiple times)")
+
+	// SOCKS5 proxy whose connections the server makes
+	fs.StringVar(&opts.socksAddr, "socks5", "", "Run a SOCKS5 proxy on this host address, e.g. 127.0.0.1:1080, whose connections are made by the server through the tunnel")
+	fs.StringVar(&opts.socksAuth, "socks5-auth", "", "Require SOCKS5 clients to authenticate as user:password (prefer WGRP_SOCKS5_AUTH, arguments are visible to other users)")
+
+	// Routes file, combinable with -r
+	fs.StringVar(&opts.routesFile, "routes-file", "", "YAML file of route mappings with their options, reloaded when it changes (combinable with -r)")
+
+	fs.Parse(args)
+	fromEnv := cli.ApplyEnv(fs, clientEnv)
+
+	// Handle version flag
+	if showVersion {
+		cli.PrintVersion("client")
+	}
+
+	opts.validate()
+	cli.LogEnv(fromEnv)
+
+	if len(routeFlags) == 0 && opts.routesFile == "" && len(forwardFlags) == 0 && opts.socksAddr == "" {
+		log.Fatal("At least one route mapping (-r), a routes file (-routes-file), a local forward (-L) or a SOCKS5 proxy (-socks5) must be specified")
+	}
+
+	// Validate SOCKS5 proxy
+	if opts.socksAddr != "" {
+		if _, _, err := net.SplitHostPort(opts.socksAddr); err != nil {
+			log.Fatalf("Invalid SOCKS5 address %q: %v", opts.socksAddr, err)
+		}
+	}
+	if opts.socksAuth != "" {
+		user, password, ok := strings.Cut(opts.socksAuth, ":")
+		if !ok || user == "" || len(user) > 255 || len(password) > 255 {
+			log.Fatal("SOCKS5 credentials must be user:password, each up to 255 bytes")
+		}
+		if opts.socksAddr == "" {
+			log.Fatal("-socks5-auth requires -socks5")
+		}
+	}
+
+	// Parse route mappings
+	routeMappings, err := client.ParseRouteMappings(routeFlags)
+	if err != nil {
+		log.Fatalf("Failed to parse route mappings: %v", err)
+	}
+
+	// Parse local forwards
+	opts.localForwards, err = client.ParseLocalForwards(forwardFlags)
+	if err != nil {
+		log.Fatalf("Failed to parse local forwards: %v", err)
+	}
+
+	// Load the routes file
+	if opts.routesFile != "" {
+		opts.fileRoutes, err = client.LoadRoutesFile(opts.routesFile)
+		if err != nil {
+			log.Fatalf("Failed to load routes file: %v", err)
+		}
+		if err := client.CheckRouteOverlap(routeMappings, opts.fileRoutes, opts.routesFile); err != nil {
+			log.Fatalf("Conflicting route mappings: %v", err)
+		}
+	}
+
+	opts.run(routeMappings, false)
+}
+
+// run brings up the WireGuard device, registers the route mappings and blocks until shutdown.
+// With partial set, mappings the server rejects are dropped instead of aborting startup.
+func (o *clientOptions) run(routeMappings []client.RouteMapping, partial bool) {
+	// Convert KB to bytes
+	bufferSize := o.bufferSizeKB * 1024
+
+	deviceOpts := append(cli.HookOptions(o.allowHooks, o.hookTimeout), cli.TCPTuningOptions(o.tcpSendBufferKB, o.tcpRecvBufferKB)...)
+	if o.wgBatch > 0 {
+		deviceOpts = append(deviceOpts, wireguard.WithBatchSize(o.wgBatch))
+	}
+	mtu, autoMTU, _ := parseMTU(o.mtu)
+	if mtu > 0 {
+		deviceOpts = append(deviceOpts, wireguard.WithMTU(mtu))
+	}
+	if autoMTU || o.autoMTUProbe {
+		deviceOpts = append(deviceOpts, wireguard.WithPathMTUProbe(o.serverIP))
+	}
+	wgDevice := cli.StartDevice("client", o.configFile, o.strictPerms, o.verbose >= 2, deviceOpts...)
+	defer wgDevice.Close()
+
+	// Track the tunnel to each peer, so that failing heartbeats aren't blamed on a server that can't be reached
+	handshakeMonitor := cli.StartHandshakeMonitor(wgDevice)
+	defer handshakeMonitor.Stop()
+
+	// Follow peers whose Endpoint hostname moves to a new address, e.g. a server on dynamic DNS
+	endpointResolver := wireguard.NewEndpointResolver(wgDevice, handshakeMonitor, o.reresolveAfter, o.resolveInterval)
+	endpointResolver.Start()
+	defer endpointResolver.Stop()
+
+	// Determine the server IP, or the candidates to try, unless it was given
+	var clientIP string
+	var serverIPs []string
+	var err error
+	if o.serverIP != "" {
+		var serverIP string
+		clientIP, serverIP, err = serverOverrideIPs(wgDevice.Config, o.serverIP)
+		serverIPs = []string{serverIP}
+	} else {
+		clientIP, serverIPs, err = determineIPs(wgDevice.Config)
+	}
+	if err != nil {
+		log.Fatalf("Failed to determine server IP: %v", err)
+	}
+
+	// Create proxy client
+	clientOpts := []client.ClientOption{
+		client.WithServerPort(o.serverPort),
+		client.WithRTTWarnThreshold(o.rttWarn),
+		client.WithHeartbeatInterval(o.heartbeat),
+		client.WithConnRateLimit(o.maxConnsPerSecond, o.maxConnsBurst),
+		client.WithLocalProbe(o.localProbe),
+		client.WithCompression(o.compression),
+		client.WithDialTimeout(o.dialTimeout),
+		client.WithResolveMode(client.ResolveMode(o.resolve), o.resolveTTL),
+		client.WithLocalCheck(o.checkLocal.mode),
+		client.WithAuthToken(o.authToken),
+		client.WithReregisterRetry(o.reregisterRetries, o.reregisterDelay),
+		client.WithStateFile(o.stateFile),
+		client.WithPeerStats(cli.PeerStats(wgDevice, handshakeMonitor)),
+		client.WithTunnelHealth(handshakeMonitor.Health),
+		client.WithTunnelWait(o.tunnelWait),
+	}
+	if partial {
+		clientOpts = append(clientOpts, client.WithPartialRegistration())
+	}
+	if o.maxBufferMB > 0 {
+		clientOpts = append(clientOpts, client.WithBufferMemoryLimit(bufferpool.NewMemoryLimit(int64(o.maxBufferMB)<<20)))
+	}
+	if len(o.fallbackServers) > 0 {
+		clientOpts = append(clientOpts, client.WithFallbackServers(fallbackServerIPs(o.fallbackServers)...))
+	}
+	if o.socksAddr != "" {
+		var creds *socks.Credentials
+		if user, password, ok := strings.Cut(o.socksAuth, ":"); ok {
+			creds = &socks.Credentials{Username: user, Password: password}
+		}
+		clientOpts = append(clientOpts, client.WithSOCKS5(o.socksAddr, creds))
+	}
+	proxyClient := client.NewProxyClient(wgDevice.Tnet, serverIPs[0], clientIP, bufferSize, clientOpts...)
+
+	// Check if server is available before proceeding, trying each candidate in turn
+	log.Printf("Checking server availability at %s...", strings.Join(serverIPs, ", "))
+	serverIP, err := proxyClient.SelectServer(serverIPs)
+	if err != nil {
+		log.Fatalf("Server is not available: %v", err)
+	}
+	log.Printf("Server is available and ready")
+
+	// Warn about an MTU the path can't carry, which stalls large transfers only
+	if o.checkMTU {
+		go proxyClient.CheckMTU(wgDevice.Config.MTU)
+	}
+
+	// Add route mappings
+	for _, mapping := range routeMappings {
+		if err := proxyClient.AddRouteMappingConfig(mapping); err != nil {
+			log.Fatalf("Failed to add route mapping: %v", err)
+		}
+	}
+	for _, mapping := range o.fileRoutes {
+		if err := proxyClient.AddRouteMappingConfig(mapping); err != nil {
+			log.Fatalf("Failed to add route mapping from %s: %v", o.routesFile, err)
+		}
+	}
+
+	for _, forward := range o.localForwards {
+		proxyClient.AddLocalForward(forward)
+	}
+
+	// Apply route schedules
+	for _, s := range o.schedules {
+		portStr, spec, ok := strings.Cut(s, "=")
+		remotePort, err := strconv.Atoi(portStr)
+		if !ok || err != nil {
+			log.Fatalf("Invalid schedule %q. Expected format: remote_port=schedule", s)
+		}
+		if err := proxyClient.SetRouteSchedule(remotePort, spec, o.scheduleCloseActive); err != nil {
+			log.Fatalf("Invalid schedule for port %d: %v", remotePort, err)
+		}
+	}
+
+	log.Printf("WireGuard client started with %d route mappings and %d local forwards", len(routeMappings)+len(o.fileRoutes), len(o.localForwards))
+	log.Printf("Client IPs: %v", wgDevice.Config.InterfaceIPs)
+	log.Printf("Server IP: %s", serverIP)
+
+	// Start the proxy client
+	if err := proxyClient.Start(); err != nil {
+		log.Fatalf("Failed to start proxy client: %v", err)
+	}
+
+	if partial {
+		printExposeSummary(os.Stdout, routeMappings, proxyClient.RegistrationFailures())
+	}
+
+	// Let operators re-register mappings without restarting, e.g. after the WireGuard peer reconnected
+	handleReRegisterSignal(proxyClient)
+
+	// Apply edits of the routes file without disturbing unchanged mappings, and on SIGHUP
+	if o.routesFile != "" {
+		proxyClient.WatchRoutesFile(o.routesFile, o.fileRoutes)
+	}
+	handleReloadSignal(proxyClient)
+
+	// Log the state of every mapping on demand
+	handleSnapshotSignal(proxyClient)
+
+	// Accept route changes from rpc add and rpc rm
+	control := startControl(o.controlSocket, proxyClient)
+	if control != nil {
+		defer control.Close()
+	}
+
+	log.Printf("All route mappings active. Press Ctrl+C to exit.")
+
+	// Set up signal handling for graceful shutdown
+	sigChan := cli.ShutdownSignals()
+
+	go func() {
+		// Wait for either server death or manual shutdown signal
+		select {
+		case <-proxyClient.WaitForShutdownSignal():
+			log.Printf("Client stopped, server may have died or restarted")
+		case <-sigChan:
+			log.Printf("Received shutdown signal, cleaning up...")
+
+			// Remove the control socket, os.Exit skips deferred calls
+			if control != nil {
+				control.Close()
+			}
+
+			// Clean up port mappings
+			if err := proxyClient.Cleanup(); err != nil {
+				log.Printf("Error during cleanup: %v", err)
+			}
+
+			log.Printf("Cleanup completed. Exiting...")
+			os.Exit(0)
+		}
+	}()
+
+	// Wait for all route listeners
+	proxyClient.Wait()
+}
@@ -0,0 +1,222 @@
+package clientcmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/client"
+)
+
+// controlTimeout bounds a single control request, including the server round trips it causes
+const controlTimeout = 30 * time.Second
+
+// Control commands understood by a running client
+const (
+	controlAdd          = "add"
+	controlRemove       = "rm"
+	controlStatus       = "status"
+	controlServerStatus = "server-status"
+)
+
+// controlRequest is a single command sent to a running client over its control socket
+type controlRequest struct {
+	Command    string `json:"command"`
+	LocalAddr  string `json:"local_addr,omitempty"`
+	RemotePort int    `json:"remote_port"`
+	ClientPort int    `json:"client_port,omitempty"`
+	Name       string `json:"name,omitempty"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+}
+
+// controlResponse is the reply to a control request
+type controlResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+
+	Status         *client.Status      `json:"status,omitempty"`          // Answer to a status request
+	Server         *api.ServerStatus   `json:"server,omitempty"`          // Answer to a server-status request
+	ServerMappings []api.MappingStatus `json:"server_mappings,omitempty"` // Answer to a server-status request
+}
+
+// startControl opens the control socket and serves requests against the proxy client in the
+// background. It returns nil if the socket can't be opened, leaving the client running without it.
+func startControl(path string, proxyClient *client.ProxyClient) net.Listener {
+	if path == "" {
+		return nil
+	}
+
+	listener, err := listenControl(path)
+	if err != nil {
+		log.Printf("Control socket disabled: %v", err)
+		return nil
+	}
+	log.Printf("Control socket listening on %s", path)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleControlConn(conn, proxyClient)
+		}
+	}()
+
+	return listener
+}
+
+// handleControlConn answers one control request
+func handleControlConn(conn net.Conn, proxyClient *client.ProxyClient) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req controlRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(controlResponse{Message: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	var err error
+	var message string
+	response := controlResponse{}
+	switch req.Command {
+	case controlAdd:
+		err = proxyClient.AddRoute(client.RouteMapping{
+			LocalAddr:  req.LocalAddr,
+			RemotePort: req.RemotePort,
+			ClientPort: req.ClientPort,
+			Name:       req.Name,
+			TTL:        time.Duration(req.TTLSeconds) * time.Second,
+		})
+		message = fmt.Sprintf("Added %s -> remote:%d", req.LocalAddr, req.RemotePort)
+	case controlRemove:
+		err = proxyClient.RemoveRoute(req.RemotePort)
+		message = fmt.Sprintf("Removed remote:%d", req.RemotePort)
+	case controlStatus:
+		status := proxyClient.Status()
+		response.Status = &status
+	case controlServerStatus:
+		response.Server, response.ServerMappings, err = proxyClient.ServerStatus()
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+
+	if err != nil {
+		log.Printf("Control request %q for port %d failed: %v", req.Command, req.RemotePort, err)
+		json.NewEncoder(conn).Encode(controlResponse{Message: err.Error()})
+		return
+	}
+	response.Success = true
+	response.Message = message
+	json.NewEncoder(conn).Encode(response)
+}
+
+// sendControl sends a request to the client running on the control socket and returns its reply
+func sendControl(path string, req controlRequest) (controlResponse, error) {
+	conn, err := dialControl(path)
+	if err != nil {
+		return controlResponse{}, fmt.Errorf("no running client on %s: %v", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return controlResponse{}, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	var response controlResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return controlResponse{}, fmt.Errorf("failed to read response: %v", err)
+	}
+	return response, nil
+}
+
+// runControlCommand sends a request to the running client and exits non-zero if it failed
+func runControlCommand(path string, req controlRequest) controlResponse {
+	response, err := sendControl(path, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !response.Success {
+		log.Fatalf("Failed: %s", response.Message)
+	}
+	if response.Message != "" {
+		fmt.Println(response.Message)
+	}
+	return response
+}
+
+// addRoute implements "rpc add": it adds a route mapping to a running client
+func addRoute(args []string) {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+
+	var controlSocket string
+	var route string
+	var ttl time.Duration
+	fs.StringVar(&controlSocket, "control-socket", defaultControlSocket(), "Control socket of the running client")
+	fs.DurationVar(&ttl, "ttl", 0, "Have the server remove the mapping after this long, e.g. 2h (0 = never)")
+	fs.StringVar(&route, "r", "", "Route mapping in format [name=service:][visibility=tunnel:][host=hostname:|sni=hostname:][local_ip:]local_port[-remote_port][@client_port]")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s add -r [name=service:][visibility=tunnel:][host=hostname:|sni=hostname:][local_ip:]local_port[-remote_port][@client_port] [flags]\n\n", command)
+		fmt.Fprintf(fs.Output(), "Add a route mapping to the running client without restarting it.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cli.ApplyEnv(fs, controlEnv)
+
+	if route == "" || (ttl != 0 && ttl < time.Second) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	mappings, err := client.ParseRouteMappings([]string{route})
+	if err != nil {
+		log.Fatalf("Failed to parse route mapping: %v", err)
+	}
+	if len(mappings) != 1 {
+		log.Fatalf("Port ranges can't be added to a running client, restart it with the range instead")
+	}
+
+	runControlCommand(controlSocket, controlRequest{
+		Command:    controlAdd,
+		LocalAddr:  mappings[0].LocalAddr,
+		RemotePort: mappings[0].RemotePort,
+		ClientPort: mappings[0].ClientPort,
+		Name:       mappings[0].Name,
+		TTLSeconds: int(ttl.Seconds()),
+	})
+}
+
+// removeRoute implements "rpc rm": it removes a route mapping from a running client
+func removeRoute(args []string) {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+
+	var controlSocket string
+	var remotePort int
+	fs.StringVar(&controlSocket, "control-socket", defaultControlSocket(), "Control socket of the running client")
+	fs.IntVar(&remotePort, "port", 0, "Remote port of the route mapping to remove")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rm -port remote_port [flags]\n\n", command)
+		fmt.Fprintf(fs.Output(), "Remove a route mapping from the running client, closing only its connections.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cli.ApplyEnv(fs, controlEnv)
+
+	if remotePort < 1 || remotePort > 65535 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	runControlCommand(controlSocket, controlRequest{Command: controlRemove, RemotePort: remotePort})
+}
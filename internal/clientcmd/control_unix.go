@@ -0,0 +1,47 @@
+//go:build !windows
+
+package clientcmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// defaultControlSocket returns the control socket path of the invoking user, in the runtime
+// directory when there is one
+func defaultControlSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("wg-rp-client-%d.sock", os.Getuid()))
+}
+
+// listenControl listens on a unix socket only the invoking user can connect to, replacing a
+// socket left behind by a client that didn't exit cleanly
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another client is already running on %s, use -control-socket to pick a different path", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket %s: %v", path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict permissions of %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// dialControl connects to the control socket of a running client
+func dialControl(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package clientcmd
+
+import (
+	"fmt"
+	"net"
+)
+
+// defaultControlSocket returns the localhost address of the control channel on Windows
+func defaultControlSocket() string {
+	return "127.0.0.1:7780"
+}
+
+// listenControl listens on a localhost TCP address, as Windows has no unix sockets with
+// file permissions to restrict access
+func listenControl(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return listener, nil
+}
+
+// dialControl connects to the control channel of a running client
+func dialControl(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
@@ -0,0 +1,30 @@
+package clientcmd
+
+import "github.com/DevonTM/wg-rp/pkg/utils"
+
+// clientEnv names the environment variables of flags whose names don't make good variable names.
+// Other flags use cli.EnvPrefix and their own name.
+var clientEnv = map[string]utils.EnvFallback{
+	"c": {Var: "WGRP_CONFIG"},
+	"v": {Var: "WGRP_VERBOSE"},
+	"V": {},
+	"b": {Var: "WGRP_BUFFER_KB"},
+	"r": {Var: "WGRP_ROUTES", List: true},
+	"L": {Var: "WGRP_LOCAL_FORWARDS", List: true},
+
+	"vv":  {}, // shorthands of -v, which WGRP_VERBOSE sets
+	"vvv": {},
+
+	"auth-token":      {Var: "WGRP_AUTH_TOKEN", Secret: true},
+	"socks5-auth":     {Var: "WGRP_SOCKS5_AUTH", Secret: true},
+	"fallback-server": {Var: "WGRP_FALLBACK_SERVER", List: true},
+}
+
+// controlEnv limits the control subcommands to the environment variable of the control socket,
+// so that e.g. WGRP_ROUTES doesn't leak into rpc add -r
+var controlEnv = map[string]utils.EnvFallback{
+	"r":    {},
+	"L":    {},
+	"port": {},
+	"json": {},
+}
@@ -0,0 +1,84 @@
+package clientcmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/client"
+)
+
+const (
+	// scanProbesPerSecond limits how fast expose-local probes local ports
+	scanProbesPerSecond = 200
+
+	// scanProbeTimeout is how long a single local probe waits for a connection
+	scanProbeTimeout = 200 * time.Millisecond
+)
+
+// exposeLocal implements "rpc expose-local": it finds which of the requested local ports are
+// listening on loopback and exposes each on the same remote port
+func exposeLocal(args []string) {
+	fs := flag.NewFlagSet("expose-local", flag.ExitOnError)
+
+	var opts clientOptions
+	var portList string
+	var scanRange string
+
+	opts.register(fs)
+	fs.StringVar(&portList, "ports", "", "Comma-separated local ports to expose if they are listening (e.g. 3000,8080,5432)")
+	fs.StringVar(&scanRange, "scan", "", "Opt-in scan of a local port range on loopback (e.g. 1024-9000)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s expose-local [flags]\n\n", command)
+		fmt.Fprintf(fs.Output(), "Expose every listed local port that is listening on loopback on the same remote port.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	fromEnv := cli.ApplyEnv(fs, clientEnv)
+
+	opts.validate()
+	cli.LogEnv(fromEnv)
+
+	var ports []int
+	var err error
+	switch {
+	case portList != "" && scanRange != "":
+		log.Fatal("Use either -ports or -scan, not both")
+	case portList != "":
+		ports, err = parsePortList(portList)
+	case scanRange != "":
+		ports, err = parsePortRange(scanRange)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("Invalid ports: %v", err)
+	}
+
+	log.Printf("Probing %d local ports on loopback...", len(ports))
+	routeMappings := client.DiscoverLocalRoutes(ports, scanProbesPerSecond, scanProbeTimeout)
+	if len(routeMappings) == 0 {
+		log.Fatal("None of the requested local ports are listening")
+	}
+	log.Printf("Found %d listening local ports", len(routeMappings))
+
+	opts.run(routeMappings, true)
+}
+
+// printExposeSummary prints which discovered services were exposed and why others were rejected
+func printExposeSummary(w io.Writer, routeMappings []client.RouteMapping, failures map[int]error) {
+	fmt.Fprintf(w, "Exposed %d of %d local services:\n", len(routeMappings)-len(failures), len(routeMappings))
+	for _, mapping := range routeMappings {
+		status := "ok"
+		if err, failed := failures[mapping.RemotePort]; failed {
+			status = fmt.Sprintf("failed: %v", err)
+		}
+		fmt.Fprintf(w, "  %-22s -> remote:%-5d  %s\n", mapping.LocalAddr, mapping.RemotePort, status)
+	}
+}
@@ -0,0 +1,65 @@
+package clientcmd
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/client"
+)
+
+func TestPrintExposeSummary(t *testing.T) {
+	mappings := []client.RouteMapping{
+		{LocalAddr: "127.0.0.1:3000", RemotePort: 3000},
+		{LocalAddr: "127.0.0.1:5432", RemotePort: 5432},
+		{LocalAddr: "[::1]:8080", RemotePort: 8080},
+	}
+	failures := map[int]error{5432: errors.New("port 5432 is not allowed")}
+
+	var out strings.Builder
+	printExposeSummary(&out, mappings, failures)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("summary has %d lines, want 4:\n%s", len(lines), out.String())
+	}
+	if lines[0] != "Exposed 2 of 3 local services:" {
+		t.Errorf("header = %q", lines[0])
+	}
+	checks := []struct{ addr, status string }{
+		{"127.0.0.1:3000", "ok"},
+		{"127.0.0.1:5432", "failed: port 5432 is not allowed"},
+		{"[::1]:8080", "ok"},
+	}
+	for i, c := range checks {
+		line := lines[i+1]
+		if !strings.Contains(line, c.addr) || !strings.HasSuffix(line, c.status) {
+			t.Errorf("line %q, want %s ... %s", line, c.addr, c.status)
+		}
+	}
+}
+
+func TestParsePortList(t *testing.T) {
+	ports, err := parsePortList("3000, 8080,,5432")
+	if err != nil || !slices.Equal(ports, []int{3000, 8080, 5432}) {
+		t.Errorf("parsePortList() = %v, %v", ports, err)
+	}
+	for _, s := range []string{"", ",", "80,http", "0", "65536"} {
+		if _, err := parsePortList(s); err == nil {
+			t.Errorf("parsePortList(%q) succeeded", s)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	ports, err := parsePortRange("1024-1027")
+	if err != nil || !slices.Equal(ports, []int{1024, 1025, 1026, 1027}) {
+		t.Errorf("parsePortRange() = %v, %v", ports, err)
+	}
+	for _, s := range []string{"1024", "9000-1024", "0-10", "1-70000", "a-b"} {
+		if _, err := parsePortRange(s); err == nil {
+			t.Errorf("parsePortRange(%q) succeeded", s)
+		}
+	}
+}
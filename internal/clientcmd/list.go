@@ -0,0 +1,106 @@
+package clientcmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/client"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+// listMappings implements "rpc list": it brings up the WireGuard device on its own, without
+// registering routes or sending heartbeats, and prints the port mappings on the server
+func listMappings(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+
+	var configFile, serverIP, authToken, output string
+	var serverPort int
+	var strictPerms bool
+
+	fs.StringVar(&configFile, "c", "wg-client.conf", "WireGuard configuration file")
+	fs.IntVar(&serverPort, "api-port", client.DefaultServerPort, "Port of the server REST API within the WireGuard netstack")
+	fs.StringVar(&serverIP, "server-ip", "", "Server IP within the WireGuard network, instead of detecting it from the host routes in the peers' AllowedIPs")
+	fs.StringVar(&authToken, "auth-token", "", "Bearer token sent with the request to the server API (prefer WGRP_AUTH_TOKEN, arguments are visible to other users)")
+	fs.BoolVar(&strictPerms, "strict-perms", false, "Refuse to start if the configuration file is readable by group or others")
+	fs.StringVar(&output, "output", "table", "Output format: table or json (the server's response as is)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s list [flags]\n\n", command)
+		fmt.Fprintf(fs.Output(), "List the port mappings on the server, connecting with the WireGuard config alone.\n")
+		fmt.Fprintf(fs.Output(), "Don't run it with the config of a running client: both would use the same key, so the server\n")
+		fmt.Fprintf(fs.Output(), "would send the running client's traffic here. Use %s server-status for that client instead.\n\n", command)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cli.ApplyEnv(fs, clientEnv)
+
+	// Validate output format
+	if output != "table" && output != "json" {
+		log.Fatalf("Invalid output format %q (use table or json)", output)
+	}
+
+	// Validate server API port
+	if serverPort < 1 || serverPort > 65535 {
+		log.Fatal("API port must be between 1-65535")
+	}
+
+	wgDevice := cli.StartDevice("client", configFile, strictPerms, false)
+	defer wgDevice.Close()
+
+	var clientIP string
+	var serverIPs []string
+	var err error
+	if serverIP != "" {
+		clientIP, serverIP, err = serverOverrideIPs(wgDevice.Config, serverIP)
+		serverIPs = []string{serverIP}
+	} else {
+		clientIP, serverIPs, err = determineIPs(wgDevice.Config)
+	}
+	if err != nil {
+		log.Fatalf("Failed to determine server IP: %v", err)
+	}
+
+	// Ask each candidate in turn; a heartbeat would have the server track this as a client
+	var mappings []api.MappingStatus
+	for _, serverIP := range serverIPs {
+		proxyClient := client.NewProxyClient(wgDevice.Tnet, serverIP, clientIP, 0,
+			client.WithServerPort(serverPort), client.WithAuthToken(authToken))
+		if mappings, err = proxyClient.PortMappings(); err == nil {
+			break
+		}
+		if len(serverIPs) > 1 {
+			log.Printf("Candidate server %s is not available: %v", serverIP, err)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to list port mappings: %v", err)
+	}
+
+	if output == "json" {
+		printJSON(os.Stdout, api.PortMappingListResponse{Success: true, Mappings: mappings})
+		return
+	}
+	printMappingList(os.Stdout, mappings)
+}
+
+// printMappingList prints the port mappings on the server as a table
+func printMappingList(w io.Writer, mappings []api.MappingStatus) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tLOCAL ADDR\tCLIENT IP\tACTIVE\tBYTES IN\tBYTES OUT")
+	for _, m := range mappings {
+		port := strconv.Itoa(m.RemotePort)
+		if m.Hostname != "" {
+			port += " " + m.Hostname
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", port, m.LocalAddr, m.ClientIP, m.ActiveConnections,
+			utils.FormatBytes(m.BytesIn), utils.FormatBytes(m.BytesOut))
+	}
+	tw.Flush()
+}
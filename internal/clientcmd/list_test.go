@@ -0,0 +1,41 @@
+package clientcmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+func TestPrintMappingList(t *testing.T) {
+	mappings := []api.MappingStatus{
+		{RemotePort: 8080, LocalAddr: "127.0.0.1:3000", ClientIP: "10.0.0.2", ActiveConnections: 2, BytesIn: 2048, BytesOut: 1 << 20},
+		{RemotePort: 443, Hostname: "app.example.com", LocalAddr: "127.0.0.1:8443", ClientIP: "10.0.0.3"},
+	}
+
+	var out strings.Builder
+	printMappingList(&out, mappings)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("table has %d lines, want 3:\n%s", len(lines), out.String())
+	}
+	if fields := strings.Fields(lines[0]); fields[0] != "PORT" || fields[len(fields)-1] != "OUT" {
+		t.Errorf("header = %q", lines[0])
+	}
+	checks := [][]string{
+		{"8080", "127.0.0.1:3000", "10.0.0.2", "2"},
+		{"443 app.example.com", "127.0.0.1:8443", "10.0.0.3", "0"},
+	}
+	for i, want := range checks {
+		line := lines[i+1]
+		if !strings.HasPrefix(line, want[0]) {
+			t.Errorf("line %q, want it to start with %q", line, want[0])
+		}
+		for _, field := range want[1:] {
+			if !strings.Contains(line, field) {
+				t.Errorf("line %q, want %q in it", line, field)
+			}
+		}
+	}
+}
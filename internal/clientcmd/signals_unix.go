@@ -0,0 +1,83 @@
+//go:build !windows
+
+package clientcmd
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/client"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+// handleReRegisterSignal re-registers all mappings with the server whenever SIGUSR1 is received
+func handleReRegisterSignal(proxyClient *client.ProxyClient) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+
+	go func() {
+		for range sigChan {
+			log.Printf("Received SIGUSR1, re-registering all route mappings...")
+			proxyClient.ReRegister()
+		}
+	}()
+}
+
+// handleReloadSignal re-reads the routes file whenever SIGHUP is received. Flags can't change
+// while running, so only mappings from the routes file are affected.
+func handleReloadSignal(proxyClient *client.ProxyClient) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			log.Printf("Received SIGHUP, reloading routes...")
+			if err := proxyClient.ReloadRoutes(); err != nil {
+				log.Printf("Failed to reload routes, keeping the running routes: %v", err)
+				continue
+			}
+			log.Printf("Routes reloaded")
+		}
+	}()
+}
+
+// handleSnapshotSignal logs the state of every mapping and the heartbeat whenever SIGUSR2 is
+// received. SIGUSR1 already re-registers the mappings.
+func handleSnapshotSignal(proxyClient *client.ProxyClient) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+
+	go func() {
+		for range sigChan {
+			logStatus(proxyClient.Status())
+		}
+	}()
+}
+
+// logStatus logs one line for the heartbeat state and one per mapping of a status snapshot
+func logStatus(status client.Status) {
+	lastHeartbeat := "never"
+	if status.LastHeartbeat > 0 {
+		lastHeartbeat = utils.FormatDuration(time.Since(time.Unix(status.LastHeartbeat, 0))) + " ago"
+	}
+	slog.Info("Snapshot",
+		"client_ip", status.ClientIP, "server_ip", status.ServerIP, "server_version", status.ServerVersion,
+		"last_heartbeat", lastHeartbeat, "heartbeat_failures", status.HeartbeatFailures,
+		"rtt_ms", status.RTTMillis, "tunnel_health", status.TunnelHealth, "mappings", len(status.Mappings))
+	for _, m := range status.Mappings {
+		slog.Info("Snapshot mapping",
+			"remote_port", m.RemotePort, "local_addr", m.LocalAddr, "client_port", m.ClientPort,
+			"active_connections", m.ActiveConnections, "bytes_relayed", m.BytesRelayed,
+			"dial_failures", m.DialFailures, "registration_failed", m.RegistrationFailed, "local_check", m.LocalCheck, "last_error", m.LastError)
+	}
+	for _, p := range status.Peers {
+		slog.Info("Snapshot peer",
+			"public_key", p.PublicKey, "endpoint", p.Endpoint, "last_handshake", cli.LastHandshake(p),
+			"rx_bytes", p.RxBytes, "tx_bytes", p.TxBytes, "handshake_stale", p.HandshakeStale, "health", p.Health)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package clientcmd
+
+import "github.com/DevonTM/wg-rp/pkg/client"
+
+// handleReRegisterSignal is a no-op on Windows, which has no SIGUSR1
+func handleReRegisterSignal(proxyClient *client.ProxyClient) {}
+
+// handleReloadSignal is a no-op on Windows, which has no SIGHUP; the routes file is still watched
+func handleReloadSignal(proxyClient *client.ProxyClient) {}
+
+// handleSnapshotSignal is a no-op on Windows, which has no SIGUSR2; use rpc status instead
+func handleSnapshotSignal(proxyClient *client.ProxyClient) {}
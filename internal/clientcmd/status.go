@@ -0,0 +1,189 @@
+package clientcmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/client"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+// statusFlags parses the flags shared by the status subcommands
+func statusFlags(name, usage string, args []string) (controlSocket string, jsonOutput bool) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&controlSocket, "control-socket", defaultControlSocket(), "Control socket of the running client")
+	fs.BoolVar(&jsonOutput, "json", false, "Print JSON instead of a table")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s\n\n", command, name, usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cli.ApplyEnv(fs, controlEnv)
+	return controlSocket, jsonOutput
+}
+
+// showStatus implements "rpc status": it prints the running client's mappings and heartbeat state
+func showStatus(args []string) {
+	controlSocket, jsonOutput := statusFlags("status", "Show the route mappings and heartbeat state of the running client.", args)
+
+	response := runControlCommand(controlSocket, controlRequest{Command: controlStatus})
+	if jsonOutput {
+		printJSON(os.Stdout, response.Status)
+		return
+	}
+	printClientStatus(os.Stdout, response.Status)
+}
+
+// showServerStatus implements "rpc server-status": it asks the running client to fetch the
+// server's status and port mappings through its tunnel
+func showServerStatus(args []string) {
+	controlSocket, jsonOutput := statusFlags("server-status", "Show the status and port mappings of the server, fetched by the running client.", args)
+
+	response := runControlCommand(controlSocket, controlRequest{Command: controlServerStatus})
+	if jsonOutput {
+		printJSON(os.Stdout, struct {
+			Server   *api.ServerStatus   `json:"server"`
+			Mappings []api.MappingStatus `json:"mappings"`
+		}{response.Server, response.ServerMappings})
+		return
+	}
+	printServerStatus(os.Stdout, response.Server, response.ServerMappings)
+}
+
+// printJSON writes v as indented JSON
+func printJSON(w io.Writer, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// printClientStatus prints the client status as a human-readable table
+func printClientStatus(w io.Writer, status *client.Status) {
+	lastHeartbeat := "never"
+	if status.LastHeartbeat > 0 {
+		lastHeartbeat = utils.FormatDuration(time.Since(time.Unix(status.LastHeartbeat, 0))) + " ago"
+	}
+
+	fmt.Fprintf(w, "Client %s -> server %s (version %s)\n", status.ClientIP, status.ServerIP, orUnknown(status.ServerVersion))
+	fmt.Fprintf(w, "Heartbeat: every %ds, last %s, %d consecutive failures, rtt %.1fms\n",
+		status.HeartbeatIntervalSeconds, lastHeartbeat, status.HeartbeatFailures, status.RTTMillis)
+	fmt.Fprintf(w, "WireGuard tunnel: %s\n\n", orUnknown(status.TunnelHealth))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REMOTE PORT\tNAME\tLOCAL ADDR\tCLIENT PORT\tSTATE\tLOCAL CHECK\tACTIVE\tRELAYED\tDIAL FAILURES\tSCHEDULE")
+	for _, m := range status.Mappings {
+		state := "registered"
+		if m.RegistrationFailed {
+			state = "failed"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\t%d\t%s\t%d\t%s\n", m.RemotePort, orDash(m.Name), m.LocalAddr, m.ClientPort, state,
+			orDash(m.LocalCheck), m.ActiveConnections, utils.FormatBytes(m.BytesRelayed), m.DialFailures, orDash(m.Schedule))
+	}
+	tw.Flush()
+
+	if len(status.Forwards) > 0 {
+		fmt.Fprintln(w)
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "LOCAL FORWARD\tTARGET\tACTIVE\tRELAYED\tDIAL FAILURES\tLAST ERROR")
+		for _, f := range status.Forwards {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\n", f.BindAddr, f.Target, f.ActiveConnections,
+				utils.FormatBytes(f.BytesRelayed), f.DialFailures, orDash(f.LastError))
+		}
+		tw.Flush()
+	}
+
+	printPeers(w, status.Peers)
+}
+
+// printServerStatus prints the server status and its mappings as a human-readable table
+func printServerStatus(w io.Writer, status *api.ServerStatus, mappings []api.MappingStatus) {
+	fmt.Fprintf(w, "Server version %s, up %s, %d clients, %d mappings\n", status.Version,
+		utils.FormatDuration(time.Since(time.Unix(status.StartupTime, 0))), status.Clients, status.Mappings)
+	fmt.Fprintf(w, "Heartbeat interval %ds, client timeout %ds", status.HeartbeatIntervalSeconds, status.ClientTimeoutSeconds)
+	if status.MaxFDs > 0 {
+		fmt.Fprintf(w, ", %d of %d file descriptors open", status.OpenFDs, status.MaxFDs)
+	}
+	fmt.Fprint(w, "\n\n")
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REMOTE PORT\tNAME\tVISIBILITY\tHOST\tCLIENT\tLOCAL ADDR\tBREAKER\tSTATE\tLABELS")
+	for _, m := range mappings {
+		state := "active"
+		switch {
+		case m.Suspended:
+			state = "suspended"
+		case m.OffSchedule:
+			state = "off schedule"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s:%d\t%s\t%s\t%s\t%s\n", m.RemotePort, orDash(m.Name), orDash(m.Visibility), orDash(m.Hostname),
+			m.ClientIP, m.ClientPort, m.LocalAddr, m.BreakerState, state, orDash(formatLabels(m.Labels)))
+	}
+	tw.Flush()
+
+	// Certificates the server failed to obtain are reported below the table, their errors are long
+	for _, m := range mappings {
+		if m.TLSError != "" {
+			fmt.Fprintf(w, "\nNo certificate for %s on port %d: %s\n", m.Hostname, m.RemotePort, m.TLSError)
+		}
+	}
+
+	printPeers(w, status.Peers)
+}
+
+// printPeers prints the WireGuard peers of a device as a table, if it reported any
+func printPeers(w io.Writer, peers []api.PeerStats) {
+	if len(peers) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tENDPOINT\tLAST HANDSHAKE\tRECEIVED\tSENT\tSTATE")
+	for _, p := range peers {
+		state := p.Health
+		if state == "" {
+			state = "up"
+			if p.HandshakeStale {
+				state = "stale"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.PublicKey, orDash(p.Endpoint), cli.LastHandshake(p),
+			utils.FormatBytes(p.RxBytes), utils.FormatBytes(p.TxBytes), state)
+	}
+	tw.Flush()
+}
+
+// orUnknown returns s, or "unknown" if it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// formatLabels lists labels as key=value pairs sorted by key
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
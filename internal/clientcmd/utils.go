@@ -0,0 +1,198 @@
+package clientcmd
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/DevonTM/wg-rp/pkg/client"
+	"github.com/DevonTM/wg-rp/pkg/config"
+)
+
+// determineIPs determines the client IP and the candidate server IPs from the WireGuard config.
+// Peers route the server with a host route (a /32 or /128 AllowedIP), so every such address in
+// the family of a client IP is a candidate, and the client uses the first that answers. Without
+// host routes it falls back to assuming the server is .1 (IPv4) or ::1 (IPv6) in the client's
+// subnet.
+func determineIPs(wgConfig *config.WireGuardConfig) (clientIP string, serverIPs []string, err error) {
+	hosts := peerHostIPs(wgConfig)
+	for _, ip := range wgConfig.InterfaceIPs {
+		for _, host := range hosts {
+			if host.Is4() == ip.Is4() {
+				serverIPs = append(serverIPs, formatIP(host))
+			}
+		}
+		if len(serverIPs) > 0 {
+			return formatIP(ip), serverIPs, nil
+		}
+	}
+
+	for _, ip := range wgConfig.InterfaceIPs {
+		ipStr := ip.String()
+		if ip.Is4() {
+			parts := strings.Split(ipStr, ".")
+			if len(parts) == 4 {
+				serverIP := fmt.Sprintf("%s.%s.%s.1", parts[0], parts[1], parts[2])
+				return ipStr, []string{serverIP}, nil
+			}
+		} else if ip.Is6() {
+			parts := strings.Split(ipStr, "::")
+			if len(parts) >= 2 && parts[0] != "" {
+				serverIP := fmt.Sprintf("[%s::1]", parts[0])
+				return formatIP(ip), []string{serverIP}, nil
+			}
+
+		}
+	}
+	return "", nil, fmt.Errorf("could not determine client and server IPs from: %v", wgConfig.InterfaceIPs)
+}
+
+// peerHostIPs returns the addresses of the host routes in the AllowedIPs of the peers, in config
+// order, leaving out the client's own addresses
+func peerHostIPs(wgConfig *config.WireGuardConfig) []netip.Addr {
+	var hosts []netip.Addr
+	for _, peer := range wgConfig.Peers {
+		for _, prefix := range peer.AllowedIPs {
+			addr := prefix.Addr().Unmap()
+			if !prefix.IsSingleIP() || slices.Contains(wgConfig.InterfaceIPs, addr) || slices.Contains(hosts, addr) {
+				continue
+			}
+			hosts = append(hosts, addr)
+		}
+	}
+	return hosts
+}
+
+// serverOverrideIPs returns the server given by -server-ip and the client IP of the config to use
+// with it, the first in the same address family
+func serverOverrideIPs(wgConfig *config.WireGuardConfig, server string) (clientIP, serverIP string, err error) {
+	addr := netip.MustParseAddr(strings.Trim(server, "[]")).Unmap()
+	for _, ip := range wgConfig.InterfaceIPs {
+		if ip.Is4() == addr.Is4() {
+			return formatIP(ip), formatIP(addr), nil
+		}
+	}
+	return "", "", fmt.Errorf("no client IP in the same address family as server %s in: %v", server, wgConfig.InterfaceIPs)
+}
+
+// formatIP formats an address as determineIPs returns it, with IPv6 addresses enclosed in brackets
+func formatIP(ip netip.Addr) string {
+	if ip.Is6() && !ip.Is4In6() {
+		return "[" + ip.String() + "]"
+	}
+	return ip.Unmap().String()
+}
+
+// parsePortList parses a comma-separated list of ports such as "3000,8080,5432"
+func parsePortList(s string) ([]int, error) {
+	var ports []int
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		port, err := parsePort(part)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	return ports, nil
+}
+
+// parsePortRange parses an inclusive port range such as "1024-9000"
+func parsePortRange(s string) ([]int, error) {
+	startStr, endStr, found := strings.Cut(s, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid port range %q: expected start-end", s)
+	}
+
+	start, err := parsePort(strings.TrimSpace(startStr))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parsePort(strings.TrimSpace(endStr))
+	if err != nil {
+		return nil, err
+	}
+	if start > end {
+		return nil, fmt.Errorf("invalid port range %q: start is greater than end", s)
+	}
+
+	ports := make([]int, 0, end-start+1)
+	for port := start; port <= end; port++ {
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// parsePort parses a single port number in the range 1-65535
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q: must be between 1-65535", s)
+	}
+	return port, nil
+}
+
+// localCheckFlag is the value of -check-local, which may be given alone like a bool flag for warn
+// or as -check-local=strict
+type localCheckFlag struct {
+	mode client.LocalCheckMode
+}
+
+func (f *localCheckFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return string(f.mode)
+}
+
+func (f *localCheckFlag) Set(value string) error {
+	mode, err := client.ParseLocalCheckMode(value)
+	if err != nil {
+		return err
+	}
+	f.mode = mode
+	return nil
+}
+
+// IsBoolFlag lets -check-local be given without a value
+func (f *localCheckFlag) IsBoolFlag() bool { return true }
+
+// fallbackServerIPs returns the fallback servers in the form of the server IP from
+// determineIPs, with IPv6 addresses enclosed in brackets
+func fallbackServerIPs(servers []string) []string {
+	ips := make([]string, 0, len(servers))
+	for _, s := range servers {
+		ips = append(ips, formatIP(netip.MustParseAddr(strings.Trim(s, "[]"))))
+	}
+	return ips
+}
+
+// MTUs -mtu accepts: the smallest packet every IPv4 host must accept, and jumbo frames
+const (
+	minMTU = 576
+	maxMTU = 9000
+)
+
+// parseMTU parses the -mtu flag: empty for the config's MTU or the detected one, auto to probe the
+// path to the server, or an MTU
+func parseMTU(value string) (mtu int, auto bool, err error) {
+	switch value {
+	case "":
+		return 0, false, nil
+	case "auto":
+		return 0, true, nil
+	}
+	mtu, err = strconv.Atoi(value)
+	if err != nil || mtu < minMTU || mtu > maxMTU {
+		return 0, false, fmt.Errorf("MTU must be auto or between %d and %d, got %q", minMTU, maxMTU, value)
+	}
+	return mtu, false, nil
+}
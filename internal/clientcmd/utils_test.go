@@ -0,0 +1,86 @@
+package clientcmd
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/config"
+)
+
+func TestDetermineIPs(t *testing.T) {
+	tests := []struct {
+		name       string
+		interfaces []string
+		allowedIPs [][]string // per peer
+		clientIP   string
+		serverIPs  []string
+	}{
+		// Host routes of the peers
+		{"IPv4 host route", []string{"10.0.0.2/24"}, [][]string{{"10.0.0.0/24", "10.0.0.1/32"}}, "10.0.0.2", []string{"10.0.0.1"}},
+		{"host routes of several peers", []string{"10.0.0.2/24"}, [][]string{{"10.0.0.1/32"}, {"10.0.0.5/32", "10.0.0.1/32"}}, "10.0.0.2", []string{"10.0.0.1", "10.0.0.5"}},
+		{"IPv6 host route", []string{"fd00::2/64"}, [][]string{{"fd00::1/128"}}, "[fd00::2]", []string{"[fd00::1]"}},
+		{"host route of the other family", []string{"10.0.0.2/24", "fd00::2/64"}, [][]string{{"10.0.0.0/24", "fd00::1/128"}}, "[fd00::2]", []string{"[fd00::1]"}},
+		{"IPv4-mapped host route", []string{"10.0.0.2/24"}, [][]string{{"::ffff:10.0.0.1/128"}}, "10.0.0.2", []string{"10.0.0.1"}},
+
+		// Without host routes the server is guessed in the client's subnet
+		{"IPv4 fallback", []string{"10.0.0.2/24"}, [][]string{{"0.0.0.0/0"}}, "10.0.0.2", []string{"10.0.0.1"}},
+		{"IPv6 fallback", []string{"fd00::2/64"}, [][]string{{"::/0"}}, "[fd00::2]", []string{"[fd00::1]"}},
+		{"own address is no host route", []string{"10.0.0.2/24"}, [][]string{{"10.0.0.2/32"}}, "10.0.0.2", []string{"10.0.0.1"}},
+		{"no peers", []string{"10.0.0.2/24"}, nil, "10.0.0.2", []string{"10.0.0.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wgConfig := &config.WireGuardConfig{}
+			for _, iface := range tt.interfaces {
+				wgConfig.InterfaceIPs = append(wgConfig.InterfaceIPs, netip.MustParsePrefix(iface).Addr())
+			}
+			for _, allowedIPs := range tt.allowedIPs {
+				var peer config.PeerConfig
+				for _, prefix := range allowedIPs {
+					peer.AllowedIPs = append(peer.AllowedIPs, netip.MustParsePrefix(prefix))
+				}
+				wgConfig.Peers = append(wgConfig.Peers, peer)
+			}
+
+			clientIP, serverIPs, err := determineIPs(wgConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clientIP != tt.clientIP || !slices.Equal(serverIPs, tt.serverIPs) {
+				t.Errorf("got client %s and servers %v, want %s and %v", clientIP, serverIPs, tt.clientIP, tt.serverIPs)
+			}
+		})
+	}
+
+	if _, _, err := determineIPs(&config.WireGuardConfig{}); err == nil {
+		t.Error("determineIPs of a config without addresses succeeded")
+	}
+}
+
+func TestParseMTU(t *testing.T) {
+	tests := []struct {
+		value   string
+		mtu     int
+		auto    bool
+		wantErr bool
+	}{
+		{"", 0, false, false},
+		{"auto", 0, true, false},
+		{"1380", 1380, false, false},
+		{"576", 576, false, false},
+		{"9000", 9000, false, false},
+		{"575", 0, false, true},
+		{"9001", 0, false, true},
+		{"Auto", 0, false, true},
+		{"1380b", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		mtu, auto, err := parseMTU(tt.value)
+		if mtu != tt.mtu || auto != tt.auto || (err != nil) != tt.wantErr {
+			t.Errorf("parseMTU(%q) = %d, %v, %v, want %d, %v, error %v", tt.value, mtu, auto, err, tt.mtu, tt.auto, tt.wantErr)
+		}
+	}
+}
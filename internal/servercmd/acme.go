@@ -0,0 +1,36 @@
+//go:build !noacme
+
+package servercmd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/DevonTM/wg-rp/pkg/acme"
+	"github.com/DevonTM/wg-rp/pkg/server"
+)
+
+// newCertIssuer creates the ACME manager SNI mappings obtain certificates from. With httpPort it
+// also answers http-01 challenges on that host port; tls-alpn-01 challenges are always answered
+// on the mappings' own ports.
+func newCertIssuer(email, cacheDir, directoryURL string, httpPort int) (server.CertIssuer, error) {
+	manager := acme.New(email, cacheDir, directoryURL)
+	if httpPort == 0 {
+		return manager, nil
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(httpPort)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for ACME challenges: %v", err)
+	}
+	go func() {
+		if err := http.Serve(listener, manager.HTTPHandler()); err != nil {
+			log.Printf("Stopped answering ACME challenges on port %d: %v", httpPort, err)
+		}
+	}()
+	log.Printf("Answering ACME http-01 challenges on port %d", httpPort)
+	return manager, nil
+}
@@ -0,0 +1,14 @@
+//go:build noacme
+
+package servercmd
+
+import (
+	"errors"
+
+	"github.com/DevonTM/wg-rp/pkg/server"
+)
+
+// newCertIssuer fails in builds without ACME support
+func newCertIssuer(email, cacheDir, directoryURL string, httpPort int) (server.CertIssuer, error) {
+	return nil, errors.New("this build has no ACME support (built with the noacme tag)")
+}
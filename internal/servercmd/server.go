@@ -0,0 +1,517 @@
+// Package servercmd implements the wg-rp server command, run as rps or wg-rp server
+package servercmd
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/circuitbreaker"
+	"github.com/DevonTM/wg-rp/pkg/logger"
+	"github.com/DevonTM/wg-rp/pkg/server"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+	"github.com/DevonTM/wg-rp/pkg/webhook"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// Run runs the server with the arguments following the command name. name is how the server
+// was invoked and is used in usage messages.
+func Run(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	var configFiles utils.ArrayFlags
+	var networkAPIPorts utils.ArrayFlags
+	var verbose bool
+	var showVersion bool
+	var bufferSizeKB int
+	var maxBufferMB int
+	var apiPort int
+	var muxPort int
+	var forwardPort int
+	var forwardAllow utils.ArrayFlags
+	var reservationTTL time.Duration
+	var minClientVersion string
+	var allowCapture bool
+	var heartbeatInterval time.Duration
+	var clientTimeout time.Duration
+	var outputFormat string
+	var logLevel string
+	var captureDir string
+	var deadClientPolicy string
+	var tunnelDialTimeout time.Duration
+	var deleteGracePeriod time.Duration
+	var breakerThreshold int
+	var breakerRecovery time.Duration
+	var historySize int
+	var strictPerms bool
+	var allowHooks bool
+	var hookTimeout time.Duration
+	var tcpSendBufferKB int
+	var tcpRecvBufferKB int
+	var wgBatch int
+	var auditLogPath string
+	var webhookURL string
+	var authToken string
+	var adminToken string
+	var metricsAddr string
+	var preloadFile string
+	var allowDeletePreloaded bool
+	var storeFile string
+	var exportFile string
+	var blockedCIDRs utils.ArrayFlags
+	var identityURL string
+	var identityCacheTTL time.Duration
+	var identityFailClosed bool
+	var historyRetention time.Duration
+	var tlsCerts utils.ArrayFlags
+	var apiRateLimit float64
+	var apiRateBurst int
+	fs.Float64Var(&apiRateLimit, "api-rate-limit", server.DefaultAPIRateLimit, "API requests per second allowed from each client IP, 0 to disable the limit")
+	fs.IntVar(&apiRateBurst, "api-rate-burst", server.DefaultAPIRateBurst, "API requests a client IP may make at once above -api-rate-limit")
+	fs.Var(&tlsCerts, "tls-cert", "Certificate mappings may terminate TLS with, as name=cert.pem,key.pem; clients select it by name (can be used multiple times, reloaded on SIGHUP)")
+	var acmeSpec string
+	var acmeDirectory string
+	var acmeHTTPPort int
+	fs.StringVar(&acmeSpec, "acme", "", "Obtain certificates for SNI mappings asking for tls_cert acme, as email,cache_dir (default: disabled)")
+	fs.StringVar(&acmeDirectory, "acme-directory", "", "Directory URL of the ACME CA (default: Let's Encrypt)")
+	fs.IntVar(&acmeHTTPPort, "acme-http-port", 0, "Host port to answer ACME http-01 challenges on, usually 80, 0 for tls-alpn-01 only")
+
+	fs.Var(&configFiles, "c", "WireGuard configuration file, repeat to serve more independent networks (default wg-server.conf)")
+	fs.BoolVar(&verbose, "v", false, "Enable verbose logging on WireGuard device")
+	fs.BoolVar(&showVersion, "V", false, "Show version and exit")
+	fs.IntVar(&bufferSizeKB, "b", 32, "Buffer size for i/o operations (in KB, minimum 1KB)")
+	fs.IntVar(&maxBufferMB, "max-buffer-mem", 0, "Memory the relay buffers of all networks may hold, pooled or in use (in MB, 0 = unlimited); beyond it connections use throwaway buffers")
+	fs.IntVar(&apiPort, "api-port", server.DefaultAPIPort, "Port for the REST API within the WireGuard netstack")
+	fs.Var(&networkAPIPorts, "network-api-port", "REST API port of the n-th network given with -c, counting from 1, e.g. 2=8080 (default: -api-port; can be used multiple times)")
+	fs.IntVar(&muxPort, "mux-port", 0, "Port within the WireGuard netstack for multiplexed client sessions (0 disables multiplexing)")
+	fs.IntVar(&forwardPort, "forward-port", 0, "Port within the WireGuard netstack for forwards from clients (-L on rpc; 0 disables forwarding)")
+	fs.Var(&forwardAllow, "forward-allow", "Allow forwards from clients to targets in this CIDR range (required with -forward-port; can be used multiple times)")
+	fs.DurationVar(&reservationTTL, "reservation-ttl", 5*time.Minute, "How long an unused port reservation is held")
+	fs.StringVar(&minClientVersion, "min-client-version", "", "Reject clients older than this version (clients without a version count as 0.0.0)")
+	fs.BoolVar(&allowCapture, "allow-capture", false, "Allow debug captures of mapping traffic via the API")
+	fs.StringVar(&captureDir, "capture-dir", os.TempDir(), "Directory for debug capture files")
+	fs.DurationVar(&heartbeatInterval, "heartbeat-interval", server.DefaultHeartbeatInterval, "Heartbeat interval advertised to clients")
+	fs.DurationVar(&clientTimeout, "client-timeout", server.DefaultClientTimeout, "Remove a client's mappings after this long without a heartbeat")
+	fs.DurationVar(&tunnelDialTimeout, "tunnel-dial-timeout", server.DefaultTunnelDialTimeout, "How long to wait when connecting to a client through the tunnel, unless its mapping sets its own")
+	fs.IntVar(&breakerThreshold, "breaker-threshold", circuitbreaker.DefaultThreshold, "Close new connections to a mapping after this many consecutive failed dials to its client")
+	fs.DurationVar(&breakerRecovery, "breaker-recovery", circuitbreaker.DefaultRecoveryTimeout, "How long a mapping's open circuit waits before letting a trial connection through")
+	fs.StringVar(&deadClientPolicy, "dead-client-policy", server.DeadClientRemove, "What to do with a dead client's mappings: remove (free the ports) or suspend (keep the ports, reject connections until it returns)")
+	fs.IntVar(&historySize, "history-size", 256, "Number of closed connections remembered per mapping")
+	fs.DurationVar(&historyRetention, "history-retention", 24*time.Hour, "How long closed connections remain in the connection history")
+	fs.Var(&blockedCIDRs, "block-cidr", "Never allow external connections from this CIDR range to any mapped port (can be used multiple times)")
+	fs.StringVar(&preloadFile, "preload-mappings", "", "JSON file with an array of port mapping requests to create at startup and keep while their clients are away")
+	fs.BoolVar(&allowDeletePreloaded, "allow-delete-preloaded", false, "Allow the API to delete preloaded port mappings")
+	fs.StringVar(&storeFile, "store", "", "JSON file to keep the port mappings in, restoring them at startup so their ports stay taken while clients reconnect (default: memory only)")
+	fs.StringVar(&exportFile, "export-mappings", "", "Write the port mappings in -store to this file in the -preload-mappings format and exit, without starting the server")
+	fs.DurationVar(&deleteGracePeriod, "delete-grace", server.DefaultDeleteGracePeriod, "How long a deleted mapping keeps its port, resetting new connections, before another client may map it (0 releases it at once)")
+	fs.StringVar(&metricsAddr, "metrics-addr", "", "Also serve Prometheus metrics on this host address, e.g. 127.0.0.1:9100 (always available at /metrics on the API)")
+	fs.StringVar(&auditLogPath, "audit-log", "", "Append a JSON line for every port mapping creation, deletion and expiry to this file")
+	fs.StringVar(&webhookURL, "webhook-url", "", "POST a JSON notification to this URL when a port mapping is created, deleted or expires or its client dies")
+	fs.StringVar(&authToken, "auth-token", "", "Require this bearer token in the Authorization header of API requests (prefer WGRP_AUTH_TOKEN, arguments are visible to other users)")
+	fs.StringVar(&adminToken, "admin-token", "", "Bearer token of privileged API requests, such as setting client quotas, which are refused without it (prefer WGRP_ADMIN_TOKEN)")
+	fs.StringVar(&identityURL, "identity-url", "", "External identity resolver endpoint mapping clients to tenants (default: each client IP is its own tenant)")
+	fs.DurationVar(&identityCacheTTL, "identity-cache-ttl", time.Minute, "How long identities from the external resolver are reused")
+	fs.BoolVar(&identityFailClosed, "identity-fail-closed", false, "Reject clients when the identity resolver is unavailable instead of using the default identity")
+	fs.BoolVar(&allowHooks, "allow-hooks", false, "Run the PreUp, PostUp, PreDown and PostDown commands of the WireGuard config")
+	fs.DurationVar(&hookTimeout, "hook-timeout", wireguard.DefaultHookTimeout, "How long each hook command may run")
+	fs.IntVar(&tcpSendBufferKB, "tcp-send-buffer", 0, "Send buffer of each TCP connection in the WireGuard netstack, the data it may have in flight (in KB, 0 = 1024); raise it for links with a large bandwidth-delay product")
+	fs.IntVar(&tcpRecvBufferKB, "tcp-recv-buffer", 0, "Initial receive window of each TCP connection in the WireGuard netstack, grown as needed up to 4096KB or this size (in KB, 0 = 1024)")
+	fs.IntVar(&wgBatch, "wg-batch", 0, "Packets WireGuard sends and hands on per batch, 1 to 128 (0 = wireguard-go's own: up to 128 per system call with GSO and GRO on Linux, 1 elsewhere)")
+	fs.BoolVar(&strictPerms, "strict-perms", false, "Refuse to start if the configuration file is readable by group or others")
+	fs.StringVar(&outputFormat, "output-format", "text", "Log output format: text (stderr) or json (stdout)")
+	fs.StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.Parse(args)
+
+	// Fall back to the environment for flags not given, e.g. WGRP_API_PORT for -api-port
+	fromEnv := cli.ApplyEnv(fs, map[string]utils.EnvFallback{
+		"c":             {List: true, Var: "WGRP_CONFIG"},
+		"v":             {Var: "WGRP_VERBOSE"},
+		"V":             {},
+		"b":             {Var: "WGRP_BUFFER_KB"},
+		"block-cidr":    {List: true, Var: "WGRP_BLOCK_CIDR"},
+		"forward-allow": {List: true, Var: "WGRP_FORWARD_ALLOW"},
+		"identity-url":  {Var: "WGRP_IDENTITY_URL", Secret: true},
+		"auth-token":    {Var: "WGRP_AUTH_TOKEN", Secret: true},
+		"admin-token":   {Var: "WGRP_ADMIN_TOKEN", Secret: true},
+	})
+
+	// Handle version flag
+	if showVersion {
+		cli.PrintVersion("server")
+	}
+
+	if _, err := logger.Setup(outputFormat, logLevel, 0); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	cli.LogEnv(fromEnv)
+
+	// Export the stored mappings offline instead of starting the server
+	if exportFile != "" {
+		if storeFile == "" {
+			log.Fatal("-export-mappings reads the mappings from -store; export a running server's mappings with POST /api/v1/port-mappings/export instead")
+		}
+		data, err := server.ExportStore(storeFile)
+		if err != nil {
+			log.Fatalf("Failed to read port mappings from %s: %v", storeFile, err)
+		}
+		if err := os.WriteFile(exportFile, data, 0o600); err != nil {
+			log.Fatalf("Failed to export port mappings: %v", err)
+		}
+		log.Printf("Exported the port mappings in %s to %s", storeFile, exportFile)
+		return
+	}
+
+	// Validate buffer size
+	if bufferSizeKB < 1 {
+		log.Fatal("Buffer size must be at least 1KB")
+	}
+
+	// Validate buffer memory limit
+	if maxBufferMB < 0 || (maxBufferMB > 0 && maxBufferMB*1024 < bufferSizeKB) {
+		log.Fatal("Buffer memory limit must not be negative and must hold at least one buffer")
+	}
+
+	// Validate API port
+	if apiPort < 1 || apiPort > 65535 {
+		log.Fatal("API port must be between 1-65535")
+	}
+
+	if len(configFiles) == 0 {
+		configFiles = utils.ArrayFlags{"wg-server.conf"}
+	}
+
+	// Validate per-network API ports
+	apiPorts := make([]int, len(configFiles))
+	for i := range apiPorts {
+		apiPorts[i] = apiPort
+	}
+	for _, spec := range networkAPIPorts {
+		indexStr, portStr, ok := strings.Cut(spec, "=")
+		index, indexErr := strconv.Atoi(indexStr)
+		port, portErr := strconv.Atoi(portStr)
+		if !ok || indexErr != nil || portErr != nil {
+			log.Fatalf("Invalid network API port %q. Expected format: network=port", spec)
+		}
+		if index < 1 || index > len(configFiles) {
+			log.Fatalf("Invalid network API port %q: network must be between 1-%d, the number of -c files", spec, len(configFiles))
+		}
+		if port < 1 || port > 65535 {
+			log.Fatalf("Invalid network API port %q: port must be between 1-65535", spec)
+		}
+		apiPorts[index-1] = port
+	}
+
+	// Validate mux port
+	if muxPort < 0 || muxPort > 65535 || (muxPort != 0 && slices.Contains(apiPorts, muxPort)) {
+		log.Fatal("Mux port must be between 1-65535 and differ from the API port, or 0 to disable")
+	}
+
+	// Validate forwarding
+	if forwardPort < 0 || forwardPort > 65535 || (forwardPort != 0 && (slices.Contains(apiPorts, forwardPort) || forwardPort == muxPort)) {
+		log.Fatal("Forward port must be between 1-65535 and differ from the API and mux ports, or 0 to disable")
+	}
+	var forwardPrefixes []netip.Prefix
+	for _, cidr := range forwardAllow {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Fatalf("Invalid forward CIDR range %q: %v", cidr, err)
+		}
+		forwardPrefixes = append(forwardPrefixes, prefix.Masked())
+	}
+	if forwardPort != 0 && len(forwardPrefixes) == 0 {
+		log.Fatal("Forwarding requires at least one -forward-allow range")
+	}
+
+	// Validate ACME
+	var acmeEmail, acmeCacheDir string
+	if acmeSpec != "" {
+		var ok bool
+		acmeEmail, acmeCacheDir, ok = strings.Cut(acmeSpec, ",")
+		if !ok || acmeEmail == "" || acmeCacheDir == "" {
+			log.Fatalf("Invalid ACME setting %q. Expected format: email,cache_dir", acmeSpec)
+		}
+	} else if acmeDirectory != "" || acmeHTTPPort != 0 {
+		log.Fatal("-acme-directory and -acme-http-port need -acme")
+	}
+	if acmeHTTPPort < 0 || acmeHTTPPort > 65535 {
+		log.Fatal("ACME HTTP port must be between 0 and 65535")
+	}
+
+	// Validate hook timeout
+	if hookTimeout <= 0 {
+		log.Fatal("Hook timeout must be positive")
+	}
+
+	// Validate netstack TCP buffers
+	for _, kb := range []int{tcpSendBufferKB, tcpRecvBufferKB} {
+		if kb < 0 || (kb > 0 && kb*1024 < wireguard.MinTCPBuffer) {
+			log.Fatalf("TCP buffer sizes must be 0 or at least %dKB", wireguard.MinTCPBuffer/1024)
+		}
+	}
+
+	// Validate WireGuard batch size
+	if wgBatch < 0 || wgBatch > wireguard.MaxBatchSize {
+		log.Fatalf("WireGuard batch size must be between 0 and %d", wireguard.MaxBatchSize)
+	}
+
+	// Validate API rate limit
+	if apiRateLimit < 0 {
+		log.Fatal("API rate limit must not be negative")
+	}
+	if apiRateBurst < 1 {
+		log.Fatal("API rate burst must be at least 1")
+	}
+
+	// Validate reservation TTL
+	if reservationTTL <= 0 {
+		log.Fatal("Reservation TTL must be positive")
+	}
+
+	// Validate delete grace period
+	if deleteGracePeriod < 0 {
+		log.Fatal("Delete grace period can't be negative")
+	}
+
+	// Validate heartbeat timing
+	if heartbeatInterval < time.Second {
+		log.Fatal("Heartbeat interval must be at least 1s")
+	}
+	if clientTimeout < 2*heartbeatInterval {
+		log.Fatal("Client timeout must be at least twice the heartbeat interval")
+	}
+
+	// Validate blocked ranges
+	for _, cidr := range blockedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			log.Fatalf("Invalid blocked CIDR range %q: %v", cidr, err)
+		}
+	}
+
+	// Validate identity cache TTL
+	if identityCacheTTL <= 0 {
+		log.Fatal("Identity cache TTL must be positive")
+	}
+
+	// Validate dead client policy
+	if deadClientPolicy != server.DeadClientRemove && deadClientPolicy != server.DeadClientSuspend {
+		log.Fatalf("Invalid dead client policy %q (use %s or %s)", deadClientPolicy, server.DeadClientRemove, server.DeadClientSuspend)
+	}
+
+	// Validate tunnel dial timeout
+	if tunnelDialTimeout <= 0 {
+		log.Fatal("Tunnel dial timeout must be positive")
+	}
+
+	// Validate circuit breaker
+	if breakerThreshold < 1 {
+		log.Fatal("Breaker threshold must be at least 1")
+	}
+	if breakerRecovery <= 0 {
+		log.Fatal("Breaker recovery timeout must be positive")
+	}
+
+	// Validate connection history
+	if historySize < 1 {
+		log.Fatal("History size must be at least 1")
+	}
+	if historyRetention <= 0 {
+		log.Fatal("History retention must be positive")
+	}
+
+	// Validate minimum client version
+	if minClientVersion != "" {
+		if _, err := utils.ParseVersion(minClientVersion); err != nil {
+			log.Fatalf("Invalid minimum client version: %v", err)
+		}
+	}
+
+	// Convert KB to bytes
+	bufferSize := bufferSizeKB * 1024
+
+	// Open audit log
+	var auditLog *server.AuditLogger
+	if auditLogPath != "" {
+		var err error
+		auditLog, err = server.NewAuditLogger(auditLogPath)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditLog.Close()
+		log.Printf("Auditing port mapping changes to %s", auditLogPath)
+	}
+
+	// Load the certificates mappings may terminate TLS with
+	var certs *server.CertStore
+	if len(tlsCerts) > 0 {
+		certs = server.NewCertStore()
+		for _, spec := range tlsCerts {
+			name, files, ok := strings.Cut(spec, "=")
+			certFile, keyFile, ok2 := strings.Cut(files, ",")
+			if !ok || !ok2 || name == "" || certFile == "" || keyFile == "" {
+				log.Fatalf("Invalid TLS certificate %q. Expected format: name=cert.pem,key.pem", spec)
+			}
+			if name == api.TLSCertACME {
+				log.Fatalf("Invalid TLS certificate %q: the name %s is reserved for ACME certificates", spec, api.TLSCertACME)
+			}
+			if err := certs.Add(name, certFile, keyFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Printf("TLS termination available with certificates: %s", strings.Join(certs.Names(), ", "))
+	}
+
+	// Obtain certificates for SNI mappings from an ACME CA
+	var certIssuer server.CertIssuer
+	if acmeSpec != "" {
+		var err error
+		certIssuer, err = newCertIssuer(acmeEmail, acmeCacheDir, acmeDirectory, acmeHTTPPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Obtaining ACME certificates for %s, cached in %s", acmeEmail, acmeCacheDir)
+	}
+
+	// Set up webhook notifications
+	var notifier *webhook.Notifier
+	if webhookURL != "" {
+		var err error
+		notifier, err = webhook.NewNotifier(webhookURL)
+		if err != nil {
+			log.Fatalf("Failed to set up webhook: %v", err)
+		}
+		log.Printf("Notifying %s of port mapping changes", webhookURL)
+	}
+
+	if authToken != "" {
+		log.Printf("API requests require a bearer token")
+	}
+	if adminToken != "" && adminToken == authToken {
+		log.Fatal("The admin token must differ from the auth token, which every client has")
+	}
+	if forwardPort != 0 {
+		log.Printf("Forwarding from clients to %s", strings.Join(forwardAllow, ", "))
+	}
+
+	// Set up identity resolution
+	var identities server.IdentityResolver
+	if identityURL != "" {
+		identities = server.NewHTTPResolver(identityURL, identityCacheTTL, identityFailClosed)
+		log.Printf("Resolving client identities with %s", identityURL)
+	}
+
+	// Options shared by the proxy servers of all networks
+	serverOpts := []server.ServerOption{
+		server.WithMuxPort(muxPort),
+		server.WithForwarding(forwardPort, forwardPrefixes),
+		server.WithCertStore(certs),
+		server.WithCertIssuer(certIssuer),
+		server.WithAPIRateLimit(apiRateLimit, apiRateBurst),
+		server.WithReservationTTL(reservationTTL),
+		server.WithMinClientVersion(minClientVersion),
+		server.WithCapture(allowCapture, captureDir),
+		server.WithHeartbeatTiming(heartbeatInterval, clientTimeout),
+		server.WithDeadClientPolicy(deadClientPolicy),
+		server.WithTunnelDialTimeout(tunnelDialTimeout),
+		server.WithCircuitBreaker(breakerThreshold, breakerRecovery),
+		server.WithAllowDeletePreloaded(allowDeletePreloaded),
+		server.WithDeleteGracePeriod(deleteGracePeriod),
+		server.WithAuditLog(auditLog),
+		server.WithWebhook(notifier),
+		server.WithAuthToken(authToken),
+		server.WithAdminToken(adminToken),
+		server.WithBlockedCIDRs(blockedCIDRs),
+		server.WithIdentityResolver(identities),
+		server.WithConnectionHistory(historySize, historyRetention),
+	}
+	if maxBufferMB > 0 {
+		serverOpts = append(serverOpts, server.WithBufferMemoryLimit(bufferpool.NewMemoryLimit(int64(maxBufferMB)<<20)))
+	}
+
+	// Bring up each WireGuard network with its own proxy server; mappings and clients of one
+	// network are not visible to the others
+	manager := server.NewServerManager()
+	deviceOpts := append(cli.HookOptions(allowHooks, hookTimeout), cli.TCPTuningOptions(tcpSendBufferKB, tcpRecvBufferKB)...)
+	if wgBatch > 0 {
+		deviceOpts = append(deviceOpts, wireguard.WithBatchSize(wgBatch))
+	}
+	for i, configFile := range configFiles {
+		wgDevice := cli.StartDevice("server", configFile, strictPerms, verbose, deviceOpts...)
+		handshakeMonitor := cli.StartHandshakeMonitor(wgDevice)
+		networkOpts := []server.ServerOption{
+			server.WithAPIPort(apiPorts[i]),
+			server.WithTunnelMTU(wgDevice.Config.MTU),
+			server.WithPeerLookup(wgDevice.PeerForAddr),
+			server.WithPeerStats(cli.PeerStats(wgDevice, handshakeMonitor)),
+		}
+		if i == 0 {
+			networkOpts = append(networkOpts, server.WithStore(storeFile))
+		}
+		proxyServer := server.NewProxyServer(wgDevice.Tnet, bufferSize, append(slices.Clone(serverOpts), networkOpts...)...)
+		manager.Add(configFile, wgDevice, proxyServer)
+	}
+
+	// Start the API servers, mux listeners and health checkers
+	if err := manager.Start(); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	proxyServer := manager.Networks()[0].Server
+
+	// Recreate the mappings from before the restart, then the fixed ones, in the first network
+	if storeFile != "" {
+		if err := proxyServer.RestoreStore(); err != nil {
+			log.Fatalf("Failed to restore port mappings: %v", err)
+		}
+	}
+	if preloadFile != "" {
+		if err := proxyServer.PreloadMappings(preloadFile); err != nil {
+			log.Fatalf("Failed to preload port mappings: %v", err)
+		}
+	}
+
+	if allowCapture {
+		log.Printf("WARNING: debug captures are enabled, captured traffic is written unencrypted to %s", captureDir)
+	}
+
+	log.Printf("Connection history keeps the last %d closed connections per mapping for %s (about %s per mapping)",
+		historySize, historyRetention, utils.FormatBytes(proxyServer.HistoryMemoryEstimate()))
+
+	// Log the state of every mapping and client on demand
+	handleSnapshotSignal(manager)
+
+	// Re-read the TLS certificates on demand, without closing any listener
+	handleReloadSignal(certs)
+
+	// Serve metrics on the host for scrapers outside the tunnel
+	if metricsAddr != "" {
+		go func() {
+			log.Printf("Metrics available at http://%s/metrics", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, manager.MetricsHandler()); err != nil {
+				log.Fatalf("Failed to serve metrics on %s: %v", metricsAddr, err)
+			}
+		}()
+	}
+
+	log.Printf("WireGuard proxy server started successfully")
+	for _, n := range manager.Networks() {
+		log.Printf("Network %s: server IPs %v, API server running on port %d within WireGuard netstack",
+			n.Name, n.Device.Config.InterfaceIPs, n.Server.APIPort())
+	}
+	log.Printf("Health checker started for monitoring client connections")
+	log.Printf("Waiting for client connections...")
+
+	// Keep the server running until asked to stop
+	<-cli.ShutdownSignals()
+
+	log.Printf("Received shutdown signal, notifying clients...")
+	manager.Shutdown()
+}
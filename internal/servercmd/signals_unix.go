@@ -0,0 +1,77 @@
+//go:build !windows
+
+package servercmd
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/cli"
+	"github.com/DevonTM/wg-rp/pkg/server"
+)
+
+// handleSnapshotSignal logs a snapshot of all mappings and clients of every network whenever
+// SIGUSR1 is received
+func handleSnapshotSignal(manager *server.ServerManager) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+
+	go func() {
+		for range sigChan {
+			networks := manager.Networks()
+			for _, n := range networks {
+				// Name the network only when there is more than one
+				logger := slog.Default()
+				if len(networks) > 1 {
+					logger = logger.With("network", n.Name)
+				}
+				logSnapshot(logger, n.Server.Snapshot())
+			}
+		}
+	}()
+}
+
+// handleReloadSignal re-reads the TLS certificates whenever SIGHUP is received. New handshakes
+// use the reloaded certificates; open connections and listeners are left alone.
+func handleReloadSignal(certs *server.CertStore) {
+	if certs == nil {
+		return
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			log.Printf("Received SIGHUP, reloading TLS certificates...")
+			if err := certs.Reload(); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}
+	}()
+}
+
+// logSnapshot logs one line per mapping and client of a snapshot
+func logSnapshot(logger *slog.Logger, snapshot server.Snapshot) {
+	logger.Info("Snapshot", "mappings", len(snapshot.Mappings), "clients", len(snapshot.Clients))
+	for _, m := range snapshot.Mappings {
+		logger.Info("Snapshot mapping",
+			"remote_port", m.RemotePort, "listen_addr", m.ListenAddr,
+			"client_ip", m.ClientIP, "client_port", m.ClientPort, "local_addr", m.LocalAddr,
+			"active_connections", m.ActiveConnections, "suspended", m.Suspended, "preloaded", m.Preloaded)
+	}
+	for _, c := range snapshot.Clients {
+		logger.Info("Snapshot client",
+			"client_ip", c.ClientIP, "version", c.Version, "heartbeat_age", c.HeartbeatAge.Round(time.Millisecond),
+			"mappings", c.Mappings, "suspended", c.Suspended)
+	}
+	for _, p := range snapshot.Peers {
+		logger.Info("Snapshot peer",
+			"public_key", p.PublicKey, "endpoint", p.Endpoint, "last_handshake", cli.LastHandshake(p),
+			"rx_bytes", p.RxBytes, "tx_bytes", p.TxBytes, "handshake_stale", p.HandshakeStale, "health", p.Health)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package servercmd
+
+import "github.com/DevonTM/wg-rp/pkg/server"
+
+// handleSnapshotSignal is a no-op on Windows, which has no SIGUSR1
+func handleSnapshotSignal(manager *server.ServerManager) {}
+
+// handleReloadSignal is a no-op on Windows, which has no SIGHUP; certificates are loaded at startup
+func handleReloadSignal(certs *server.CertStore) {}
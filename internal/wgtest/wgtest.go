@@ -0,0 +1,167 @@
+// Package wgtest connects two WireGuard netstack devices over loopback UDP for tests and
+// benchmarks that need a real tunnel between a server and a client
+package wgtest
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// Tunnel addresses of the two ends of a pair
+const (
+	ServerIP   = "10.99.0.1"
+	ClientIP   = "10.99.0.2"
+	ServerIPv6 = "fd99::1"
+	ClientIPv6 = "fd99::2"
+)
+
+// MTU is the tunnel MTU of both ends, a typical WireGuard MTU over an Ethernet path
+const MTU = 1420
+
+// Pair is a server and a client device with a tunnel between them
+type Pair struct {
+	Server *wireguard.WireGuardDevice
+	Client *wireguard.WireGuardDevice
+}
+
+// NewPair creates both devices with opts applied to each and closes them when the test ends. The
+// client has a persistent keepalive, so the handshake completes without waiting for traffic.
+func NewPair(tb testing.TB, opts ...wireguard.DeviceOption) *Pair {
+	tb.Helper()
+	return newPair(tb, 0, opts...)
+}
+
+// NewDelayedPair is NewPair with the client's packets relayed to the server and back, each delayed
+// by half of rtt, to emulate a link with that round-trip time
+func NewDelayedPair(tb testing.TB, rtt time.Duration, opts ...wireguard.DeviceOption) *Pair {
+	tb.Helper()
+	return newPair(tb, rtt, opts...)
+}
+
+func newPair(tb testing.TB, rtt time.Duration, opts ...wireguard.DeviceOption) *Pair {
+	tb.Helper()
+
+	serverKey, serverPub := newKey(tb)
+	clientKey, clientPub := newKey(tb)
+	port := freeUDPPort(tb)
+	endpoint := port
+	if rtt > 0 {
+		endpoint = delayRelay(tb, port, rtt/2)
+	}
+
+	serverConfig := fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s/24, %s/64
+ListenPort = %d
+MTU = %d
+
+[Peer]
+PublicKey = %s
+AllowedIPs = %s/32, %s/128
+`, serverKey, ServerIP, ServerIPv6, port, MTU, clientPub, ClientIP, ClientIPv6)
+
+	clientConfig := fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s/24, %s/64
+MTU = %d
+
+[Peer]
+PublicKey = %s
+AllowedIPs = %s/32, %s/128
+Endpoint = 127.0.0.1:%d
+PersistentKeepalive = 1
+`, clientKey, ClientIP, ClientIPv6, MTU, serverPub, ServerIP, ServerIPv6, endpoint)
+
+	server, err := wireguard.NewWireGuardDevice(serverConfig, false, opts...)
+	if err != nil {
+		tb.Fatalf("failed to create server device: %v", err)
+	}
+	tb.Cleanup(server.Close)
+
+	client, err := wireguard.NewWireGuardDevice(clientConfig, false, opts...)
+	if err != nil {
+		tb.Fatalf("failed to create client device: %v", err)
+	}
+	tb.Cleanup(client.Close)
+
+	return &Pair{Server: server, Client: client}
+}
+
+// newKey returns a new WireGuard private key and its public key, base64 encoded
+func newKey(tb testing.TB) (string, string) {
+	tb.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+// freeUDPPort returns a loopback UDP port nothing listens on
+func freeUDPPort(tb testing.TB) int {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// delayRelay listens on a loopback UDP port and forwards what arrives to serverPort, and the
+// replies back to the last sender, each packet delay after it arrived and in order. It returns
+// its port.
+func delayRelay(tb testing.TB, serverPort int, delay time.Duration) int {
+	tb.Helper()
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	relay.SetReadBuffer(4 << 20)
+	relay.SetWriteBuffer(4 << 20)
+	tb.Cleanup(func() { relay.Close() })
+
+	type delayed struct {
+		packet []byte
+		to     *net.UDPAddr
+		due    time.Time
+	}
+	queue := make(chan delayed, 1<<16)
+	go func() {
+		for d := range queue {
+			time.Sleep(time.Until(d.due))
+			relay.WriteToUDP(d.packet, d.to)
+		}
+	}()
+
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverPort}
+	go func() {
+		defer close(queue)
+		var client *net.UDPAddr
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			to := server
+			if from.Port == serverPort {
+				if client == nil {
+					continue
+				}
+				to = client
+			} else {
+				client = from
+			}
+			queue <- delayed{append([]byte(nil), buf[:n]...), to, time.Now().Add(delay)}
+		}
+	}()
+	return relay.LocalAddr().(*net.UDPAddr).Port
+}
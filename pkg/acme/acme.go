@@ -0,0 +1,169 @@
+// Package acme obtains and renews certificates from an ACME CA, such as Let's Encrypt, for the
+// hostnames of mappings that terminate TLS on the server. It is only imported by the server
+// command, so builds with the noacme tag leave it out.
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Backoff between issuance attempts for a hostname after a failure, doubling per failure, so a
+// misconfigured hostname doesn't exhaust the CA's rate limits
+const (
+	minRetryDelay = 5 * time.Minute
+	maxRetryDelay = time.Hour
+)
+
+// Manager issues certificates on first use for the hostnames mappings registered with it, and
+// renews them in the background. Certificates and the account key are kept in a directory cache,
+// so restarts reuse them instead of issuing again.
+type Manager struct {
+	autocert *autocert.Manager
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+// hostState tracks a hostname mappings terminate TLS for
+type hostState struct {
+	mappings    int       // mappings using the hostname
+	ready       bool      // a certificate was obtained
+	failures    int       // consecutive failed issuance attempts
+	lastErr     error     // error of the last failed attempt
+	nextAttempt time.Time // no issuance is attempted before this after a failure
+}
+
+// New creates a manager registering its account with email at the CA of directoryURL, Let's
+// Encrypt if empty, and keeping certificates in cacheDir
+func New(email, cacheDir, directoryURL string) *Manager {
+	m := &Manager{hosts: make(map[string]*hostState)}
+	m.autocert = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: m.hostPolicy,
+		Email:      email,
+	}
+	if directoryURL != "" {
+		m.autocert.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m
+}
+
+// Allow lets certificates be issued for hostname while a mapping uses it
+func (m *Manager) Allow(hostname string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, exists := m.hosts[hostname]
+	if !exists {
+		state = &hostState{}
+		m.hosts[hostname] = state
+	}
+	state.mappings++
+}
+
+// Forget stops issuing certificates for hostname once no mapping uses it. Certificates already
+// in the cache stay there for when it's mapped again.
+func (m *Manager) Forget(hostname string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, exists := m.hosts[hostname]
+	if !exists {
+		return
+	}
+	state.mappings--
+	if state.mappings <= 0 {
+		delete(m.hosts, hostname)
+	}
+}
+
+// Err returns why the last issuance attempt for hostname failed, or nil if it has a certificate
+// or none was attempted yet
+func (m *Manager) Err(hostname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state, exists := m.hosts[hostname]; exists {
+		return state.lastErr
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate for the server name of a TLS handshake, obtaining it
+// from the CA on first use. It also answers tls-alpn-01 challenges.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return m.autocert.GetCertificate(hello)
+	}
+
+	hostname := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	m.mu.Lock()
+	state, exists := m.hosts[hostname]
+	if !exists {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("acme: no mapping for hostname %q", hello.ServerName)
+	}
+	if !state.ready && time.Now().Before(state.nextAttempt) {
+		err := state.lastErr
+		m.mu.Unlock()
+		return nil, fmt.Errorf("acme: not retrying %s before %s: %v", hostname, state.nextAttempt.Format(time.TimeOnly), err)
+	}
+	m.mu.Unlock()
+
+	cert, err := m.autocert.GetCertificate(hello)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, exists = m.hosts[hostname]
+	if !exists {
+		return cert, err // the mapping went away meanwhile
+	}
+	if err != nil {
+		state.ready = false
+		state.failures++
+		state.lastErr = err
+		delay := maxRetryDelay
+		if state.failures <= 8 {
+			delay = min(minRetryDelay<<(state.failures-1), maxRetryDelay)
+		}
+		state.nextAttempt = time.Now().Add(delay)
+		log.Printf("Failed to obtain certificate for %s, retrying in %s: %v", hostname, delay, err)
+		return nil, err
+	}
+	if !state.ready {
+		state.ready = true
+		state.failures = 0
+		state.lastErr = nil
+		if cert.Leaf != nil {
+			log.Printf("Certificate for %s ready, valid until %s", hostname, cert.Leaf.NotAfter.Format(time.DateOnly))
+		} else {
+			log.Printf("Certificate for %s ready", hostname)
+		}
+	}
+	return cert, nil
+}
+
+// HTTPHandler answers http-01 challenges and redirects other requests to HTTPS, to be served on
+// port 80
+func (m *Manager) HTTPHandler() http.Handler {
+	return m.autocert.HTTPHandler(nil)
+}
+
+// hostPolicy lets the CA be asked only for hostnames that are mapped
+func (m *Manager) hostPolicy(_ context.Context, hostname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.hosts[hostname]; !exists {
+		return fmt.Errorf("acme: no mapping for hostname %q", hostname)
+	}
+	return nil
+}
@@ -2,26 +2,379 @@ package api
 
 // PortMappingRequest represents a request to create a port mapping
 type PortMappingRequest struct {
-	LocalAddr  string `json:"local_addr"`  // Format: ip:port (e.g., "127.0.0.1:8080")
-	RemotePort int    `json:"remote_port"` // Port to expose on server (e.g., 8080)
-	ClientIP   string `json:"client_ip"`   // Client IP within WireGuard tunnel
-	ClientPort int    `json:"client_port"` // Random port client is listening on
+	LocalAddr  string `json:"local_addr"`          // Format: ip:port (e.g., "127.0.0.1:8080")
+	RemotePort int    `json:"remote_port"`         // Port to expose on server (e.g., 8080)
+	ClientIP   string `json:"client_ip"`           // Client IP within WireGuard tunnel
+	ClientPort int    `json:"client_port"`         // Random port client is listening on
+	Version    string `json:"version,omitempty"`   // Client version (empty for old clients)
+	Transport  string `json:"transport,omitempty"` // Data path the client offers (empty = direct dial only)
+
+	Schedule            string `json:"schedule,omitempty"`              // Daily windows the mapping accepts connections in (empty = always)
+	ScheduleCloseActive bool   `json:"schedule_close_active,omitempty"` // Close open connections when the window closes
+
+	MaxConnsPerSecond float64 `json:"max_conns_per_second,omitempty"` // Rate of new external connections (0 = unlimited)
+	MaxConnsBurst     int     `json:"max_conns_burst,omitempty"`      // Connections allowed at once above the rate (0 = derived from the rate)
+	MaxHalfOpen       int     `json:"max_half_open,omitempty"`        // Connections that may be set up at once, before reaching the client (0 = server default)
+
+	LocalProbe string `json:"local_probe,omitempty"` // Answer connections from the server host itself locally (empty = relay them)
+
+	TunnelDialTimeoutMillis int `json:"tunnel_dial_timeout_ms,omitempty"` // How long the server waits to connect to the client (0 = server default)
+	WriteDeadlineSeconds    int `json:"write_deadline_seconds,omitempty"` // How long a write to an external connection may block (0 = no limit)
+
+	SampleRate *float64 `json:"sample_rate,omitempty"` // Fraction of connections, 0 to 1, whose open and close are logged (nil = all)
+
+	Name   string            `json:"name,omitempty"`   // Service name shown in logs and listings, need not be unique
+	Labels map[string]string `json:"labels,omitempty"` // Free-form labels shown in listings and exports
+
+	TTLSeconds int `json:"ttl_seconds,omitempty"` // Remove the mapping this long after it's created (0 = no expiry)
+
+	HTTPHostRewrite string `json:"http_host_rewrite,omitempty"` // Host header to set on the first HTTP request of each connection (empty = unchanged)
+
+	ProxyProtocol  bool       `json:"proxy_protocol,omitempty"`   // Send each connection's addresses ahead of its data in a PROXY protocol v2 header
+	ProxyProtoTLVs []TLVEntry `json:"proxy_proto_tlvs,omitempty"` // Application data added to the PROXY protocol header, needs ProxyProtocol
+
+	Visibility string `json:"visibility,omitempty"` // Where the port is exposed: VisibilityPublic or VisibilityTunnel (empty = public)
+
+	Mode     string `json:"mode,omitempty"`     // How connections reach the mapping: ModeTCP, ModeHTTP or ModeSNI (empty = tcp)
+	Hostname string `json:"hostname,omitempty"` // Host routed to the mapping in ModeHTTP and ModeSNI, e.g. "app.example.com" or "*.dev.example.com"
+
+	BufferSizeKB int `json:"buffer_size_kb,omitempty"` // Size of the buffers the server relays this mapping with, in KB (0 = server default)
+
+	TLSCert string   `json:"tls_cert,omitempty"` // Name of a server certificate to terminate TLS with, relaying plaintext to the client, or TLSCertACME (empty = raw TCP)
+	TLSALPN []string `json:"tls_alpn,omitempty"` // Protocols the backend speaks, "h2" and/or "http/1.1", offered to TLS clients in order (empty = no ALPN)
+
+	Compression string `json:"compression,omitempty"` // Compress the tunnel leg with CompressionSnappy or CompressionZstd if the server supports it (empty = none)
+}
+
+// TLVEntry is a type-length-value field of a PROXY protocol v2 header. Types 0xE0 to 0xEF are
+// reserved for application data.
+type TLVEntry struct {
+	Type  uint8  `json:"type"`
+	Value []byte `json:"value"` // base64 in JSON
 }
 
+// Compression algorithms for the tunnel leg of a mapping's connections
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy" // Fast, for CPU-constrained ends
+	CompressionZstd   = "zstd"   // Better ratio at more CPU
+)
+
+// TLSCertACME is the TLSCert of an SNI mapping terminating TLS with a certificate the server
+// obtains for its hostname from an ACME CA, on servers started with -acme
+const TLSCertACME = "acme"
+
+// MaxBufferSizeKB is the largest buffer size a port mapping may ask for
+const MaxBufferSizeKB = 1024
+
+// Modes of a port mapping
+const (
+	ModeTCP  = "tcp"  // The mapping owns its port and gets every connection
+	ModeHTTP = "http" // The port is shared, each connection goes to the mapping of the Host it requests
+	ModeSNI  = "sni"  // The port is shared, each TLS connection goes to the mapping of its server name
+)
+
+// SNIDefaultHost is the hostname of the SNI mapping that gets the connections of a shared port
+// without a usable server name: those without SNI, and those using Encrypted Client Hello
+const SNIDefaultHost = "*"
+
+// Visibilities of a mapped port
+const (
+	VisibilityPublic = "public" // Listen on the server host's network
+	VisibilityTunnel = "tunnel" // Listen only within the WireGuard network, for the other peers
+)
+
+// Local probe modes for connections from the server host to a mapped port
+const (
+	LocalProbeAccept = "accept" // Accept the connection and close it
+	LocalProbeHTTP   = "http"   // Answer with a minimal HTTP 200 response
+)
+
+// TransportYamux multiplexes all connections of a client as yamux streams over one tunnel connection
+const TransportYamux = "yamux"
+
 // PortMappingResponse represents the response to a port mapping request
 type PortMappingResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	Transport string `json:"transport,omitempty"` // Data path the server chose (empty = direct dial)
+	MuxPort   int    `json:"mux_port,omitempty"`  // Server port for the multiplexed session
+
+	Compression string `json:"compression,omitempty"` // Compression the server agreed to for the tunnel leg (empty = none)
+
+	GracePeriodEndsAt int64 `json:"grace_period_ends_at,omitempty"` // Unix time a deleted mapping releases its port
+}
+
+// PortMappingUpdate changes settings of an existing port mapping; fields left out are kept
+type PortMappingUpdate struct {
+	SampleRate *float64           `json:"sample_rate,omitempty"` // Fraction of connections, 0 to 1, whose open and close are logged
+	Labels     *map[string]string `json:"labels,omitempty"`      // Replace the mapping's labels, {} to remove them
 }
 
 // HeartbeatRequest represents a heartbeat request from client
 type HeartbeatRequest struct {
-	ClientIP string `json:"client_ip"` // Client IP within WireGuard tunnel
+	ClientIP                 string       `json:"client_ip"`                            // Client IP within WireGuard tunnel
+	Version                  string       `json:"version,omitempty"`                    // Client version (empty for old clients)
+	Stats                    *ClientStats `json:"stats,omitempty"`                      // Client-side counters (empty for old clients)
+	RTTMillis                float64      `json:"rtt_ms,omitempty"`                     // Smoothed heartbeat round-trip time measured by the client
+	HeartbeatIntervalSeconds int          `json:"heartbeat_interval_seconds,omitempty"` // Interval the client currently uses
 }
 
 // HeartbeatResponse represents the response to a heartbeat request
 type HeartbeatResponse struct {
+	Success                  bool   `json:"success"`
+	Message                  string `json:"message"`
+	ServerStartupTime        int64  `json:"server_startup_time"`
+	Version                  string `json:"version,omitempty"`                    // Server version
+	HeartbeatIntervalSeconds int    `json:"heartbeat_interval_seconds,omitempty"` // Interval the server wants clients to use
+	ClientTimeoutSeconds     int    `json:"client_timeout_seconds,omitempty"`     // How long the server waits for heartbeats at that interval
+
+	ForwardPort int `json:"forward_port,omitempty"` // Port of the forward listener within the WireGuard netstack (0 = forwarding disabled)
+}
+
+// MappingStatus describes a port mapping on the server
+type MappingStatus struct {
+	RemotePort      int    `json:"remote_port"`
+	ClientIP        string `json:"client_ip"`
+	ClientPort      int    `json:"client_port"`
+	LocalAddr       string `json:"local_addr"`
+	Suspended       bool   `json:"suspended,omitempty"`    // Rejecting connections because the client is dead
+	OffSchedule     bool   `json:"off_schedule,omitempty"` // Rejecting connections outside the schedule window
+	BreakerState    string `json:"breaker_state"`          // Circuit breaker state: closed, open or half-open
+	BreakerFailures int    `json:"breaker_failures"`       // Consecutive failed dials to the client
+	MTUSuspects     int64  `json:"mtu_suspects,omitempty"` // Connections that looked like MTU blackholes
+	RateLimited     int64  `json:"rate_limited,omitempty"` // Connections rejected by the rate limiter
+	LocalProbes     int64  `json:"local_probes,omitempty"` // Health checks answered by the local probe fast path
+	Preloaded       bool   `json:"preloaded,omitempty"`    // Created from the server's preload file
+	Name            string `json:"name,omitempty"`         // Service name given by the client
+	ExpiresAt       int64  `json:"expires_at,omitempty"`   // Unix time the mapping is removed at, if it has a TTL
+
+	Labels map[string]string `json:"labels,omitempty"` // Free-form labels given by the client
+
+	GracePeriodEndsAt int64 `json:"grace_period_ends_at,omitempty"` // Deleted, resetting connections until this Unix time
+
+	ActiveConnections int    `json:"active_connections"` // Connections being relayed
+	BytesIn           uint64 `json:"bytes_in"`           // Received from external peers, by open and closed connections
+	BytesOut          uint64 `json:"bytes_out"`          // Sent to external peers, by open and closed connections
+
+	HalfOpenLimited int64 `json:"half_open_limited,omitempty"` // Connections reset because too many were being set up
+
+	SampleRate *float64 `json:"sample_rate,omitempty"` // Fraction of connections whose open and close are logged, if not all
+	Sampled    int64    `json:"sampled,omitempty"`     // Connections whose open and close were logged
+
+	RelayErrors map[string]int64 `json:"relay_errors,omitempty"` // Connections that ended abnormally, by class: reset, timeout, ...
+
+	HTTPHostRewrite string `json:"http_host_rewrite,omitempty"` // Host header set on forwarded HTTP requests
+
+	ProxyProtocol  bool       `json:"proxy_protocol,omitempty"`   // Connections start with a PROXY protocol v2 header
+	ProxyProtoTLVs []TLVEntry `json:"proxy_proto_tlvs,omitempty"` // Application data in the PROXY protocol header
+
+	Visibility string `json:"visibility"` // Where the port is exposed: public or tunnel
+
+	Mode     string `json:"mode"`               // tcp, or http or sni for a hostname on a shared port
+	Hostname string `json:"hostname,omitempty"` // Host routed to the mapping in http and sni mode
+
+	BufferSizeKB int `json:"buffer_size_kb"` // Size of the buffers the server relays the mapping with, in KB
+
+	TLSCert  string `json:"tls_cert,omitempty"`  // Certificate the server terminates TLS with, empty for raw TCP
+	TLSError string `json:"tls_error,omitempty"` // Why the server failed to obtain the mapping's ACME certificate, if it did
+
+	Compression string `json:"compression,omitempty"` // Compression of the tunnel leg, empty for none
+}
+
+// PortMappingListResponse represents the response to a port mapping list request
+type PortMappingListResponse struct {
+	Success  bool            `json:"success"`
+	Message  string          `json:"message,omitempty"` // Why the list was refused, e.g. a missing token
+	Mappings []MappingStatus `json:"mappings"`
+}
+
+// PortReservationRequest represents a request to reserve a port without starting a listener
+type PortReservationRequest struct {
+	RemotePort int    `json:"remote_port"` // Port to reserve on server (e.g., 8080)
+	ClientIP   string `json:"client_ip"`   // Client IP within WireGuard tunnel
+}
+
+// PortReservationResponse represents the response to a port reservation request
+type PortReservationResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix time the reservation expires if unused
+}
+
+// MappingStats holds aggregate client-side counters for a single route mapping
+type MappingStats struct {
+	RemotePort        int    `json:"remote_port"`
+	ActiveConnections int64  `json:"active_connections"` // Currently open local connections
+	BytesRelayed      uint64 `json:"bytes_relayed"`      // Cumulative bytes relayed in both directions
+	DialFailures      uint64 `json:"dial_failures"`      // Failed dials to the local service
+}
+
+// ClientStats is a snapshot of client-side counters reported with each heartbeat
+type ClientStats struct {
+	Mappings []MappingStats `json:"mappings"`
+}
+
+// ClientStatus describes a client known to the server
+type ClientStatus struct {
+	ClientIP      string       `json:"client_ip"`
+	TenantID      string       `json:"tenant_id,omitempty"` // Tenant the client was resolved to
+	Namespace     string       `json:"namespace,omitempty"`
+	Version       string       `json:"version,omitempty"`
+	LastHeartbeat int64        `json:"last_heartbeat"` // Unix time of the last heartbeat
+	Mappings      []int        `json:"mappings"`       // Remote ports mapped by this client
+	Stats         *ClientStats `json:"stats,omitempty"`
+	RTTMillis     float64      `json:"rtt_ms,omitempty"` // Heartbeat round-trip time reported by the client
+
+	BandwidthQuotaBps int64 `json:"bandwidth_quota_bps,omitempty"` // Bits per second all connections of the client may relay together
+}
+
+// ClientQuotaRequest sets the bandwidth quota of a client
+type ClientQuotaRequest struct {
+	BandwidthQuotaBps int64 `json:"bandwidth_quota_bps"` // Bits per second, counting both directions of all the client's connections; 0 for unlimited
+}
+
+// ClientQuotaResponse represents the response to a client quota request
+type ClientQuotaResponse struct {
 	Success           bool   `json:"success"`
 	Message           string `json:"message"`
+	BandwidthQuotaBps int64  `json:"bandwidth_quota_bps"`
+}
+
+// ClientListResponse represents the response to a client list request
+type ClientListResponse struct {
+	Success bool           `json:"success"`
+	Clients []ClientStatus `json:"clients"`
+}
+
+// CaptureRequest represents a request to capture the traffic of a single port mapping
+type CaptureRequest struct {
+	RemotePort      int   `json:"remote_port"`      // Mapped port to capture
+	DurationSeconds int   `json:"duration_seconds"` // Capture length (0 = server default)
+	MaxBytes        int64 `json:"max_bytes"`        // Capture file size limit (0 = server default)
+
+	Hostname   string `json:"hostname,omitempty"`   // Host of an HTTP or SNI mapping on a shared port
+	Visibility string `json:"visibility,omitempty"` // Mapping of the port to capture, public first if empty
+
+	// Capture a mapping that terminates TLS, whose relayed traffic is the decrypted plaintext
+	AllowTLSPlaintext bool `json:"allow_tls_plaintext,omitempty"`
+}
+
+// CaptureResponse represents the response to a capture request
+type CaptureResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"` // Capture file path on the server
+}
+
+// ServerStatus describes the server and its configuration
+type ServerStatus struct {
+	Version                  string `json:"version"`
+	StartupTime              int64  `json:"startup_time"` // Unix time the server started
+	HeartbeatIntervalSeconds int    `json:"heartbeat_interval_seconds"`
+	ClientTimeoutSeconds     int    `json:"client_timeout_seconds"`
+	Mappings                 int    `json:"mappings"`
+	Clients                  int    `json:"clients"`
+	OpenFDs                  int    `json:"open_fds,omitempty"` // File descriptors the server process has open
+	MaxFDs                   int    `json:"max_fds,omitempty"`  // Soft RLIMIT_NOFILE of the server process
+
+	Peers []PeerStats `json:"peers,omitempty"` // WireGuard peers of the server's device
+}
+
+// PeerStats describes a WireGuard peer as the device sees it
+type PeerStats struct {
+	PublicKey      string `json:"public_key"`                // Base64, as in WireGuard configs
+	Endpoint       string `json:"endpoint,omitempty"`        // Address packets to the peer are sent to, empty until it is known
+	LastHandshake  int64  `json:"last_handshake,omitempty"`  // Unix time of the last completed handshake, 0 for none
+	HandshakeStale bool   `json:"handshake_stale,omitempty"` // No handshake for over 3 minutes, the tunnel is likely down
+	Health         string `json:"health,omitempty"`          // Tunnel health from the handshake monitor: up, degraded or down
+	RxBytes        uint64 `json:"rx_bytes"`
+	TxBytes        uint64 `json:"tx_bytes"`
+}
+
+// ServerStats holds server-wide totals since the server started
+type ServerStats struct {
+	UptimeSeconds        int64  `json:"uptime_seconds"`
+	TotalMappings        int    `json:"total_mappings"`
+	ActiveConnections    int    `json:"active_connections"`     // Open proxy connections
+	TotalConnectionsEver uint64 `json:"total_connections_ever"` // Proxy connections established since startup
+	TotalBytesIn         uint64 `json:"total_bytes_in"`         // Bytes received from external connections, counted when they close
+	TotalBytesOut        uint64 `json:"total_bytes_out"`        // Bytes sent to external connections, counted when they close
+	ClientCount          int    `json:"client_count"`
+	DeadClientsEvicted   uint64 `json:"dead_clients_evicted"` // Clients whose mappings were removed for missing heartbeats
+}
+
+// APIVersion is the version of the REST API, the prefix of its paths
+const APIVersion = "v1"
+
+// VersionResponse describes the server build, for clients and operators to check compatibility
+type VersionResponse struct {
+	Version     string `json:"version"`
+	GoVersion   string `json:"go_version"`
+	StartupTime string `json:"startup_time"` // RFC 3339 time the server started
+	APIVersion  string `json:"api_version"`
+}
+
+// ConnectionRecord describes a closed proxy connection kept in the server's connection history
+type ConnectionRecord struct {
+	ID             uint64 `json:"id"`
+	RemotePort     int    `json:"remote_port"`
+	Peer           string `json:"peer"`       // Address of the external client
+	StartTime      int64  `json:"start_time"` // Unix time in milliseconds
+	EndTime        int64  `json:"end_time"`   // Unix time in milliseconds
+	DurationMillis int64  `json:"duration_ms"`
+	BytesIn        uint64 `json:"bytes_in"`  // Bytes received from the external client
+	BytesOut       uint64 `json:"bytes_out"` // Bytes sent to the external client
+	CloseReason    string `json:"close_reason"`
+}
+
+// ConnectionHistoryResponse represents the response to a connection history request
+type ConnectionHistoryResponse struct {
+	Success     bool               `json:"success"`
+	Message     string             `json:"message,omitempty"`
+	Connections []ConnectionRecord `json:"connections"`
+}
+
+// ConnectionInfo describes an open proxy connection
+type ConnectionInfo struct {
+	ID          uint64 `json:"id"`          // Same ID the connection gets in the connection history
+	RemoteAddr  string `json:"remote_addr"` // Address of the external client
+	TunnelAddr  string `json:"tunnel_addr"` // Local address of the connection into the tunnel
+	MappingPort int    `json:"mapping_port"`
+	StartTime   int64  `json:"start_time"` // Unix time in milliseconds
+	BytesIn     uint64 `json:"bytes_in"`   // Bytes received from the external client so far
+	BytesOut    uint64 `json:"bytes_out"`  // Bytes sent to the external client so far
+}
+
+// ConnectionListResponse represents the response to a live connection list request
+type ConnectionListResponse struct {
+	Success     bool             `json:"success"`
+	Message     string           `json:"message,omitempty"`
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// Event types pushed to clients over the event stream
+const (
+	EventRestarted      = "restarted"          // Sent first on every stream; carries the server startup time
+	EventMappingRemoved = "mapping-removed"    // A mapping of the client was removed on the server
+	EventReRegister     = "please-re-register" // The server dropped the client's mappings and wants them registered again
+	EventShuttingDown   = "shutting-down"      // The server is going away
+	EventMappingPaused  = "mapping-paused"     // A mapping's schedule window closed
+	EventMappingResumed = "mapping-resumed"    // A mapping's schedule window opened
+)
+
+// Event is a server-pushed notification sent on GET /api/v1/events as a server-sent event
+type Event struct {
+	ID                uint64 `json:"id"` // Increases with every event for the lifetime of the server
+	Type              string `json:"type"`
+	Port              int    `json:"port,omitempty"`
+	Hostname          string `json:"hostname,omitempty"`   // Hostname of an HTTP or SNI mapping on a shared port
+	Visibility        string `json:"visibility,omitempty"` // Visibility of the mapping, empty from servers that map each port once
 	ServerStartupTime int64  `json:"server_startup_time"`
 }
+
+// BlocklistResponse represents the response to a blocklist request
+type BlocklistResponse struct {
+	Success bool     `json:"success"`
+	CIDRs   []string `json:"cidrs"` // Ranges never allowed to connect to any mapped port
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// v1Fixtures maps each golden fixture in testdata/v1 to the type it is a v1 message of. Every field
+// is set in the fixtures, so renaming, removing or retyping a field of these types fails the test.
+var v1Fixtures = map[string]func() any{
+	"port_mapping_request.json":        func() any { return new(PortMappingRequest) },
+	"port_mapping_response.json":       func() any { return new(PortMappingResponse) },
+	"port_mapping_update.json":         func() any { return new(PortMappingUpdate) },
+	"port_mapping_list_response.json":  func() any { return new(PortMappingListResponse) },
+	"port_reservation_request.json":    func() any { return new(PortReservationRequest) },
+	"port_reservation_response.json":   func() any { return new(PortReservationResponse) },
+	"heartbeat_request.json":           func() any { return new(HeartbeatRequest) },
+	"heartbeat_response.json":          func() any { return new(HeartbeatResponse) },
+	"client_list_response.json":        func() any { return new(ClientListResponse) },
+	"client_quota_request.json":        func() any { return new(ClientQuotaRequest) },
+	"client_quota_response.json":       func() any { return new(ClientQuotaResponse) },
+	"capture_request.json":             func() any { return new(CaptureRequest) },
+	"capture_response.json":            func() any { return new(CaptureResponse) },
+	"server_status.json":               func() any { return new(ServerStatus) },
+	"server_stats.json":                func() any { return new(ServerStats) },
+	"version_response.json":            func() any { return new(VersionResponse) },
+	"connection_history_response.json": func() any { return new(ConnectionHistoryResponse) },
+	"connection_list_response.json":    func() any { return new(ConnectionListResponse) },
+	"event.json":                       func() any { return new(Event) },
+	"blocklist_response.json":          func() any { return new(BlocklistResponse) },
+}
+
+// decodeStrict decodes data into v, failing on fields v doesn't have
+func decodeStrict(t *testing.T, data []byte, v any) {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("fixture does not decode into %T: %v", v, err)
+	}
+}
+
+// jsonValue unmarshals data into generic values, so documents can be compared regardless of
+// field order and formatting
+func jsonValue(t *testing.T, data []byte) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestV1Fixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "v1", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(v1Fixtures) {
+		t.Errorf("found %d fixtures in testdata/v1, want one for each of the %d v1 types", len(files), len(v1Fixtures))
+	}
+
+	for name, newValue := range v1Fixtures {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "v1", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v := newValue()
+			decodeStrict(t, data, v)
+
+			// Encoding the decoded value again must give the same document: no field of the fixture
+			// was dropped, renamed or changed its type
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := jsonValue(t, encoded), jsonValue(t, data); !reflect.DeepEqual(got, want) {
+				t.Errorf("%T encodes differently from its fixture:\n got: %s\nwant: %s", v, encoded, bytes.TrimSpace(data))
+			}
+		})
+	}
+}
+
+// TestOriginalV1Messages decodes the messages of the first v1 clients and servers, which only
+// knew about port mappings and heartbeats, into the current types
+func TestOriginalV1Messages(t *testing.T) {
+	tests := []struct {
+		file string
+		got  any
+		want any
+	}{
+		{
+			"port_mapping_request.json",
+			new(PortMappingRequest),
+			&PortMappingRequest{LocalAddr: "127.0.0.1:8080", RemotePort: 8080, ClientIP: "10.0.0.2", ClientPort: 40123},
+		},
+		{
+			"port_mapping_response.json",
+			new(PortMappingResponse),
+			&PortMappingResponse{Success: true, Message: "Port mapping created successfully for port 8080"},
+		},
+		{
+			"heartbeat_request.json",
+			new(HeartbeatRequest),
+			&HeartbeatRequest{ClientIP: "10.0.0.2"},
+		},
+		{
+			"heartbeat_response.json",
+			new(HeartbeatResponse),
+			&HeartbeatResponse{Success: true, Message: "Heartbeat received", ServerStartupTime: 1792300000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "v1", "original", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decodeStrict(t, data, tt.got)
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", tt.got, tt.want)
+			}
+
+			// Fields added since are all optional, so the current types encode the original
+			// message unchanged when none of them is set
+			encoded, err := json.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := jsonValue(t, encoded), jsonValue(t, data); !reflect.DeepEqual(got, want) {
+				t.Errorf("encodes as %s, want the original %s", encoded, bytes.TrimSpace(data))
+			}
+		})
+	}
+}
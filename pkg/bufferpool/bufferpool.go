@@ -2,42 +2,149 @@ package bufferpool
 
 import (
 	"io"
+	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
-// BufferPool manages a pool of byte buffers for efficient I/O operations
+// BufferPool manages a pool of byte buffers for efficient I/O operations. The pool holds pointers
+// to the buffers, since storing a slice in a sync.Pool allocates its header on every Put.
 type BufferPool struct {
-	pool sync.Pool
-	size int
+	pool  sync.Pool
+	size  int
+	count *counters
+
+	mu   sync.Mutex
+	lent map[*byte]*[]byte // buffers handed out by Get, by their first byte, until Put returns them
+}
+
+// counters tracks the buffers of a pool. It is allocated apart from the pool, since the cleanups
+// of the buffers refer to it and must not keep the pool's own references to them alive.
+type counters struct {
+	limit       *MemoryLimit
+	size        int64
+	live        atomic.Int64 // buffers allocated within the limit and not yet garbage collected
+	outstanding atomic.Int64 // of those, buffers handed out by Get and not yet returned
+	overflow    atomic.Int64 // throwaway buffers handed out because the limit was reached
+}
+
+// Stats is a snapshot of the buffers of a pool
+type Stats struct {
+	Outstanding int64 // buffers handed out and not yet returned, Overflow included
+	Pooled      int64 // buffers idle in the pool
+	Overflow    int64 // throwaway buffers handed out because the memory limit was reached
+}
+
+// Option configures optional BufferPool settings
+type Option func(*BufferPool)
+
+// WithMemoryLimit counts the pool's buffers, pooled or handed out, against limit. Once it is
+// reached, Get allocates throwaway buffers that Put discards instead of pooling. Pools may share
+// a limit.
+func WithMemoryLimit(limit *MemoryLimit) Option {
+	return func(bp *BufferPool) {
+		bp.count.limit = limit
+	}
 }
 
 // NewBufferPool creates a new buffer pool with the specified buffer size
-func NewBufferPool(bufferSize int) *BufferPool {
-	return &BufferPool{
-		pool: sync.Pool{
-			New: func() any {
-				return make([]byte, bufferSize)
-			},
-		},
-		size: bufferSize,
+func NewBufferPool(bufferSize int, opts ...Option) *BufferPool {
+	bp := &BufferPool{
+		size:  bufferSize,
+		count: &counters{size: int64(bufferSize)},
+		lent:  make(map[*byte]*[]byte),
 	}
+	for _, opt := range opts {
+		opt(bp)
+	}
+	return bp
 }
 
-// Get retrieves a buffer from the pool
+// Size returns the size of the pool's buffers in bytes
+func (bp *BufferPool) Size() int {
+	return bp.size
+}
+
+// Stats returns how many buffers are handed out and how many are idle in the pool. Buffers the
+// garbage collector reclaimed from the pool are no longer counted once their cleanup ran.
+func (bp *BufferPool) Stats() Stats {
+	outstanding := bp.count.outstanding.Load()
+	overflow := bp.count.overflow.Load()
+	return Stats{
+		Outstanding: outstanding + overflow,
+		Pooled:      max(bp.count.live.Load()-outstanding, 0),
+		Overflow:    overflow,
+	}
+}
+
+// Get retrieves a buffer from the pool. It's counted as handed out until it's given to Put.
 func (bp *BufferPool) Get() []byte {
-	return bp.pool.Get().([]byte)
+	bufp := bp.get()
+	bp.mu.Lock()
+	bp.lent[&(*bufp)[0]] = bufp
+	bp.mu.Unlock()
+	return *bufp
 }
 
-// Put returns a buffer to the pool
+// Put returns a buffer from Get to the pool, also if it was resliced to a shorter length, which
+// it regains. Buffers that didn't come from Get or were already returned are dropped, as are
+// throwaway ones.
 func (bp *BufferPool) Put(buf []byte) {
-	if len(buf) == bp.size {
-		bp.pool.Put(buf)
+	if cap(buf) == 0 {
+		return
+	}
+
+	// The header Get handed out is pooled again, so returning a buffer doesn't allocate
+	bp.mu.Lock()
+	key := &buf[:1][0]
+	bufp, lent := bp.lent[key]
+	delete(bp.lent, key)
+	bp.mu.Unlock()
+	if lent {
+		bp.put(bufp)
 	}
 }
 
-// CopyWithBuffer copies from src to dst using a buffer from the pool
+// CopyWithBuffer copies from src to dst using a buffer from the pool, without allocating
 func (bp *BufferPool) CopyWithBuffer(dst io.Writer, src io.Reader) (int64, error) {
-	buf := bp.Get()
-	defer bp.Put(buf)
-	return io.CopyBuffer(dst, src, buf)
+	bufp := bp.get()
+	defer bp.put(bufp)
+	return io.CopyBuffer(dst, src, *bufp)
+}
+
+// get takes an idle buffer, or allocates one. A buffer that would exceed the limit is allocated
+// with one byte of spare capacity, which tells put it's a throwaway.
+func (bp *BufferPool) get() *[]byte {
+	if bufp, ok := bp.pool.Get().(*[]byte); ok {
+		bp.count.outstanding.Add(1)
+		return bufp
+	}
+
+	if !bp.count.limit.reserve(bp.count.size) {
+		bp.count.overflow.Add(1)
+		buf := make([]byte, bp.size, bp.size+1)
+		return &buf
+	}
+	buf := make([]byte, bp.size)
+	bp.count.live.Add(1)
+	bp.count.outstanding.Add(1)
+	runtime.AddCleanup(&buf[0], (*counters).free, bp.count)
+	return &buf
+}
+
+// put pools a buffer from get, or discards it if it's a throwaway
+func (bp *BufferPool) put(bufp *[]byte) {
+	switch cap(*bufp) {
+	case bp.size:
+		bp.count.outstanding.Add(-1)
+		bp.pool.Put(bufp)
+	case bp.size + 1:
+		bp.count.overflow.Add(-1)
+	}
+}
+
+// free accounts for a buffer within the limit that was garbage collected
+func (c *counters) free() {
+	c.live.Add(-1)
+	c.limit.release(c.size)
 }
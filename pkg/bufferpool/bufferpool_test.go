@@ -0,0 +1,193 @@
+package bufferpool
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestPutReturnsOwnBuffers(t *testing.T) {
+	bp := NewBufferPool(1024)
+
+	buf := bp.Get()
+	if len(buf) != 1024 {
+		t.Fatalf("Get() returned %d bytes, want 1024", len(buf))
+	}
+	if s := bp.Stats(); s.Outstanding != 1 || s.Pooled != 0 {
+		t.Fatalf("stats after Get = %+v, want 1 outstanding", s)
+	}
+
+	// A buffer resliced to a shorter length is pooled at its full length
+	bp.Put(buf[:10])
+	if s := bp.Stats(); s.Outstanding != 0 || s.Pooled != 1 {
+		t.Errorf("stats after Put = %+v, want 1 pooled", s)
+	}
+	if again := bp.Get(); len(again) != 1024 {
+		t.Errorf("Get() after Put returned %d bytes, want 1024", len(again))
+	}
+}
+
+func TestPutDropsForeignBuffers(t *testing.T) {
+	bp := NewBufferPool(1024)
+	buf := bp.Get()
+
+	// Buffers of the pool's size that it didn't hand out, or returned already, don't change its counts
+	bp.Put(make([]byte, 1024))
+	bp.Put(make([]byte, 10, 1024))
+	bp.Put(make([]byte, 1024, 1025))
+	bp.Put(buf[1:])
+	bp.Put(nil)
+	if s := bp.Stats(); s.Outstanding != 1 || s.Pooled != 0 || s.Overflow != 0 {
+		t.Errorf("stats after foreign Puts = %+v, want only the lent buffer outstanding", s)
+	}
+
+	bp.Put(buf)
+	bp.Put(buf)
+	if s := bp.Stats(); s.Outstanding != 0 || s.Pooled != 1 {
+		t.Errorf("stats after returning a buffer twice = %+v, want it pooled once", s)
+	}
+}
+
+func TestMemoryLimitOverflow(t *testing.T) {
+	limit := NewMemoryLimit(2048)
+	bp := NewBufferPool(1024, WithMemoryLimit(limit))
+
+	bufs := [][]byte{bp.Get(), bp.Get(), bp.Get()}
+	if s := bp.Stats(); s.Outstanding != 3 || s.Overflow != 1 {
+		t.Fatalf("stats = %+v, want 3 outstanding with 1 throwaway", s)
+	}
+	if used := limit.Used(); used != 2048 {
+		t.Errorf("limit used = %d, want 2048", used)
+	}
+
+	// The throwaway buffer is discarded, the others pooled
+	for _, buf := range bufs {
+		bp.Put(buf)
+	}
+	if s := bp.Stats(); s.Outstanding != 0 || s.Pooled != 2 || s.Overflow != 0 {
+		t.Errorf("stats after Put = %+v, want 2 pooled", s)
+	}
+}
+
+func TestGetPutDoesNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops buffers at random under the race detector")
+	}
+	bp := NewBufferPool(32 * 1024)
+	bp.Put(bp.Get())
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		bp.Put(bp.Get())
+	})
+	if allocs != 0 {
+		t.Errorf("Get and Put allocate %.1f times, want 0", allocs)
+	}
+}
+
+func TestCopyWithBuffer(t *testing.T) {
+	bp := NewBufferPool(1024)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var dst bytes.Buffer
+	n, err := bp.CopyWithBuffer(onlyWriter{&dst}, onlyReader{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+		t.Errorf("copied %d bytes, %v, want all %d", n, err, len(data))
+	}
+	if s := bp.Stats(); s.Outstanding != 0 || s.Pooled != 1 {
+		t.Errorf("stats after copying = %+v, want the buffer pooled again", s)
+	}
+}
+
+// slicePool is a pool storing slices directly, as BufferPool did before it pooled pointers
+type slicePool struct {
+	pool sync.Pool
+	size int
+}
+
+func (p *slicePool) Get() []byte {
+	if buf, ok := p.pool.Get().([]byte); ok {
+		return buf
+	}
+	return make([]byte, p.size)
+}
+
+func (p *slicePool) Put(buf []byte) {
+	if cap(buf) == p.size {
+		p.pool.Put(buf[:p.size]) // allocates the slice header, see staticcheck SA6002
+	}
+}
+
+// BenchmarkBufferPool compares a Get and Put of a 32KB buffer with the slice pool it replaced
+func BenchmarkBufferPool(b *testing.B) {
+	b.Run("pointers", func(b *testing.B) {
+		bp := NewBufferPool(32 * 1024)
+		b.ReportAllocs()
+		for b.Loop() {
+			bp.Put(bp.Get())
+		}
+	})
+	b.Run("slices", func(b *testing.B) {
+		p := &slicePool{size: 32 * 1024}
+		b.ReportAllocs()
+		for b.Loop() {
+			p.Put(p.Get())
+		}
+	})
+}
+
+// BenchmarkBufferPoolParallel is BenchmarkBufferPool with every CPU getting and putting buffers
+func BenchmarkBufferPoolParallel(b *testing.B) {
+	b.Run("pointers", func(b *testing.B) {
+		bp := NewBufferPool(32 * 1024)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				bp.Put(bp.Get())
+			}
+		})
+	})
+	b.Run("slices", func(b *testing.B) {
+		p := &slicePool{size: 32 * 1024}
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				p.Put(p.Get())
+			}
+		})
+	})
+}
+
+// onlyReader and onlyWriter hide WriterTo and ReaderFrom, so copies go through the pool's buffer
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+// BenchmarkCopyWithBuffer relays payloads of typical sizes through a 32KB buffer from the pool
+func BenchmarkCopyWithBuffer(b *testing.B) {
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"4KB", 4 << 10},
+		{"64KB", 64 << 10},
+		{"1MB", 1 << 20},
+	}
+
+	for _, s := range sizes {
+		b.Run(s.name, func(b *testing.B) {
+			bp := NewBufferPool(32 * 1024)
+			data := make([]byte, s.size)
+			src := bytes.NewReader(data)
+			var dst io.Writer = onlyWriter{io.Discard}
+			var r io.Reader = onlyReader{src}
+			b.SetBytes(int64(s.size))
+			b.ReportAllocs()
+			for b.Loop() {
+				src.Reset(data)
+				if _, err := bp.CopyWithBuffer(dst, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package bufferpool
+
+import "sync/atomic"
+
+// MemoryLimit caps the bytes of the buffers pools keep, whether pooled or handed out, across all
+// pools sharing it. A nil limit allows any amount.
+type MemoryLimit struct {
+	max  int64
+	used atomic.Int64
+}
+
+// NewMemoryLimit creates a limit of maxBytes
+func NewMemoryLimit(maxBytes int64) *MemoryLimit {
+	return &MemoryLimit{max: maxBytes}
+}
+
+// Max returns the limit in bytes
+func (l *MemoryLimit) Max() int64 {
+	return l.max
+}
+
+// Used returns the bytes of the buffers counted against the limit
+func (l *MemoryLimit) Used() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.used.Load()
+}
+
+// reserve counts n bytes against the limit if they fit
+func (l *MemoryLimit) reserve(n int64) bool {
+	if l == nil {
+		return true
+	}
+	for {
+		used := l.used.Load()
+		if used+n > l.max {
+			return false
+		}
+		if l.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// release returns n bytes reserved before
+func (l *MemoryLimit) release(n int64) {
+	if l != nil {
+		l.used.Add(-n)
+	}
+}
@@ -0,0 +1,106 @@
+package bufferpool
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMemoryLimitConcurrency relays on more goroutines than the limit has buffers for: every
+// copy must still be correct, and the pools never hold more than the limit
+func TestMemoryLimitConcurrency(t *testing.T) {
+	const bufSize = 1024
+	limit := NewMemoryLimit(4 * bufSize)
+	pools := []*BufferPool{
+		NewBufferPool(bufSize, WithMemoryLimit(limit)),
+		NewBufferPool(bufSize, WithMemoryLimit(limit)),
+	}
+
+	var exceeded atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bp := pools[i%len(pools)]
+			data := bytes.Repeat([]byte{byte(i)}, 10*bufSize+i)
+			for range 50 {
+				var dst bytes.Buffer
+				n, err := bp.CopyWithBuffer(onlyWriter{&dst}, onlyReader{bytes.NewReader(data)})
+				if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+					t.Errorf("goroutine %d copied %d bytes, %v, want its %d bytes intact", i, n, err, len(data))
+					return
+				}
+
+				// Buffers from Get may be written while another goroutine holds one too
+				buf := bp.Get()
+				buf[0], buf[len(buf)-1] = byte(i), byte(i)
+				if buf[0] != byte(i) || buf[len(buf)-1] != byte(i) {
+					t.Errorf("goroutine %d shares a buffer", i)
+				}
+				bp.Put(buf)
+
+				if used := limit.Used(); used > limit.Max() {
+					exceeded.Store(used)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if used := exceeded.Load(); used != 0 {
+		t.Errorf("pools held %d bytes, over the limit of %d", used, limit.Max())
+	}
+	for i, bp := range pools {
+		if s := bp.Stats(); s.Outstanding != 0 || s.Overflow != 0 {
+			t.Errorf("pool %d stats = %+v, want nothing outstanding once all copies are done", i, s)
+		}
+	}
+}
+
+// BenchmarkMemoryLimit relays 64KB payloads through 1MB buffers on 64 goroutines per CPU, with and
+// without a 16MB limit. peak-MB is the most the pool held at once, heap-MB the heap after the run
+// and a garbage collection, which with the limit stay bounded by it however many copies run.
+func BenchmarkMemoryLimit(b *testing.B) {
+	const bufSize = 1 << 20
+	for _, limitMB := range []int64{0, 16} {
+		name := "unlimited"
+		if limitMB > 0 {
+			name = fmt.Sprintf("limit=%dMB", limitMB)
+		}
+		b.Run(name, func(b *testing.B) {
+			var opts []Option
+			if limitMB > 0 {
+				opts = append(opts, WithMemoryLimit(NewMemoryLimit(limitMB<<20)))
+			}
+			bp := NewBufferPool(bufSize, opts...)
+			data := make([]byte, 64<<10)
+
+			var peak atomic.Int64
+			b.SetParallelism(64)
+			b.SetBytes(int64(len(data)))
+			b.RunParallel(func(pb *testing.PB) {
+				src := bytes.NewReader(data)
+				var dst io.Writer = onlyWriter{io.Discard}
+				var r io.Reader = onlyReader{src}
+				for pb.Next() {
+					src.Reset(data)
+					bp.CopyWithBuffer(dst, r)
+					if held := bp.count.live.Load() * bufSize; held > peak.Load() {
+						peak.Store(held)
+					}
+				}
+			})
+
+			runtime.GC()
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			b.ReportMetric(float64(peak.Load())/(1<<20), "peak-MB")
+			b.ReportMetric(float64(m.HeapAlloc)/(1<<20), "heap-MB")
+		})
+	}
+}
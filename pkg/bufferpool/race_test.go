@@ -0,0 +1,6 @@
+//go:build race
+
+package bufferpool
+
+// raceEnabled is set when the race detector runs, which makes sync.Pool drop buffers at random
+const raceEnabled = true
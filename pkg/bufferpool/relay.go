@@ -0,0 +1,80 @@
+package bufferpool
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+)
+
+// Direction customizes one direction of a relay. The zero value copies from the source
+// connection to the destination connection through a buffer from the pool.
+type Direction struct {
+	Dst io.Writer // written to instead of the destination connection, e.g. to observe the data
+	Src io.Reader // read from instead of the source connection, e.g. to rewrite the data
+}
+
+// RelayResult reports how both directions of a relay ended
+type RelayResult struct {
+	AToB, BToA       int64 // bytes copied in each direction
+	AToBErr, BToAErr error // first error of each direction, nil if it ended with EOF or was closed after the other ended
+}
+
+// Err returns the error the relay ended with, nil if both directions ended cleanly
+func (r RelayResult) Err() error {
+	if r.AToBErr != nil {
+		return r.AToBErr
+	}
+	return r.BToAErr
+}
+
+// Relay copies between a and b in both directions until both are done. A direction ending with
+// EOF is passed on as a half-close, while a failing one closes both connections.
+func (bp *BufferPool) Relay(a, b net.Conn) RelayResult {
+	return bp.RelayWith(a, b, Direction{}, Direction{})
+}
+
+// RelayWith is Relay with the directions from a to b and from b to a customized
+func (bp *BufferPool) RelayWith(a, b net.Conn, aToB, bToA Direction) RelayResult {
+	var result RelayResult
+	var ended atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		result.AToB, result.AToBErr = bp.relayDirection(b, a, aToB, &ended)
+	}()
+
+	go func() {
+		defer wg.Done()
+		result.BToA, result.BToAErr = bp.relayDirection(a, b, bToA, &ended)
+	}()
+
+	wg.Wait()
+	return result
+}
+
+// relayDirection copies one direction of a relay and passes its end on. Once the other direction
+// ended, ended is set and closing the connections is the expected way for this one to end, so
+// net.ErrClosed isn't reported.
+func (bp *BufferPool) relayDirection(dst, src net.Conn, d Direction, ended *atomic.Bool) (int64, error) {
+	var w io.Writer = dst
+	var r io.Reader = src
+	if d.Dst != nil {
+		w = d.Dst
+	}
+	if d.Src != nil {
+		r = d.Src
+	}
+	n, err := bp.CopyWithBuffer(w, r)
+	otherEnded := ended.Swap(true)
+	conntrack.FinishCopy(dst, src, err)
+	if otherEnded && errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package bufferpool
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		dialed.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func TestRelayPassesHalfClose(t *testing.T) {
+	client, a := tcpPair(t)
+	b, backend := tcpPair(t)
+
+	done := make(chan RelayResult, 1)
+	go func() { done <- NewBufferPool(1024).Relay(a, b) }()
+
+	// The backend answers only after the request has ended, which needs the half-close passed on
+	go func() {
+		request, _ := io.ReadAll(backend)
+		backend.Write(append([]byte("re: "), request...))
+		backend.Close()
+	}()
+
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "re: ping" {
+		t.Errorf("reply = %q, want %q", reply, "re: ping")
+	}
+
+	result := <-done
+	if result.AToB != 4 || result.BToA != 8 || result.AToBErr != nil || result.BToAErr != nil {
+		t.Errorf("result = %+v, want 4 and 8 bytes without errors", result)
+	}
+}
+
+func TestRelayReportsReset(t *testing.T) {
+	client, a := tcpPair(t)
+	b, backend := tcpPair(t)
+
+	done := make(chan RelayResult, 1)
+	go func() { done <- NewBufferPool(1024).Relay(a, b) }()
+
+	backend.(*net.TCPConn).SetLinger(0)
+	backend.Close()
+
+	// The reset ends the relay, closing the client's connection too
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the connections ends the other direction, which is not an error of its own
+	result := <-done
+	if result.AToBErr != nil {
+		t.Errorf("error of the direction ended by the close = %v, want nil", result.AToBErr)
+	}
+	if class := conntrack.ClassifyError(result.Err()); class != conntrack.ErrorReset {
+		t.Errorf("relay ended with %v (%s), want a reset", result.Err(), class)
+	}
+}
@@ -0,0 +1,193 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Magic is written at the start of every capture file to identify the format
+const Magic = "WGRPCAP1"
+
+// Direction identifies which way captured bytes were flowing
+type Direction byte
+
+const (
+	// IntoTunnel is data received from the external peer and sent into the tunnel
+	IntoTunnel Direction = 'I'
+	// OutOfTunnel is data received from the tunnel and sent to the external peer
+	OutOfTunnel Direction = 'O'
+)
+
+// frameHeaderSize is the size of a frame header: timestamp, connection ID, direction and length
+const frameHeaderSize = 8 + 8 + 1 + 4
+
+// record is a chunk of relayed data queued for writing
+type record struct {
+	connID uint64
+	dir    Direction
+	at     time.Time
+	data   []byte
+}
+
+// Capture writes relayed bytes to a file in a simple framed format:
+//
+//	Magic, then repeated frames of
+//	[8 byte unix nanos][8 byte connection ID][1 byte direction][4 byte length][data]
+//
+// all integers big endian. Records are queued on a bounded channel so the relay never
+// blocks on disk I/O; when the writer lags behind, records are dropped and counted.
+type Capture struct {
+	path     string
+	file     *os.File
+	w        *bufio.Writer
+	records  chan record
+	maxBytes int64
+	timer    *time.Timer
+
+	written  atomic.Int64
+	dropped  atomic.Uint64
+	stopOnce sync.Once
+	stopped  chan struct{}
+	done     chan struct{}
+}
+
+// New creates a capture file at path that stops after duration or once maxBytes have been written.
+// queueSize bounds the number of records buffered in memory.
+func New(path string, duration time.Duration, maxBytes int64, queueSize int) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %v", err)
+	}
+
+	c := &Capture{
+		path:     path,
+		file:     file,
+		w:        bufio.NewWriter(file),
+		records:  make(chan record, queueSize),
+		maxBytes: maxBytes,
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if _, err := c.w.WriteString(Magic); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write capture header: %v", err)
+	}
+
+	c.timer = time.AfterFunc(duration, c.Stop)
+	go c.run()
+
+	return c, nil
+}
+
+// Record queues a copy of data for writing. It never blocks: if the queue is full
+// or the capture has stopped, the data is dropped and counted.
+func (c *Capture) Record(connID uint64, dir Direction, data []byte) {
+	select {
+	case <-c.stopped:
+		return
+	default:
+	}
+
+	rec := record{
+		connID: connID,
+		dir:    dir,
+		at:     time.Now(),
+		data:   append([]byte(nil), data...),
+	}
+
+	select {
+	case c.records <- rec:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// Stop ends the capture; queued records are flushed before the file is closed
+func (c *Capture) Stop() {
+	c.stopOnce.Do(func() {
+		c.timer.Stop()
+		close(c.stopped)
+	})
+}
+
+// Done is closed once the capture file has been flushed and closed
+func (c *Capture) Done() <-chan struct{} {
+	return c.done
+}
+
+// Path returns the capture file path
+func (c *Capture) Path() string {
+	return c.path
+}
+
+// BytesWritten returns the number of bytes written to the capture file, including framing
+func (c *Capture) BytesWritten() int64 {
+	return c.written.Load()
+}
+
+// Dropped returns the number of records dropped because the writer fell behind
+func (c *Capture) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// run writes queued records until the capture is stopped or the size limit is reached
+func (c *Capture) run() {
+	defer close(c.done)
+	defer c.file.Close()
+	defer c.w.Flush()
+
+	c.written.Store(int64(len(Magic)))
+
+	for {
+		select {
+		case rec := <-c.records:
+			if !c.write(rec) {
+				c.Stop()
+				return
+			}
+		case <-c.stopped:
+			// Drain what was queued before the stop
+			for {
+				select {
+				case rec := <-c.records:
+					if !c.write(rec) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a single frame, returning false once the capture should stop
+func (c *Capture) write(rec record) bool {
+	frameSize := int64(frameHeaderSize + len(rec.data))
+	if c.written.Load()+frameSize > c.maxBytes {
+		return false
+	}
+
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(rec.at.UnixNano()))
+	binary.BigEndian.PutUint64(header[8:16], rec.connID)
+	header[16] = byte(rec.dir)
+	binary.BigEndian.PutUint32(header[17:21], uint32(len(rec.data)))
+
+	if _, err := c.w.Write(header[:]); err != nil {
+		return false
+	}
+	if _, err := c.w.Write(rec.data); err != nil {
+		return false
+	}
+
+	c.written.Add(frameSize)
+	return true
+}
@@ -0,0 +1,135 @@
+// Package circuitbreaker stops calling a dependency that keeps failing until it has had time to recover
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultThreshold is how many consecutive failures open the circuit
+	DefaultThreshold = 5
+
+	// DefaultRecoveryTimeout is how long an open circuit waits before letting a trial call through
+	DefaultRecoveryTimeout = 10 * time.Second
+)
+
+// State is the state of a circuit
+type State string
+
+// Circuit states
+const (
+	Closed   State = "closed"    // calls are allowed
+	Open     State = "open"      // calls are refused until the recovery timeout passes
+	HalfOpen State = "half-open" // a single trial call is in flight, others are refused
+)
+
+// CircuitBreaker counts consecutive failures of a dependency and refuses calls once they reach a
+// threshold. After the recovery timeout one trial call is allowed: success closes the circuit,
+// failure opens it again.
+type CircuitBreaker struct {
+	threshold       int
+	recoveryTimeout time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time // start of the current recovery timeout
+	since    time.Time // when the circuit left the closed state
+}
+
+// New creates a closed circuit breaker. Non-positive values select the defaults.
+func New(threshold int, recoveryTimeout time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	if recoveryTimeout <= 0 {
+		recoveryTimeout = DefaultRecoveryTimeout
+	}
+
+	return &CircuitBreaker{
+		threshold:       threshold,
+		recoveryTimeout: recoveryTimeout,
+		state:           Closed,
+	}
+}
+
+// Allow reports whether a call may be made. Once the recovery timeout has passed on an open
+// circuit, it half-opens and allows the caller the trial call.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case Closed:
+		return true
+	case Open:
+		if time.Since(cb.openedAt) < cb.recoveryTimeout {
+			return false
+		}
+		cb.state = HalfOpen
+		return true
+	default:
+		return false
+	}
+}
+
+// RecordSuccess closes the circuit and reports whether it was open or half-open before
+func (cb *CircuitBreaker) RecordSuccess() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	recovered := cb.state != Closed
+	cb.state = Closed
+	cb.failures = 0
+	cb.openedAt = time.Time{}
+	cb.since = time.Time{}
+	return recovered
+}
+
+// RecordFailure counts a failed call and reports whether it opened the circuit. A failed trial
+// call reopens the circuit for another recovery timeout without reporting it as newly opened.
+func (cb *CircuitBreaker) RecordFailure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	switch cb.state {
+	case HalfOpen:
+		cb.state = Open
+		cb.openedAt = time.Now()
+		return false
+	case Open:
+		return false
+	}
+
+	if cb.failures < cb.threshold {
+		return false
+	}
+	cb.state = Open
+	cb.openedAt = time.Now()
+	cb.since = cb.openedAt
+	return true
+}
+
+// State returns the current state and consecutive failure count
+func (cb *CircuitBreaker) State() (State, int) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state, cb.failures
+}
+
+// OpenSince returns when the circuit last opened, or the zero time if it is closed.
+// A half-open circuit keeps the time it first opened.
+func (cb *CircuitBreaker) OpenSince() time.Time {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.since
+}
+
+// Threshold returns how many consecutive failures open the circuit
+func (cb *CircuitBreaker) Threshold() int {
+	return cb.threshold
+}
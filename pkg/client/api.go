@@ -4,12 +4,47 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
+	wgrp "github.com/DevonTM/wg-rp"
 	"github.com/DevonTM/wg-rp/pkg/api"
 )
 
+// apiURL returns the URL of an API path on the server
+func (pc *ProxyClient) apiURL(path string) string {
+	return pc.serverURL(pc.currentServerIP(), path)
+}
+
+// serverURL returns the URL of an API path on the server with the given IP
+func (pc *ProxyClient) serverURL(serverIP, path string) string {
+	return fmt.Sprintf("%s:%d%s", serverBaseURL(serverIP), pc.serverPort, path)
+}
+
+// serverBaseURL returns the URL of the server at ip, e.g. "http://10.0.0.1" or "http://[fd00::1]".
+// An IPv6 address is bracketed unless it already is, and an address that has a port keeps it.
+func serverBaseURL(ip string) string {
+	if _, _, err := net.SplitHostPort(ip); err == nil {
+		return "http://" + ip
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if strings.Contains(host, ":") {
+		// Also for IPv4-mapped addresses like ::ffff:10.0.0.1, and a zone's "%" is escaped in a URL
+		host = "[" + strings.Replace(host, "%", "%25", 1) + "]"
+	}
+	return "http://" + host
+}
+
+// serverAddr returns the address of port on the server at ip, with an IPv6 address bracketed
+func serverAddr(ip string, port int) string {
+	host := strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // registerPortMapping registers a port mapping with the server via REST API
 func (pc *ProxyClient) registerPortMapping(mapping RouteMapping) error {
 	request := api.PortMappingRequest{
@@ -17,6 +52,72 @@ func (pc *ProxyClient) registerPortMapping(mapping RouteMapping) error {
 		RemotePort: mapping.RemotePort,
 		ClientIP:   pc.clientIP,
 		ClientPort: mapping.ClientPort,
+		Version:    wgrp.VERSION,
+		Transport:  api.TransportYamux,
+
+		Schedule:            mapping.Schedule,
+		ScheduleCloseActive: mapping.ScheduleCloseActive,
+
+		MaxConnsPerSecond: pc.maxConnsPerSecond,
+		MaxConnsBurst:     pc.maxConnsBurst,
+		LocalProbe:        pc.localProbe,
+		Name:              mapping.Name,
+		Labels:            mapping.Labels,
+		HTTPHostRewrite:   mapping.HTTPHostRewrite,
+		ProxyProtocol:     mapping.ProxyProtocol,
+		ProxyProtoTLVs:    mapping.ProxyProtoTLVs,
+		Visibility:        mapping.Visibility,
+		TLSCert:           mapping.TLSCert,
+		TLSALPN:           mapping.TLSALPN,
+	}
+
+	// A hostname has the server route HTTP, or TLS by server name, on a port shared with other hostnames
+	if mapping.Hostname != "" {
+		request.Mode = api.ModeHTTP
+		if mapping.SNI {
+			request.Mode = api.ModeSNI
+		}
+		request.Hostname = mapping.Hostname
+
+		// Multiplexed streams name only the remote port, which the client's other hostnames on
+		// the port share, so the server dials the mapping's own listener instead
+		request.Transport = ""
+	}
+
+	// The same goes for a tunnel-only mapping, whose remote port may also be mapped publicly
+	if mapping.visibility() == api.VisibilityTunnel {
+		request.Transport = ""
+	}
+
+	// A mapping's own compression takes precedence over the client-wide one. Connections may arrive
+	// before the response does, so expect the asked-for algorithm until the server answers.
+	request.Compression = pc.compression
+	if mapping.Compression != "" {
+		request.Compression = mapping.Compression
+	}
+	if request.Compression == api.CompressionNone {
+		request.Compression = ""
+	}
+	mapping.stats.setCompression(request.Compression)
+
+	// A mapping's own rate limit takes precedence over the client-wide one
+	if mapping.MaxConnsPerSecond > 0 {
+		request.MaxConnsPerSecond = mapping.MaxConnsPerSecond
+		request.MaxConnsBurst = mapping.MaxConnsBurst
+	}
+	request.MaxHalfOpen = mapping.MaxHalfOpen
+	request.SampleRate = mapping.SampleRate
+
+	if mapping.TTL > 0 {
+		request.TTLSeconds = int(mapping.TTL.Seconds())
+	}
+
+	if mapping.WriteDeadline > 0 {
+		request.WriteDeadlineSeconds = int(mapping.WriteDeadline.Seconds())
+	}
+
+	if mapping.TunnelDialTimeout > 0 {
+		request.TunnelDialTimeoutMillis = int(mapping.TunnelDialTimeout.Milliseconds())
 	}
 
 	jsonData, err := json.Marshal(request)
@@ -24,7 +125,7 @@ func (pc *ProxyClient) registerPortMapping(mapping RouteMapping) error {
 		return fmt.Errorf("failed to marshal request: %v", err)
 	}
 
-	serverURL := fmt.Sprintf("http://%s/api/v1/port-mappings", pc.serverIP)
+	serverURL := pc.apiURL("/api/v1/port-mappings")
 	resp, err := pc.httpClient.Post(serverURL, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
@@ -40,14 +141,83 @@ func (pc *ProxyClient) registerPortMapping(mapping RouteMapping) error {
 		return fmt.Errorf("server error: %s", response.Message)
 	}
 
-	log.Printf("Registered port mapping: remote port %d -> client port %d",
-		mapping.RemotePort, mapping.ClientPort)
+	if request.Compression != response.Compression {
+		slog.Warn("Server does not support the compression, relaying uncompressed",
+			"remote_port", mapping.RemotePort, "compression", request.Compression)
+	}
+	mapping.stats.setCompression(response.Compression)
+
+	if response.Transport == api.TransportYamux && response.MuxPort > 0 {
+		pc.enableMux(response.MuxPort)
+	}
+
+	slog.Info("Registered port mapping", "remote_port", mapping.RemotePort, "client_port", mapping.ClientPort, mapping.nameAttr())
+
+	if err := pc.portState.save(mapping.RemotePort, mapping.ClientPort); err != nil {
+		slog.Warn("Failed to save client port", "remote_port", mapping.RemotePort, "error", err)
+	}
 	return nil
 }
 
-// deletePortMapping deletes a port mapping from the server via REST API
-func (pc *ProxyClient) deletePortMapping(remotePort int) error {
-	serverURL := fmt.Sprintf("http://%s/api/v1/port-mappings?port=%d", pc.serverIP, remotePort)
+// mappingPath returns the API path of a port mapping on the server, named by its remote port, and by
+// its hostname on a port shared by hostname and its visibility
+func mappingPath(remotePort int, hostname, visibility string) string {
+	query := url.Values{"port": {strconv.Itoa(remotePort)}}
+	if hostname != "" {
+		query.Set("hostname", hostname)
+	}
+	if visibility != "" {
+		query.Set("visibility", visibility)
+	}
+	return "/api/v1/port-mappings?" + query.Encode()
+}
+
+// updatePortMappingLabels replaces the labels of a port mapping on the server
+func (pc *ProxyClient) updatePortMappingLabels(remotePort int, hostname, visibility string, labels map[string]string) error {
+	path := mappingPath(remotePort, hostname, visibility)
+
+	// Labels are always sent, an empty map removes them
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	jsonData, err := json.Marshal(api.PortMappingUpdate{Labels: &labels})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPatch, pc.apiURL(path), bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := pc.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response api.PortMappingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("server error: %s", response.Message)
+	}
+	return nil
+}
+
+// deletePortMapping deletes a port mapping from the server via REST API. The hostname of an HTTP
+// mapping tells it apart from the other mappings on its port, and is empty for TCP mappings. The
+// visibility tells a public mapping apart from a tunnel-only one on the same port.
+func (pc *ProxyClient) deletePortMapping(remotePort int, hostname, visibility string) error {
+	return pc.deletePortMappingFrom(pc.currentServerIP(), remotePort, hostname, visibility)
+}
+
+// deletePortMappingFrom deletes a port mapping from the server with the given IP
+func (pc *ProxyClient) deletePortMappingFrom(serverIP string, remotePort int, hostname, visibility string) error {
+	serverURL := pc.serverURL(serverIP, mappingPath(remotePort, hostname, visibility))
 	req, err := http.NewRequest(http.MethodDelete, serverURL, http.NoBody)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
@@ -68,6 +238,6 @@ func (pc *ProxyClient) deletePortMapping(remotePort int) error {
 		return fmt.Errorf("server error: %s", response.Message)
 	}
 
-	log.Printf("Deleted port mapping for remote port %d", remotePort)
+	slog.Info("Deleted port mapping", "remote_port", remotePort)
 	return nil
 }
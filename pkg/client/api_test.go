@@ -0,0 +1,98 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestServerBaseURL(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		// IPv4
+		{"10.0.0.1", "http://10.0.0.1"},
+		{"10.0.0.1:8080", "http://10.0.0.1:8080"},
+
+		// IPv6 is bracketed, once
+		{"fd00::1", "http://[fd00::1]"},
+		{"::1", "http://[::1]"},
+		{"[fd00::1]", "http://[fd00::1]"},
+		{"::ffff:10.0.0.1", "http://[::ffff:10.0.0.1]"},
+		{"fe80::1%wg0", "http://[fe80::1%25wg0]"},
+
+		// IPv6 with a port keeps it
+		{"[fd00::1]:8080", "http://[fd00::1]:8080"},
+		{"[::1]:80", "http://[::1]:80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := serverBaseURL(tt.ip); got != tt.want {
+				t.Errorf("serverBaseURL(%q) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerBaseURLParses(t *testing.T) {
+	tests := []struct {
+		ip       string
+		hostname string
+		port     string
+	}{
+		{"10.0.0.1", "10.0.0.1", ""},
+		{"fd00::1", "fd00::1", ""},
+		{"[fd00::1]:8080", "fd00::1", "8080"},
+		{"fe80::1%wg0", "fe80::1%wg0", ""},
+	}
+
+	// The API paths appended to the base must give a URL the HTTP client can dial
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			u, err := url.Parse(serverBaseURL(tt.ip) + "/api/v1/port-mappings")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Hostname() != tt.hostname || u.Port() != tt.port || u.Path != "/api/v1/port-mappings" {
+				t.Errorf("parsed host %q port %q path %q, want %q %q", u.Hostname(), u.Port(), u.Path, tt.hostname, tt.port)
+			}
+		})
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.0.0.1", "10.0.0.1:7000"},
+		{"fd00::1", "[fd00::1]:7000"},
+		{"[fd00::1]", "[fd00::1]:7000"},
+	}
+
+	for _, tt := range tests {
+		if got := serverAddr(tt.ip, 7000); got != tt.want {
+			t.Errorf("serverAddr(%q, 7000) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestMappingPath(t *testing.T) {
+	tests := []struct {
+		hostname   string
+		visibility string
+		want       string
+	}{
+		{"", "", "/api/v1/port-mappings?port=8080"},
+		{"app.example.com", "", "/api/v1/port-mappings?hostname=app.example.com&port=8080"},
+		{"", "tunnel", "/api/v1/port-mappings?port=8080&visibility=tunnel"},
+		{"*.example.com", "public", "/api/v1/port-mappings?hostname=%2A.example.com&port=8080&visibility=public"},
+	}
+
+	for _, tt := range tests {
+		if got := mappingPath(8080, tt.hostname, tt.visibility); got != tt.want {
+			t.Errorf("mappingPath(8080, %q, %q) = %q, want %q", tt.hostname, tt.visibility, got, tt.want)
+		}
+	}
+}
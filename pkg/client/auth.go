@@ -0,0 +1,25 @@
+package client
+
+import "net/http"
+
+// bearerPrefix starts the Authorization header value of a bearer token
+const bearerPrefix = "Bearer "
+
+// BearerTokenTransport adds an Authorization header with a bearer token to every request it
+// sends through Base
+type BearerTokenTransport struct {
+	Token string
+	Base  http.RoundTripper // nil for http.DefaultTransport
+}
+
+// RoundTrip sends the request with the bearer token, leaving the caller's request unchanged
+func (t *BearerTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", bearerPrefix+t.Token)
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalCheckMode selects what happens to routes whose local service can't be reached when they
+// are registered
+type LocalCheckMode string
+
+const (
+	LocalCheckOff    LocalCheckMode = ""       // Don't check local services
+	LocalCheckWarn   LocalCheckMode = "warn"   // Warn about routes that point at nothing
+	LocalCheckStrict LocalCheckMode = "strict" // Refuse to register routes that point at nothing
+)
+
+// localCheckTimeout bounds the dial of a local service check, so a filtered port doesn't hold
+// up startup for the full dial timeout
+const localCheckTimeout = time.Second
+
+// Local check results shown in the status of a route mapping
+const (
+	localReachable   = "reachable"
+	localUnreachable = "unreachable"
+)
+
+// ParseLocalCheckMode parses the value of -check-local, where "true" stands for warn
+func ParseLocalCheckMode(s string) (LocalCheckMode, error) {
+	switch s {
+	case "", "false", "off":
+		return LocalCheckOff, nil
+	case "true", string(LocalCheckWarn):
+		return LocalCheckWarn, nil
+	case string(LocalCheckStrict):
+		return LocalCheckStrict, nil
+	}
+	return "", fmt.Errorf("invalid local check mode %q (use %s or %s)", s, LocalCheckWarn, LocalCheckStrict)
+}
+
+// checkLocal dials the local service of a mapping once and records the result in its stats
+func (pc *ProxyClient) checkLocal(mapping RouteMapping) error {
+	conn, _, err := dialLocal(mapping, min(pc.dialTimeout, localCheckTimeout))
+
+	result := localReachable
+	if err != nil {
+		result = localUnreachable
+		mapping.stats.recordError(err)
+	} else {
+		conn.Close()
+	}
+	mapping.stats.localCheck.Store(&result)
+	return err
+}
+
+// checkLocalServices checks the local services of mappings before they are registered. Routes
+// that point at nothing are logged together; in LocalCheckStrict mode they are an error.
+func (pc *ProxyClient) checkLocalServices(mappings []RouteMapping) error {
+	if pc.localCheck == LocalCheckOff || len(mappings) == 0 {
+		return nil
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []string
+	)
+	sem := make(chan struct{}, maxConcurrentProbes)
+	for _, mapping := range mappings {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(mapping RouteMapping) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := pc.checkLocal(mapping); err != nil {
+				slog.Warn("Local service is not reachable", "local_addr", mapping.LocalAddr,
+					"remote_port", mapping.RemotePort, mapping.nameAttr(), "error", err)
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s-%d", mapping.LocalAddr, mapping.RemotePort))
+				mu.Unlock()
+			}
+		}(mapping)
+	}
+	wg.Wait()
+	slices.Sort(failed)
+
+	if len(failed) == 0 {
+		return nil
+	}
+	if pc.localCheck == LocalCheckStrict {
+		return fmt.Errorf("routes point at no local service: %s", strings.Join(failed, ", "))
+	}
+	slog.Warn("Routes point at no local service yet, connections to them fail until it is started",
+		"routes", strings.Join(failed, ", "))
+	return nil
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxConcurrentProbes bounds the number of probe dials in flight at once
+	maxConcurrentProbes = 32
+)
+
+// loopbackHosts are the only hosts local discovery ever probes, in order of preference
+var loopbackHosts = []string{"127.0.0.1", "::1"}
+
+// DiscoverLocalRoutes probes the given ports on the loopback interface and returns a route
+// mapping local:N -> remote:N for every port that accepts TCP connections. Probes are paced
+// to at most probesPerSecond and each one gives up after timeout. Only loopback addresses
+// are ever dialed.
+func DiscoverLocalRoutes(ports []int, probesPerSecond int, timeout time.Duration) []RouteMapping {
+	if probesPerSecond < 1 {
+		probesPerSecond = 1
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(probesPerSecond))
+	defer ticker.Stop()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		mappings []RouteMapping
+	)
+	sem := make(chan struct{}, maxConcurrentProbes)
+
+	for _, port := range ports {
+		<-ticker.C
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(port int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if addr, ok := probeLoopbackPort(port, timeout); ok {
+				mu.Lock()
+				mappings = append(mappings, RouteMapping{LocalAddr: addr, RemotePort: port})
+				mu.Unlock()
+			}
+		}(port)
+	}
+	wg.Wait()
+
+	slices.SortFunc(mappings, func(a, b RouteMapping) int {
+		return a.RemotePort - b.RemotePort
+	})
+	return mappings
+}
+
+// probeLoopbackPort checks whether a port is listening on a loopback address and returns that address
+func probeLoopbackPort(port int, timeout time.Duration) (string, bool) {
+	for _, host := range loopbackHosts {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		return addr, true
+	}
+	return "", false
+}
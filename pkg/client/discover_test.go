@@ -0,0 +1,82 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// listenLoopback starts a listener on an ephemeral loopback port and returns the port
+func listenLoopback(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// closedPort returns a loopback port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+func TestDiscoverLocalRoutes(t *testing.T) {
+	open1, open2 := listenLoopback(t), listenLoopback(t)
+	closed := closedPort(t)
+
+	mappings := DiscoverLocalRoutes([]int{open2, closed, open1}, 1000, time.Second)
+	if len(mappings) != 2 {
+		t.Fatalf("found %d listening ports, want 2: %+v", len(mappings), mappings)
+	}
+
+	// Sorted by port, each exposed on the same remote port
+	want := []int{min(open1, open2), max(open1, open2)}
+	for i, m := range mappings {
+		if m.RemotePort != want[i] {
+			t.Errorf("mapping %d has remote port %d, want %d", i, m.RemotePort, want[i])
+		}
+		host, _, err := net.SplitHostPort(m.LocalAddr)
+		if err != nil || !net.ParseIP(host).IsLoopback() {
+			t.Errorf("mapping %d has local address %q, want a loopback address", i, m.LocalAddr)
+		}
+	}
+}
+
+func TestDiscoverLocalRoutesIsRateLimited(t *testing.T) {
+	ports := []int{closedPort(t), closedPort(t), closedPort(t), closedPort(t), closedPort(t)}
+
+	start := time.Now()
+	DiscoverLocalRoutes(ports, 10, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("probing 5 ports at 10 per second took %s, want at least 400ms", elapsed)
+	}
+}
+
+func TestProbeLoopbackPortOnlyDialsLoopback(t *testing.T) {
+	for _, host := range loopbackHosts {
+		if !net.ParseIP(host).IsLoopback() {
+			t.Errorf("discovery probes non-loopback host %s", host)
+		}
+	}
+	if _, ok := probeLoopbackPort(closedPort(t), 100*time.Millisecond); ok {
+		t.Error("closed port reported as listening")
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/DevonTM/wg-rp/pkg/server"
+)
+
+// startEchoService echoes connections on a local address like the service behind a route
+func startEchoService(t *testing.T, network, address string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", address, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// freeRemotePort returns a TCP port on the host nothing listens on
+func freeRemotePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// expectEcho sends a message over a new connection to address and expects it back
+func expectEcho(t *testing.T, address string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	message := []byte("hello through the tunnel")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("no echo from %s: %v", address, err)
+	}
+	if string(reply) != string(message) {
+		t.Errorf("echo = %q, want %q", reply, message)
+	}
+}
+
+// startRelay starts a server and a client on the two ends of a tunnel, with the client reaching
+// the server at serverIP, and maps a free port on the server host to localAddr. It returns the port
+// and the client.
+func startRelay(t *testing.T, serverIP, clientIP, localAddr string) (int, *ProxyClient) {
+	t.Helper()
+	pair := wgtest.NewPair(t)
+
+	ps := server.NewProxyServer(pair.Server.Tnet, 32*1024)
+	if err := ps.StartAPIServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := ParseRouteMappings([]string{fmt.Sprintf("%s-%d", localAddr, freeRemotePort(t))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := NewProxyClient(pair.Client.Tnet, serverIP, clientIP, 32*1024)
+	for _, route := range routes {
+		if err := pc.AddRouteMappingConfig(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Shutdown()
+		pc.Cleanup()
+		pc.Wait()
+	})
+	return routes[0].RemotePort, pc
+}
+
+// TestIPv6EndToEnd relays connections from the server host through the tunnel to a service on
+// the IPv6 loopback, with the client reaching the server over either tunnel address family
+func TestIPv6EndToEnd(t *testing.T) {
+	tests := []struct {
+		name     string
+		serverIP string
+		clientIP string
+	}{
+		{"IPv4 tunnel", wgtest.ServerIP, wgtest.ClientIP},
+		{"IPv6 tunnel", wgtest.ServerIPv6, wgtest.ClientIPv6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := startEchoService(t, "tcp6", "[::1]:0")
+			remotePort, _ := startRelay(t, tt.serverIP, tt.clientIP, service.Addr().String())
+
+			// The mapped port is reachable on the server host over both address families
+			expectEcho(t, fmt.Sprintf("127.0.0.1:%d", remotePort))
+			if ln, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+				ln.Close()
+				expectEcho(t, fmt.Sprintf("[::1]:%d", remotePort))
+			}
+		})
+	}
+}
+
+func TestPortMappingsCountTraffic(t *testing.T) {
+	service := startEchoService(t, "tcp", "127.0.0.1:0")
+	remotePort, pc := startRelay(t, wgtest.ServerIP, wgtest.ClientIP, service.Addr().String())
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	message := []byte("counted")
+	conn.Write(message)
+	if _, err := io.ReadFull(conn, make([]byte, len(message))); err != nil {
+		t.Fatal(err)
+	}
+
+	// An open connection is listed with the bytes it has relayed so far
+	mappings, err := pc.PortMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint64(len(message))
+	if len(mappings) != 1 || mappings[0].ActiveConnections != 1 || mappings[0].BytesIn != want || mappings[0].BytesOut != want {
+		t.Fatalf("mappings = %+v, want one with an active connection and %d bytes each way", mappings, want)
+	}
+
+	// Its bytes stay counted once it's closed
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if mappings, err = pc.PortMappings(); err != nil {
+			t.Fatal(err)
+		}
+		if mappings[0].ActiveConnections == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mappings[0].ActiveConnections != 0 || mappings[0].BytesIn != want || mappings[0].BytesOut != want {
+		t.Errorf("mapping after the close = %+v, want no active connection and %d bytes each way", mappings[0], want)
+	}
+}
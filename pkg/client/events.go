@@ -0,0 +1,246 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+const (
+	// eventStreamMinBackoff and eventStreamMaxBackoff bound the delay between stream reconnects
+	eventStreamMinBackoff = time.Second
+	eventStreamMaxBackoff = time.Minute
+
+	// eventStreamIdleTimeout drops a stream that stopped delivering events and keep-alives
+	eventStreamIdleTimeout = 45 * time.Second
+
+	// eventStreamShutdownPause is how long to wait before reconnecting after the server announced it is shutting down
+	eventStreamShutdownPause = 30 * time.Second
+)
+
+// startEventStream keeps a server event stream open so server-side changes are handled
+// immediately. Heartbeats keep working without it, so failures only delay reconnects.
+func (pc *ProxyClient) startEventStream() {
+	go func() {
+		// Streams are long-lived, so they can't share the API client's request timeout
+		streamClient := &http.Client{Transport: pc.httpClient.Transport}
+		backoff := eventStreamMinBackoff
+
+		for {
+			connected, err := pc.streamEvents(streamClient)
+			if connected {
+				backoff = eventStreamMinBackoff
+			}
+
+			select {
+			case <-pc.shutdownChan:
+				return
+			default:
+			}
+
+			wait := backoff
+			if err != nil {
+				slog.Debug("Event stream unavailable, relying on heartbeats", "retry_in", wait, "error", err)
+			}
+			if pc.serverShuttingDown {
+				pc.serverShuttingDown = false
+				wait = eventStreamShutdownPause
+			}
+			backoff = min(backoff*2, eventStreamMaxBackoff)
+
+			select {
+			case <-pc.shutdownChan:
+				return
+			case <-pc.clock.After(wait):
+			}
+		}
+	}()
+}
+
+// streamEvents reads one event stream until it ends, reporting whether it was established
+func (pc *ProxyClient) streamEvents(streamClient *http.Client) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Drop the stream on shutdown or when it goes quiet for too long
+	idle := time.AfterFunc(eventStreamIdleTimeout, cancel)
+	defer idle.Stop()
+	go func() {
+		select {
+		case <-pc.shutdownChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	serverURL := pc.apiURL("/api/v1/events?client_ip=" + url.QueryEscape(pc.clientIP))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL, http.NoBody)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	slog.Debug("Subscribed to server events")
+
+	var eventType string
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(eventStreamIdleTimeout)
+
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if eventType != "" && data.Len() > 0 {
+				var ev api.Event
+				if err := json.Unmarshal([]byte(data.String()), &ev); err != nil {
+					slog.Warn("Ignoring malformed server event", "type", eventType, "error", err)
+				} else {
+					pc.handleEvent(ev)
+				}
+			}
+			eventType = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+
+	return true, scanner.Err()
+}
+
+// handleEvent reacts to a single server event. Events already handled on an earlier stream
+// from the same server instance are ignored.
+func (pc *ProxyClient) handleEvent(ev api.Event) {
+	if ev.ServerStartupTime == pc.lastEventStartup && ev.ID <= pc.lastEventID {
+		return
+	}
+	pc.lastEventStartup = ev.ServerStartupTime
+	pc.lastEventID = ev.ID
+
+	switch ev.Type {
+	case api.EventRestarted:
+		pc.handleServerStartup(ev.ServerStartupTime)
+	case api.EventMappingRemoved:
+		slog.Warn("Server removed port mapping", "remote_port", ev.Port, "hostname", ev.Hostname, "visibility", ev.Visibility)
+		pc.dropMapping(ev.Port, ev.Hostname, ev.Visibility)
+	case api.EventReRegister:
+		slog.Warn("Server asked to re-register port mappings")
+		pc.reregisterAll()
+	case api.EventMappingPaused:
+		slog.Info("Port mapping is outside its schedule window", "remote_port", ev.Port)
+	case api.EventMappingResumed:
+		slog.Info("Port mapping is inside its schedule window", "remote_port", ev.Port)
+	case api.EventShuttingDown:
+		slog.Warn("Server is shutting down")
+		pc.serverShuttingDown = true
+	default:
+		slog.Debug("Ignoring unknown server event", "type", ev.Type)
+	}
+}
+
+// handleServerStartup records the startup time of the server and re-registers all mappings when
+// it changed. Both heartbeats and the event stream report it, but a restart is only handled once.
+func (pc *ProxyClient) handleServerStartup(startupTime int64) {
+	pc.mu.Lock()
+	previous := pc.serverStartupTime
+	pc.serverStartupTime = startupTime
+	pc.mu.Unlock()
+
+	if previous == 0 || previous == startupTime {
+		return
+	}
+
+	slog.Warn("Server restart detected",
+		"previous_startup", utils.FormatDateTimeFromUnix(previous),
+		"current_startup", utils.FormatDateTimeFromUnix(startupTime))
+	pc.reregisterAll()
+}
+
+// reregisterAll registers every active mapping with the server again. Mappings are retried
+// independently, so one that keeps failing doesn't hold up the others.
+func (pc *ProxyClient) reregisterAll() {
+	mappings := pc.Mappings()
+	slog.Debug("Re-registering all port mappings", "count", len(mappings))
+
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for _, mapping := range mappings {
+		wg.Go(func() {
+			err := pc.reregisterWithRetry(mapping, pc.reregisterRetries, pc.reregisterDelay)
+			if mapping.stats != nil {
+				mapping.stats.registrationFailed.Store(err != nil)
+			}
+			if err != nil {
+				failed.Add(1)
+				if mapping.stats != nil {
+					mapping.stats.recordError(err)
+				}
+				slog.Error("Failed to re-register port mapping, giving up",
+					"remote_port", mapping.RemotePort, "retries", pc.reregisterRetries, "error", err)
+			}
+		})
+	}
+	wg.Wait()
+	slog.Info("Port mapping re-registration completed", "failed", failed.Load())
+}
+
+// reregisterWithRetry registers a mapping again, retrying up to maxRetries times with a delay
+// that starts at delay and doubles after each attempt. It returns the last error.
+func (pc *ProxyClient) reregisterWithRetry(mapping RouteMapping, maxRetries int, delay time.Duration) error {
+	err := pc.registerPortMapping(mapping)
+	for retry := 1; err != nil && retry <= maxRetries; retry++ {
+		slog.Warn("Failed to re-register port mapping, retrying",
+			"remote_port", mapping.RemotePort, "retry", retry, "retry_in", delay, "error", err)
+
+		select {
+		case <-pc.shutdownChan:
+			return err
+		case <-pc.clock.After(delay):
+		}
+
+		err = pc.registerPortMapping(mapping)
+		delay *= 2
+	}
+	return err
+}
+
+// dropMapping stops the listener of the mappings on remotePort, only those of hostname and with
+// visibility if they aren't empty, and closes their connections
+func (pc *ProxyClient) dropMapping(remotePort int, hostname, visibility string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.mappings = slices.DeleteFunc(pc.mappings, func(m RouteMapping) bool {
+		if !m.matches(remotePort, hostname, visibility) {
+			return false
+		}
+		close(m.stop)
+		return true
+	})
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"log/slog"
+	"time"
+)
+
+// currentServerIP returns the IP of the server the client is using, which changes when it fails
+// over to a fallback server
+func (pc *ProxyClient) currentServerIP() string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.serverIP
+}
+
+// serverIPs returns the primary server followed by the fallback servers
+func (pc *ProxyClient) serverIPs() []string {
+	return append([]string{pc.primaryServerIP}, pc.fallbackServerIPs...)
+}
+
+// useServer makes the index-th entry of serverIPs the server the client talks to. Its startup
+// time is not known yet, so the first heartbeat doesn't count as a restart.
+func (pc *ProxyClient) useServer(index int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.currentServerIndex = index
+	pc.serverIP = pc.serverIPs()[index]
+	pc.serverStartupTime = 0
+	pc.serverShuttingDown = false
+}
+
+// failover tries the other servers in turn, starting after the current one, and switches to
+// the first that answers a heartbeat. It removes the mappings from the old server as far as it
+// still answers, registers them with the new one and reports whether it switched.
+func (pc *ProxyClient) failover() bool {
+	servers := pc.serverIPs()
+	if len(servers) < 2 {
+		return false
+	}
+
+	pc.mu.Lock()
+	current := pc.currentServerIndex
+	pc.mu.Unlock()
+	oldServerIP := servers[current]
+
+	for step := 1; step < len(servers); step++ {
+		next := (current + step) % len(servers)
+		slog.Info("Trying fallback server", "server_ip", servers[next])
+		pc.useServer(next)
+
+		if err := pc.sendHeartbeat(); err != nil {
+			slog.Warn("Fallback server is not available", "server_ip", servers[next], "error", err)
+			continue
+		}
+
+		slog.Warn("Switched to fallback server", "server_ip", servers[next], "previous_server_ip", oldServerIP)
+		pc.mu.Lock()
+		pc.heartbeatFailures = 0
+		pc.lastHeartbeat = time.Now()
+		pc.mu.Unlock()
+
+		// The old server is most likely gone, so don't wait for it
+		go func() {
+			if err := pc.cleanupServer(oldServerIP); err != nil {
+				slog.Debug("Failed to clean up port mappings on the previous server", "server_ip", oldServerIP, "error", err)
+			}
+		}()
+
+		pc.reregisterAll()
+		return true
+	}
+
+	// Stay with the server that failed, nothing else answered
+	pc.useServer(current)
+	return false
+}
+
+// SelectServer makes the first of serverIPs that answers a heartbeat the primary server, for
+// clients that found several candidate servers in their WireGuard config. It returns the server
+// it selected, or the error of the last candidate if none answered.
+func (pc *ProxyClient) SelectServer(serverIPs []string) (string, error) {
+	var err error
+	for _, serverIP := range serverIPs {
+		pc.mu.Lock()
+		pc.serverIP = serverIP
+		pc.primaryServerIP = serverIP
+		pc.mu.Unlock()
+
+		if err = pc.CheckServerAvailability(); err == nil {
+			return serverIP, nil
+		}
+		if len(serverIPs) > 1 {
+			slog.Warn("Candidate server is not available", "server_ip", serverIP, "error", err)
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+)
+
+// defaultForwardBind is the address local forwards listen on unless the spec names one
+const defaultForwardBind = "127.0.0.1"
+
+// LocalForward forwards connections to a port on the client's host network through the tunnel
+// to a target the server connects to, like ssh -L
+type LocalForward struct {
+	BindAddr string // host:port the client listens on
+	Target   string // host:port the server connects to
+	stats    *mappingStats
+}
+
+// ForwardStatus describes a local forward and its counters
+type ForwardStatus struct {
+	BindAddr          string `json:"bind_addr"`
+	Target            string `json:"target"` // "socks5" for the SOCKS5 proxy, whose clients pick their targets
+	ActiveConnections int64  `json:"active_connections"`
+	BytesRelayed      uint64 `json:"bytes_relayed"`
+	DialFailures      uint64 `json:"dial_failures"`
+	LastError         string `json:"last_error,omitempty"`
+
+	RelayErrors map[string]int64 `json:"relay_errors,omitempty"` // Connections that ended abnormally, by class
+}
+
+// ParseLocalForwards parses local forwards in the form [bind_addr:]local_port:target_host:target_port.
+// IPv6 addresses are enclosed in brackets; the bind address defaults to 127.0.0.1.
+func ParseLocalForwards(specs []string) ([]LocalForward, error) {
+	forwards := make([]LocalForward, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		forward, err := parseLocalForward(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local forward %q: %v", spec, err)
+		}
+		if seen[forward.BindAddr] {
+			return nil, fmt.Errorf("invalid local forward %q: %s is forwarded more than once", spec, forward.BindAddr)
+		}
+		seen[forward.BindAddr] = true
+		forwards = append(forwards, forward)
+	}
+	return forwards, nil
+}
+
+// parseLocalForward parses a single local forward, splitting it from the end so that only the
+// bind address is optional
+func parseLocalForward(spec string) (LocalForward, error) {
+	const format = "expected format: [bind_addr:]local_port:target_host:target_port"
+
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return LocalForward{}, fmt.Errorf("%s", format)
+	}
+	rest, targetPort := spec[:i], spec[i+1:]
+
+	var targetHost string
+	if strings.HasSuffix(rest, "]") {
+		j := strings.LastIndex(rest, "[")
+		if j < 1 || rest[j-1] != ':' {
+			return LocalForward{}, fmt.Errorf("%s", format)
+		}
+		targetHost, rest = rest[j+1:len(rest)-1], rest[:j-1]
+	} else {
+		j := strings.LastIndex(rest, ":")
+		if j < 0 {
+			return LocalForward{}, fmt.Errorf("%s", format)
+		}
+		targetHost, rest = rest[j+1:], rest[:j]
+	}
+
+	bindHost, localPort := defaultForwardBind, rest
+	if strings.Contains(rest, ":") {
+		var err error
+		if bindHost, localPort, err = net.SplitHostPort(rest); err != nil {
+			return LocalForward{}, fmt.Errorf("%s", format)
+		}
+	}
+
+	if targetHost == "" {
+		return LocalForward{}, fmt.Errorf("target host is empty")
+	}
+	for _, port := range []string{localPort, targetPort} {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return LocalForward{}, fmt.Errorf("port %q must be between 1-65535", port)
+		}
+	}
+
+	return LocalForward{
+		BindAddr: net.JoinHostPort(bindHost, localPort),
+		Target:   net.JoinHostPort(targetHost, targetPort),
+		stats:    &mappingStats{},
+	}, nil
+}
+
+// AddLocalForward adds a local forward. It must be called before Start.
+func (pc *ProxyClient) AddLocalForward(forward LocalForward) {
+	if forward.stats == nil {
+		forward.stats = &mappingStats{}
+	}
+	pc.forwards = append(pc.forwards, forward)
+}
+
+// startLocalForwards listens for the local forwards and the SOCKS5 proxy once the server is known
+// to accept forwards
+func (pc *ProxyClient) startLocalForwards() error {
+	if len(pc.forwards) == 0 && pc.socksAddr == "" {
+		return nil
+	}
+
+	// The forward port arrives with heartbeats, so don't wait for the first scheduled one
+	if err := pc.sendHeartbeat(); err != nil {
+		return fmt.Errorf("failed to ask the server for its forward port: %v", err)
+	}
+	if pc.currentForwardPort() == 0 {
+		return fmt.Errorf("server does not accept local forwards (start it with -forward-port)")
+	}
+
+	for _, forward := range pc.forwards {
+		listener, err := net.Listen("tcp", forward.BindAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for local forward to %s: %v", forward.Target, err)
+		}
+		slog.Info("Local forward started", "bind_addr", forward.BindAddr, "target", forward.Target)
+
+		pc.wg.Add(1)
+		go func(forward LocalForward) {
+			defer pc.wg.Done()
+			pc.serveLocalForward(listener, forward)
+		}(forward)
+	}
+	return pc.startSOCKS5()
+}
+
+// serveLocalForward accepts connections for a local forward until shutdown
+func (pc *ProxyClient) serveLocalForward(listener net.Listener, forward LocalForward) {
+	go func() {
+		<-pc.shutdownChan
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !pc.IsShuttingDown() {
+				slog.Error("Local forward listener failed", "bind_addr", forward.BindAddr, "error", err)
+			}
+			return
+		}
+		go pc.handleForwardConnection(conn, forward)
+	}
+}
+
+// handleForwardConnection asks the server to connect to the forward's target and relays between
+// the local connection and the tunnel
+func (pc *ProxyClient) handleForwardConnection(localConn net.Conn, forward LocalForward) {
+	defer localConn.Close()
+
+	tunnelConn, err := pc.openForward(forward.Target)
+	if err != nil {
+		forward.stats.dialFailures.Add(1)
+		forward.stats.recordError(err)
+		slog.Error("Failed to open local forward", "bind_addr", forward.BindAddr, "target", forward.Target, "error", err)
+		return
+	}
+	defer tunnelConn.Close()
+
+	forward.stats.activeConns.Add(1)
+	defer forward.stats.activeConns.Add(-1)
+
+	slog.Debug("Established forward connection", "bind_addr", forward.BindAddr,
+		"local_remote", localConn.RemoteAddr(), "target", forward.Target)
+
+	start := time.Now()
+	bytesIn, bytesOut, err := pc.relay(tunnelConn, localConn, forward.stats)
+
+	slog.Log(context.Background(), closeLogLevel(err), "Forward connection closed", "bind_addr", forward.BindAddr,
+		"local_remote", localConn.RemoteAddr(), "target", forward.Target,
+		"bytes_in", bytesIn, "bytes_out", bytesOut, "duration", time.Since(start), relayErrorAttr(err))
+}
+
+// openForward connects to the server's forward listener and has it connect to target
+func (pc *ProxyClient) openForward(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pc.dialTimeout)
+	defer cancel()
+	conn, err := pc.tnet.DialContext(ctx, "tcp", serverAddr(pc.currentServerIP(), pc.currentForwardPort()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the server: %v", err)
+	}
+
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if pc.authToken != "" {
+		request += "Authorization: " + bearerPrefix + pc.authToken + "\r\n"
+	}
+	conn.SetDeadline(time.Now().Add(pc.dialTimeout))
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send forward request: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read forward response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		conn.Close()
+		return nil, &forwardRefusedError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conntrack.NewBufferedConn(conn, reader), nil
+}
+
+// forwardRefusedError is returned by openForward when the server refuses a forward
+type forwardRefusedError struct {
+	status  int
+	message string
+}
+
+func (e *forwardRefusedError) Error() string {
+	return fmt.Sprintf("server refused forward (%d %s): %s", e.status, http.StatusText(e.status), e.message)
+}
+
+// currentForwardPort returns the forward port last advertised by the server, 0 if it has none
+func (pc *ProxyClient) currentForwardPort() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.forwardPort
+}
+
+// forwardStatuses returns the local forwards with their counters
+func (pc *ProxyClient) forwardStatuses() []ForwardStatus {
+	statuses := make([]ForwardStatus, 0, len(pc.forwards)+1)
+	for _, forward := range pc.forwards {
+		statuses = append(statuses, ForwardStatus{
+			BindAddr:          forward.BindAddr,
+			Target:            forward.Target,
+			ActiveConnections: forward.stats.activeConns.Load(),
+			BytesRelayed:      forward.stats.bytesRelayed.Load(),
+			DialFailures:      forward.stats.dialFailures.Load(),
+			LastError:         forward.stats.latestError(),
+			RelayErrors:       forward.stats.relayErrors.Snapshot(),
+		})
+	}
+	if pc.socksAddr != "" {
+		statuses = append(statuses, ForwardStatus{
+			BindAddr:          pc.socksAddr,
+			Target:            socksTarget,
+			ActiveConnections: pc.socksStats.activeConns.Load(),
+			BytesRelayed:      pc.socksStats.bytesRelayed.Load(),
+			DialFailures:      pc.socksStats.dialFailures.Load(),
+			LastError:         pc.socksStats.latestError(),
+			RelayErrors:       pc.socksStats.relayErrors.Snapshot(),
+		})
+	}
+	return statuses
+}
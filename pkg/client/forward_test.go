@@ -0,0 +1,68 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLocalForwards(t *testing.T) {
+	tests := []struct {
+		spec     string
+		bindAddr string
+		target   string
+	}{
+		// Default bind address
+		{"8080:10.0.0.5:80", "127.0.0.1:8080", "10.0.0.5:80"},
+		{"5432:db.internal:5432", "127.0.0.1:5432", "db.internal:5432"},
+
+		// Explicit bind address
+		{"0.0.0.0:8080:10.0.0.5:80", "0.0.0.0:8080", "10.0.0.5:80"},
+		{":8080:10.0.0.5:80", ":8080", "10.0.0.5:80"},
+
+		// Bracketed IPv6 on either side
+		{"[::1]:8080:10.0.0.5:80", "[::1]:8080", "10.0.0.5:80"},
+		{"8080:[fd00::5]:80", "127.0.0.1:8080", "[fd00::5]:80"},
+		{"[::1]:8080:[fd00::5]:80", "[::1]:8080", "[fd00::5]:80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			forwards, err := ParseLocalForwards([]string{tt.spec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if forwards[0].BindAddr != tt.bindAddr || forwards[0].Target != tt.target {
+				t.Errorf("got %s to %s, want %s to %s", forwards[0].BindAddr, forwards[0].Target, tt.bindAddr, tt.target)
+			}
+		})
+	}
+}
+
+func TestParseLocalForwardsErrors(t *testing.T) {
+	tests := []struct {
+		specs []string
+		want  string
+	}{
+		{[]string{"8080"}, "expected format"},
+		{[]string{"8080:80"}, "expected format"},
+		{[]string{"8080:[fd00::5]80"}, "expected format"},
+		{[]string{"::1:8080:10.0.0.5:80"}, "expected format"},
+		{[]string{"8080::80"}, "target host is empty"},
+		{[]string{"0:10.0.0.5:80"}, `port "0" must be between 1-65535`},
+		{[]string{"8080:10.0.0.5:65536"}, `port "65536" must be between 1-65535`},
+		{[]string{"8080:10.0.0.5:http"}, `port "http" must be between 1-65535`},
+		{[]string{"8080:10.0.0.5:80", "8080:10.0.0.6:80"}, "127.0.0.1:8080 is forwarded more than once"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.specs, " "), func(t *testing.T) {
+			forwards, err := ParseLocalForwards(tt.specs)
+			if err == nil {
+				t.Fatalf("got %+v, want an error", forwards)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q doesn't say %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -4,51 +4,185 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
 	"time"
 
+	wgrp "github.com/DevonTM/wg-rp"
 	"github.com/DevonTM/wg-rp/pkg/api"
 	"github.com/DevonTM/wg-rp/pkg/utils"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
 )
 
+const (
+	// DefaultHeartbeatInterval is used until the server advertises its own interval
+	DefaultHeartbeatInterval = 20 * time.Second
+
+	// MinHeartbeatInterval and MaxHeartbeatInterval bound the interval a server may ask for, or
+	// the client may be given
+	MinHeartbeatInterval = 5 * time.Second
+	MaxHeartbeatInterval = 5 * time.Minute
+
+	// DefaultTunnelWait is how long the client waits for a WireGuard tunnel that isn't up once
+	// heartbeats fail, before shutting down as it does when the server is gone
+	DefaultTunnelWait = 5 * time.Minute
+)
+
+// Clock abstracts waiting so the heartbeat schedule can be driven without real time
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+	Now() time.Time
+}
+
+// realClock waits using the time package
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// heartbeatJitter is the fraction by which each heartbeat interval is randomly varied so that
+// clients started together don't heartbeat in lockstep
+const heartbeatJitter = 0.2
+
+// heartbeatRetryDelays are the quick retries made after a failed heartbeat before it counts as a strike
+var heartbeatRetryDelays = []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second}
+
 // startHeartbeat starts sending periodic heartbeats to the server
 func (pc *ProxyClient) startHeartbeat() {
 	go func() {
-		ticker := time.NewTicker(20 * time.Second) // Send heartbeat every 20 seconds
-		defer ticker.Stop()
+		retry := 0
+		waitingForTunnel := false
+		var waitingSince time.Time
 
 		for {
+			// Wait for the next jittered beat, or the next quick retry after a failure
+			wait := jitter(pc.currentHeartbeatInterval(), heartbeatJitter)
+			if retry > 0 {
+				wait = heartbeatRetryDelays[retry-1]
+			}
+
 			select {
 			case <-pc.shutdownChan:
-				log.Printf("Heartbeat stopped due to shutdown signal")
+				slog.Info("Heartbeat stopped due to shutdown signal")
 				return
-			case <-ticker.C:
-				if err := pc.sendHeartbeat(); err != nil {
-					pc.heartbeatFailures++
-					log.Printf("Failed to send heartbeat (attempt %d/%d): %v",
-						pc.heartbeatFailures, pc.maxHeartbeatFails, err)
-
-					if pc.heartbeatFailures >= pc.maxHeartbeatFails {
-						log.Printf("Server appears to be dead after %d failed heartbeat attempts. Shutting down client...",
-							pc.maxHeartbeatFails)
-
-						// Signal shutdown to main application
-						close(pc.shutdownChan)
-						return
-					}
+			case <-pc.clock.After(wait):
+			}
+
+			err := pc.sendHeartbeat()
+			if err == nil {
+				// Reset failure counter and schedule on successful heartbeat
+				pc.mu.Lock()
+				failures := pc.heartbeatFailures
+				pc.heartbeatFailures = 0
+				pc.lastHeartbeat = time.Now()
+				pc.mu.Unlock()
+				if failures > 0 || retry > 0 {
+					slog.Info("Heartbeat succeeded again", "failed_heartbeats", failures, "retries", retry)
 				} else {
-					// Reset failure counter on successful heartbeat
-					pc.heartbeatFailures = 0
+					slog.Debug("Heartbeat sent")
+				}
+				retry = 0
+
+				// The server may have dropped the mappings while the tunnel was down
+				if waitingForTunnel {
+					waitingForTunnel = false
+					slog.Info("WireGuard tunnel is back, registering mappings again")
+					pc.reregisterAll()
 				}
+				continue
+			}
+
+			if retry < len(heartbeatRetryDelays) {
+				slog.Warn("Failed to send heartbeat, retrying",
+					"retry_in", heartbeatRetryDelays[retry], "error", err)
+				retry++
+				continue
+			}
+
+			// The beat and all of its retries failed, count it as a strike
+			retry = 0
+			pc.mu.Lock()
+			pc.heartbeatFailures++
+			failures := pc.heartbeatFailures
+			pc.mu.Unlock()
+			slog.Warn("Failed to send heartbeat",
+				"attempt", failures, "max_attempts", pc.maxHeartbeatFails, "error", err)
+
+			if failures >= pc.maxHeartbeatFails {
+				// Don't blame the server while no WireGuard handshake completes, wait for the tunnel,
+				// for up to tunnelWait unless that is 0
+				if health := pc.currentTunnelHealth(); health != wireguard.TunnelUp {
+					if !waitingForTunnel {
+						waitingForTunnel = true
+						waitingSince = pc.clock.Now()
+						slog.Warn("Heartbeats fail because the WireGuard tunnel is not up, waiting for it instead of giving up on the server",
+							"tunnel_health", health, "failed_heartbeats", failures, "max_wait", pc.tunnelWait)
+					}
+					waited := pc.clock.Now().Sub(waitingSince)
+					if pc.tunnelWait == 0 || waited < pc.tunnelWait {
+						continue
+					}
+
+					slog.Error("WireGuard tunnel did not come back, shutting down client",
+						"tunnel_health", health, "waited", waited.Round(time.Second))
+					pc.Shutdown()
+					return
+				}
+
+				// Carry on with a fallback server if one answers
+				if pc.failover() {
+					continue
+				}
+
+				slog.Error("Server appears to be dead, shutting down client",
+					"failed_heartbeats", pc.maxHeartbeatFails)
+
+				// Signal shutdown to main application
+				pc.Shutdown()
+				return
 			}
 		}
 	}()
 }
 
+// currentTunnelHealth returns the health of the WireGuard tunnel, up if it isn't known
+func (pc *ProxyClient) currentTunnelHealth() wireguard.TunnelHealth {
+	if pc.tunnelHealth == nil {
+		return wireguard.TunnelUp
+	}
+	return pc.tunnelHealth()
+}
+
+// currentHeartbeatInterval returns the interval between heartbeats, which the server may change
+func (pc *ProxyClient) currentHeartbeatInterval() time.Duration {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.heartbeatInterval
+}
+
+// jitter randomly varies d by up to ±frac
+func jitter(d time.Duration, frac float64) time.Duration {
+	return time.Duration(float64(d) * (1 - frac + 2*frac*rand.Float64()))
+}
+
 // sendHeartbeat sends a heartbeat to the server
 func (pc *ProxyClient) sendHeartbeat() error {
 	request := api.HeartbeatRequest{
-		ClientIP: pc.clientIP,
+		ClientIP:                 pc.clientIP,
+		Version:                  wgrp.VERSION,
+		Stats:                    pc.statsSnapshot(),
+		HeartbeatIntervalSeconds: int(pc.currentHeartbeatInterval() / time.Second),
+	}
+
+	// Report the latest RTT average so the server can show per-client latency
+	if rtt := pc.rtt.snapshot(); rtt.Samples > 0 {
+		request.RTTMillis = float64(rtt.EWMA) / float64(time.Millisecond)
 	}
 
 	jsonData, err := json.Marshal(request)
@@ -56,46 +190,141 @@ func (pc *ProxyClient) sendHeartbeat() error {
 		return fmt.Errorf("failed to marshal heartbeat request: %v", err)
 	}
 
-	serverURL := fmt.Sprintf("http://%s/api/v1/heartbeat", pc.serverIP)
+	serverURL := pc.apiURL("/api/v1/heartbeat")
+	start := time.Now()
 	resp, err := pc.httpClient.Post(serverURL, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
+		if isTimeout(err) {
+			pc.rtt.recordTimeout()
+		}
 		return fmt.Errorf("failed to send heartbeat request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	var response api.HeartbeatResponse
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		if isTimeout(err) {
+			pc.rtt.recordTimeout()
+		}
 		return fmt.Errorf("failed to decode heartbeat response: %v", err)
 	}
 
+	// Record the round trip including the response body
+	rtt := time.Since(start)
+	pc.rtt.record(rtt)
+	if rtt > pc.rttWarnThreshold {
+		slog.Warn("Heartbeat round-trip time exceeds threshold, the tunnel may be degraded",
+			"rtt", rtt.Round(time.Millisecond), "threshold", pc.rttWarnThreshold)
+	}
+
 	if !response.Success {
 		return fmt.Errorf("heartbeat rejected: %s", response.Message)
 	}
 
-	// Check for server restart
-	if pc.serverStartupTime != 0 && response.ServerStartupTime != pc.serverStartupTime {
-		log.Printf("Server restart detected! Previous startup: %s, Current startup: %s",
-			utils.FormatDateTimeFromUnix(pc.serverStartupTime), utils.FormatDateTimeFromUnix(response.ServerStartupTime))
-		log.Printf("Re-registering all %d port mappings...", len(pc.mappings))
-
-		// Re-register all port mappings
-		for _, mapping := range pc.mappings {
-			if err := pc.registerPortMapping(mapping); err != nil {
-				log.Printf("Failed to re-register port mapping for port %d: %v", mapping.RemotePort, err)
-				// Continue trying to register other mappings even if one fails
-			}
+	// Warn once whenever the server reports a version different from ours
+	pc.mu.Lock()
+	previousVersion := pc.serverVersion
+	pc.serverVersion = response.Version
+	pc.mu.Unlock()
+	if response.Version != previousVersion && utils.CompareVersions(response.Version, wgrp.VERSION) != 0 {
+		serverVersion := response.Version
+		if serverVersion == "" {
+			serverVersion = "unknown"
 		}
-		log.Printf("Port mapping re-registration completed")
+		slog.Warn("Server version differs from client version", "server_version", serverVersion, "client_version", wgrp.VERSION)
 	}
 
-	// Update the server startup time
-	pc.serverStartupTime = response.ServerStartupTime
+	pc.adoptHeartbeatInterval(response.HeartbeatIntervalSeconds)
+	pc.checkServerTimeout(response.ClientTimeoutSeconds)
+
+	pc.mu.Lock()
+	pc.forwardPort = response.ForwardPort
+	pc.mu.Unlock()
+
+	// Re-register everything if the server restarted since the last heartbeat
+	pc.handleServerStartup(response.ServerStartupTime)
 
 	return nil
 }
 
-// CheckServerAvailability checks if the server is available by sending a heartbeat
+// adoptHeartbeatInterval switches to the interval advertised by the server, bounded to a sane range
+func (pc *ProxyClient) adoptHeartbeatInterval(seconds int) {
+	if seconds <= 0 || pc.fixedHeartbeat {
+		return
+	}
+
+	interval := min(max(time.Duration(seconds)*time.Second, MinHeartbeatInterval), MaxHeartbeatInterval)
+	pc.mu.Lock()
+	previous := pc.heartbeatInterval
+	pc.heartbeatInterval = interval
+	pc.mu.Unlock()
+	if interval != previous {
+		slog.Info("Adopting heartbeat interval from server", "interval", interval, "previous", previous)
+	}
+}
+
+// checkServerTimeout warns, once per timeout the server advertises, when a fixed heartbeat
+// interval leaves the server less than two heartbeats before it considers the client dead.
+// Servers that scale their wait to the reported interval keep the client anyway.
+func (pc *ProxyClient) checkServerTimeout(seconds int) {
+	timeout := time.Duration(seconds) * time.Second
+	if seconds <= 0 {
+		return
+	}
+	pc.mu.Lock()
+	previous := pc.serverTimeout
+	pc.serverTimeout = timeout
+	pc.mu.Unlock()
+	if timeout == previous {
+		return
+	}
+	if interval := pc.currentHeartbeatInterval(); pc.fixedHeartbeat && interval > timeout/2 {
+		slog.Warn("Heartbeat interval exceeds half the server's client timeout, missed heartbeats may get the mappings removed",
+			"interval", interval, "client_timeout", timeout)
+	}
+}
+
+// checkServerVersion fetches the server version and logs a warning if its major version differs
+// from the client's. Servers too old to report it are only noted at debug level.
+func (pc *ProxyClient) checkServerVersion() {
+	resp, err := pc.httpClient.Get(pc.apiURL("/api/v1/version"))
+	if err != nil {
+		slog.Debug("Failed to fetch server version", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Debug("Server does not report its version", "status", resp.Status)
+		return
+	}
+
+	var response api.VersionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		slog.Debug("Failed to decode server version", "error", err)
+		return
+	}
+
+	serverVersion, err := utils.ParseVersion(response.Version)
+	if err != nil {
+		slog.Warn("Server reports an invalid version", "server_version", response.Version, "error", err)
+		return
+	}
+	clientVersion, err := utils.ParseVersion(wgrp.VERSION)
+	if err != nil {
+		return
+	}
+	if serverVersion.Major != clientVersion.Major {
+		slog.Warn("Server major version differs from client, they may not be compatible",
+			"server_version", response.Version, "client_version", wgrp.VERSION, "server_api_version", response.APIVersion)
+	}
+}
+
+// CheckServerAvailability checks if the server is available by sending a heartbeat. Before that
+// it asks the server for its version and warns if its major version differs from the client's.
 func (pc *ProxyClient) CheckServerAvailability() error {
+	pc.checkServerVersion()
+
 	// Try to send a heartbeat to check server availability
 	err := pc.sendHeartbeat()
 	if err != nil {
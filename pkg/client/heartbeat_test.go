@@ -0,0 +1,297 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// fakeClock hands every wait the heartbeat loop asks for to the test, which ends it with fire.
+// Its time is the real time moved forward by skip.
+type fakeClock struct {
+	waits chan time.Duration
+	fire  chan time.Time
+	skip  atomic.Int64
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{waits: make(chan time.Duration, 1), fire: make(chan time.Time)}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fire
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Now().Add(time.Duration(c.skip.Load()))
+}
+
+// next returns the next wait the loop asks for and ends it once the test checked it
+func (c *fakeClock) next(t *testing.T) time.Duration {
+	t.Helper()
+	select {
+	case d := <-c.waits:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat loop did not wait again")
+		return 0
+	}
+}
+
+// heartbeatServer answers heartbeats, successfully while ok is set, and counts them
+type heartbeatServer struct {
+	ok       atomic.Bool
+	interval int    // heartbeat interval advertised to the client in seconds, 0 for none
+	timeout  int    // client timeout advertised to the client in seconds, 0 for none
+	version  string // server version reported to the client
+	flap     bool   // every other beat reports a different timeout and version
+	beats    atomic.Int64
+}
+
+func (s *heartbeatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	beat := s.beats.Add(1)
+	response := api.HeartbeatResponse{
+		Success:                  s.ok.Load(),
+		HeartbeatIntervalSeconds: s.interval,
+		ClientTimeoutSeconds:     s.timeout,
+		Version:                  s.version,
+	}
+	if s.flap && beat%2 == 0 {
+		response.ClientTimeoutSeconds++
+		response.Version += "-flap"
+	}
+	if !response.Success {
+		response.Message = "not now"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// newHeartbeatClient returns a client that sends its heartbeats to hs and waits on clock
+func newHeartbeatClient(t *testing.T, hs *heartbeatServer, clock Clock) *ProxyClient {
+	t.Helper()
+	srv := httptest.NewServer(hs)
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	pc := NewProxyClient(nil, host, "10.0.0.2", 1024, WithClock(clock))
+	pc.serverPort, _ = strconv.Atoi(port)
+	pc.httpClient = srv.Client()
+	t.Cleanup(pc.Shutdown)
+	return pc
+}
+
+// fireAndWait ends the current wait and returns the next one, once the heartbeat was answered
+func fireAndWait(t *testing.T, clock *fakeClock) time.Duration {
+	t.Helper()
+	clock.fire <- time.Now()
+	return clock.next(t)
+}
+
+func TestHeartbeatRetriesThenCountsAStrike(t *testing.T) {
+	hs := &heartbeatServer{interval: 60}
+	clock := newFakeClock()
+	pc := newHeartbeatClient(t, hs, clock)
+	pc.startHeartbeat()
+
+	// The first beat is the default interval, jittered
+	wait := clock.next(t)
+	low, high := jitterBounds(DefaultHeartbeatInterval)
+	if wait < low || wait > high {
+		t.Fatalf("first wait = %v, want within [%v, %v]", wait, low, high)
+	}
+
+	// A failed beat is retried quickly, each delay longer than the last
+	for _, want := range heartbeatRetryDelays {
+		if wait := fireAndWait(t, clock); wait != want {
+			t.Fatalf("retry wait = %v, want %v", wait, want)
+		}
+	}
+	if failures := pc.Status().HeartbeatFailures; failures != 0 {
+		t.Fatalf("HeartbeatFailures = %d during retries, want 0", failures)
+	}
+
+	// The last retry failing counts a strike and goes back to the regular schedule
+	wait = fireAndWait(t, clock)
+	if wait < low || wait > high {
+		t.Fatalf("wait after a strike = %v, want within [%v, %v]", wait, low, high)
+	}
+	if failures := pc.Status().HeartbeatFailures; failures != 1 {
+		t.Fatalf("HeartbeatFailures = %d, want 1", failures)
+	}
+
+	// A successful beat resets the strikes and adopts the server's interval
+	hs.ok.Store(true)
+	wait = fireAndWait(t, clock)
+	low, high = jitterBounds(time.Minute)
+	if wait < low || wait > high {
+		t.Fatalf("wait after adopting the server's interval = %v, want within [%v, %v]", wait, low, high)
+	}
+	status := pc.Status()
+	if status.HeartbeatFailures != 0 || status.HeartbeatIntervalSeconds != 60 {
+		t.Fatalf("HeartbeatFailures = %d, HeartbeatIntervalSeconds = %d, want 0 and 60",
+			status.HeartbeatFailures, status.HeartbeatIntervalSeconds)
+	}
+	if beats := hs.beats.Load(); beats != 5 {
+		t.Errorf("server saw %d heartbeats, want 5", beats)
+	}
+}
+
+func TestHeartbeatShutsDownAfterMaxStrikes(t *testing.T) {
+	hs := &heartbeatServer{}
+	clock := newFakeClock()
+	pc := newHeartbeatClient(t, hs, clock)
+	pc.startHeartbeat()
+
+	clock.next(t)
+	for strike := 1; strike <= pc.maxHeartbeatFails; strike++ {
+		for range heartbeatRetryDelays {
+			fireAndWait(t, clock)
+		}
+		clock.fire <- time.Now()
+		if strike < pc.maxHeartbeatFails {
+			clock.next(t)
+		}
+	}
+
+	select {
+	case <-pc.shutdownChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not shut down after the last strike")
+	}
+	if !pc.IsShuttingDown() {
+		t.Error("IsShuttingDown() = false after the last strike")
+	}
+}
+
+func TestHeartbeatKeepsFixedInterval(t *testing.T) {
+	hs := &heartbeatServer{interval: 60}
+	hs.ok.Store(true)
+	clock := newFakeClock()
+	pc := newHeartbeatClient(t, hs, clock)
+	WithHeartbeatInterval(10 * time.Second)(pc)
+	pc.startHeartbeat()
+
+	low, high := jitterBounds(10 * time.Second)
+	for range 3 {
+		if wait := clock.next(t); wait < low || wait > high {
+			t.Fatalf("wait = %v, want within [%v, %v]", wait, low, high)
+		}
+		clock.fire <- time.Now()
+	}
+}
+
+func TestConcurrentHeartbeats(t *testing.T) {
+	hs := &heartbeatServer{interval: 60, timeout: 90, version: "0.0.1", flap: true}
+	hs.ok.Store(true)
+	pc := newHeartbeatClient(t, hs, newFakeClock())
+
+	// Forwards and failover send heartbeats besides the loop, while Status reads what they record;
+	// the race detector checks they all go through the lock
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 5 {
+				if err := pc.sendHeartbeat(); err != nil {
+					t.Error(err)
+				}
+				pc.Status()
+			}
+		})
+	}
+	wg.Wait()
+
+	// A last beat on its own, the 21st, leaves the values it reported
+	if err := pc.sendHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	if version := pc.Status().ServerVersion; version != "0.0.1" {
+		t.Errorf("ServerVersion = %q, want 0.0.1", version)
+	}
+	pc.mu.Lock()
+	timeout := pc.serverTimeout
+	pc.mu.Unlock()
+	if timeout != 90*time.Second {
+		t.Errorf("serverTimeout = %v, want 90s", timeout)
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	low, high := jitterBounds(DefaultHeartbeatInterval)
+	for range 1000 {
+		if d := jitter(DefaultHeartbeatInterval, heartbeatJitter); d < low || d > high {
+			t.Fatalf("jitter() = %v, want within [%v, %v]", d, low, high)
+		}
+	}
+}
+
+// jitterBounds returns the shortest and longest wait a heartbeat interval d is jittered to
+func jitterBounds(d time.Duration) (time.Duration, time.Duration) {
+	return time.Duration(float64(d) * (1 - heartbeatJitter)), time.Duration(float64(d) * (1 + heartbeatJitter))
+}
+
+// strike fails a beat and all its retries, starting from a wait for the beat
+func strike(t *testing.T, clock *fakeClock) {
+	t.Helper()
+	for range heartbeatRetryDelays {
+		fireAndWait(t, clock)
+	}
+	clock.fire <- time.Now()
+}
+
+func TestHeartbeatWaitsForTunnelThenShutsDown(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		wait     time.Duration
+		shutDown bool
+	}{
+		{"bounded", DefaultTunnelWait, true},
+		{"forever", 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hs := &heartbeatServer{}
+			clock := newFakeClock()
+			pc := newHeartbeatClient(t, hs, clock)
+			WithTunnelHealth(func() wireguard.TunnelHealth { return wireguard.TunnelDown })(pc)
+			WithTunnelWait(tt.wait)(pc)
+			pc.startHeartbeat()
+
+			// The client waits for the tunnel instead of shutting down after the last strike
+			clock.next(t)
+			for range pc.maxHeartbeatFails {
+				strike(t, clock)
+				clock.next(t)
+			}
+			strike(t, clock)
+			clock.next(t)
+			if pc.IsShuttingDown() {
+				t.Fatal("client shut down while waiting for the tunnel")
+			}
+
+			// Once the tunnel has been down for longer than the wait, the next strike shuts it down
+			clock.skip.Store(int64(DefaultTunnelWait + time.Minute))
+			strike(t, clock)
+			if !tt.shutDown {
+				clock.next(t)
+				if pc.IsShuttingDown() {
+					t.Fatal("client shut down although it waits forever")
+				}
+				return
+			}
+			select {
+			case <-pc.shutdownChan:
+			case <-time.After(5 * time.Second):
+				t.Fatal("client did not shut down after waiting for the tunnel")
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Bytes of the IP and TCP headers in front of the payload of a netstack TCP segment, with the
+// timestamp option the netstack sends
+const (
+	segmentOverheadIPv4 = 20 + 20 + 12
+	segmentOverheadIPv6 = 40 + 20 + 12
+)
+
+// Smallest packet CheckMTU probes, the least every IPv4 host must accept (IPv6 requires 1280)
+const (
+	minCheckedMTU     = 576
+	minCheckedMTUIPv6 = 1280
+)
+
+// How long a probe waits for its echo, and how often a size is probed before it counts as lost
+const (
+	mtuProbeTimeout  = 3 * time.Second
+	mtuProbeAttempts = 2
+)
+
+// errEchoUnsupported is returned by CheckMTU for servers without the echo endpoint
+var errEchoUnsupported = errors.New("server has no echo endpoint")
+
+// CheckMTU checks that packets of mtu bytes, the MTU of the WireGuard device, get through the
+// tunnel to the server and back, and logs what to do if they don't. Each probe is an echo request
+// to the server API sized to fill one packet, on a connection of its own so that a lost one
+// doesn't hold up the others. Servers without the echo endpoint are skipped.
+func (pc *ProxyClient) CheckMTU(mtu int) {
+	largest, err := pc.largestEcho(mtu)
+	switch {
+	case errors.Is(err, errEchoUnsupported):
+		slog.Debug("Skipping the MTU check, the server can't echo probes")
+	case err != nil:
+		slog.Warn("MTU check failed", "mtu", mtu, "error", err)
+	case largest < mtu:
+		slog.Warn("MTU is larger than the path to the server carries: small requests work but large transfers stall",
+			"mtu", mtu, "largest_working", largest,
+			"hint", fmt.Sprintf("set MTU = %d in the [Interface] section of the WireGuard config, or start with -mtu %d or -mtu auto", largest, largest))
+	default:
+		slog.Info("MTU verified, full-size packets get through to the server", "mtu", mtu)
+	}
+}
+
+// largestEcho finds the largest packet size up to mtu whose echo comes back, by binary search
+func (pc *ProxyClient) largestEcho(mtu int) (int, error) {
+	serverIP := pc.currentServerIP()
+	addr, err := netip.ParseAddr(strings.Trim(serverIP, "[]"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid server IP %q: %v", serverIP, err)
+	}
+	overhead, lo := segmentOverheadIPv4, minCheckedMTU
+	if addr.Unmap().Is6() {
+		overhead, lo = segmentOverheadIPv6, minCheckedMTUIPv6
+	}
+	lo = min(lo, mtu)
+
+	echoes := func(size int) (bool, error) {
+		for range mtuProbeAttempts {
+			if ok, err := pc.echoProbe(serverIP, size-overhead); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	// Check the full size first, which passes on most tunnels
+	hi := mtu
+	ok, err := echoes(hi)
+	if err != nil || ok {
+		return hi, err
+	}
+	if ok, err = echoes(lo); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, fmt.Errorf("even packets of %d bytes get no echo", lo)
+	}
+
+	// lo gets through and hi doesn't
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := echoes(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// echoProbe sends an echo request of payload bytes, headers included, in a single write and
+// reports whether the echo came back. An error means the server refused the request, not that
+// it was lost.
+func (pc *ProxyClient) echoProbe(serverIP string, payload int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mtuProbeTimeout)
+	defer cancel()
+	conn, err := pc.tnet.DialContext(ctx, "tcp", serverAddr(serverIP, pc.serverPort))
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+
+	// The length of the header depends on the digits of the body length it announces
+	bodyLen := payload
+	for range 2 {
+		bodyLen = max(0, payload-len(echoHeader(serverIP, bodyLen, pc.authToken)))
+	}
+	header := echoHeader(serverIP, bodyLen, pc.authToken)
+
+	conn.SetDeadline(time.Now().Add(mtuProbeTimeout))
+	if _, err := io.WriteString(conn, header+strings.Repeat("x", bodyLen)); err != nil {
+		return false, nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return false, nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return false, errEchoUnsupported
+	default:
+		return false, fmt.Errorf("server answered the probe with %s", resp.Status)
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	return err == nil && n == int64(bodyLen), nil
+}
+
+// echoHeader returns the request header of an echo request with a body of bodyLen bytes
+func echoHeader(serverIP string, bodyLen int, authToken string) string {
+	header := fmt.Sprintf("POST /api/v1/echo HTTP/1.1\r\nHost: %s\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\nConnection: close\r\n",
+		serverIP, bodyLen)
+	if authToken != "" {
+		header += "Authorization: " + bearerPrefix + authToken + "\r\n"
+	}
+	return header + "\r\n"
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/DevonTM/wg-rp/pkg/server"
+)
+
+func TestLargestEcho(t *testing.T) {
+	pair := wgtest.NewPair(t)
+	ps := server.NewProxyServer(pair.Server.Tnet, 32*1024)
+	if err := ps.StartAPIServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loopback carries full-size packets, so the first probe confirms the device MTU
+	for _, serverIP := range []string{wgtest.ServerIP, wgtest.ServerIPv6} {
+		pc := NewProxyClient(pair.Client.Tnet, serverIP, wgtest.ClientIP, 32*1024)
+		largest, err := pc.largestEcho(wgtest.MTU)
+		if err != nil {
+			t.Fatalf("checking the MTU via %s: %v", serverIP, err)
+		}
+		if largest != wgtest.MTU {
+			t.Errorf("largest echo via %s = %d, want %d", serverIP, largest, wgtest.MTU)
+		}
+	}
+}
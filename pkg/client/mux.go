@@ -0,0 +1,131 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	// muxMinBackoff and muxMaxBackoff bound the delay between multiplexed session reconnects
+	muxMinBackoff = time.Second
+	muxMaxBackoff = time.Minute
+
+	// muxHeaderTimeout is how long a new stream may take to name its mapping
+	muxHeaderTimeout = 10 * time.Second
+)
+
+// enableMux starts the multiplexed session once the server accepted it for a mapping. The route
+// listeners stay up, so the server falls back to dialing them while no session is open.
+func (pc *ProxyClient) enableMux(port int) {
+	pc.muxOnce.Do(func() {
+		slog.Info("Server supports multiplexing, opening a multiplexed session", "mux_port", port)
+		go pc.runMux(port)
+	})
+}
+
+// runMux keeps a multiplexed session to the server open, reconnecting with backoff
+func (pc *ProxyClient) runMux(port int) {
+	backoff := muxMinBackoff
+
+	for {
+		established, err := pc.serveMuxSession(port)
+		if established {
+			backoff = muxMinBackoff
+		}
+
+		select {
+		case <-pc.shutdownChan:
+			return
+		default:
+		}
+
+		slog.Warn("Multiplexed session ended, falling back to direct connections", "retry_in", backoff, "error", err)
+
+		select {
+		case <-pc.shutdownChan:
+			return
+		case <-pc.clock.After(backoff):
+		}
+		backoff = min(backoff*2, muxMaxBackoff)
+	}
+}
+
+// serveMuxSession opens one session and relays its streams until it closes, reporting whether
+// the session was established
+func (pc *ProxyClient) serveMuxSession(port int) (bool, error) {
+	conn, err := pc.tnet.Dial("tcp", serverAddr(pc.currentServerIP(), port))
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to mux port: %v", err)
+	}
+
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		return false, fmt.Errorf("failed to start mux session: %v", err)
+	}
+	defer session.Close()
+
+	// Close the session on shutdown so Accept returns
+	go func() {
+		select {
+		case <-pc.shutdownChan:
+			session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+
+	slog.Info("Multiplexed session established", "mux_port", port)
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return true, err
+		}
+
+		go pc.handleMuxStream(stream)
+	}
+}
+
+// handleMuxStream reads which mapping a stream belongs to and relays it like a direct connection
+func (pc *ProxyClient) handleMuxStream(stream net.Conn) {
+	var header [2]byte
+	stream.SetReadDeadline(time.Now().Add(muxHeaderTimeout))
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		slog.Error("Failed to read multiplexed stream header", "error", err)
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	remotePort := int(binary.BigEndian.Uint16(header[:]))
+	mapping, exists := pc.mappingFor(remotePort)
+	if !exists {
+		slog.Error("Multiplexed stream for unknown mapping", "remote_port", remotePort)
+		stream.Close()
+		return
+	}
+
+	pc.handleRouteConnection(stream, mapping)
+}
+
+// mappingFor returns the active multiplexed mapping for a remote port. Streams name only the remote
+// port, so mappings that share it by hostname or visibility are dialed directly instead.
+func (pc *ProxyClient) mappingFor(remotePort int) (RouteMapping, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for _, mapping := range pc.mappings {
+		if mapping.RemotePort == remotePort && mapping.Hostname == "" && mapping.visibility() == api.VisibilityPublic {
+			return mapping, true
+		}
+	}
+	return RouteMapping{}, false
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/socks"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// ClientOption configures optional ProxyClient settings
+type ClientOption func(*ProxyClient)
+
+// WithServerPort sets the port of the server's REST API within the WireGuard netstack
+func WithServerPort(port int) ClientOption {
+	return func(pc *ProxyClient) {
+		if port > 0 {
+			pc.serverPort = port
+		}
+	}
+}
+
+// WithRTTWarnThreshold sets the heartbeat round-trip time above which a warning is logged
+func WithRTTWarnThreshold(threshold time.Duration) ClientOption {
+	return func(pc *ProxyClient) {
+		if threshold > 0 {
+			pc.rttWarnThreshold = threshold
+		}
+	}
+}
+
+// WithPartialRegistration keeps the client running when only some mappings can be registered.
+// Mappings the server rejects are dropped and reported by RegistrationFailures.
+func WithPartialRegistration() ClientOption {
+	return func(pc *ProxyClient) {
+		pc.partialRegistration = true
+	}
+}
+
+// WithHeartbeatInterval sends heartbeats at a fixed interval instead of the one the server
+// advertises, e.g. a longer one over a constrained link. The server waits for clients in
+// proportion to the interval they report.
+func WithHeartbeatInterval(interval time.Duration) ClientOption {
+	return func(pc *ProxyClient) {
+		if interval > 0 {
+			pc.heartbeatInterval = interval
+			pc.fixedHeartbeat = true
+		}
+	}
+}
+
+// WithClock replaces the clock used to schedule heartbeats
+func WithClock(clock Clock) ClientOption {
+	return func(pc *ProxyClient) {
+		if clock != nil {
+			pc.clock = clock
+		}
+	}
+}
+
+// WithConnRateLimit asks the server to accept at most perSecond new connections per second on
+// each mapping, with bursts of up to burst connections (0 derives the burst from the rate)
+func WithConnRateLimit(perSecond float64, burst int) ClientOption {
+	return func(pc *ProxyClient) {
+		if perSecond > 0 {
+			pc.maxConnsPerSecond = perSecond
+			pc.maxConnsBurst = max(burst, 0)
+		}
+	}
+}
+
+// WithDialTimeout sets how long the client waits to connect to a local service
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(pc *ProxyClient) {
+		if timeout > 0 {
+			pc.dialTimeout = timeout
+		}
+	}
+}
+
+// WithResolveMode sets when hostnames of local targets are resolved: once when the mapping is
+// added, or for new connections, reusing a lookup for ttl (0 keeps DefaultResolveTTL)
+func WithResolveMode(mode ResolveMode, ttl time.Duration) ClientOption {
+	return func(pc *ProxyClient) {
+		if mode != "" {
+			pc.resolveMode = mode
+		}
+		if ttl > 0 {
+			pc.resolveTTL = ttl
+		}
+	}
+}
+
+// WithLocalCheck checks the local service of each route before it is registered, warning about
+// routes that point at nothing or, with LocalCheckStrict, refusing to register them
+func WithLocalCheck(mode LocalCheckMode) ClientOption {
+	return func(pc *ProxyClient) {
+		pc.localCheck = mode
+	}
+}
+
+// WithAuthToken sends token as a bearer token with every request to the server's API and every
+// local forward
+func WithAuthToken(token string) ClientOption {
+	return func(pc *ProxyClient) {
+		if token != "" {
+			pc.authToken = token
+			pc.httpClient.Transport = &BearerTokenTransport{Token: token, Base: pc.httpClient.Transport}
+		}
+	}
+}
+
+// WithSOCKS5 runs a SOCKS5 proxy on addr of the host network whose connections the server makes
+// through the tunnel, like local forwards. With creds set, SOCKS5 clients must authenticate with
+// them.
+func WithSOCKS5(addr string, creds *socks.Credentials) ClientOption {
+	return func(pc *ProxyClient) {
+		if addr != "" {
+			pc.socksAddr = addr
+			pc.socksCreds = creds
+			pc.socksStats = &mappingStats{}
+		}
+	}
+}
+
+// WithFallbackServers sets servers to switch to, in order, when the server in use stops
+// answering heartbeats. They must be reachable through the WireGuard device like the primary and
+// are given in the same form; IPv6 addresses may be enclosed in brackets or not.
+func WithFallbackServers(serverIPs ...string) ClientOption {
+	return func(pc *ProxyClient) {
+		pc.fallbackServerIPs = append(pc.fallbackServerIPs, serverIPs...)
+	}
+}
+
+// WithReregisterRetry sets how often a mapping that fails to re-register is retried and the delay
+// before the first retry, which doubles for each further retry
+func WithReregisterRetry(retries int, delay time.Duration) ClientOption {
+	return func(pc *ProxyClient) {
+		if retries >= 0 {
+			pc.reregisterRetries = retries
+		}
+		if delay > 0 {
+			pc.reregisterDelay = delay
+		}
+	}
+}
+
+// WithCompression asks the server to compress the tunnel leg of every mapping that doesn't choose
+// its own algorithm, with api.CompressionSnappy or api.CompressionZstd
+func WithCompression(algorithm string) ClientOption {
+	return func(pc *ProxyClient) {
+		if algorithm != api.CompressionNone {
+			pc.compression = algorithm
+		}
+	}
+}
+
+// WithBufferMemoryLimit counts the client's relay buffers against limit. Beyond it connections
+// relay with throwaway buffers instead of pooled ones.
+func WithBufferMemoryLimit(limit *bufferpool.MemoryLimit) ClientOption {
+	return func(pc *ProxyClient) {
+		pc.bufferPool = bufferpool.NewBufferPool(pc.bufferPool.Size(), bufferpool.WithMemoryLimit(limit))
+	}
+}
+
+// WithLocalProbe asks the server to answer connections from its own host to the mapped ports
+// itself instead of relaying them, as api.LocalProbeAccept or api.LocalProbeHTTP
+func WithLocalProbe(mode string) ClientOption {
+	return func(pc *ProxyClient) {
+		pc.localProbe = mode
+	}
+}
+
+// WithPeerStats sets how the WireGuard peers reported with the status are found
+func WithPeerStats(stats func() []api.PeerStats) ClientOption {
+	return func(pc *ProxyClient) {
+		pc.peerStats = stats
+	}
+}
+
+// WithTunnelHealth sets how the health of the WireGuard tunnel is found. While the tunnel isn't
+// up, failing heartbeats are blamed on it instead of the server: the client doesn't fail over,
+// waits for the tunnel for up to the WithTunnelWait duration before shutting down, and registers
+// its mappings again once heartbeats get through.
+func WithTunnelHealth(health func() wireguard.TunnelHealth) ClientOption {
+	return func(pc *ProxyClient) {
+		pc.tunnelHealth = health
+	}
+}
+
+// WithTunnelWait sets how long the client waits for a WireGuard tunnel that isn't up once its
+// heartbeats fail, DefaultTunnelWait by default. 0 waits forever.
+func WithTunnelWait(wait time.Duration) ClientOption {
+	return func(pc *ProxyClient) {
+		pc.tunnelWait = wait
+	}
+}
+
+// WithStateFile remembers the client port of each remote port in path and reuses it when the
+// client restarts, so the server sees the same client ports. An empty path disables this. A
+// state file that can't be read is logged and replaced.
+func WithStateFile(path string) ClientOption {
+	return func(pc *ProxyClient) {
+		if path == "" {
+			return
+		}
+		state, err := loadPortState(path)
+		if err != nil {
+			slog.Warn("Ignoring client port state", "error", err)
+			state = &portState{path: path, ports: make(map[int]int)}
+		}
+		pc.portState = state
+	}
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+// MaxPortRangeSize is the most ports a single range route may expose
+const MaxPortRangeSize = 1024
+
+// parseRangeRoute expands a route with port ranges, "[local_ip:]first..last[-first..last]", into
+// one mapping per port. Both ranges must have the same length; without a remote range the local
+// ports are exposed on the same remote ports.
+func parseRangeRoute(route string) ([]RouteMapping, error) {
+	// The remote range never has a ":", so a "-" followed by one belongs to the local host
+	localPart, remotePart := route, ""
+	if i := strings.LastIndex(route, "-"); i >= 0 && !strings.Contains(route[i:], ":") {
+		localPart, remotePart = route[:i], route[i+1:]
+	}
+
+	host, localRange := DefaultLocalHost, localPart
+	if strings.Contains(localPart, ":") {
+		var err error
+		host, localRange, err = net.SplitHostPort(localPart)
+		if err != nil {
+			if strings.Count(localPart, ":") > 1 && !strings.HasPrefix(localPart, "[") {
+				return nil, fmt.Errorf("local address %q was read as ip:first..last, but IPv6 addresses must be enclosed in brackets, e.g. [::1]:6000..6010", localPart)
+			}
+			return nil, fmt.Errorf("local address %q was read as ip:first..last: %v", localPart, err)
+		}
+		if host == "" {
+			host = DefaultLocalHost
+		} else if err := utils.ValidateHost(host); err != nil {
+			return nil, fmt.Errorf("local address %q was read as ip:first..last: %v", localPart, err)
+		}
+	}
+	if remotePart == "" {
+		remotePart = localRange
+	}
+
+	localFirst, localLast, err := parsePortRange(localRange)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local port range: %v", err)
+	}
+	remoteFirst, remoteLast, err := parsePortRange(remotePart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote port range: %v", err)
+	}
+	if localLast-localFirst != remoteLast-remoteFirst {
+		return nil, fmt.Errorf("local range %s has %d ports but remote range %s has %d",
+			localRange, localLast-localFirst+1, remotePart, remoteLast-remoteFirst+1)
+	}
+
+	label := fmt.Sprintf("%d..%d", remoteFirst, remoteLast)
+	mappings := make([]RouteMapping, 0, remoteLast-remoteFirst+1)
+	for offset := 0; offset <= remoteLast-remoteFirst; offset++ {
+		mappings = append(mappings, RouteMapping{
+			LocalAddr:  net.JoinHostPort(host, strconv.Itoa(localFirst+offset)),
+			RemotePort: remoteFirst + offset,
+			portRange:  label,
+		})
+	}
+	return mappings, nil
+}
+
+// parsePortRange parses "first..last", where both are port numbers and first is not above last
+func parsePortRange(s string) (int, int, error) {
+	firstStr, lastStr, ok := strings.Cut(s, "..")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not a range of the form first..last", s)
+	}
+	first, err := strconv.Atoi(firstStr)
+	if err != nil || first < 1 || first > 65535 {
+		return 0, 0, fmt.Errorf("%q does not start with a port between 1 and 65535", s)
+	}
+	last, err := strconv.Atoi(lastStr)
+	if err != nil || last < 1 || last > 65535 {
+		return 0, 0, fmt.Errorf("%q does not end with a port between 1 and 65535", s)
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("%q starts above its end", s)
+	}
+	if last-first+1 > MaxPortRangeSize {
+		return 0, 0, fmt.Errorf("%q has more than %d ports", s, MaxPortRangeSize)
+	}
+	return first, last, nil
+}
+
+// portRanges groups the mappings that came from range routes by their range, in order
+func portRanges(mappings []RouteMapping) [][]RouteMapping {
+	var groups [][]RouteMapping
+	index := make(map[string]int)
+	for _, mapping := range mappings {
+		if mapping.portRange == "" {
+			continue
+		}
+		i, exists := index[mapping.portRange]
+		if !exists {
+			i = len(groups)
+			index[mapping.portRange] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], mapping)
+	}
+	return groups
+}
+
+// startPortRange starts the listeners of all mappings of a port range and registers them. The
+// range is all or nothing: if any port is rejected, the ports registered so far are deleted again,
+// the listeners are stopped and the error names every rejected port.
+func (pc *ProxyClient) startPortRange(group []RouteMapping) ([]RouteMapping, error) {
+	label := group[0].portRange
+
+	started := make([]RouteMapping, 0, len(group))
+	stopAll := func() {
+		for _, mapping := range started {
+			close(mapping.stop)
+		}
+	}
+	for _, mapping := range group {
+		if err := pc.startRouteListener(&mapping); err != nil {
+			stopAll()
+			return nil, fmt.Errorf("port range %s: %v", label, err)
+		}
+		started = append(started, mapping)
+	}
+
+	var registered, rejected []int
+	var firstErr error
+	for _, mapping := range started {
+		if err := pc.registerPortMapping(mapping); err != nil {
+			rejected = append(rejected, mapping.RemotePort)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		registered = append(registered, mapping.RemotePort)
+	}
+	if len(rejected) == 0 {
+		return started, nil
+	}
+
+	for _, port := range registered {
+		if err := pc.deletePortMapping(port, "", group[0].visibility()); err != nil {
+			slog.Warn("Failed to delete port mapping of rejected range", "remote_port", port, "error", err)
+		}
+	}
+	stopAll()
+	return nil, fmt.Errorf("port range %s rejected, %d of %d ports are unavailable (%s): %v",
+		label, len(rejected), len(group), formatPorts(rejected), firstErr)
+}
+
+// formatPorts lists ports separated by commas
+func formatPorts(ports []int) string {
+	parts := make([]string, len(ports))
+	for i, port := range ports {
+		parts[i] = strconv.Itoa(port)
+	}
+	return strings.Join(parts, ", ")
+}
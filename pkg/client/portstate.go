@@ -0,0 +1,130 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// DefaultStateFileName is the name of the state file in the home directory
+const DefaultStateFileName = ".wg-rp.state"
+
+// DefaultStateFile returns the default state file path, ~/.wg-rp.state, or an empty path if the
+// home directory is unknown
+func DefaultStateFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, DefaultStateFileName)
+}
+
+// portState remembers the client port each remote port was last registered with, so a restarted
+// client listens on the same ports and the server's records stay the same. The file is a JSON
+// object of remote port to client port.
+type portState struct {
+	mu    sync.Mutex
+	path  string
+	ports map[int]int
+}
+
+// loadPortState reads the state file at path. A missing file is an empty state.
+func loadPortState(path string) (*portState, error) {
+	ports, err := readPortState(path)
+	if err != nil {
+		return nil, err
+	}
+	return &portState{path: path, ports: ports}, nil
+}
+
+// readPortState reads the remote port to client port map from path
+func readPortState(path string) (map[int]int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(map[int]int), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %v", path, err)
+	}
+
+	var saved map[string]int
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+
+	ports := make(map[int]int, len(saved))
+	for remote, clientPort := range saved {
+		remotePort, err := strconv.Atoi(remote)
+		if err != nil || remotePort < 1 || remotePort > 65535 || clientPort < 1 || clientPort > 65535 {
+			continue
+		}
+		ports[remotePort] = clientPort
+	}
+	return ports, nil
+}
+
+// clientPort returns the client port saved for remotePort, 0 if there is none
+func (s *portState) clientPort(remotePort int) int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ports[remotePort]
+}
+
+// save records the client port of remotePort and writes the file if it changed. The file is read
+// again first so entries written by another client sharing it are kept.
+func (s *portState) save(remotePort, clientPort int) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ports[remotePort] == clientPort {
+		return nil
+	}
+
+	ports, err := readPortState(s.path)
+	if err != nil {
+		ports = make(map[int]int)
+	}
+	ports[remotePort] = clientPort
+	s.ports = ports
+
+	saved := make(map[string]int, len(ports))
+	for remote, port := range ports {
+		saved[strconv.Itoa(remote)] = port
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	// Write a temporary file and rename it over the old one, so a crash never leaves half a file
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file %s: %v", s.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file %s: %v", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file %s: %v", s.path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file %s: %v", s.path, err)
+	}
+	return nil
+}
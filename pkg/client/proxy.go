@@ -1,33 +1,100 @@
 package client
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/DevonTM/wg-rp/pkg/api"
 	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/socks"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
 
 	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
+// DefaultServerPort is the default port of the server's REST API within the WireGuard netstack
+const DefaultServerPort = 80
+
+// DefaultDialTimeout is how long the client waits to connect to a local service
+const DefaultDialTimeout = 10 * time.Second
+
+// DefaultReregisterRetries and DefaultReregisterDelay control how a mapping that fails to
+// re-register after a server restart is retried
+const (
+	DefaultReregisterRetries = 3
+	DefaultReregisterDelay   = 2 * time.Second
+)
+
 // ProxyClient manages client-side proxy connections
 type ProxyClient struct {
-	tnet              *netstack.Net
-	serverIP          string
-	clientIP          string
-	mappings          []RouteMapping
-	wg                sync.WaitGroup
-	httpClient        *http.Client
-	heartbeatFailures int
-	maxHeartbeatFails int
-	shutdownChan      chan struct{}
-	serverStartupTime int64
-	bufferPool        *bufferpool.BufferPool
+	tnet               *netstack.Net
+	serverIP           string // server in use, guarded by mu once started
+	primaryServerIP    string
+	fallbackServerIPs  []string // tried in turn when the server in use stops answering
+	currentServerIndex int      // index of serverIP in the primary and fallback servers
+	serverPort         int
+	clientIP           string
+	mu                 sync.Mutex // guards mappings once started, serverStartupTime and the heartbeat state read by Status
+	routesMu           sync.Mutex // serializes AddRoute and RemoveRoute
+	reloadMu           sync.Mutex // serializes routes file reloads, guards routesFile and fileRoutes
+	routesFile         string
+	fileRoutes         []RouteMapping // mappings in effect from routesFile
+	mappings           []RouteMapping
+	wg                 sync.WaitGroup
+	httpClient         *http.Client
+	heartbeatFailures  int
+	lastHeartbeat      time.Time // last successful heartbeat
+	heartbeatInterval  time.Duration
+	fixedHeartbeat     bool          // heartbeatInterval was set with WithHeartbeatInterval, the server's is ignored
+	serverTimeout      time.Duration // client timeout last advertised by the server
+	clock              Clock
+	maxHeartbeatFails  int
+	tunnelWait         time.Duration // how long failing heartbeats wait for a tunnel that isn't up, 0 forever
+	reregisterRetries  int           // retries of a mapping that fails to re-register
+	reregisterDelay    time.Duration // delay before the first retry, doubled for each further one
+	shutdownChan       chan struct{}
+	shutdownOnce       sync.Once
+	muxOnce            sync.Once
+	serverStartupTime  int64
+	serverVersion      string
+	lastEventStartup   int64 // server instance of the last handled event
+	lastEventID        uint64
+	serverShuttingDown bool
+	rtt                rttTracker
+	rttWarnThreshold   time.Duration
+	maxConnsPerSecond  float64
+	maxConnsBurst      int
+	localProbe         string
+	compression        string        // compression asked for on mappings without their own, empty for none
+	dialTimeout        time.Duration // how long connecting to a local service may take
+	resolveMode        ResolveMode   // when hostnames of local targets are resolved
+	resolveTTL         time.Duration // how long a per-connection lookup is reused
+	portState          *portState    // client ports saved across restarts, nil when disabled
+
+	peerStats func() []api.PeerStats // WireGuard peers of the device, nil if unknown
+
+	tunnelHealth func() wireguard.TunnelHealth // health of the WireGuard tunnel, nil if unknown
+
+	forwards    []LocalForward
+	forwardPort int    // forward port advertised by the server, guarded by mu
+	authToken   string // bearer token sent with API requests and forwards, empty for none
+	socksAddr   string // address of the SOCKS5 proxy, empty when disabled
+	socksCreds  *socks.Credentials
+	socksStats  *mappingStats
+
+	localCheck           LocalCheckMode // what to do about routes whose local service can't be reached
+	partialRegistration  bool
+	registrationFailures map[int]error
+	bufferPool           *bufferpool.BufferPool
 }
 
 // NewProxyClient creates a new proxy client
-func NewProxyClient(tnet *netstack.Net, serverIP string, clientIP string, bufferSize int) *ProxyClient {
+func NewProxyClient(tnet *netstack.Net, serverIP string, clientIP string, bufferSize int, opts ...ClientOption) *ProxyClient {
 	// Use Protocols to enable HTTP/2 support
 	protocols := new(http.Protocols)
 	protocols.SetUnencryptedHTTP2(true)
@@ -41,45 +108,128 @@ func NewProxyClient(tnet *netstack.Net, serverIP string, clientIP string, buffer
 		Timeout: 10 * time.Second,
 	}
 
-	return &ProxyClient{
-		tnet:              tnet,
-		serverIP:          serverIP,
-		clientIP:          clientIP,
-		mappings:          make([]RouteMapping, 0),
-		httpClient:        httpClient,
-		maxHeartbeatFails: 3,
-		shutdownChan:      make(chan struct{}),
-		bufferPool:        bufferpool.NewBufferPool(bufferSize),
+	pc := &ProxyClient{
+		tnet:                 tnet,
+		serverIP:             serverIP,
+		primaryServerIP:      serverIP,
+		serverPort:           DefaultServerPort,
+		clientIP:             clientIP,
+		mappings:             make([]RouteMapping, 0),
+		httpClient:           httpClient,
+		heartbeatInterval:    DefaultHeartbeatInterval,
+		clock:                realClock{},
+		maxHeartbeatFails:    3,
+		tunnelWait:           DefaultTunnelWait,
+		reregisterRetries:    DefaultReregisterRetries,
+		reregisterDelay:      DefaultReregisterDelay,
+		rttWarnThreshold:     defaultRTTWarnThreshold,
+		dialTimeout:          DefaultDialTimeout,
+		resolveMode:          ResolveOnce,
+		resolveTTL:           DefaultResolveTTL,
+		registrationFailures: make(map[int]error),
+		shutdownChan:         make(chan struct{}),
+		bufferPool:           bufferpool.NewBufferPool(bufferSize),
 	}
+
+	for _, opt := range opts {
+		opt(pc)
+	}
+
+	return pc
 }
 
-// Start starts all route listeners and registers them with the server
+// Start starts all route listeners and registers them with the server, then starts the local
+// forwards
 func (pc *ProxyClient) Start() error {
-	// Start route listeners
-	for _, mapping := range pc.mappings {
-		pc.wg.Add(1)
-		go func(m RouteMapping) {
-			defer pc.wg.Done()
-			pc.startRouteListener(m)
-		}(mapping)
+	// Find routes that point at nothing before they are exposed
+	if err := pc.checkLocalServices(pc.mappings); err != nil {
+		return err
 	}
 
-	// Register port mappings with server
+	// Start route listeners, then register each listening mapping with the server
+	registered := make([]RouteMapping, 0, len(pc.mappings))
 	for _, mapping := range pc.mappings {
+		if mapping.portRange != "" {
+			continue // registered as a whole below
+		}
+		if err := pc.startRouteListener(&mapping); err != nil {
+			slog.Error("Failed to start route listener", "remote_port", mapping.RemotePort, "client_port", mapping.ClientPort, mapping.nameAttr(), "error", err)
+			if !pc.partialRegistration {
+				return err
+			}
+
+			// Drop the mapping and keep going with the others
+			pc.registrationFailures[mapping.RemotePort] = err
+			continue
+		}
+
 		if err := pc.registerPortMapping(mapping); err != nil {
-			log.Printf("Failed to register port mapping for port %d: %v", mapping.RemotePort, err)
-			return err
+			slog.Error("Failed to register port mapping", "remote_port", mapping.RemotePort, mapping.nameAttr(), "error", err)
+			if !pc.partialRegistration {
+				return err
+			}
+
+			// Drop the mapping and keep going with the others
+			close(mapping.stop)
+			pc.registrationFailures[mapping.RemotePort] = err
+			continue
 		}
+		registered = append(registered, mapping)
 	}
+	for _, group := range portRanges(pc.mappings) {
+		started, err := pc.startPortRange(group)
+		if err != nil {
+			slog.Error("Failed to register port range", "remote_ports", group[0].portRange, "error", err)
+			if !pc.partialRegistration {
+				return err
+			}
 
-	log.Printf("All %d route mappings registered successfully", len(pc.mappings))
+			// Drop the whole range and keep going with the others
+			for _, mapping := range group {
+				pc.registrationFailures[mapping.RemotePort] = err
+			}
+			continue
+		}
+		registered = append(registered, started...)
+	}
 
-	// Start sending heartbeats to the server
+	if len(registered) == 0 && len(pc.mappings) > 0 {
+		return fmt.Errorf("none of the %d route mappings could be registered", len(pc.mappings))
+	}
+
+	if len(registered) < len(pc.mappings) {
+		slog.Warn("Some route mappings could not be registered", "registered", len(registered), "total", len(pc.mappings))
+	} else {
+		slog.Info("All route mappings registered successfully", "count", len(registered))
+	}
+	pc.mu.Lock()
+	pc.mappings = registered
+	pc.mu.Unlock()
+
+	if err := pc.startLocalForwards(); err != nil {
+		return err
+	}
+
+	// Start sending heartbeats to the server, and listen for events it pushes in between
 	pc.startHeartbeat()
+	pc.startEventStream()
 
 	return nil
 }
 
+// Mappings returns the active route mappings
+func (pc *ProxyClient) Mappings() []RouteMapping {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return slices.Clone(pc.mappings)
+}
+
+// RegistrationFailures returns the registration errors of mappings dropped by partial registration, by remote port
+func (pc *ProxyClient) RegistrationFailures() map[int]error {
+	return maps.Clone(pc.registrationFailures)
+}
+
 // Wait waits for all route listeners to finish
 func (pc *ProxyClient) Wait() {
 	pc.wg.Wait()
@@ -90,6 +240,20 @@ func (pc *ProxyClient) WaitForShutdownSignal() <-chan struct{} {
 	return pc.shutdownChan
 }
 
+// Shutdown signals the client to stop, as if the server had died. It is safe to call more than once.
+func (pc *ProxyClient) Shutdown() {
+	pc.shutdownOnce.Do(func() {
+		close(pc.shutdownChan)
+	})
+}
+
+// ReRegister registers every active mapping with the server again, for operators to recover
+// after the WireGuard peer reconnected or the server lost its state. Route listeners and their
+// open connections are left alone; only the server-side records are recreated.
+func (pc *ProxyClient) ReRegister() {
+	pc.reregisterAll()
+}
+
 // IsShuttingDown returns true if the client is shutting down due to server failure
 func (pc *ProxyClient) IsShuttingDown() bool {
 	select {
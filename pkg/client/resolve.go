@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ResolveMode selects when the hostname of a local target is resolved
+type ResolveMode string
+
+const (
+	// ResolveOnce resolves the hostname when the mapping is added and keeps its addresses
+	ResolveOnce ResolveMode = "once"
+	// ResolvePerConnection resolves the hostname for new connections, caching the result for a while
+	ResolvePerConnection ResolveMode = "per-connection"
+)
+
+// DefaultResolveTTL is how long per-connection resolution reuses a successful lookup
+const DefaultResolveTTL = 30 * time.Second
+
+// negativeResolveTTL is how long a failed lookup is reused, so a burst of connections to a
+// hostname that doesn't resolve doesn't send a lookup each
+const negativeResolveTTL = 5 * time.Second
+
+// ParseResolveMode parses a resolution mode given on the command line
+func ParseResolveMode(s string) (ResolveMode, error) {
+	switch mode := ResolveMode(s); mode {
+	case ResolveOnce, ResolvePerConnection:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid resolve mode %q (use %s or %s)", s, ResolveOnce, ResolvePerConnection)
+}
+
+// localResolver resolves and dials the hostname of a mapping's local target. The hostname stays
+// in the mapping's LocalAddr; the resolver holds the addresses it resolved to.
+type localResolver struct {
+	host    string
+	port    string
+	mode    ResolveMode
+	ttl     time.Duration
+	timeout time.Duration // per lookup
+
+	mu      sync.Mutex
+	addrs   []string  // addresses of the last successful lookup
+	err     error     // error of the last lookup if it failed
+	expires time.Time // when the last lookup is done again (per-connection mode)
+	healthy string    // address of the last successful dial, tried first
+}
+
+// newLocalResolver returns the resolver of a local target, or nil if it needs none because it is
+// an IP address or a unix socket. In ResolveOnce mode the hostname is resolved right away.
+func (pc *ProxyClient) newLocalResolver(localAddr string) *localResolver {
+	if isUnixTarget(localAddr) {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+
+	r := &localResolver{
+		host:    host,
+		port:    port,
+		mode:    pc.resolveMode,
+		ttl:     pc.resolveTTL,
+		timeout: pc.dialTimeout,
+	}
+	if r.mode == ResolveOnce {
+		// A failed lookup is retried by the first connection
+		r.lookup(false)
+	}
+	return r
+}
+
+// lookup returns the addresses of the hostname, from the cache unless force is set. In
+// ResolveOnce mode a successful lookup is kept for good.
+func (r *localResolver) lookup(force bool) ([]string, error) {
+	r.mu.Lock()
+	if r.mode == ResolveOnce && r.addrs != nil {
+		addrs := r.addrs
+		r.mu.Unlock()
+		return addrs, nil
+	}
+	if !force && time.Now().Before(r.expires) {
+		addrs, err := r.addrs, r.err
+		r.mu.Unlock()
+		return addrs, err
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, r.host)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		slog.Warn("Failed to resolve local host", "host", r.host, "resolve", r.mode, "error", err)
+		r.err = err
+		r.expires = time.Now().Add(min(negativeResolveTTL, r.ttl))
+		return nil, err
+	}
+	if !slices.Equal(addrs, r.addrs) {
+		slog.Info("Resolved local host", "host", r.host, "addresses", addrs, "resolve", r.mode)
+	}
+	r.addrs, r.err = addrs, nil
+	r.expires = time.Now().Add(r.ttl)
+	return addrs, nil
+}
+
+// dial connects to the local target, giving each address timeout, and returns the address it
+// connected to. In ResolvePerConnection mode a failed dial looks the hostname up again and tries
+// the new addresses.
+func (r *localResolver) dial(timeout time.Duration) (net.Conn, string, error) {
+	addrs, err := r.lookup(false)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, addr, err := r.dialAddrs(addrs, timeout)
+	if err == nil || r.mode != ResolvePerConnection {
+		return conn, addr, err
+	}
+
+	fresh, lookupErr := r.lookup(true)
+	if lookupErr != nil || slices.Equal(fresh, addrs) {
+		return nil, "", err
+	}
+	slog.Debug("Local host resolves to new addresses, retrying", "host", r.host, "addresses", fresh)
+	return r.dialAddrs(fresh, timeout)
+}
+
+// dialAddrs tries the addresses in turn, starting with the last healthy one
+func (r *localResolver) dialAddrs(addrs []string, timeout time.Duration) (net.Conn, string, error) {
+	r.mu.Lock()
+	healthy := r.healthy
+	r.mu.Unlock()
+	if i := slices.Index(addrs, healthy); i > 0 {
+		addrs = append([]string{healthy}, slices.Delete(slices.Clone(addrs), i, i+1)...)
+	}
+
+	var err error
+	for _, ip := range addrs {
+		address := net.JoinHostPort(ip, r.port)
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", address, timeout)
+		r.mu.Lock()
+		if err == nil {
+			r.healthy = ip
+		} else if r.healthy == ip {
+			r.healthy = ""
+		}
+		r.mu.Unlock()
+		if err == nil {
+			return conn, address, nil
+		}
+	}
+	return nil, "", err
+}
+
+// dialLocal connects to a mapping's local target within timeout and returns the address it
+// connected to
+func dialLocal(mapping RouteMapping, timeout time.Duration) (net.Conn, string, error) {
+	if mapping.resolver != nil {
+		return mapping.resolver.dial(timeout)
+	}
+	network, address := localTarget(mapping.LocalAddr)
+	conn, err := net.DialTimeout(network, address, timeout)
+	return conn, address, err
+}
@@ -1,39 +1,107 @@
 package client
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"math/rand/v2"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/compress"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+	"github.com/DevonTM/wg-rp/pkg/logger"
+	"github.com/DevonTM/wg-rp/pkg/schedule"
+	"github.com/DevonTM/wg-rp/pkg/utils"
 )
 
 // RouteMapping represents a local to remote port mapping
 type RouteMapping struct {
-	LocalAddr  string // Format: ip:port (e.g., "127.0.0.1:8080")
+	LocalAddr  string // Format: ip:port (e.g., "127.0.0.1:8080"), or unix:path for a unix socket
 	RemotePort int    // Port to expose on server
-	ClientPort int    // Random port client listens on
+	ClientPort int    // Port the client listens on (0 until bound, unless pinned)
+
+	Schedule            string // Daily windows the server accepts connections in (empty = always)
+	ScheduleCloseActive bool   // Have the server close open connections when the window closes
+
+	MaxConnsPerSecond float64           // Rate limit for this mapping (0 = the client-wide limit)
+	MaxConnsBurst     int               // Burst for this mapping's rate limit (0 = derived from the rate)
+	MaxHalfOpen       int               // Connections the server may set up at once for this mapping (0 = server default)
+	Labels            map[string]string // Free-form labels for operators, shown in the server's listings
+	TunnelDialTimeout time.Duration     // How long the server waits to connect to this mapping (0 = server default)
+	WriteDeadline     time.Duration     // How long the server's writes to external connections may block (0 = no limit)
+	SampleRate        *float64          // Fraction of connections, 0 to 1, the server logs the open and close of (nil = all)
+	Name              string            // Service name shown in logs and listings on both sides, need not be unique
+	TTL               time.Duration     // Have the server remove the mapping this long after registering it (0 = never)
+	HTTPHostRewrite   string            // Host header the server sets on forwarded HTTP requests (empty = unchanged)
+	ProxyProtocol     bool              // Have the server send each connection's addresses ahead of its data in a PROXY protocol v2 header
+	ProxyProtoTLVs    []api.TLVEntry    // Application data the server adds to the PROXY protocol header
+	Visibility        string            // api.VisibilityTunnel to expose the port only to WireGuard peers (empty = public)
+	Hostname          string            // Route HTTP for this hostname on a remote port shared with other hostnames (empty = own the port)
+	SNI               bool              // Route TLS connections for Hostname by their server name instead of HTTP requests
+	TLSCert           string            // Server certificate, by name, the server terminates TLS with (empty = raw TCP)
+	TLSALPN           []string          // Protocols the local service speaks, offered to TLS clients by the server
+	Compression       string            // Compress the tunnel leg: api.CompressionNone, CompressionSnappy or CompressionZstd (empty = client-wide setting)
+
+	stats     *mappingStats
+	stop      chan struct{}  // closed to stop this mapping's listener
+	savedPort int            // client port from the state file, tried before a free one
+	portRange string         // remote range of a range route, e.g. "6000..6010", registered as a whole
+	resolver  *localResolver // resolves a hostname in LocalAddr, nil for IP addresses and unix sockets
 }
 
-// startRouteListener starts a listener for a specific route mapping
-func (pc *ProxyClient) startRouteListener(mapping RouteMapping) {
-	listener, err := pc.tnet.ListenTCP(&net.TCPAddr{Port: mapping.ClientPort})
+// startRouteListener binds the listener of a route mapping and serves it in the background.
+// Without a pinned client port the port saved in the state file is reused if it's free, otherwise
+// the netstack assigns a free one, which is stored in the mapping.
+func (pc *ProxyClient) startRouteListener(mapping *RouteMapping) error {
+	port := mapping.ClientPort
+	if port == 0 && mapping.savedPort != 0 {
+		port = mapping.savedPort
+	}
+	listener, err := pc.tnet.ListenTCP(&net.TCPAddr{Port: port})
+	if err != nil && port != mapping.ClientPort {
+		slog.Debug("Saved client port is not available, using a free one",
+			"remote_port", mapping.RemotePort, "client_port", port, "error", err)
+		listener, err = pc.tnet.ListenTCP(&net.TCPAddr{Port: 0})
+	}
 	if err != nil {
-		log.Fatalf("Failed to listen on client port %d: %v", mapping.ClientPort, err)
+		// A pinned port is never swapped for another one, the user relies on it being fixed
+		if mapping.ClientPort != 0 {
+			return fmt.Errorf("failed to listen on pinned client port %d for remote port %d (remove @client_port to use a free port): %v",
+				mapping.ClientPort, mapping.RemotePort, err)
+		}
+		return fmt.Errorf("failed to listen on a free client port: %v", err)
 	}
-	defer listener.Close()
+	mapping.ClientPort = listener.Addr().(*net.TCPAddr).Port
+
+	slog.Info("Route listener started", "client_port", mapping.ClientPort, "local_addr", mapping.LocalAddr, mapping.nameAttr())
+
+	pc.wg.Add(1)
+	go func(m RouteMapping) {
+		defer pc.wg.Done()
+		pc.serveRouteListener(listener, m)
+	}(*mapping)
+
+	return nil
+}
 
-	log.Printf("Route listener started on client port %d, forwarding to %s",
-		mapping.ClientPort, mapping.LocalAddr)
+// serveRouteListener accepts connections for a route mapping until it is stopped
+func (pc *ProxyClient) serveRouteListener(listener net.Listener, mapping RouteMapping) {
+	defer listener.Close()
 
 	cancel := make(chan struct{})
 
 	go func() {
-		<-pc.shutdownChan
-		listener.Close()
+		select {
+		case <-pc.shutdownChan:
+		case <-mapping.stop:
+		}
 		close(cancel)
+		listener.Close()
 	}()
 
 	for {
@@ -43,8 +111,10 @@ func (pc *ProxyClient) startRouteListener(mapping RouteMapping) {
 		default:
 			conn, err := listener.Accept()
 			if err != nil {
-				if !pc.IsShuttingDown() {
-					log.Printf("Failed to accept connection: %v", err)
+				select {
+				case <-cancel:
+				default:
+					slog.Error("Failed to accept connection", "client_port", mapping.ClientPort, "error", err)
 				}
 				continue
 			}
@@ -58,122 +128,610 @@ func (pc *ProxyClient) startRouteListener(mapping RouteMapping) {
 func (pc *ProxyClient) handleRouteConnection(tunnelConn net.Conn, mapping RouteMapping) {
 	defer tunnelConn.Close()
 
+	// Decompress what the server compressed, as agreed at registration
+	if algorithm := mapping.stats.compression.Load(); algorithm != nil {
+		compressed, err := compress.NewConn(tunnelConn, *algorithm)
+		if err != nil {
+			slog.Error("Failed to set up compression", "remote_port", mapping.RemotePort, "compression", *algorithm, "error", err)
+			return
+		}
+		tunnelConn = compressed
+	}
+
 	// Connect to local service
-	localConn, err := net.Dial("tcp", mapping.LocalAddr)
+	localConn, dialedAddr, err := dialLocal(mapping, pc.dialTimeout)
 	if err != nil {
-		log.Printf("Failed to connect to local service %s: %v", mapping.LocalAddr, err)
+		mapping.stats.dialFailures.Add(1)
+		mapping.stats.recordError(err)
+		slog.Error("Failed to connect to local service", "local_addr", mapping.LocalAddr, mapping.nameAttr(), "error", err)
 		return
 	}
 	defer localConn.Close()
 
-	log.Printf("Established route connection: %s <- %s <- %s <- remote:%d",
-		mapping.LocalAddr, tunnelConn.LocalAddr(), tunnelConn.RemoteAddr(), mapping.RemotePort)
-
-	// Bidirectional copy
-	var wg sync.WaitGroup
-	wg.Add(2)
+	mapping.stats.activeConns.Add(1)
+	defer mapping.stats.activeConns.Add(-1)
 
+	// Close the connection when its mapping is removed, leaving other mappings alone
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		defer wg.Done()
-		pc.bufferPool.CopyWithBuffer(localConn, tunnelConn)
-		localConn.Close()
+		select {
+		case <-mapping.stop:
+			tunnelConn.Close()
+			localConn.Close()
+		case <-done:
+		}
 	}()
 
-	go func() {
-		defer wg.Done()
-		pc.bufferPool.CopyWithBuffer(tunnelConn, localConn)
-		tunnelConn.Close()
-	}()
+	slog.Debug("Established route connection",
+		"local_addr", mapping.LocalAddr, "tunnel_local", tunnelConn.LocalAddr(),
+		"tunnel_remote", tunnelConn.RemoteAddr(), "remote_port", mapping.RemotePort)
+
+	start := time.Now()
+	bytesIn, bytesOut, err := pc.relay(tunnelConn, localConn, mapping.stats)
+
+	slog.Log(context.Background(), closeLogLevel(err), "Route connection closed",
+		"local_addr", mapping.LocalAddr, "tunnel_local", tunnelConn.LocalAddr(),
+		"tunnel_remote", tunnelConn.RemoteAddr(), "remote_port", mapping.RemotePort,
+		"dialed_addr", dialedAddr, "bytes_in", bytesIn, "bytes_out", bytesOut,
+		"duration", time.Since(start), relayErrorAttr(err))
+}
+
+// relay copies between a tunnel connection and a local one until both directions are done,
+// passing a half-close on to the other side. It adds the traffic to stats and counts the error
+// the relay ended with, if any, returning the bytes read from and written to the tunnel and that
+// error.
+func (pc *ProxyClient) relay(tunnelConn, localConn net.Conn, stats *mappingStats) (bytesIn, bytesOut uint64, err error) {
+	var fromTunnel, toTunnel bufferpool.Direction
+	if slog.Default().Enabled(context.Background(), logger.LevelTrace) {
+		fromTunnel.Dst = &traceWriter{w: localConn, direction: "from_tunnel", tunnelRemote: tunnelConn.RemoteAddr()}
+		toTunnel.Dst = &traceWriter{w: tunnelConn, direction: "to_tunnel", tunnelRemote: tunnelConn.RemoteAddr()}
+	}
+	result := pc.bufferPool.RelayWith(tunnelConn, localConn, fromTunnel, toTunnel)
+	bytesIn, bytesOut = uint64(result.AToB), uint64(result.BToA)
+	stats.bytesRelayed.Add(bytesIn + bytesOut)
+	if err = result.Err(); err != nil {
+		stats.relayErrors.Add(conntrack.ClassifyError(err))
+	}
+	return bytesIn, bytesOut, err
+}
+
+// closeLogLevel is the level the close of a connection is logged at: debug, or info if it ended
+// with an error
+func closeLogLevel(err error) slog.Level {
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+// traceWriter logs the size of each write of a relay direction at logger.LevelTrace
+type traceWriter struct {
+	w            io.Writer
+	direction    string
+	tunnelRemote net.Addr
+}
+
+// Write writes to the underlying writer and logs how much was written
+func (t *traceWriter) Write(b []byte) (int, error) {
+	n, err := t.w.Write(b)
+	slog.Log(context.Background(), logger.LevelTrace, "Relayed data",
+		"direction", t.direction, "tunnel_remote", t.tunnelRemote, "bytes", n)
+	return n, err
+}
+
+// relayErrorAttr describes the error a relay ended with in log lines, and adds nothing if it
+// ended cleanly
+func relayErrorAttr(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	return slog.Group("relay_error", "class", conntrack.ClassifyError(err), "error", err)
+}
+
+// validateVisibility checks the visibility of a route, empty for the default
+func validateVisibility(visibility string) error {
+	if visibility != "" && visibility != api.VisibilityPublic && visibility != api.VisibilityTunnel {
+		return fmt.Errorf("visibility %q is neither %s nor %s", visibility, api.VisibilityPublic, api.VisibilityTunnel)
+	}
+	return nil
+}
 
-	wg.Wait()
-	log.Printf("Route connection closed: %s <- %s <- %s <- remote:%d",
-		mapping.LocalAddr, tunnelConn.LocalAddr(), tunnelConn.RemoteAddr(), mapping.RemotePort)
+// validateRouteHostname checks the hostname of a route routed by hostname. Only SNI routes may use
+// api.SNIDefaultHost, for TLS connections without a usable server name.
+func validateRouteHostname(hostname string, sni bool) error {
+	if sni && hostname == api.SNIDefaultHost {
+		return nil
+	}
+	return utils.ValidateRoutedHostname(hostname)
+}
+
+// nameAttr names the mapping in log lines, and adds nothing if it has no name
+func (m RouteMapping) nameAttr() slog.Attr {
+	if m.Name == "" {
+		return slog.Attr{}
+	}
+	return slog.String("name", m.Name)
+}
+
+// warnDuplicateName warns if mapping shares its name with one of mappings. Names need not be
+// unique, but a shared name makes logs and listings ambiguous.
+func warnDuplicateName(mappings []RouteMapping, mapping RouteMapping) {
+	if mapping.Name == "" {
+		return
+	}
+	for _, other := range mappings {
+		if other.Name == mapping.Name && other.RemotePort != mapping.RemotePort &&
+			(mapping.portRange == "" || other.portRange != mapping.portRange) {
+			slog.Warn("Route mapping name is used more than once", "name", mapping.Name,
+				"remote_port", mapping.RemotePort, "other_remote_port", other.RemotePort)
+			return
+		}
+	}
 }
 
-// ParseRouteMappings parses route mapping strings in format "local_ip:local_port-remote_port"
+// DefaultLocalHost is the local host of routes that give only a port, e.g. "8080" or ":8080-80"
+const DefaultLocalHost = "127.0.0.1"
+
+// routeFormat is the route mapping syntax shown in errors
+const routeFormat = "[name=service:][visibility=tunnel:][host=hostname:|sni=hostname:][local_ip:]local_port[-remote_port][@client_port]"
+
+// ParseRouteMappings parses route mapping strings in format
+// "[name=service:][visibility=tunnel:][host=hostname:|sni=hostname:]local_ip:local_port-remote_port[@client_port]",
+// where the client port may also be written as "@client_port=port". A host prefix routes HTTP
+// requests for that hostname on a remote port the server shares between hostnames, an sni prefix
+// routes TLS connections by their server name the same way. Shorter forms are accepted for the
+// common cases:
+//
+//	8080          127.0.0.1:8080 exposed on remote port 8080
+//	8080-9090     127.0.0.1:8080 exposed on remote port 9090
+//	:8080-80      127.0.0.1:8080 exposed on remote port 80
+//
+// IPv6 local addresses must be bracketed, e.g. "[::1]:8080-80".
 func ParseRouteMappings(routeFlags []string) ([]RouteMapping, error) {
 	var mappings []RouteMapping
+	type portUse struct {
+		flag    int // index in routeFlags
+		mapping RouteMapping
+	}
+	remotePorts := make(map[int][]portUse)
+	clientPorts := make(map[int]string)
+
+	// Reject a remote port given more than once, naming both flags, unless the mappings share it
+	// by hostname
+	checkRemotePort := func(i int, m RouteMapping) error {
+		for _, use := range remotePorts[m.RemotePort] {
+			if sharesPort(use.mapping, m) {
+				continue
+			}
+			if routeFlags[use.flag] == routeFlags[i] {
+				return fmt.Errorf("route mapping %s is given more than once", routeFlags[i])
+			}
+			return fmt.Errorf("remote port %d is mapped by both %s and %s", m.RemotePort, routeFlags[use.flag], routeFlags[i])
+		}
+		remotePorts[m.RemotePort] = append(remotePorts[m.RemotePort], portUse{i, m})
+		return nil
+	}
 
-	for _, mapping := range routeFlags {
-		// Split by "-" to separate local and remote parts
-		parts := strings.SplitN(mapping, "-", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid route mapping format: %s. Expected format: local_ip:local_port-remote_port", mapping)
+	for i, mapping := range routeFlags {
+		// Take off an optional "name=service:" prefix
+		var name string
+		route := mapping
+		if rest, named := strings.CutPrefix(mapping, "name="); named {
+			name, route, _ = strings.Cut(rest, ":")
+			if err := utils.ValidateMappingName(name); err != nil {
+				return nil, err
+			}
 		}
 
-		localPart := parts[0]
-		remotePortStr := parts[1]
+		// Take off an optional "visibility=tunnel:" prefix
+		var visibility string
+		if rest, ok := strings.CutPrefix(route, "visibility="); ok {
+			visibility, route, _ = strings.Cut(rest, ":")
+			if err := validateVisibility(visibility); err != nil {
+				return nil, fmt.Errorf("invalid route mapping %s: %v", mapping, err)
+			}
+		}
 
-		// Parse local part (ip:port)
-		localHost, localPort, err := net.SplitHostPort(localPart)
-		if err != nil {
-			return nil, fmt.Errorf("invalid local address format: %s. Expected format: ip:port", localPart)
+		// Take off an optional "host=hostname:" or "sni=hostname:" prefix
+		var hostname string
+		rest, sni := strings.CutPrefix(route, "sni=")
+		if !sni {
+			rest, _ = strings.CutPrefix(route, "host=")
+		}
+		if rest != route {
+			hostname, route, _ = strings.Cut(rest, ":")
+			hostname = strings.ToLower(hostname)
+			if err := validateRouteHostname(hostname, sni); err != nil {
+				return nil, fmt.Errorf("invalid route mapping %s: %v", mapping, err)
+			}
+		}
+
+		route, clientPortStr, pinned := strings.Cut(route, "@")
+
+		// Expand port ranges into one mapping per port
+		if strings.Contains(route, "..") && !isUnixTarget(route) {
+			if hostname != "" {
+				return nil, fmt.Errorf("invalid route mapping %s: a port range can't be routed by hostname", mapping)
+			}
+			if pinned {
+				return nil, fmt.Errorf("invalid route mapping %s: client ports can't be pinned for a port range", mapping)
+			}
+			expanded, err := parseRangeRoute(route)
+			if err != nil {
+				return nil, fmt.Errorf("invalid route mapping %s: %v. Expected format: [name=service:][visibility=tunnel:][local_ip:]first..last[-first..last]", mapping, err)
+			}
+			for k := range expanded {
+				expanded[k].Name = name
+				expanded[k].Visibility = visibility
+				if err := checkRemotePort(i, expanded[k]); err != nil {
+					return nil, err
+				}
+			}
+			mappings = append(mappings, expanded...)
+			continue
 		}
 
-		// Parse remote port
-		remotePort, err := strconv.Atoi(remotePortStr)
+		localAddr, remotePort, err := splitRoute(route)
 		if err != nil {
-			return nil, fmt.Errorf("invalid remote port: %s", remotePortStr)
+			return nil, fmt.Errorf("invalid route mapping %s: %v. Expected format: %s", mapping, err, routeFormat)
+		}
+
+		// Parse optional client port, given as "@port" or "@client_port=port"
+		clientPort := 0
+		if pinned {
+			clientPortStr = strings.TrimPrefix(clientPortStr, "client_port=")
+			clientPort, err = strconv.Atoi(clientPortStr)
+			if err != nil || clientPort < 1 || clientPort > 65535 {
+				return nil, fmt.Errorf("invalid client port: %s", clientPortStr)
+			}
+			if other, used := clientPorts[clientPort]; used {
+				return nil, fmt.Errorf("client port %d is used by both %s and %s", clientPort, other, mapping)
+			}
+			clientPorts[clientPort] = mapping
 		}
 
-		localAddr := net.JoinHostPort(localHost, localPort)
-		mappings = append(mappings, RouteMapping{
+		routeMapping := RouteMapping{
 			LocalAddr:  localAddr,
 			RemotePort: remotePort,
-		})
+			ClientPort: clientPort,
+			Name:       name,
+			Visibility: visibility,
+			Hostname:   hostname,
+			SNI:        sni,
+		}
+		if err := checkRemotePort(i, routeMapping); err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, routeMapping)
 	}
 
 	return mappings, nil
 }
 
-// AddRouteMapping adds a route mapping configuration
-func (pc *ProxyClient) AddRouteMapping(localAddr string, remotePort int) {
-	// Generate a random port for the client listener
-	clientPort := pc.generateRandomPort()
+// splitRoute splits a route without its name and client port into the local address and the
+// remote port. A unix socket target, "/path" or "unix:path", is split at the last "-" and needs
+// a remote port. A route without a "-" is a bare port exposed on the same remote port. Otherwise it
+// is split at the last "-" whose sides both parse, so hostnames and service names may contain
+// dashes; the error is the one from splitting at the last "-".
+func splitRoute(route string) (string, int, error) {
+	if isUnixTarget(route) {
+		i := strings.LastIndex(route, "-")
+		if i < 0 {
+			return "", 0, fmt.Errorf("%q was read as a unix socket, which needs a remote port, e.g. /run/app.sock-8080", route)
+		}
+		localAddr, err := parseUnixTarget(route[:i])
+		if err != nil {
+			return "", 0, err
+		}
+		remotePort, err := parsePort(route[i+1:])
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid remote port: %v", err)
+		}
+		return localAddr, remotePort, nil
+	}
+
+	if !strings.Contains(route, "-") {
+		port, err := parsePort(route)
+		if err != nil {
+			return "", 0, fmt.Errorf("%q has no \"-\", so it was read as a port: %v", route, err)
+		}
+		return net.JoinHostPort(DefaultLocalHost, strconv.Itoa(port)), port, nil
+	}
+
+	var firstErr error
+	for i := strings.LastIndex(route, "-"); i >= 0; i = strings.LastIndex(route[:i], "-") {
+		localAddr, err := parseLocalAddr(route[:i])
+		if err == nil {
+			var remotePort int
+			remotePort, err = parsePort(route[i+1:])
+			if err == nil {
+				return localAddr, remotePort, nil
+			}
+			err = fmt.Errorf("invalid remote port: %v", err)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", 0, firstErr
+}
+
+// parsePort parses a port number between 1 and 65535 or a TCP service name such as "https",
+// which is looked up in the system's services database
+func parsePort(s string) (int, error) {
+	port, atoiErr := strconv.Atoi(s)
+	if atoiErr == nil {
+		if port < 1 || port > 65535 {
+			return 0, fmt.Errorf("port %d is not between 1 and 65535", port)
+		}
+		return port, nil
+	}
+
+	port, lookupErr := net.LookupPort("tcp", s)
+	if lookupErr != nil || port < 1 {
+		if lookupErr == nil {
+			lookupErr = fmt.Errorf("no port")
+		}
+		return 0, fmt.Errorf("%q is neither a port number (%v) nor a known service name (%v)", s, atoiErr, lookupErr)
+	}
+	return port, nil
+}
+
+// parseLocalAddr parses the local part of a route: "ip:port", ":port" or a bare port, where
+// the latter two use DefaultLocalHost. Ports may be service names; the address returned always
+// has a numeric port. Errors say which form s was taken for.
+func parseLocalAddr(s string) (string, error) {
+	if !strings.Contains(s, ":") {
+		port, err := parsePort(s)
+		if err != nil {
+			return "", fmt.Errorf("local address %q has no host, so it was read as a port: %v", s, err)
+		}
+		return net.JoinHostPort(DefaultLocalHost, strconv.Itoa(port)), nil
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		if strings.Count(s, ":") > 1 && !strings.HasPrefix(s, "[") {
+			return "", fmt.Errorf("local address %q was read as ip:port, but IPv6 addresses must be enclosed in brackets, e.g. [::1]:8080", s)
+		}
+		return "", fmt.Errorf("local address %q was read as ip:port: %v", s, err)
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return "", fmt.Errorf("local address %q was read as ip:port: %v", s, err)
+	}
+	if host == "" {
+		host = DefaultLocalHost
+	} else if err := utils.ValidateHost(host); err != nil {
+		return "", fmt.Errorf("local address %q was read as ip:port: %v", s, err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
 
-	mapping := RouteMapping{
+// AddRouteMapping adds a route mapping configuration. With a clientPort of 0 the listener gets
+// a free port when it starts; any other port is used as is if no other mapping pins it.
+func (pc *ProxyClient) AddRouteMapping(localAddr string, remotePort int, clientPort int) error {
+	return pc.AddRouteMappingConfig(RouteMapping{
 		LocalAddr:  localAddr,
 		RemotePort: remotePort,
 		ClientPort: clientPort,
+	})
+}
+
+// AddRouteMappingConfig adds a route mapping configuration with all of its options, e.g. from a
+// routes file. It must be called before Start.
+func (pc *ProxyClient) AddRouteMappingConfig(mapping RouteMapping) error {
+	if err := pc.checkRouteConflicts(pc.mappings, mapping); err != nil {
+		return err
+	}
+	warnDuplicateName(pc.mappings, mapping)
+
+	mapping.stats = &mappingStats{}
+	mapping.stop = make(chan struct{})
+	mapping.resolver = pc.newLocalResolver(mapping.LocalAddr)
+	if mapping.ClientPort == 0 {
+		mapping.savedPort = pc.portState.clientPort(mapping.RemotePort)
 	}
 
 	pc.mappings = append(pc.mappings, mapping)
-	log.Printf("Added route mapping: %s <- %s:%d <- remote:%d",
-		localAddr, pc.clientIP, clientPort, remotePort)
+	if mapping.ClientPort != 0 {
+		slog.Info("Added route mapping",
+			"local_addr", mapping.LocalAddr, "client_ip", pc.clientIP, "client_port", mapping.ClientPort, "remote_port", mapping.RemotePort, mapping.nameAttr())
+	} else {
+		slog.Info("Added route mapping", "local_addr", mapping.LocalAddr, "client_ip", pc.clientIP, "remote_port", mapping.RemotePort, mapping.nameAttr())
+	}
+	return nil
 }
 
-// Cleanup removes all port mappings from the server
-func (pc *ProxyClient) Cleanup() error {
-	log.Printf("Cleaning up %d port mappings...", len(pc.mappings))
+// routeKey identifies a route mapping: its remote port, its visibility and, on a port shared by
+// hostname, its hostname
+type routeKey struct {
+	port       int
+	hostname   string
+	visibility string
+}
 
-	var lastErr error
-	for _, mapping := range pc.mappings {
-		if err := pc.deletePortMapping(mapping.RemotePort); err != nil {
-			log.Printf("Failed to delete port mapping for port %d: %v", mapping.RemotePort, err)
-			lastErr = err
+func (m RouteMapping) key() routeKey {
+	return routeKey{port: m.RemotePort, hostname: m.Hostname, visibility: m.visibility()}
+}
+
+// visibility returns where the mapping's remote port is exposed, api.VisibilityPublic or api.VisibilityTunnel
+func (m RouteMapping) visibility() string {
+	if m.Visibility == api.VisibilityTunnel {
+		return api.VisibilityTunnel
+	}
+	return api.VisibilityPublic
+}
+
+// matches reports whether the mapping is on remotePort and, if hostname and visibility aren't
+// empty, routes hostname with that visibility
+func (m RouteMapping) matches(remotePort int, hostname, visibility string) bool {
+	return m.RemotePort == remotePort && (hostname == "" || m.Hostname == hostname) &&
+		(visibility == "" || m.visibility() == visibility)
+}
+
+// sharesPort reports whether two mappings may use the same remote port. The server listens on a
+// public and a tunnel-only port separately, and within each shares a port between HTTP or SNI
+// mappings, each for its own hostname.
+func sharesPort(a, b RouteMapping) bool {
+	if a.visibility() != b.visibility() {
+		return true
+	}
+	return a.Hostname != "" && b.Hostname != "" && a.Hostname != b.Hostname && a.SNI == b.SNI
+}
+
+// checkRouteConflicts returns an error if mapping uses a remote port or pinned client port of another mapping
+func (pc *ProxyClient) checkRouteConflicts(mappings []RouteMapping, mapping RouteMapping) error {
+	for _, other := range mappings {
+		if other.RemotePort == mapping.RemotePort && !sharesPort(other, mapping) {
+			if other.Hostname != "" && other.Hostname == mapping.Hostname {
+				return fmt.Errorf("hostname %s on remote port %d is already mapped to %s", mapping.Hostname, mapping.RemotePort, other.LocalAddr)
+			}
+			return fmt.Errorf("remote port %d is already mapped to %s", mapping.RemotePort, other.LocalAddr)
+		}
+		if mapping.ClientPort != 0 && other.ClientPort == mapping.ClientPort {
+			return fmt.Errorf("client port %d is already used by the mapping for remote port %d", mapping.ClientPort, other.RemotePort)
 		}
 	}
+	return nil
+}
 
-	return lastErr
+// AddRoute adds a route mapping to a started client: it starts the route listener and registers
+// the mapping with the server. Mappings added before Start use AddRouteMapping instead.
+func (pc *ProxyClient) AddRoute(mapping RouteMapping) error {
+	pc.routesMu.Lock()
+	defer pc.routesMu.Unlock()
+
+	if err := pc.checkRouteConflicts(pc.Mappings(), mapping); err != nil {
+		return err
+	}
+	warnDuplicateName(pc.Mappings(), mapping)
+
+	mapping.stats = &mappingStats{}
+	mapping.stop = make(chan struct{})
+	mapping.resolver = pc.newLocalResolver(mapping.LocalAddr)
+	if mapping.ClientPort == 0 {
+		mapping.savedPort = pc.portState.clientPort(mapping.RemotePort)
+	}
+
+	if err := pc.checkLocalServices([]RouteMapping{mapping}); err != nil {
+		return err
+	}
+	if err := pc.startRouteListener(&mapping); err != nil {
+		return err
+	}
+
+	// Make the mapping known before registering so multiplexed streams for it can be served
+	pc.mu.Lock()
+	pc.mappings = append(pc.mappings, mapping)
+	pc.mu.Unlock()
+
+	if err := pc.registerPortMapping(mapping); err != nil {
+		pc.dropMapping(mapping.RemotePort, mapping.Hostname, mapping.visibility())
+		return err
+	}
+
+	slog.Info("Added route mapping at runtime",
+		"local_addr", mapping.LocalAddr, "client_port", mapping.ClientPort, "remote_port", mapping.RemotePort, mapping.nameAttr())
+	return nil
 }
 
-// generateRandomPort generates a random port number for internal use
-func (pc *ProxyClient) generateRandomPort() int {
-	for {
-		// Use ports in range 10000-60000 to avoid conflicts
-		port := 10000 + rand.IntN(50000)
-
-		// Check if this port is already used in existing mappings
-		used := false
-		for _, mapping := range pc.mappings {
-			if mapping.ClientPort == port {
-				used = true
-				break
+// RemoveRoute removes a route mapping from a started client: it deletes the mapping on the server,
+// stops the route listener and closes the mapping's open connections. Other mappings are not affected.
+// On a port shared by hostname, or mapped both publicly and in the tunnel, all of the client's
+// mappings on it are removed.
+func (pc *ProxyClient) RemoveRoute(remotePort int) error {
+	return pc.removeRoute(remotePort, "", "")
+}
+
+// removeRoute removes the route mappings on remotePort, only those for hostname and with visibility
+// if they aren't empty
+func (pc *ProxyClient) removeRoute(remotePort int, hostname, visibility string) error {
+	pc.routesMu.Lock()
+	defer pc.routesMu.Unlock()
+
+	var removed []RouteMapping
+	for _, m := range pc.Mappings() {
+		if m.matches(remotePort, hostname, visibility) {
+			removed = append(removed, m)
+		}
+	}
+	if len(removed) == 0 {
+		return fmt.Errorf("no route mapping for remote port %d", remotePort)
+	}
+
+	// A port of a range removes the entire range
+	portRange := removed[0].portRange
+	if portRange != "" {
+		removed = removed[:0]
+		for _, m := range pc.Mappings() {
+			if m.portRange == portRange {
+				removed = append(removed, m)
 			}
 		}
+	}
+
+	// Remove locally even if the server call fails; the server expires the mapping on its own
+	var failed []int
+	for _, m := range removed {
+		if err := pc.deletePortMapping(m.RemotePort, m.Hostname, m.visibility()); err != nil {
+			slog.Warn("Failed to delete port mapping", "remote_port", m.RemotePort, "error", err)
+			failed = append(failed, m.RemotePort)
+		}
+		pc.dropMapping(m.RemotePort, m.Hostname, m.visibility())
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("removed locally, but the server did not delete port %s", formatPorts(failed))
+	}
+
+	if portRange != "" {
+		slog.Info("Removed port range at runtime", "remote_ports", portRange)
+	} else {
+		slog.Info("Removed route mapping at runtime", "remote_port", remotePort)
+	}
+	return nil
+}
+
+// SetRouteSchedule limits a route mapping to the daily windows in spec, e.g.
+// "Mon-Fri 09:00-17:00 Europe/Berlin". The server enforces the schedule.
+func (pc *ProxyClient) SetRouteSchedule(remotePort int, spec string, closeActive bool) error {
+	if _, err := schedule.Parse(spec); err != nil {
+		return err
+	}
+
+	// On a port shared by hostname the schedule applies to each of the client's mappings on it
+	found := false
+	for i := range pc.mappings {
+		if pc.mappings[i].RemotePort == remotePort {
+			pc.mappings[i].Schedule = spec
+			pc.mappings[i].ScheduleCloseActive = closeActive
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no route mapping for remote port %d", remotePort)
+	}
+	return nil
+}
+
+// Cleanup removes all port mappings from the server
+func (pc *ProxyClient) Cleanup() error {
+	return pc.cleanupServer(pc.currentServerIP())
+}
+
+// cleanupServer removes all port mappings from the server with the given IP
+func (pc *ProxyClient) cleanupServer(serverIP string) error {
+	mappings := pc.Mappings()
+	slog.Info("Cleaning up port mappings", "server_ip", serverIP, "count", len(mappings))
 
-		if !used {
-			return port
+	var lastErr error
+	for _, mapping := range mappings {
+		if err := pc.deletePortMappingFrom(serverIP, mapping.RemotePort, mapping.Hostname, mapping.visibility()); err != nil {
+			slog.Error("Failed to delete port mapping", "remote_port", mapping.RemotePort, mapping.nameAttr(), "error", err)
+			lastErr = err
 		}
 	}
+
+	return lastErr
 }
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// parsedRoute is the part of a RouteMapping set by ParseRouteMappings
+type parsedRoute struct {
+	LocalAddr  string
+	RemotePort int
+	ClientPort int
+	Name       string
+	Visibility string
+	Hostname   string
+	SNI        bool
+}
+
+func parsed(m RouteMapping) parsedRoute {
+	return parsedRoute{m.LocalAddr, m.RemotePort, m.ClientPort, m.Name, m.Visibility, m.Hostname, m.SNI}
+}
+
+func TestParseRouteMappings(t *testing.T) {
+	tests := []struct {
+		route string
+		want  parsedRoute
+	}{
+		// Shorthands
+		{"8080", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 8080}},
+		{"8080-9090", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 9090}},
+		{":8080-80", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 80}},
+
+		// Full form
+		{"127.0.0.1:8080-80", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 80}},
+		{"192.168.1.10:3000-3000", parsedRoute{LocalAddr: "192.168.1.10:3000", RemotePort: 3000}},
+		{"localhost:8080-80", parsedRoute{LocalAddr: "localhost:8080", RemotePort: 80}},
+		{"my-host:8080-80", parsedRoute{LocalAddr: "my-host:8080", RemotePort: 80}},
+		{"db-1.internal:5432-15432", parsedRoute{LocalAddr: "db-1.internal:5432", RemotePort: 15432}},
+
+		// Bracketed IPv6, with colons and dashes that aren't separators
+		{"[::1]:8080-80", parsedRoute{LocalAddr: "[::1]:8080", RemotePort: 80}},
+		{"[fd00::2]:443-8443", parsedRoute{LocalAddr: "[fd00::2]:443", RemotePort: 8443}},
+		{"[::ffff:127.0.0.1]:22-2222", parsedRoute{LocalAddr: "[::ffff:127.0.0.1]:22", RemotePort: 2222}},
+
+		// Service names
+		{"https", parsedRoute{LocalAddr: "127.0.0.1:443", RemotePort: 443}},
+		{"8443-https", parsedRoute{LocalAddr: "127.0.0.1:8443", RemotePort: 443}},
+		{"127.0.0.1:ssh-2222", parsedRoute{LocalAddr: "127.0.0.1:22", RemotePort: 2222}},
+
+		// Pinned client ports
+		{"8080@42001", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 8080, ClientPort: 42001}},
+		{"127.0.0.1:8080-80@client_port=42001", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 80, ClientPort: 42001}},
+		{"[::1]:8080-80@42001", parsedRoute{LocalAddr: "[::1]:8080", RemotePort: 80, ClientPort: 42001}},
+
+		// Prefixes
+		{"name=web:8080-80", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 80, Name: "web"}},
+		{"visibility=tunnel:5432", parsedRoute{LocalAddr: "127.0.0.1:5432", RemotePort: 5432, Visibility: "tunnel"}},
+		{"name=db:visibility=public:5432", parsedRoute{LocalAddr: "127.0.0.1:5432", RemotePort: 5432, Name: "db", Visibility: "public"}},
+		{"host=App.Example.com:8080-80", parsedRoute{LocalAddr: "127.0.0.1:8080", RemotePort: 80, Hostname: "app.example.com"}},
+		{"name=api:visibility=public:host=api.example.com:[::1]:8080-80@42001", parsedRoute{LocalAddr: "[::1]:8080", RemotePort: 80, ClientPort: 42001, Name: "api", Visibility: "public", Hostname: "api.example.com"}},
+		{"sni=*.example.com:8443-443", parsedRoute{LocalAddr: "127.0.0.1:8443", RemotePort: 443, Hostname: "*.example.com", SNI: true}},
+		{"sni=*:8443-443", parsedRoute{LocalAddr: "127.0.0.1:8443", RemotePort: 443, Hostname: "*", SNI: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			mappings, err := ParseRouteMappings([]string{tt.route})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mappings) != 1 {
+				t.Fatalf("got %d mappings, want 1", len(mappings))
+			}
+			if got := parsed(mappings[0]); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRouteMappingsErrors(t *testing.T) {
+	tests := []struct {
+		route string
+		want  string // part of the error, naming the interpretation that was attempted
+	}{
+		{"", "was read as a port"},
+		{"0", "not between 1 and 65535"},
+		{"65536", "not between 1 and 65535"},
+		{"127.0.0.1:8080", `has no "-", so it was read as a port`},
+		{"[::1]:8080", `has no "-", so it was read as a port`},
+		{"65536-80", "has no host, so it was read as a port"},
+		{"8080-0", "invalid remote port"},
+		{"8080-", "invalid remote port"},
+		{"8080-nosuchservice", "nor a known service name"},
+		{"::1:8080-80", "must be enclosed in brackets"},
+		{"fd00::2:8080-80", "must be enclosed in brackets"},
+		{"[fd00::zz]:8080-80", "invalid IPv6 address"},
+		{"999.1.1.1:8080-80", "invalid IPv4 address"},
+		{"bad!host:8080-80", "invalid hostname"},
+		{"127.0.0.1:0-80", "was read as ip:port"},
+		{"8080@0", "invalid client port"},
+		{"8080@65536", "invalid client port"},
+		{"8080@client_port=abc", "invalid client port"},
+		{"name=-web:8080", "invalid name"},
+		{"host=bad_host:8080-80", "invalid hostname"},
+		{"host=*:8080-80", "invalid hostname"},
+		{"host=app.example.com:6000..6010", "can't be routed by hostname"},
+		{"6000..6010@7000", "can't be pinned"},
+		{"6000..6010-7000..7005", "has 11 ports but remote range"},
+		{"6000..5000", "starts above its end"},
+		{"1..2000", "has more than 1024 ports"},
+		{"6000..70000", "does not end with a port"},
+		{"visibility=private:8080", "visibility"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			mappings, err := ParseRouteMappings([]string{tt.route})
+			if err == nil {
+				t.Fatalf("got %+v, want an error", mappings)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q doesn't say %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRouteMappingsConflicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		want   string
+	}{
+		{"same route twice", []string{"8080", "8080"}, "route mapping 8080 is given more than once"},
+		{"same remote port", []string{"8080-80", "9090-80"}, "remote port 80 is mapped by both 8080-80 and 9090-80"},
+		{"shorthand and full form", []string{"8080", "127.0.0.1:9090-8080"}, "remote port 8080 is mapped by both"},
+		{"range and single port", []string{"6000..6002", "6001"}, "remote port 6001 is mapped by both 6000..6002 and 6001"},
+		{"overlapping ranges", []string{"6000..6002", "7000..7002-6002..6004"}, "remote port 6002 is mapped by both 6000..6002 and 7000..7002-6002..6004"},
+		{"same range twice", []string{"6000..6002", "6000..6002"}, "route mapping 6000..6002 is given more than once"},
+		{"same route with another client port", []string{"8080@42001", "8080@42002"}, "remote port 8080 is mapped by both"},
+		{"same client port", []string{"8080@42001", "9090@42001"}, "client port 42001 is used by both 8080@42001 and 9090@42001"},
+
+		// Within a visibility, only different hostnames of the same kind share a port
+		{"same hostname", []string{"host=app.example.com:8080-80", "host=app.example.com:9090-80"}, "remote port 80 is mapped by both"},
+		{"hostname and TCP", []string{"host=app.example.com:8080-80", "9090-80"}, "remote port 80 is mapped by both"},
+		{"TCP and hostname", []string{"9090-80", "host=app.example.com:8080-80"}, "remote port 80 is mapped by both"},
+		{"HTTP and SNI", []string{"host=app.example.com:8080-443", "sni=api.example.com:8443-443"}, "remote port 443 is mapped by both"},
+		{"same tunnel port", []string{"visibility=tunnel:8080-80", "visibility=tunnel:9090-80"}, "remote port 80 is mapped by both"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRouteMappings(tt.routes)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRouteMappingsRanges(t *testing.T) {
+	mappings, err := ParseRouteMappings([]string{"name=game:visibility=tunnel:[::1]:6000..6002-7000..7002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 3 {
+		t.Fatalf("got %d mappings, want 3", len(mappings))
+	}
+	for i, m := range mappings {
+		want := parsedRoute{LocalAddr: fmt.Sprintf("[::1]:%d", 6000+i), RemotePort: 7000 + i, Name: "game", Visibility: "tunnel"}
+		if got := parsed(m); got != want {
+			t.Errorf("mapping %d = %+v, want %+v", i, got, want)
+		}
+		if m.portRange != "7000..7002" {
+			t.Errorf("mapping %d has range %q, want 7000..7002", i, m.portRange)
+		}
+	}
+
+	// Without a remote range, the local ports are exposed as they are
+	mappings, err = ParseRouteMappings([]string{"6000..6001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 || parsed(mappings[1]) != (parsedRoute{LocalAddr: "127.0.0.1:6001", RemotePort: 6001}) {
+		t.Errorf("got %+v, want 6000..6001 on the same remote ports", mappings)
+	}
+}
+
+func TestParseRouteMappingsSharedPort(t *testing.T) {
+	routes := []string{
+		"host=app.example.com:8080-80",
+		"host=api.example.com:9090-80",
+		"visibility=public:host=www.example.com:7070-80",
+		"sni=app.example.com:8443-443",
+		"sni=*:9443-443",
+
+		// A tunnel-only port is a listener of its own next to the public one
+		"visibility=tunnel:host=app.example.com:6060-80",
+		"visibility=tunnel:5050-443",
+		"9000-9000",
+		"visibility=tunnel:9001-9000",
+	}
+	mappings, err := ParseRouteMappings(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != len(routes) {
+		t.Errorf("got %d mappings, want %d", len(mappings), len(routes))
+	}
+}
+
+func TestCheckRouteConflicts(t *testing.T) {
+	pc := &ProxyClient{}
+	existing, err := ParseRouteMappings([]string{"host=app.example.com:8080-80", "9090-90"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		route string
+		want  string // empty if the route may be added
+	}{
+		{"host=api.example.com:8081-80", ""},
+		{"7070-70", ""},
+		{"host=app.example.com:8081-80", "hostname app.example.com on remote port 80 is already mapped to 127.0.0.1:8080"},
+		{"8081-80", "remote port 80 is already mapped to 127.0.0.1:8080"},
+		{"sni=api.example.com:8443-80", "remote port 80 is already mapped"},
+		{"host=api.example.com:8081-90", "remote port 90 is already mapped to 127.0.0.1:9090"},
+		{"visibility=tunnel:8081-90", ""},
+		{"visibility=tunnel:host=app.example.com:8081-80", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			mappings, err := ParseRouteMappings([]string{tt.route})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = pc.checkRouteConflicts(existing, mappings[0])
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropMappingByVisibility(t *testing.T) {
+	pc := &ProxyClient{}
+	routes, err := ParseRouteMappings([]string{"8080-80", "visibility=tunnel:9090-80", "host=app.example.com:7070-443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range routes {
+		m.stop = make(chan struct{})
+		pc.mappings = append(pc.mappings, m)
+	}
+
+	// A removal names the namespace of the port, so the public mapping of port 80 stays
+	pc.dropMapping(80, "", "tunnel")
+	if len(pc.mappings) != 2 || pc.mappings[0].LocalAddr != "127.0.0.1:8080" {
+		t.Fatalf("mappings after dropping the tunnel port = %+v, want 127.0.0.1:8080 and the hostname", pc.mappings)
+	}
+	if _, ok := pc.mappingFor(80); !ok {
+		t.Error("mappingFor(80) found no multiplexed mapping")
+	}
+	if _, ok := pc.mappingFor(443); ok {
+		t.Error("mappingFor(443) found a mapping routed by hostname")
+	}
+
+	// Without a visibility, as sent by servers that map each port once, every mapping of the port goes
+	pc.dropMapping(80, "", "")
+	if len(pc.mappings) != 1 {
+		t.Errorf("%d mappings left, want 1", len(pc.mappings))
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"1", 1},
+		{"8080", 8080},
+		{"65535", 65535},
+
+		// Common names, which resolve without /etc/services too
+		{"http", 80},
+		{"https", 443},
+		{"ssh", 22},
+		{"smtp", 25},
+		{"imaps", 993},
+
+		// Service names are matched regardless of case
+		{"HTTPS", 443},
+		{"Ssh", 22},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parsePort(tt.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parsePort(%q) = %d, want %d", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortErrors(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string // parts of the error
+	}{
+		{"0", []string{"port 0 is not between 1 and 65535"}},
+		{"65536", []string{"port 65536 is not between 1 and 65535"}},
+		{"-1", []string{"port -1 is not between 1 and 65535"}},
+
+		// Names that don't resolve report both failures
+		{"nosuchservice", []string{`"nosuchservice" is neither a port number`, "nor a known service name"}},
+		{"http s", []string{"neither a port number", "nor a known service name"}},
+		{"", []string{"neither a port number", "nor a known service name"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			port, err := parsePort(tt.s)
+			if err == nil {
+				t.Fatalf("parsePort(%q) = %d, want an error", tt.s, port)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't say %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRouteMappingsStoresResolvedPorts(t *testing.T) {
+	mappings, err := ParseRouteMappings([]string{"127.0.0.1:HTTPS-ssh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parsed(mappings[0]), (parsedRoute{LocalAddr: "127.0.0.1:443", RemotePort: 22}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
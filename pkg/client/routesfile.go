@@ -0,0 +1,502 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/compress"
+	"github.com/DevonTM/wg-rp/pkg/httprewrite"
+	"github.com/DevonTM/wg-rp/pkg/proxyproto"
+	"github.com/DevonTM/wg-rp/pkg/schedule"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// routesFilePollInterval is how often a watched routes file is checked for changes
+const routesFilePollInterval = 2 * time.Second
+
+// routeFileEntry is a single route mapping in a routes file
+type routeFileEntry struct {
+	LocalAddr           string            `yaml:"local_addr"`
+	RemotePort          int               `yaml:"remote_port"`
+	ClientPort          int               `yaml:"client_port"`
+	Protocol            string            `yaml:"protocol"` // only tcp is supported
+	Schedule            string            `yaml:"schedule"`
+	ScheduleCloseActive bool              `yaml:"schedule_close_active"`
+	MaxConnsPerSecond   float64           `yaml:"max_conns_per_second"`
+	MaxConnsBurst       int               `yaml:"max_conns_burst"`
+	MaxHalfOpen         int               `yaml:"max_half_open"`
+	Labels              map[string]string `yaml:"labels"`
+	TunnelDialTimeout   time.Duration     `yaml:"tunnel_dial_timeout"` // e.g. 30s
+	WriteDeadline       time.Duration     `yaml:"write_deadline"`      // e.g. 30s
+	SampleRate          *float64          `yaml:"sample_rate"`         // e.g. 0.01 to log one connection in 100
+	Name                string            `yaml:"name"`
+	TTL                 time.Duration     `yaml:"ttl"` // e.g. 2h
+	HTTPHostRewrite     string            `yaml:"http_host_rewrite"`
+	ProxyProtocol       bool              `yaml:"proxy_protocol"`
+	ProxyProtoTLVs      []routeFileTLV    `yaml:"proxy_proto_tlvs"`
+	Visibility          string            `yaml:"visibility"`  // public or tunnel
+	Hostname            string            `yaml:"hostname"`    // route HTTP for this hostname on a shared remote port
+	SNI                 bool              `yaml:"sni"`         // route TLS by server name for hostname instead of HTTP
+	TLSCert             string            `yaml:"tls_cert"`    // name of a certificate configured on the server
+	TLSALPN             []string          `yaml:"tls_alpn"`    // e.g. [h2, http/1.1]
+	Compression         string            `yaml:"compression"` // none, snappy or zstd
+}
+
+// routeFileTLV is a PROXY protocol TLV field in a routes file, its value given as text or in hex
+type routeFileTLV struct {
+	Type  uint8  `yaml:"type"` // e.g. 0xE0
+	Value string `yaml:"value"`
+	Hex   string `yaml:"hex"`
+}
+
+// yamlLineRe finds the line number in errors returned by the YAML decoder
+var yamlLineRe = regexp.MustCompile(`line (\d+)`)
+
+// LoadRoutesFile parses a YAML routes file of the form
+//
+//	routes:
+//	  - local_addr: 127.0.0.1:8080
+//	    remote_port: 8080
+//	    schedule: Mon-Fri 09:00-17:00
+//	    max_conns_per_second: 50
+//	    labels: {team: web}
+//
+// Errors name the offending line and quote it.
+func LoadRoutesFile(path string) ([]RouteMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode strictly for typed errors, and again as nodes to know each entry's line
+	var file struct {
+		Routes []routeFileEntry `yaml:"routes"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, withLineContext(path, data, yamlErrorLine(err), err)
+	}
+
+	var nodes struct {
+		Routes []yaml.Node `yaml:"routes"`
+	}
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, withLineContext(path, data, yamlErrorLine(err), err)
+	}
+
+	mappings := make([]RouteMapping, 0, len(file.Routes))
+	lines := make([]int, 0, len(file.Routes))
+	clientPorts := make(map[int]int)
+	for i, entry := range file.Routes {
+		line := nodes.Routes[i].Line
+
+		mapping, err := entry.routeMapping()
+		if err != nil {
+			return nil, withLineContext(path, data, line, err)
+		}
+		for j, other := range mappings {
+			if other.RemotePort == mapping.RemotePort && !sharesPort(other, mapping) {
+				return nil, withLineContext(path, data, line, fmt.Errorf("remote port %d is also mapped on line %d", mapping.RemotePort, lines[j]))
+			}
+		}
+		if mapping.ClientPort != 0 {
+			if other, used := clientPorts[mapping.ClientPort]; used {
+				return nil, withLineContext(path, data, line, fmt.Errorf("client port %d is also used on line %d", mapping.ClientPort, other))
+			}
+			clientPorts[mapping.ClientPort] = line
+		}
+
+		mappings = append(mappings, mapping)
+		lines = append(lines, line)
+	}
+
+	return mappings, nil
+}
+
+// CheckRouteOverlap returns an error if a mapping from the routes file at path uses the remote
+// port or pinned client port of a mapping given otherwise, e.g. with -r, naming both
+func CheckRouteOverlap(routes, fileRoutes []RouteMapping, path string) error {
+	for _, fileRoute := range fileRoutes {
+		for _, route := range routes {
+			if route.RemotePort == fileRoute.RemotePort && !sharesPort(route, fileRoute) {
+				return fmt.Errorf("remote port %d is mapped by both route %s-%d and %s (to %s)",
+					route.RemotePort, route.LocalAddr, route.RemotePort, path, fileRoute.LocalAddr)
+			}
+			if route.ClientPort != 0 && route.ClientPort == fileRoute.ClientPort {
+				return fmt.Errorf("client port %d is pinned by both route %s-%d and %s (remote port %d)",
+					route.ClientPort, route.LocalAddr, route.RemotePort, path, fileRoute.RemotePort)
+			}
+		}
+	}
+	return nil
+}
+
+// localAddr validates the entry's local address, ip:port or a unix socket path
+func (e routeFileEntry) localAddr() (string, error) {
+	if isUnixTarget(e.LocalAddr) {
+		localAddr, err := parseUnixTarget(e.LocalAddr)
+		if err != nil {
+			return "", fmt.Errorf("invalid local_addr %q: %v", e.LocalAddr, err)
+		}
+		return localAddr, nil
+	}
+
+	host, port, err := net.SplitHostPort(e.LocalAddr)
+	if err != nil {
+		if strings.Count(e.LocalAddr, ":") > 1 && !strings.HasPrefix(e.LocalAddr, "[") {
+			return "", fmt.Errorf("invalid local_addr %q, IPv6 addresses must be enclosed in brackets, e.g. [::1]:8080", e.LocalAddr)
+		}
+		return "", fmt.Errorf("invalid local_addr %q, expected ip:port or a unix socket path", e.LocalAddr)
+	}
+	if host != "" {
+		if err := utils.ValidateHost(host); err != nil {
+			return "", fmt.Errorf("invalid local_addr %q: %v", e.LocalAddr, err)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// routeMapping validates the entry and converts it to a route mapping
+func (e routeFileEntry) routeMapping() (RouteMapping, error) {
+	localAddr, err := e.localAddr()
+	if err != nil {
+		return RouteMapping{}, err
+	}
+	if e.RemotePort < 1 || e.RemotePort > 65535 {
+		return RouteMapping{}, fmt.Errorf("remote_port must be between 1-65535")
+	}
+	if e.ClientPort < 0 || e.ClientPort > 65535 {
+		return RouteMapping{}, fmt.Errorf("client_port must be between 1-65535")
+	}
+	if e.Protocol != "" && e.Protocol != "tcp" {
+		return RouteMapping{}, fmt.Errorf("unsupported protocol %q, only tcp is supported", e.Protocol)
+	}
+	if e.Schedule != "" {
+		if _, err := schedule.Parse(e.Schedule); err != nil {
+			return RouteMapping{}, err
+		}
+	}
+	if e.MaxConnsPerSecond < 0 || e.MaxConnsBurst < 0 {
+		return RouteMapping{}, fmt.Errorf("max_conns_per_second and max_conns_burst must not be negative")
+	}
+	if e.SampleRate != nil && (*e.SampleRate < 0 || *e.SampleRate > 1) {
+		return RouteMapping{}, fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if e.MaxHalfOpen < 0 {
+		return RouteMapping{}, fmt.Errorf("max_half_open must not be negative")
+	}
+	if e.Name != "" {
+		if err := utils.ValidateMappingName(e.Name); err != nil {
+			return RouteMapping{}, err
+		}
+	}
+	if err := utils.ValidateMappingLabels(e.Labels); err != nil {
+		return RouteMapping{}, err
+	}
+	if e.TTL < 0 || (e.TTL > 0 && e.TTL < time.Second) {
+		return RouteMapping{}, fmt.Errorf("ttl must be at least 1s")
+	}
+	if e.HTTPHostRewrite != "" {
+		if err := httprewrite.ValidateHost(e.HTTPHostRewrite); err != nil {
+			return RouteMapping{}, fmt.Errorf("invalid http_host_rewrite: %v", err)
+		}
+	}
+	tlvs, err := e.proxyProtoTLVs()
+	if err != nil {
+		return RouteMapping{}, err
+	}
+	if e.TunnelDialTimeout < 0 {
+		return RouteMapping{}, fmt.Errorf("tunnel_dial_timeout must not be negative")
+	}
+	if e.WriteDeadline < 0 || (e.WriteDeadline > 0 && e.WriteDeadline < time.Second) {
+		return RouteMapping{}, fmt.Errorf("write_deadline must be at least 1s")
+	}
+	if err := validateVisibility(e.Visibility); err != nil {
+		return RouteMapping{}, fmt.Errorf("invalid visibility: %v", err)
+	}
+	hostname := strings.ToLower(e.Hostname)
+	if hostname != "" {
+		if err := validateRouteHostname(hostname, e.SNI); err != nil {
+			return RouteMapping{}, fmt.Errorf("invalid hostname: %v", err)
+		}
+	} else if e.SNI {
+		return RouteMapping{}, fmt.Errorf("sni needs a hostname")
+	}
+	if len(e.TLSALPN) > 0 && e.TLSCert == "" {
+		return RouteMapping{}, fmt.Errorf("tls_alpn needs a tls_cert")
+	}
+	if e.Compression != "" && !compress.Supported(e.Compression) {
+		return RouteMapping{}, fmt.Errorf("invalid compression %q (use %s, %s or %s)", e.Compression,
+			api.CompressionNone, api.CompressionSnappy, api.CompressionZstd)
+	}
+
+	return RouteMapping{
+		LocalAddr:           localAddr,
+		RemotePort:          e.RemotePort,
+		ClientPort:          e.ClientPort,
+		Schedule:            e.Schedule,
+		ScheduleCloseActive: e.ScheduleCloseActive,
+		MaxConnsPerSecond:   e.MaxConnsPerSecond,
+		MaxConnsBurst:       e.MaxConnsBurst,
+		MaxHalfOpen:         e.MaxHalfOpen,
+		Labels:              e.Labels,
+		TunnelDialTimeout:   e.TunnelDialTimeout,
+		WriteDeadline:       e.WriteDeadline,
+		SampleRate:          e.SampleRate,
+		Name:                e.Name,
+		TTL:                 e.TTL,
+		HTTPHostRewrite:     e.HTTPHostRewrite,
+		ProxyProtocol:       e.ProxyProtocol,
+		ProxyProtoTLVs:      tlvs,
+		Visibility:          e.Visibility,
+		Hostname:            hostname,
+		SNI:                 e.SNI,
+		TLSCert:             e.TLSCert,
+		TLSALPN:             e.TLSALPN,
+		Compression:         e.Compression,
+	}, nil
+}
+
+// proxyProtoTLVs decodes the entry's PROXY protocol TLVs, nil if it has none
+func (e routeFileEntry) proxyProtoTLVs() ([]api.TLVEntry, error) {
+	if len(e.ProxyProtoTLVs) == 0 {
+		return nil, nil
+	}
+	if !e.ProxyProtocol {
+		return nil, fmt.Errorf("proxy_proto_tlvs needs proxy_protocol")
+	}
+
+	tlvs := make([]api.TLVEntry, 0, len(e.ProxyProtoTLVs))
+	for _, t := range e.ProxyProtoTLVs {
+		value := []byte(t.Value)
+		if t.Hex != "" {
+			if t.Value != "" {
+				return nil, fmt.Errorf("TLV 0x%02x has both a value and hex", t.Type)
+			}
+			decoded, err := hex.DecodeString(t.Hex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex of TLV 0x%02x: %v", t.Type, err)
+			}
+			value = decoded
+		}
+		tlvs = append(tlvs, api.TLVEntry{Type: t.Type, Value: value})
+	}
+	if err := proxyproto.ValidateTLVs(tlvs); err != nil {
+		return nil, fmt.Errorf("invalid proxy_proto_tlvs: %v", err)
+	}
+	return tlvs, nil
+}
+
+// yamlErrorLine returns the line a YAML decoder error refers to, or 0 if it names none
+func yamlErrorLine(err error) int {
+	m := yamlLineRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
+
+// withLineContext prefixes err with the file and line and quotes the line
+func withLineContext(path string, data []byte, line int, err error) error {
+	lines := strings.Split(string(data), "\n")
+	if line < 1 || line > len(lines) {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return fmt.Errorf("%s:%d: %v\n    %d | %s", path, line, err, line, lines[line-1])
+}
+
+// WatchRoutesFile polls a routes file and applies edits to a started client: mappings removed
+// from the file are removed, new ones added, and changed ones replaced, leaving the rest alone.
+// current is the set of mappings loaded from the file at startup. A file that fails to parse is
+// logged and the previous routes are kept.
+func (pc *ProxyClient) WatchRoutesFile(path string, current []RouteMapping) {
+	pc.reloadMu.Lock()
+	pc.routesFile = path
+	pc.fileRoutes = current
+	pc.reloadMu.Unlock()
+
+	info, _ := os.Stat(path)
+
+	go func() {
+		ticker := time.NewTicker(routesFilePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-pc.shutdownChan:
+				return
+			case <-ticker.C:
+			}
+
+			latest, err := os.Stat(path)
+			if err != nil || (info != nil && latest.ModTime().Equal(info.ModTime()) && latest.Size() == info.Size()) {
+				continue
+			}
+			info = latest
+
+			slog.Info("Routes file changed, applying differences", "path", path)
+			if err := pc.ReloadRoutes(); err != nil {
+				slog.Error("Failed to reload routes file, keeping the previous routes", "path", path, "error", err)
+			}
+		}
+	}()
+}
+
+// ReloadRoutes re-reads the watched routes file now and applies the differences like
+// WatchRoutesFile does. If the file doesn't parse or conflicts with the mappings not managed by
+// it, nothing is changed and the error is returned.
+func (pc *ProxyClient) ReloadRoutes() error {
+	pc.reloadMu.Lock()
+	defer pc.reloadMu.Unlock()
+
+	if pc.routesFile == "" {
+		return errors.New("no routes file to reload")
+	}
+
+	desired, err := LoadRoutesFile(pc.routesFile)
+	if err != nil {
+		return err
+	}
+
+	// Check the new routes against the other mappings before changing anything
+	fromFile := make(map[routeKey]bool, len(pc.fileRoutes))
+	for _, mapping := range pc.fileRoutes {
+		fromFile[mapping.key()] = true
+	}
+	var others []RouteMapping
+	for _, mapping := range pc.Mappings() {
+		if !fromFile[mapping.key()] {
+			others = append(others, mapping)
+		}
+	}
+	for _, mapping := range desired {
+		if err := pc.checkRouteConflicts(others, mapping); err != nil {
+			return err
+		}
+	}
+
+	pc.fileRoutes = pc.applyRoutes(pc.fileRoutes, desired)
+	return nil
+}
+
+// applyRoutes brings the file-managed mappings from current to desired and returns the mappings
+// now in effect. Mappings that fail to apply are logged and left as they were.
+func (pc *ProxyClient) applyRoutes(current, desired []RouteMapping) []RouteMapping {
+	byKey := make(map[routeKey]RouteMapping, len(current))
+	for _, mapping := range current {
+		byKey[mapping.key()] = mapping
+	}
+	wanted := make(map[routeKey]RouteMapping, len(desired))
+	for _, mapping := range desired {
+		wanted[mapping.key()] = mapping
+	}
+
+	// Remove mappings that left the file or changed
+	for key, mapping := range byKey {
+		if next, keep := wanted[key]; keep && sameRoute(mapping, next) {
+			continue
+		}
+		if err := pc.removeRoute(key.port, key.hostname, key.visibility); err != nil {
+			slog.Error("Failed to remove route from routes file", "remote_port", key.port, "error", err)
+		}
+		delete(byKey, key)
+	}
+
+	// Add new and changed mappings
+	for _, mapping := range desired {
+		if existing, exists := byKey[mapping.key()]; exists {
+			// Labels are informational, the server changes them without registering again
+			if !maps.Equal(existing.Labels, mapping.Labels) {
+				pc.setRouteLabels(mapping.key(), mapping.Labels)
+				byKey[mapping.key()] = mapping
+			}
+			continue
+		}
+		if err := pc.AddRoute(mapping); err != nil {
+			slog.Error("Failed to add route from routes file", "remote_port", mapping.RemotePort, mapping.nameAttr(), "error", err)
+			continue
+		}
+		byKey[mapping.key()] = mapping
+	}
+
+	applied := make([]RouteMapping, 0, len(byKey))
+	for _, mapping := range byKey {
+		applied = append(applied, mapping)
+	}
+	return applied
+}
+
+// sameRoute reports whether two mappings of a remote port would be registered identically
+func sameRoute(a, b RouteMapping) bool {
+	return a.LocalAddr == b.LocalAddr &&
+		a.ClientPort == b.ClientPort &&
+		a.Schedule == b.Schedule &&
+		a.ScheduleCloseActive == b.ScheduleCloseActive &&
+		a.MaxConnsPerSecond == b.MaxConnsPerSecond &&
+		a.MaxConnsBurst == b.MaxConnsBurst &&
+		a.MaxHalfOpen == b.MaxHalfOpen &&
+		a.TunnelDialTimeout == b.TunnelDialTimeout &&
+		a.WriteDeadline == b.WriteDeadline &&
+		equalPtr(a.SampleRate, b.SampleRate) &&
+		a.Name == b.Name &&
+		a.TTL == b.TTL &&
+		a.HTTPHostRewrite == b.HTTPHostRewrite &&
+		a.ProxyProtocol == b.ProxyProtocol &&
+		slices.EqualFunc(a.ProxyProtoTLVs, b.ProxyProtoTLVs, equalTLV) &&
+		a.Visibility == b.Visibility &&
+		a.Hostname == b.Hostname &&
+		a.SNI == b.SNI &&
+		a.TLSCert == b.TLSCert &&
+		slices.Equal(a.TLSALPN, b.TLSALPN) &&
+		a.Compression == b.Compression
+}
+
+// setRouteLabels replaces the labels of an active mapping, on the server too
+func (pc *ProxyClient) setRouteLabels(key routeKey, labels map[string]string) {
+	pc.mu.Lock()
+	var ports []int
+	for i := range pc.mappings {
+		if pc.mappings[i].key() == key {
+			pc.mappings[i].Labels = labels
+			ports = append(ports, pc.mappings[i].RemotePort)
+		}
+	}
+	pc.mu.Unlock()
+
+	// A range has its labels on each of its ports
+	for _, port := range ports {
+		if err := pc.updatePortMappingLabels(port, key.hostname, key.visibility, labels); err != nil {
+			slog.Warn("Failed to update the labels of port mapping", "remote_port", port, "error", err)
+		}
+	}
+}
+
+// equalTLV reports whether two PROXY protocol TLVs are the same
+func equalTLV(a, b api.TLVEntry) bool {
+	return a.Type == b.Type && bytes.Equal(a.Value, b.Value)
+}
+
+// equalPtr reports whether two optional values are both unset or both set to the same value
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// writeRoutesFile writes a routes file with the given content and returns its path
+func writeRoutesFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRoutesFileConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			"same remote port",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n  - local_addr: 127.0.0.1:9090\n    remote_port: 80\n",
+			"remote port 80 is also mapped on line 2",
+		},
+		{
+			"same hostname",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    hostname: app.example.com\n  - local_addr: 127.0.0.1:9090\n    remote_port: 80\n    hostname: app.example.com\n",
+			"remote port 80 is also mapped on line 2",
+		},
+		{
+			"hostname and TCP",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    hostname: app.example.com\n  - local_addr: 127.0.0.1:9090\n    remote_port: 80\n",
+			"remote port 80 is also mapped on line 2",
+		},
+		{
+			"same client port",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    client_port: 42001\n  - local_addr: 127.0.0.1:9090\n    remote_port: 90\n    client_port: 42001\n",
+			"client port 42001 is also used on line 2",
+		},
+		{
+			"remote port out of range",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 65536\n",
+			"remote_port must be between 1-65535",
+		},
+		{
+			"invalid label",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    labels: {team name: web}\n",
+			"invalid label",
+		},
+		{
+			"TLVs without PROXY protocol",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    proxy_proto_tlvs: [{type: 0xE0, value: web}]\n",
+			"proxy_proto_tlvs needs proxy_protocol",
+		},
+		{
+			"TLV with invalid hex",
+			"routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    proxy_protocol: true\n    proxy_proto_tlvs: [{type: 0xE0, hex: zz}]\n",
+			"invalid hex of TLV 0xe0",
+		},
+		{
+			"IPv6 without brackets",
+			"routes:\n  - local_addr: ::1:8080\n    remote_port: 80\n",
+			"must be enclosed in brackets",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeRoutesFile(t, tt.content)
+			_, err := LoadRoutesFile(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRoutesFileSharedPort(t *testing.T) {
+	path := writeRoutesFile(t, "routes:\n"+
+		"  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    hostname: app.example.com\n"+
+		"  - local_addr: 127.0.0.1:9090\n    remote_port: 80\n    hostname: api.example.com\n"+
+		"  - local_addr: 127.0.0.1:8443\n    remote_port: 443\n    hostname: app.example.com\n    sni: true\n"+
+		"  - local_addr: 127.0.0.1:9443\n    remote_port: 443\n    hostname: api.example.com\n    sni: true\n")
+	mappings, err := LoadRoutesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 4 {
+		t.Errorf("got %d mappings, want 4", len(mappings))
+	}
+
+	// Routes given with -r share the port with the file's other hostnames too
+	routes, err := ParseRouteMappings([]string{"host=www.example.com:7070-80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckRouteOverlap(routes, mappings, path); err != nil {
+		t.Errorf("route for another hostname overlaps the file: %v", err)
+	}
+	routes, err = ParseRouteMappings([]string{"host=api.example.com:7070-80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckRouteOverlap(routes, mappings, path); err == nil {
+		t.Error("route for a hostname of the file doesn't overlap it")
+	}
+}
+
+func TestLoadRoutesFileProxyProtoTLVs(t *testing.T) {
+	path := writeRoutesFile(t, "routes:\n"+
+		"  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    proxy_protocol: true\n"+
+		"    proxy_proto_tlvs:\n      - {type: 0xE0, value: web}\n      - {type: 0xE1, hex: 00ff}\n")
+	mappings, err := LoadRoutesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []api.TLVEntry{{Type: 0xE0, Value: []byte("web")}, {Type: 0xE1, Value: []byte{0x00, 0xFF}}}
+	if len(mappings) != 1 || !mappings[0].ProxyProtocol || !slices.EqualFunc(mappings[0].ProxyProtoTLVs, want, equalTLV) {
+		t.Errorf("got %+v, want the PROXY protocol with TLVs %v", mappings, want)
+	}
+}
+
+func TestCheckRouteOverlap(t *testing.T) {
+	path := writeRoutesFile(t, "routes:\n  - local_addr: 127.0.0.1:8080\n    remote_port: 80\n    client_port: 42001\n")
+	fileRoutes, err := LoadRoutesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		route string
+		want  string // empty if the route doesn't overlap the file
+	}{
+		{"9090-90", ""},
+		{"9090-90@42002", ""},
+		{"9090-80", "remote port 80 is mapped by both route 127.0.0.1:9090-80 and " + path + " (to 127.0.0.1:8080)"},
+		{"75..85", "remote port 80 is mapped by both route 127.0.0.1:80-80 and " + path},
+		{"9090-90@42001", "client port 42001 is pinned by both route 127.0.0.1:9090-90 and " + path + " (remote port 80)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			routes, err := ParseRouteMappings([]string{tt.route})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = CheckRouteOverlap(routes, fileRoutes, path)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRTTWarnThreshold is the heartbeat round-trip time above which a warning is logged
+	defaultRTTWarnThreshold = time.Second
+
+	// rttEWMAWeight is the weight given to a new sample in the moving average
+	rttEWMAWeight = 0.2
+)
+
+// RTTStats summarizes heartbeat round-trip times
+type RTTStats struct {
+	Last     time.Duration // most recent successful sample
+	EWMA     time.Duration // exponentially weighted moving average
+	Min      time.Duration
+	Max      time.Duration
+	Samples  int // successful measurements
+	Timeouts int // heartbeats that timed out before a response arrived
+}
+
+// rttTracker records heartbeat round-trip times
+type rttTracker struct {
+	mu    sync.Mutex
+	stats RTTStats
+}
+
+// record adds a successful round-trip sample
+func (t *rttTracker) record(rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &t.stats
+	if s.Samples == 0 {
+		s.EWMA = rtt
+		s.Min = rtt
+		s.Max = rtt
+	} else {
+		s.EWMA = time.Duration(rttEWMAWeight*float64(rtt) + (1-rttEWMAWeight)*float64(s.EWMA))
+		s.Min = min(s.Min, rtt)
+		s.Max = max(s.Max, rtt)
+	}
+	s.Last = rtt
+	s.Samples++
+}
+
+// recordTimeout counts a heartbeat that timed out, which is not a valid RTT sample
+func (t *rttTracker) recordTimeout() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Timeouts++
+}
+
+// snapshot returns a copy of the current stats
+func (t *rttTracker) snapshot() RTTStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// isTimeout reports whether err was caused by a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// HeartbeatRTT returns the heartbeat round-trip time statistics
+func (pc *ProxyClient) HeartbeatRTT() RTTStats {
+	return pc.rtt.snapshot()
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/socks"
+)
+
+// socksTarget stands for the target of the SOCKS5 proxy in status reports
+const socksTarget = "socks5"
+
+// socksHandshakeTimeout bounds how long a SOCKS5 client may take to send its request
+const socksHandshakeTimeout = 10 * time.Second
+
+// startSOCKS5 listens for SOCKS5 clients, if the proxy is enabled
+func (pc *ProxyClient) startSOCKS5() error {
+	if pc.socksAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", pc.socksAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SOCKS5 proxy: %v", err)
+	}
+	slog.Info("SOCKS5 proxy started", "bind_addr", pc.socksAddr, "auth", pc.socksCreds != nil)
+
+	pc.wg.Add(1)
+	go func() {
+		defer pc.wg.Done()
+		pc.serveSOCKS5(listener)
+	}()
+	return nil
+}
+
+// serveSOCKS5 accepts SOCKS5 clients until shutdown
+func (pc *ProxyClient) serveSOCKS5(listener net.Listener) {
+	go func() {
+		<-pc.shutdownChan
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !pc.IsShuttingDown() {
+				slog.Error("SOCKS5 listener failed", "bind_addr", pc.socksAddr, "error", err)
+			}
+			return
+		}
+		go pc.handleSOCKSConnection(conn)
+	}
+}
+
+// handleSOCKSConnection reads a SOCKS5 request, has the server connect to its target and relays
+// between the SOCKS5 client and the tunnel
+func (pc *ProxyClient) handleSOCKSConnection(localConn net.Conn) {
+	defer localConn.Close()
+
+	localConn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := socks.Handshake(localConn, pc.socksCreds)
+	if err != nil {
+		slog.Warn("Rejected SOCKS5 request", "local_remote", localConn.RemoteAddr(), "error", err)
+		return
+	}
+	localConn.SetDeadline(time.Time{})
+
+	tunnelConn, err := pc.openForward(target)
+	if err != nil {
+		pc.socksStats.dialFailures.Add(1)
+		pc.socksStats.recordError(err)
+		slog.Error("Failed to open SOCKS5 connection", "local_remote", localConn.RemoteAddr(), "target", target, "error", err)
+		socks.Reply(localConn, socksReplyCode(err))
+		return
+	}
+	defer tunnelConn.Close()
+
+	if err := socks.Reply(localConn, socks.ReplySucceeded); err != nil {
+		return
+	}
+
+	pc.socksStats.activeConns.Add(1)
+	defer pc.socksStats.activeConns.Add(-1)
+
+	slog.Debug("Established SOCKS5 connection", "local_remote", localConn.RemoteAddr(), "target", target)
+
+	start := time.Now()
+	bytesIn, bytesOut, err := pc.relay(tunnelConn, localConn, pc.socksStats)
+
+	slog.Log(context.Background(), closeLogLevel(err), "SOCKS5 connection closed", "local_remote", localConn.RemoteAddr(), "target", target,
+		"bytes_in", bytesIn, "bytes_out", bytesOut, "duration", time.Since(start), relayErrorAttr(err))
+}
+
+// socksReplyCode translates an error opening a forward into a SOCKS5 reply
+func socksReplyCode(err error) byte {
+	var refused *forwardRefusedError
+	if !errors.As(err, &refused) {
+		return socks.ReplyGeneralFailure
+	}
+	switch refused.status {
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return socks.ReplyNotAllowed
+	case http.StatusBadGateway:
+		return socks.ReplyHostUnreachable
+	}
+	return socks.ReplyGeneralFailure
+}
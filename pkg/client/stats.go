@@ -0,0 +1,76 @@
+package client
+
+import (
+	"sync/atomic"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+)
+
+// mappingStats holds counters for a route mapping, updated atomically on the relay path
+type mappingStats struct {
+	activeConns  atomic.Int64
+	bytesRelayed atomic.Uint64
+	dialFailures atomic.Uint64
+	relayErrors  conntrack.ErrorCounts // connections that ended with an error, by class
+
+	registrationFailed atomic.Bool // re-registering failed after all retries
+	lastError          atomic.Pointer[string]
+	localCheck         atomic.Pointer[string] // result of the local service check, nil if not checked
+	compression        atomic.Pointer[string] // compression of the tunnel leg agreed with the server, nil for none
+}
+
+// recordError remembers the latest error of the mapping for status reports
+func (s *mappingStats) recordError(err error) {
+	msg := err.Error()
+	s.lastError.Store(&msg)
+}
+
+// latestError returns the latest error recorded for the mapping, or an empty string
+func (s *mappingStats) latestError() string {
+	if msg := s.lastError.Load(); msg != nil {
+		return *msg
+	}
+	return ""
+}
+
+// localCheckResult returns the result of the mapping's local service check, or an empty string
+func (s *mappingStats) localCheckResult() string {
+	if result := s.localCheck.Load(); result != nil {
+		return *result
+	}
+	return ""
+}
+
+// setCompression records the compression of the mapping's tunnel leg, empty for none
+func (s *mappingStats) setCompression(algorithm string) {
+	if algorithm == "" {
+		s.compression.Store(nil)
+		return
+	}
+	s.compression.Store(&algorithm)
+}
+
+// statsSnapshot collects the current counters of all route mappings for a heartbeat
+func (pc *ProxyClient) statsSnapshot() *api.ClientStats {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	stats := &api.ClientStats{
+		Mappings: make([]api.MappingStats, 0, len(pc.mappings)),
+	}
+
+	for _, mapping := range pc.mappings {
+		if mapping.stats == nil {
+			continue
+		}
+		stats.Mappings = append(stats.Mappings, api.MappingStats{
+			RemotePort:        mapping.RemotePort,
+			ActiveConnections: mapping.stats.activeConns.Load(),
+			BytesRelayed:      mapping.stats.bytesRelayed.Load(),
+			DialFailures:      mapping.stats.dialFailures.Load(),
+		})
+	}
+
+	return stats
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// RouteStatus describes an active route mapping and its counters
+type RouteStatus struct {
+	Name              string `json:"name,omitempty"`
+	LocalAddr         string `json:"local_addr"`
+	RemotePort        int    `json:"remote_port"`
+	ClientPort        int    `json:"client_port"`
+	Schedule          string `json:"schedule,omitempty"`
+	Visibility        string `json:"visibility,omitempty"`
+	Hostname          string `json:"hostname,omitempty"`
+	SNI               bool   `json:"sni,omitempty"`
+	ActiveConnections int64  `json:"active_connections"`
+	BytesRelayed      uint64 `json:"bytes_relayed"`
+	DialFailures      uint64 `json:"dial_failures"`
+
+	RegistrationFailed bool   `json:"registration_failed,omitempty"` // Re-registering with the server failed after all retries
+	LastError          string `json:"last_error,omitempty"`          // Latest local dial or registration error
+	LocalCheck         string `json:"local_check,omitempty"`         // Local service at registration: reachable or unreachable (empty = not checked)
+
+	RelayErrors map[string]int64 `json:"relay_errors,omitempty"` // Connections that ended abnormally, by class
+}
+
+// Status is a snapshot of the client's mappings and its heartbeat state
+type Status struct {
+	ClientIP                 string        `json:"client_ip"`
+	ServerIP                 string        `json:"server_ip"`
+	ServerVersion            string        `json:"server_version,omitempty"`
+	ServerStartupTime        int64         `json:"server_startup_time,omitempty"` // Unix time
+	HeartbeatIntervalSeconds int           `json:"heartbeat_interval_seconds"`
+	LastHeartbeat            int64         `json:"last_heartbeat,omitempty"` // Unix time of the last successful heartbeat
+	HeartbeatFailures        int           `json:"heartbeat_failures"`       // Consecutive failed heartbeats
+	RTTMillis                float64       `json:"rtt_ms,omitempty"`         // Smoothed heartbeat round-trip time
+	Mappings                 []RouteStatus `json:"mappings"`
+
+	Forwards []ForwardStatus `json:"forwards,omitempty"`
+
+	Peers []api.PeerStats `json:"peers,omitempty"` // WireGuard peers of the client's device
+
+	TunnelHealth string `json:"tunnel_health,omitempty"` // up while any peer completes handshakes, degraded or down
+}
+
+// Status returns the current mappings with their counters and the heartbeat state
+func (pc *ProxyClient) Status() Status {
+	pc.mu.Lock()
+	status := Status{
+		ClientIP:                 pc.clientIP,
+		ServerIP:                 pc.serverIP,
+		ServerVersion:            pc.serverVersion,
+		ServerStartupTime:        pc.serverStartupTime,
+		HeartbeatIntervalSeconds: int(pc.heartbeatInterval / time.Second),
+		HeartbeatFailures:        pc.heartbeatFailures,
+		Mappings:                 make([]RouteStatus, 0, len(pc.mappings)),
+	}
+	if !pc.lastHeartbeat.IsZero() {
+		status.LastHeartbeat = pc.lastHeartbeat.Unix()
+	}
+	for _, mapping := range pc.mappings {
+		route := RouteStatus{
+			Name:       mapping.Name,
+			LocalAddr:  mapping.LocalAddr,
+			RemotePort: mapping.RemotePort,
+			ClientPort: mapping.ClientPort,
+			Schedule:   mapping.Schedule,
+			Visibility: mapping.Visibility,
+			Hostname:   mapping.Hostname,
+			SNI:        mapping.SNI,
+		}
+		if mapping.stats != nil {
+			route.ActiveConnections = mapping.stats.activeConns.Load()
+			route.BytesRelayed = mapping.stats.bytesRelayed.Load()
+			route.DialFailures = mapping.stats.dialFailures.Load()
+			route.RegistrationFailed = mapping.stats.registrationFailed.Load()
+			route.LastError = mapping.stats.latestError()
+			route.LocalCheck = mapping.stats.localCheckResult()
+			route.RelayErrors = mapping.stats.relayErrors.Snapshot()
+		}
+		status.Mappings = append(status.Mappings, route)
+	}
+	pc.mu.Unlock()
+	status.Forwards = pc.forwardStatuses()
+
+	if rtt := pc.rtt.snapshot(); rtt.Samples > 0 {
+		status.RTTMillis = float64(rtt.EWMA) / float64(time.Millisecond)
+	}
+	if pc.peerStats != nil {
+		status.Peers = pc.peerStats()
+	}
+	if pc.tunnelHealth != nil {
+		status.TunnelHealth = string(pc.tunnelHealth())
+	}
+	return status
+}
+
+// ServerStatus fetches the server's status and its list of port mappings through the tunnel
+func (pc *ProxyClient) ServerStatus() (*api.ServerStatus, []api.MappingStatus, error) {
+	var status api.ServerStatus
+	if err := pc.getJSON("/api/v1/status", &status); err != nil {
+		return nil, nil, err
+	}
+
+	mappings, err := pc.PortMappings()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &status, mappings, nil
+}
+
+// PortMappings fetches the list of port mappings on the server, of every client, through the tunnel
+func (pc *ProxyClient) PortMappings() ([]api.MappingStatus, error) {
+	var list api.PortMappingListResponse
+	if err := pc.getJSON("/api/v1/port-mappings", &list); err != nil {
+		return nil, err
+	}
+	if !list.Success {
+		return nil, fmt.Errorf("server refused to list port mappings: %s", list.Message)
+	}
+	return list.Mappings, nil
+}
+
+// getJSON fetches an API path on the server and decodes its JSON response
+func (pc *ProxyClient) getJSON(path string, v any) error {
+	resp, err := pc.httpClient.Get(pc.apiURL(path))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks the local address of a mapping whose service listens on a unix socket
+const unixPrefix = "unix:"
+
+// isUnixTarget reports whether the local part of a route names a unix socket, by a "unix:"
+// prefix or a leading "/"
+func isUnixTarget(s string) bool {
+	return strings.HasPrefix(s, unixPrefix) || strings.HasPrefix(s, "/")
+}
+
+// localTarget returns the network and address to dial for a mapping's local address
+func localTarget(localAddr string) (string, string) {
+	if path, ok := strings.CutPrefix(localAddr, unixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", localAddr
+}
+
+// parseUnixTarget parses a unix socket target, "/path" or "unix:path", into a local address of
+// the form "unix:path". A socket that doesn't exist yet is only warned about, since the service
+// may start after the client.
+func parseUnixTarget(s string) (string, error) {
+	if err := unixTargetsSupported(); err != nil {
+		return "", err
+	}
+
+	path := strings.TrimPrefix(s, unixPrefix)
+	if path == "" {
+		return "", fmt.Errorf("unix socket target %q has no path", s)
+	}
+
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		slog.Warn("Unix socket does not exist yet", "path", path)
+	case err != nil:
+		slog.Warn("Cannot check unix socket", "path", path, "error", err)
+	case info.Mode()&fs.ModeSocket == 0:
+		slog.Warn("Local target is not a unix socket", "path", path, "mode", info.Mode().String())
+	}
+
+	return unixPrefix + path, nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package client
+
+// unixTargetsSupported reports whether mappings may forward to unix sockets
+func unixTargetsSupported() error {
+	return nil
+}
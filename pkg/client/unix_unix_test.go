@@ -0,0 +1,77 @@
+//go:build !windows
+
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+)
+
+func TestUnixSocketRoutes(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "app.sock")
+	startEchoService(t, "unix", socket)
+
+	tests := []struct {
+		route string
+		want  string
+	}{
+		{socket + "-8080", "unix:" + socket},
+		{"unix:" + socket + "-8080", "unix:" + socket},
+		{"name=app:unix:" + socket + "-8080@42001", "unix:" + socket},
+
+		// A socket that doesn't exist yet is accepted, the service may start after the client
+		{filepath.Join(dir, "later.sock") + "-8080", "unix:" + filepath.Join(dir, "later.sock")},
+
+		// Only the last "-" separates the remote port
+		{"unix:" + filepath.Join(dir, "my-app.sock") + "-8080", "unix:" + filepath.Join(dir, "my-app.sock")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			mappings, err := ParseRouteMappings([]string{tt.route})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mappings[0].LocalAddr != tt.want || mappings[0].RemotePort != 8080 {
+				t.Errorf("got %s on remote port %d, want %s on 8080", mappings[0].LocalAddr, mappings[0].RemotePort, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnixSocketRouteErrors(t *testing.T) {
+	tests := []struct {
+		route string
+		want  string
+	}{
+		{"/run/app.sock", "unix socket, which needs a remote port"},
+		{"unix:-8080", "has no path"},
+		{"/run/app.sock-0", "invalid remote port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			_, err := ParseRouteMappings([]string{tt.route})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestUnixSocketEndToEnd relays connections from the server host through the tunnel to a unix
+// socket echo server on the client host
+func TestUnixSocketEndToEnd(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "echo.sock")
+	startEchoService(t, "unix", socket)
+
+	remotePort, _ := startRelay(t, wgtest.ServerIP, wgtest.ClientIP, socket)
+	for range 3 {
+		expectEcho(t, fmt.Sprintf("127.0.0.1:%d", remotePort))
+	}
+}
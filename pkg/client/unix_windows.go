@@ -0,0 +1,11 @@
+//go:build windows
+
+package client
+
+import "errors"
+
+// unixTargetsSupported reports whether mappings may forward to unix sockets, which is not the
+// case on Windows
+func unixTargetsSupported() error {
+	return errors.New("unix socket targets are not supported on Windows")
+}
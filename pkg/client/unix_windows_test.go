@@ -0,0 +1,17 @@
+//go:build windows
+
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnixSocketRoutesRejected(t *testing.T) {
+	for _, route := range []string{"/run/app.sock-8080", "unix:/run/app.sock-8080"} {
+		_, err := ParseRouteMappings([]string{route})
+		if err == nil || !strings.Contains(err.Error(), "not supported on Windows") {
+			t.Errorf("%s: error = %v, want unix sockets rejected on Windows", route, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package compress compresses the tunnel leg of relayed connections. Every write is compressed
+// and flushed on its own, so interactive traffic is never held back waiting for a full block,
+// while bulk transfers still compress well because the relay writes what it read in one go.
+package compress
+
+import (
+	"io"
+	"net"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdWindowSize bounds the memory each direction of a zstd connection needs
+const zstdWindowSize = 1 << 20
+
+// Supported reports whether algorithm is one this build can relay with, api.CompressionNone included
+func Supported(algorithm string) bool {
+	switch algorithm {
+	case api.CompressionNone, api.CompressionSnappy, api.CompressionZstd:
+		return true
+	}
+	return false
+}
+
+// Conn is a tunnel connection compressing what is written to it and decompressing what is read
+type Conn struct {
+	net.Conn
+	r       io.Reader
+	w       flushWriter
+	release func() // frees the decompressor once reading is done, nil if there is nothing to free
+	readErr error
+}
+
+// flushWriter is a compressing writer that can push out what it holds and end its stream
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// NewConn wraps conn in algorithm, or returns it as it is for api.CompressionNone. Both ends of
+// the connection must use the same algorithm.
+func NewConn(conn net.Conn, algorithm string) (net.Conn, error) {
+	switch algorithm {
+	case api.CompressionSnappy:
+		return &Conn{
+			Conn: conn,
+			r:    s2.NewReader(conn),
+			w:    s2.NewWriter(conn, s2.WriterSnappyCompat(), s2.WriterConcurrency(1), s2.WriterFlushOnWrite()),
+		}, nil
+	case api.CompressionZstd:
+		enc, err := zstd.NewWriter(conn, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(zstdWindowSize), zstd.WithLowerEncoderMem(true))
+		if err != nil {
+			return nil, err
+		}
+		dec, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(zstdWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		return &Conn{Conn: conn, r: dec, w: enc, release: dec.Close}, nil
+	}
+	return conn, nil
+}
+
+// Read decompresses from the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	n, err := c.r.Read(b)
+	if err != nil {
+		c.readErr = err
+		if c.release != nil {
+			c.release()
+			c.release = nil
+		}
+	}
+	return n, err
+}
+
+// Write compresses b and flushes it to the connection right away
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// CloseWrite ends the compressed stream and half-closes the connection, so the peer reads EOF
+func (c *Conn) CloseWrite() error {
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+	return conntrack.CloseWrite(c.Conn)
+}
@@ -0,0 +1,271 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+var algorithms = []string{api.CompressionNone, api.CompressionSnappy, api.CompressionZstd}
+
+// relayChunk is what the relay writes at a time with its default buffer
+const relayChunk = 32 * 1024
+
+// streamSize is larger than the zstd window, so the benchmarks' chunks can't be matched against
+// their earlier copies
+const streamSize = 4 * zstdWindowSize
+
+// payloads are a text-heavy protocol, which compresses well, and random data, which doesn't
+var payloads = map[string][]byte{
+	"text":   textPayload(streamSize),
+	"random": randomPayload(streamSize),
+}
+
+// chunk returns the i-th relay write of a payload, wrapping around at its end
+func chunk(payload []byte, i int) []byte {
+	off := i * relayChunk % len(payload)
+	return payload[off : off+relayChunk]
+}
+
+// textPayload returns n bytes of access-log lines
+func textPayload(n int) []byte {
+	r := rand.New(rand.NewPCG(1, 2))
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		fmt.Fprintf(&buf, `{"time":"2026-01-02T15:04:%02d","method":"GET","path":"/api/v1/items/%d","status":%d,"ms":%d}`+"\n",
+			r.IntN(60), r.IntN(100000), []int{200, 200, 200, 304, 404}[r.IntN(5)], r.IntN(500))
+	}
+	return buf.Bytes()[:n]
+}
+
+// randomPayload returns n random bytes, like already compressed or encrypted data
+func randomPayload(n int) []byte {
+	b := make([]byte, n)
+	rand.NewChaCha8([32]byte{}).Read(b)
+	return b
+}
+
+// memConn is a connection that reads from r and writes to w
+type memConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *memConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *memConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// countingConn counts the bytes written to a connection
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	a, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		tb.Fatal("accept failed")
+	}
+	tb.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			a, b := tcpPair(t)
+			writer, err := NewConn(a, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader, err := NewConn(b, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Writes of every size arrive whole and in order, and closing the write side ends the stream
+			var want bytes.Buffer
+			go func() {
+				for _, size := range []int{1, 100, relayChunk, 3 * relayChunk} {
+					data := payloads["text"][:size]
+					for written := 0; written < size; written += relayChunk {
+						writer.Write(data[written:min(written+relayChunk, size)])
+					}
+				}
+				writer.(interface{ CloseWrite() error }).CloseWrite()
+			}()
+			for _, size := range []int{1, 100, relayChunk, 3 * relayChunk} {
+				want.Write(payloads["text"][:size])
+			}
+
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Errorf("read %d bytes that differ from the %d written", len(got), want.Len())
+			}
+		})
+	}
+}
+
+// TestConnFlushesEachWrite checks a small write can be read before the next one, so interactive
+// traffic isn't held back
+func TestConnFlushesEachWrite(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			a, b := tcpPair(t)
+			writer, _ := NewConn(a, algorithm)
+			reader, _ := NewConn(b, algorithm)
+
+			buf := make([]byte, 16)
+			for _, line := range []string{"ls\n", "cd /tmp\n"} {
+				if _, err := writer.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+				n, err := io.ReadFull(reader, buf[:len(line)])
+				if err != nil || string(buf[:n]) != line {
+					t.Fatalf("read %q, %v, want %q", buf[:n], err, line)
+				}
+			}
+		})
+	}
+}
+
+func TestSupported(t *testing.T) {
+	for _, algorithm := range algorithms {
+		if !Supported(algorithm) {
+			t.Errorf("Supported(%q) = false", algorithm)
+		}
+	}
+	if Supported("gzip") {
+		t.Error(`Supported("gzip") = true`)
+	}
+}
+
+// BenchmarkThroughput relays 32KB writes over loopback TCP through a compressing and a
+// decompressing end, reporting how much of the payload goes over the wire
+func BenchmarkThroughput(b *testing.B) {
+	for _, payload := range []string{"text", "random"} {
+		for _, algorithm := range algorithms {
+			b.Run(payload+"/"+algorithm, func(b *testing.B) {
+				a, c := tcpPair(b)
+				wire := &countingConn{Conn: a}
+				writer, err := NewConn(wire, algorithm)
+				if err != nil {
+					b.Fatal(err)
+				}
+				reader, err := NewConn(c, algorithm)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				done := make(chan struct{})
+				go func() {
+					io.Copy(io.Discard, reader)
+					close(done)
+				}()
+
+				b.SetBytes(relayChunk)
+				i := 0
+				for b.Loop() {
+					if _, err := writer.Write(chunk(payloads[payload], i)); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+				a.Close()
+				<-done
+				b.ReportMetric(float64(wire.written.Load())/float64(i*relayChunk), "wire/payload")
+			})
+		}
+	}
+}
+
+// BenchmarkCompress measures the CPU cost of compressing and flushing a 32KB write in memory
+func BenchmarkCompress(b *testing.B) {
+	for _, payload := range []string{"text", "random"} {
+		for _, algorithm := range algorithms {
+			b.Run(payload+"/"+algorithm, func(b *testing.B) {
+				conn, err := NewConn(&memConn{w: io.Discard}, algorithm)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(relayChunk)
+				i := 0
+				for b.Loop() {
+					if _, err := conn.Write(chunk(payloads[payload], i)); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkDecompress measures the CPU cost of decompressing a 32KB write in memory
+func BenchmarkDecompress(b *testing.B) {
+	for _, payload := range []string{"text", "random"} {
+		for _, algorithm := range algorithms {
+			b.Run(payload+"/"+algorithm, func(b *testing.B) {
+				// Compress the whole payload, which is decompressed over and over
+				writes := streamSize / relayChunk
+				var stream bytes.Buffer
+				enc, err := NewConn(&memConn{w: &stream}, algorithm)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for i := range writes {
+					enc.Write(chunk(payloads[payload], i))
+				}
+
+				buf := make([]byte, relayChunk)
+				b.SetBytes(relayChunk)
+				var dec net.Conn
+				i := 0
+				for b.Loop() {
+					if i%writes == 0 {
+						dec, _ = NewConn(&memConn{r: bytes.NewReader(stream.Bytes())}, algorithm)
+					}
+					if _, err := io.ReadFull(dec, buf); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		}
+	}
+}
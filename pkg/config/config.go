@@ -10,17 +10,41 @@ import (
 	"strings"
 )
 
+// DefaultMTU is the MTU of the WireGuard device when the config sets none and none can be detected
+const DefaultMTU = 1420
+
 // WireGuardConfig holds parsed WireGuard configuration
 type WireGuardConfig struct {
 	InterfaceIPs []netip.Addr
-	MTU          int
+	MTU          int // 0 if the config sets none
 	IPCConfig    string
+	Endpoints    []string // resolved peer endpoints as ip:port
+	Peers        []PeerConfig
+
+	// Shell commands of the [Interface] hooks, in the order given, run as wg-quick does when
+	// hooks are allowed
+	PreUp    []string
+	PostUp   []string
+	PreDown  []string
+	PostDown []string
+}
+
+// PeerConfig holds the parsed settings of a [Peer] section
+type PeerConfig struct {
+	AllowedIPs []netip.Prefix
+	Endpoint   string // resolved as ip:port, empty if the peer has none
+
+	PublicKey    string // base64, as in the config
+	EndpointHost string // hostname the endpoint was resolved from, empty if it was given as an IP
 }
 
 // ParseWireGuardConfig parses a WireGuard config file and returns all needed values in one pass
 func ParseWireGuardConfig(config string) (*WireGuardConfig, error) {
 	var interfaceIPs []netip.Addr
-	var mtu int = 1420 // default MTU
+	var mtu int // 0 = not set
+	var endpoints []string
+	var peers []PeerConfig
+	var preUp, postUp, preDown, postDown []string
 	var ipcConfig strings.Builder
 
 	lines := strings.SplitSeq(config, "\n")
@@ -42,6 +66,7 @@ func ParseWireGuardConfig(config string) (*WireGuardConfig, error) {
 		} else if line == "[Peer]" {
 			inInterface = false
 			inPeer = true
+			peers = append(peers, PeerConfig{})
 			continue
 		}
 
@@ -99,8 +124,17 @@ func ParseWireGuardConfig(config string) (*WireGuardConfig, error) {
 						return nil, fmt.Errorf("invalid ListenPort %d: must be between 1-65535", port)
 					}
 					ipcConfig.WriteString(fmt.Sprintf("listen_port=%s\n", value))
+				case "PreUp":
+					preUp = append(preUp, value)
+				case "PostUp":
+					postUp = append(postUp, value)
+				case "PreDown":
+					preDown = append(preDown, value)
+				case "PostDown":
+					postDown = append(postDown, value)
 				}
 			} else if inPeer {
+				peer := &peers[len(peers)-1]
 				switch key {
 				case "PublicKey":
 					// Convert base64 to hex for IPC
@@ -110,6 +144,7 @@ func ParseWireGuardConfig(config string) (*WireGuardConfig, error) {
 					}
 					hexKey := hex.EncodeToString(keyBytes)
 					ipcConfig.WriteString(fmt.Sprintf("public_key=%s\n", hexKey))
+					peer.PublicKey = value
 				case "AllowedIPs":
 					// Handle multiple IPs and ensure proper CIDR notation
 					allowedIPs := strings.SplitSeq(value, ",")
@@ -131,10 +166,11 @@ func ParseWireGuardConfig(config string) (*WireGuardConfig, error) {
 						}
 
 						// Validate CIDR notation
-						_, _, err := net.ParseCIDR(allowedIP)
+						prefix, err := netip.ParsePrefix(allowedIP)
 						if err != nil {
 							return nil, fmt.Errorf("invalid AllowedIP CIDR %s: %v", allowedIP, err)
 						}
+						peer.AllowedIPs = append(peer.AllowedIPs, prefix)
 
 						ipcConfig.WriteString(fmt.Sprintf("allowed_ip=%s\n", allowedIP))
 					}
@@ -169,8 +205,11 @@ func ParseWireGuardConfig(config string) (*WireGuardConfig, error) {
 						if len(ips) > 0 {
 							endpointValue = net.JoinHostPort(ips[0].String(), port)
 						}
+						peer.EndpointHost = host
 					}
 					ipcConfig.WriteString(fmt.Sprintf("endpoint=%s\n", endpointValue))
+					endpoints = append(endpoints, endpointValue)
+					peer.Endpoint = endpointValue
 				case "PersistentKeepalive":
 					// Validate keepalive interval
 					keepalive, err := strconv.Atoi(value)
@@ -194,5 +233,11 @@ func ParseWireGuardConfig(config string) (*WireGuardConfig, error) {
 		InterfaceIPs: interfaceIPs,
 		MTU:          mtu,
 		IPCConfig:    ipcConfig.String(),
+		Endpoints:    endpoints,
+		Peers:        peers,
+		PreUp:        preUp,
+		PostUp:       postUp,
+		PreDown:      preDown,
+		PostDown:     postDown,
 	}, nil
 }
@@ -0,0 +1,19 @@
+package config
+
+import (
+	"log"
+	"os"
+)
+
+// ReadSecretFile reads a file that holds secrets such as a private key. Files readable by group or
+// others are reported: with strict set the read fails, otherwise a warning is logged.
+func ReadSecretFile(path string, strict bool) ([]byte, error) {
+	if err := checkSecretPermissions(path); err != nil {
+		if strict {
+			return nil, err
+		}
+		log.Printf("WARNING: %v", err)
+	}
+
+	return os.ReadFile(path)
+}
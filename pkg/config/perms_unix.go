@@ -0,0 +1,23 @@
+//go:build !windows
+
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkSecretPermissions returns an error if the file can be accessed by its group or by others
+func checkSecretPermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		// Let the read report missing or unreadable files
+		return nil
+	}
+
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("%s contains secrets but is accessible by group or others (mode %04o), run chmod 600 %s",
+			path, perm, path)
+	}
+	return nil
+}
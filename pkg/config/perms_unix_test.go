@@ -0,0 +1,78 @@
+//go:build !windows
+
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSecretFile creates a file with the given mode, regardless of the umask
+func writeSecretFile(t *testing.T, mode os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wg.conf")
+	if err := os.WriteFile(path, []byte("[Interface]\n"), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadSecretFilePermissions(t *testing.T) {
+	tests := []struct {
+		mode    os.FileMode
+		tooOpen bool
+	}{
+		{0o600, false},
+		{0o400, false},
+		{0o700, false},
+		{0o640, true},
+		{0o644, true},
+		{0o660, true},
+		{0o604, true},
+		{0o602, true},
+		{0o610, true},
+		{0o666, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			path := writeSecretFile(t, tt.mode)
+
+			if err := checkSecretPermissions(path); (err != nil) != tt.tooOpen {
+				t.Errorf("checkSecretPermissions() = %v, want too open: %v", err, tt.tooOpen)
+			}
+
+			// Without strict mode the file is read either way
+			data, err := ReadSecretFile(path, false)
+			if err != nil || len(data) == 0 {
+				t.Errorf("ReadSecretFile(strict=false) = %q, %v, want the contents", data, err)
+			}
+
+			data, err = ReadSecretFile(path, true)
+			if tt.tooOpen && (err == nil || data != nil) {
+				t.Errorf("ReadSecretFile(strict=true) = %q, %v, want an error", data, err)
+			}
+			if !tt.tooOpen && err != nil {
+				t.Errorf("ReadSecretFile(strict=true) = %v, want the contents", err)
+			}
+		})
+	}
+}
+
+func TestReadSecretFileMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.conf")
+
+	// The read reports a missing file, not the permission check
+	if err := checkSecretPermissions(path); err != nil {
+		t.Errorf("checkSecretPermissions() = %v, want nil", err)
+	}
+	if _, err := ReadSecretFile(path, true); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadSecretFile() = %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package config
+
+// checkSecretPermissions is a no-op on Windows, where access is governed by ACLs rather than
+// POSIX mode bits and files in a user's profile are private by default
+func checkSecretPermissions(path string) error {
+	return nil
+}
@@ -0,0 +1,31 @@
+package conntrack
+
+import (
+	"bufio"
+	"net"
+)
+
+// BufferedConn is a connection whose first bytes were already read into a bufio.Reader, e.g.
+// while parsing a request header. Reads drain the reader before reading from the connection.
+type BufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewBufferedConn returns conn reading through r, or conn itself if r holds no data
+func NewBufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	return &BufferedConn{Conn: conn, r: r}
+}
+
+// Read reads the buffered bytes first, then from the connection
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection
+func (c *BufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
@@ -0,0 +1,54 @@
+package conntrack
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// CountingConn wraps a net.Conn and counts the bytes read from and written to it
+type CountingConn struct {
+	net.Conn
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	writeTimeout time.Duration // how long each write may block, 0 for no limit
+}
+
+// NewCountingConn wraps conn so that its traffic is counted
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+// Read reads from the underlying connection and counts the bytes read
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(uint64(n))
+	return n, err
+}
+
+// SetWriteTimeout bounds how long each write may block. The write deadline is moved forward as
+// each write starts, so time spent waiting for something to write doesn't count. Set it before
+// the connection is used.
+func (c *CountingConn) SetWriteTimeout(d time.Duration) {
+	c.writeTimeout = d
+}
+
+// Write writes to the underlying connection and counts the bytes written
+func (c *CountingConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(uint64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the connection so far
+func (c *CountingConn) BytesRead() uint64 {
+	return c.bytesRead.Load()
+}
+
+// BytesWritten returns the number of bytes written to the connection so far
+func (c *CountingConn) BytesWritten() uint64 {
+	return c.bytesWritten.Load()
+}
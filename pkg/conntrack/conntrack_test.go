@@ -0,0 +1,38 @@
+package conntrack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteTimeoutBoundsEachWrite(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := NewCountingConn(local)
+	conn.SetWriteTimeout(50 * time.Millisecond)
+
+	// Time spent idle between writes doesn't count against the timeout
+	go io.Copy(io.Discard, io.LimitReader(remote, 5))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// A write nobody reads blocks until the timeout
+	start := time.Now()
+	_, err := conn.Write([]byte("stuck"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("blocked write error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("blocked write returned after %v, want soon after the timeout", elapsed)
+	}
+	if n := conn.BytesWritten(); n != 5 {
+		t.Errorf("BytesWritten() = %d, want 5", n)
+	}
+}
@@ -0,0 +1,93 @@
+package conntrack
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Classes of the errors a relay can end with
+const (
+	ErrorReset       = "reset"       // the peer reset the connection
+	ErrorTimeout     = "timeout"     // a deadline passed, or the kernel gave up retransmitting
+	ErrorBrokenPipe  = "broken_pipe" // written to after the peer closed it
+	ErrorAborted     = "aborted"     // aborted on this side, e.g. by the netstack
+	ErrorUnreachable = "unreachable" // the network or host became unreachable
+	ErrorClosed      = "closed"      // closed locally while still in use
+	ErrorOther       = "other"
+)
+
+// netstackErrors maps the messages of the netstack's TCP errors, which its connections return as
+// plain strings, to their classes
+var netstackErrors = map[string]string{
+	"connection reset by peer": ErrorReset,
+	"operation timed out":      ErrorTimeout,
+	"connection aborted":       ErrorAborted,
+	"network is unreachable":   ErrorUnreachable,
+	"no route to host":         ErrorUnreachable,
+}
+
+// ClassifyError sorts an error a relay ended with into one of the Error classes, by its errno,
+// whether it's a timeout, or its netstack message. It returns an empty string for nil.
+func ClassifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNRESET:
+			return ErrorReset
+		case syscall.ETIMEDOUT:
+			return ErrorTimeout
+		case syscall.EPIPE:
+			return ErrorBrokenPipe
+		case syscall.ECONNABORTED:
+			return ErrorAborted
+		case syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+			return ErrorUnreachable
+		}
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return ErrorClosed
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+
+	msg := err.Error()
+	for text, class := range netstackErrors {
+		if strings.HasSuffix(msg, text) {
+			return class
+		}
+	}
+	return ErrorOther
+}
+
+// ErrorCounts counts relay errors by class. The zero value is ready to use.
+type ErrorCounts struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// Add counts an error of class
+func (c *ErrorCounts) Add(class string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[class]++
+}
+
+// Snapshot returns a copy of the counts, nil if no error was counted
+func (c *ErrorCounts) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.counts)
+}
@@ -0,0 +1,58 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ErrorReset},
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, ErrorBrokenPipe},
+		{"kernel timeout", syscall.ETIMEDOUT, ErrorTimeout},
+		{"host unreachable", syscall.EHOSTUNREACH, ErrorUnreachable},
+		{"deadline", &net.OpError{Op: "write", Net: "tcp", Err: os.ErrDeadlineExceeded}, ErrorTimeout},
+		{"closed", fmt.Errorf("copy: %w", net.ErrClosed), ErrorClosed},
+		{"netstack reset", errors.New("connection reset by peer"), ErrorReset},
+		{"netstack abort", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection aborted")}, ErrorAborted},
+		{"unknown", errors.New("something else"), ErrorOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorCounts(t *testing.T) {
+	var counts ErrorCounts
+	if snapshot := counts.Snapshot(); snapshot != nil {
+		t.Errorf("Snapshot before any error = %v, want nil", snapshot)
+	}
+
+	counts.Add(ErrorReset)
+	counts.Add(ErrorReset)
+	counts.Add(ErrorTimeout)
+	snapshot := counts.Snapshot()
+	if snapshot[ErrorReset] != 2 || snapshot[ErrorTimeout] != 1 || len(snapshot) != 2 {
+		t.Errorf("Snapshot = %v, want 2 resets and 1 timeout", snapshot)
+	}
+
+	// The snapshot is a copy
+	snapshot[ErrorReset] = 10
+	if got := counts.Snapshot()[ErrorReset]; got != 2 {
+		t.Errorf("resets after changing a snapshot = %d, want 2", got)
+	}
+}
@@ -0,0 +1,33 @@
+package conntrack
+
+import "net"
+
+// closeWriter is implemented by connections that can shut down their writing side alone, such as
+// *net.TCPConn and the netstack's TCP connections
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of conn, so its peer reads EOF while data can still flow
+// the other way. Connections without CloseWrite are closed; for yamux streams that is the same,
+// since closing a stream only ends the local side.
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// FinishCopy ends one direction of a relay once copying from src to dst stopped with err. A copy
+// that reached EOF half-closes dst, passing the end of the data on while the other direction keeps
+// flowing, as protocols like SMTP expect. A failed copy closes both connections.
+func FinishCopy(dst, src net.Conn, err error) {
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if CloseWrite(dst) != nil {
+		dst.Close()
+	}
+}
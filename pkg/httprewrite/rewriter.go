@@ -0,0 +1,121 @@
+// Package httprewrite rewrites the Host header of the first HTTP request read from a connection
+package httprewrite
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// MaxHeaderBytes bounds how much of the first request is buffered while looking for the end of
+// its header. The rest of a larger header is passed through unchanged.
+const MaxHeaderBytes = 64 << 10
+
+// ValidateHost checks that host can be used as a Host header value
+func ValidateHost(host string) error {
+	if host == "" || len(host) > 255 {
+		return fmt.Errorf("host must be 1 to 255 characters")
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c <= ' ' || c >= 0x7f {
+			return fmt.Errorf("host %q contains a space or control character", host)
+		}
+	}
+	return nil
+}
+
+// Reader passes through the bytes of an underlying reader, setting the Host header of the first
+// HTTP request in them. Later requests on a kept-alive connection are passed through unchanged.
+// Data that doesn't start like an HTTP request, such as a TLS handshake, is not touched.
+type Reader struct {
+	br      *bufio.Reader
+	host    string
+	r       io.Reader // what Read returns from, set on the first Read
+	scanned bool
+}
+
+// NewReader returns a Reader setting the Host header of the first request read from r to host
+func NewReader(r io.Reader, host string) *Reader {
+	return &Reader{
+		br:   bufio.NewReaderSize(r, 4096),
+		host: host,
+	}
+}
+
+// Read reads the rewritten data. The first call reads the whole header of the first request.
+func (r *Reader) Read(p []byte) (int, error) {
+	if !r.scanned {
+		r.scanned = true
+		r.r = r.rewriteHeader()
+	}
+	return r.r.Read(p)
+}
+
+// rewriteHeader reads the header of the first request and returns a reader for the rewritten
+// header followed by the rest of the data. Whatever was read is kept if the data isn't HTTP.
+func (r *Reader) rewriteHeader() io.Reader {
+	// HTTP methods start with an upper case letter; anything else is passed on without waiting
+	// for a line that may never come
+	first, err := r.br.Peek(1)
+	if err != nil || first[0] < 'A' || first[0] > 'Z' {
+		return r.br
+	}
+
+	var head bytes.Buffer
+	sawHost := false
+	for {
+		line, err := r.br.ReadSlice('\n')
+		if err != nil {
+			// The data ended or a single line is longer than the buffer; give up on rewriting
+			head.Write(line)
+			return io.MultiReader(&head, r.br)
+		}
+
+		// The request line is kept as is
+		if head.Len() == 0 {
+			if !bytes.Contains(line, []byte(" HTTP/")) {
+				head.Write(line)
+				return io.MultiReader(&head, r.br)
+			}
+			head.Write(line)
+			continue
+		}
+
+		// The blank line ends the header; add a Host header if the request had none
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			if !sawHost {
+				fmt.Fprintf(&head, "Host: %s%s", r.host, lineEnding(line))
+			}
+			head.Write(line)
+			return io.MultiReader(&head, r.br)
+		}
+
+		if isHostHeader(line) {
+			if !sawHost {
+				fmt.Fprintf(&head, "Host: %s%s", r.host, lineEnding(line))
+			}
+			sawHost = true
+		} else {
+			head.Write(line)
+		}
+
+		if head.Len() > MaxHeaderBytes {
+			return io.MultiReader(&head, r.br)
+		}
+	}
+}
+
+// isHostHeader reports whether a header line is a Host header
+func isHostHeader(line []byte) bool {
+	name, _, found := bytes.Cut(line, []byte(":"))
+	return found && bytes.EqualFold(bytes.TrimSpace(name), []byte("Host"))
+}
+
+// lineEnding returns the line ending of line, "\r\n" or "\n"
+func lineEnding(line []byte) string {
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return "\r\n"
+	}
+	return "\n"
+}
@@ -0,0 +1,160 @@
+package logger
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LevelTrace is below slog.LevelDebug, for logs as detailed as every write of a relay
+const LevelTrace = slog.Level(-8)
+
+// Setup configures the default slog logger and returns it.
+// format is "text" (human-readable, stderr) or "json" (machine-readable, stdout);
+// level is one of "trace", "debug", "info", "warn" or "error", lowered further by verbose.
+// Output of the standard log package is routed through the same handler.
+func Setup(format, level string, verbose VerboseLevel) (*slog.Logger, error) {
+	var lvl slog.Level
+	if strings.EqualFold(level, "trace") {
+		lvl = LevelTrace
+	} else if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: must be trace, debug, info, warn or error", level)
+	}
+	lvl = verbose.apply(lvl)
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: lvl,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.LevelKey {
+					a.Value = levelName(a.Value)
+				}
+				return a
+			},
+		})
+	case "json":
+		handler = newJSONHandler(os.Stdout, lvl)
+	default:
+		return nil, fmt.Errorf("invalid output format %q: must be text or json", format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// newJSONHandler creates a JSON handler that names the standard keys timestamp, level and message
+func newJSONHandler(w io.Writer, level slog.Level) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.TimeKey:
+				a.Key = "timestamp"
+			case slog.MessageKey:
+				a.Key = "message"
+			case slog.LevelKey:
+				a.Value = levelName(a.Value)
+			}
+			return a
+		},
+	})
+}
+
+// levelName names LevelTrace TRACE instead of DEBUG-4
+func levelName(v slog.Value) slog.Value {
+	if level, ok := v.Any().(slog.Level); ok && level == LevelTrace {
+		return slog.StringValue("TRACE")
+	}
+	return v
+}
+
+// VerboseLevel is a flag counting how verbose logging should be: 1 for info, such as mappings
+// being registered, 2 for debug, such as each connection being opened and closed, and 3 for
+// trace, such as each write of a relay. Each -v raises it by one and a number sets it.
+type VerboseLevel int
+
+// String returns the level as a number
+func (v *VerboseLevel) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v))
+}
+
+// Set raises the level by one for a bare -v, and sets it to a number, e.g. from WGRP_VERBOSE
+func (v *VerboseLevel) Set(s string) error {
+	switch s {
+	case "true":
+		*v++
+		return nil
+	case "false":
+		*v = 0
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid verbosity %q: must be a number of at least 0", s)
+	}
+	*v = VerboseLevel(n)
+	return nil
+}
+
+// IsBoolFlag lets -v be given without a value
+func (v *VerboseLevel) IsBoolFlag() bool {
+	return true
+}
+
+// Register adds -v to fs, along with -vv and -vvv as the flag package doesn't combine them
+func (v *VerboseLevel) Register(fs *flag.FlagSet) {
+	fs.Var(v, "v", "Verbose logging: -v for info, -vv for debug with each connection and WireGuard device logs, -vvv for trace with each relayed write")
+	fs.Var(verboseShorthand{v, 2}, "vv", "Same as -v=2")
+	fs.Var(verboseShorthand{v, 3}, "vvv", "Same as -v=3")
+}
+
+// apply lowers level to the one the verbosity asks for, leaving it if it's lower already
+func (v VerboseLevel) apply(level slog.Level) slog.Level {
+	switch {
+	case v >= 3:
+		return min(level, LevelTrace)
+	case v == 2:
+		return min(level, slog.LevelDebug)
+	case v == 1:
+		return min(level, slog.LevelInfo)
+	}
+	return level
+}
+
+// verboseShorthand is a flag like -vv, raising a VerboseLevel to its level when given
+type verboseShorthand struct {
+	v     *VerboseLevel
+	level VerboseLevel
+}
+
+func (s verboseShorthand) String() string {
+	return "false"
+}
+
+func (s verboseShorthand) Set(value string) error {
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if on {
+		*s.v = max(*s.v, s.level)
+	}
+	return nil
+}
+
+func (s verboseShorthand) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,76 @@
+package logger
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestVerboseLevelFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want VerboseLevel
+	}{
+		{nil, 0},
+		{[]string{"-v"}, 1},
+		{[]string{"-v", "-v"}, 2},
+		{[]string{"-v", "-v", "-v", "-v"}, 4},
+		{[]string{"-vv"}, 2},
+		{[]string{"-vvv"}, 3},
+		{[]string{"-vv", "-v"}, 3},
+		{[]string{"-vvv", "-vv"}, 3},
+		{[]string{"-v=2"}, 2},
+		{[]string{"-v", "-v=0"}, 0},
+		{[]string{"-v=false"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			var v VerboseLevel
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			v.Register(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if v != tt.want {
+				t.Errorf("got %d, want %d", v, tt.want)
+			}
+		})
+	}
+
+	var v VerboseLevel
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	v.Register(fs)
+	for _, arg := range []string{"-v=-1", "-v=lots"} {
+		if err := fs.Parse([]string{arg}); err == nil {
+			t.Errorf("%s was accepted", arg)
+		}
+	}
+}
+
+func TestVerboseLevelApply(t *testing.T) {
+	tests := []struct {
+		verbose VerboseLevel
+		level   slog.Level
+		want    slog.Level
+	}{
+		{0, slog.LevelWarn, slog.LevelWarn},
+		{1, slog.LevelWarn, slog.LevelInfo},
+		{2, slog.LevelInfo, slog.LevelDebug},
+		{3, slog.LevelInfo, LevelTrace},
+		{5, slog.LevelInfo, LevelTrace},
+
+		// A level that is already lower is kept
+		{1, slog.LevelDebug, slog.LevelDebug},
+		{2, LevelTrace, LevelTrace},
+	}
+
+	for _, tt := range tests {
+		if got := tt.verbose.apply(tt.level); got != tt.want {
+			t.Errorf("VerboseLevel(%d).apply(%s) = %s, want %s", tt.verbose, tt.level, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package proxyproto writes version 2 of the PROXY protocol header, which tells the backend the
+// address an external connection came from, followed by TLV fields of application data. See
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// signature starts every version 2 header
+var signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Version and command byte: version 2 in the high nibble, the command in the low one
+const (
+	cmdLocal = 0x20 // no addresses, e.g. for health checks
+	cmdProxy = 0x21 // relayed on behalf of the addresses that follow
+)
+
+// Address family and transport byte
+const (
+	famUnspec  = 0x00
+	famTCPIPv4 = 0x11
+	famTCPIPv6 = 0x21
+)
+
+// Sizes of the fixed parts of a header
+const (
+	headerSize    = 16 // signature, version and command, family, and length
+	ipv4AddrsSize = 12 // source and destination address, source and destination port
+	ipv6AddrsSize = 36
+	tlvHeaderSize = 3 // type and 16-bit length
+)
+
+// TypeCRC32C is the TLV type of a checksum over the whole header, which WriteV2Header doesn't
+// compute and so refuses
+const TypeCRC32C = 0x03
+
+// ValidateTLVs checks that tlvs fit in a header and that WriteV2Header can send them
+func ValidateTLVs(tlvs []api.TLVEntry) error {
+	size := ipv6AddrsSize
+	for _, tlv := range tlvs {
+		if tlv.Type == TypeCRC32C {
+			return fmt.Errorf("TLV type 0x%02x is a checksum over the header and can't be set", tlv.Type)
+		}
+		size += tlvHeaderSize + len(tlv.Value)
+	}
+	if size > 0xFFFF {
+		return fmt.Errorf("TLVs take %d bytes, more than a header can hold", size-ipv6AddrsSize)
+	}
+	return nil
+}
+
+// WriteV2Header writes a PROXY protocol version 2 header for a TCP connection from src to dst,
+// followed by tlvs in their order. An IPv4 address is sent as IPv4-mapped IPv6 if the other one
+// is IPv6. If either address isn't TCP, the header uses the LOCAL command without addresses, so
+// the backend uses those of the connection itself.
+func WriteV2Header(w io.Writer, src, dst net.Addr, tlvs []api.TLVEntry) error {
+	if err := ValidateTLVs(tlvs); err != nil {
+		return err
+	}
+
+	cmd, fam := byte(cmdLocal), byte(famUnspec)
+	var addrs []byte
+	srcAddr, srcOK := tcpAddrPort(src)
+	dstAddr, dstOK := tcpAddrPort(dst)
+	if srcOK && dstOK {
+		cmd = cmdProxy
+		if srcAddr.Addr().Is4() && dstAddr.Addr().Is4() {
+			fam = famTCPIPv4
+			addrs = make([]byte, 0, ipv4AddrsSize)
+			addrs = append(addrs, srcAddr.Addr().AsSlice()...)
+			addrs = append(addrs, dstAddr.Addr().AsSlice()...)
+		} else {
+			fam = famTCPIPv6
+			addrs = make([]byte, 0, ipv6AddrsSize)
+			addrs = append(addrs, as16(srcAddr.Addr())...)
+			addrs = append(addrs, as16(dstAddr.Addr())...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, srcAddr.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dstAddr.Port())
+	}
+
+	length := len(addrs)
+	for _, tlv := range tlvs {
+		length += tlvHeaderSize + len(tlv.Value)
+	}
+
+	header := make([]byte, 0, headerSize+length)
+	header = append(header, signature...)
+	header = append(header, cmd, fam)
+	header = binary.BigEndian.AppendUint16(header, uint16(length))
+	header = append(header, addrs...)
+	for _, tlv := range tlvs {
+		header = append(header, tlv.Type)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(tlv.Value)))
+		header = append(header, tlv.Value...)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// tcpAddrPort returns the address and port of a TCP address, unmapping IPv4-mapped IPv6
+func tcpAddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	addrPort := tcpAddr.AddrPort()
+	if !addrPort.IsValid() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+}
+
+// as16 returns addr in its 16-byte form, IPv4 as IPv4-mapped IPv6
+func as16(addr netip.Addr) []byte {
+	b := addr.As16()
+	return b[:]
+}
@@ -0,0 +1,251 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// header is a PROXY protocol version 2 header as read by a backend
+type header struct {
+	command  byte
+	family   byte
+	src, dst netip.AddrPort
+	tlvs     []api.TLVEntry
+}
+
+// parseV2Header reads a header the way section 2.2 of the specification describes, independently
+// of WriteV2Header, and returns what follows it
+func parseV2Header(b []byte) (header, []byte, error) {
+	var h header
+	if len(b) < headerSize || !bytes.Equal(b[:12], signature) {
+		return h, nil, errors.New("no signature")
+	}
+	if b[12]>>4 != 2 {
+		return h, nil, fmt.Errorf("version %d", b[12]>>4)
+	}
+	h.command, h.family = b[12]&0x0F, b[13]
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < headerSize+length {
+		return h, nil, fmt.Errorf("length %d exceeds the %d bytes that follow", length, len(b)-headerSize)
+	}
+	body, rest := b[headerSize:headerSize+length], b[headerSize+length:]
+
+	// Addresses come first for the PROXY command; the LOCAL command has none to skip
+	switch h.family {
+	case famTCPIPv4:
+		if len(body) < ipv4AddrsSize {
+			return h, nil, errors.New("short IPv4 addresses")
+		}
+		h.src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:10]))
+		h.dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[4:8])), binary.BigEndian.Uint16(body[10:12]))
+		body = body[ipv4AddrsSize:]
+	case famTCPIPv6:
+		if len(body) < ipv6AddrsSize {
+			return h, nil, errors.New("short IPv6 addresses")
+		}
+		h.src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[0:16])), binary.BigEndian.Uint16(body[32:34]))
+		h.dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[16:32])), binary.BigEndian.Uint16(body[34:36]))
+		body = body[ipv6AddrsSize:]
+	case famUnspec:
+	default:
+		return h, nil, fmt.Errorf("family 0x%02x", h.family)
+	}
+
+	// The rest of the announced length is TLVs, each a type, a 16-bit length and the value
+	for len(body) > 0 {
+		if len(body) < tlvHeaderSize {
+			return h, nil, errors.New("truncated TLV header")
+		}
+		n := int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < tlvHeaderSize+n {
+			return h, nil, errors.New("truncated TLV value")
+		}
+		h.tlvs = append(h.tlvs, api.TLVEntry{Type: body[0], Value: body[tlvHeaderSize : tlvHeaderSize+n]})
+		body = body[tlvHeaderSize+n:]
+	}
+	return h, rest, nil
+}
+
+func tcpAddr(s string) *net.TCPAddr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+// TestWriteV2HeaderBytes checks headers byte for byte against ones encoded by hand from the spec
+func TestWriteV2HeaderBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		tlvs     []api.TLVEntry
+		want     []byte // after the signature
+	}{
+		{
+			"IPv4",
+			tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.7:443"), nil,
+			[]byte{
+				0x21, 0x11, 0x00, 0x0C, // version 2 PROXY, TCP over IPv4, 12 bytes
+				192, 0, 2, 1, 198, 51, 100, 7,
+				0xDC, 0x04, 0x01, 0xBB,
+			},
+		},
+		{
+			"IPv4 with TLVs",
+			tcpAddr("10.0.0.1:1"), tcpAddr("10.0.0.2:2"),
+			[]api.TLVEntry{{Type: 0xE0, Value: []byte("peer")}, {Type: 0x02, Value: []byte{}}},
+			[]byte{
+				0x21, 0x11, 0x00, 0x16, // 12 bytes of addresses and 3+4 and 3+0 bytes of TLVs
+				10, 0, 0, 1, 10, 0, 0, 2,
+				0x00, 0x01, 0x00, 0x02,
+				0xE0, 0x00, 0x04, 'p', 'e', 'e', 'r',
+				0x02, 0x00, 0x00,
+			},
+		},
+		{
+			"IPv6",
+			tcpAddr("[2001:db8::1]:8080"), tcpAddr("[2001:db8::2]:80"), nil,
+			[]byte{
+				0x21, 0x21, 0x00, 0x24, // version 2 PROXY, TCP over IPv6, 36 bytes
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+				0x1F, 0x90, 0x00, 0x50,
+			},
+		},
+		{
+			"IPv4 source to IPv6 destination",
+			tcpAddr("192.0.2.1:1"), tcpAddr("[2001:db8::2]:2"), nil,
+			[]byte{
+				0x21, 0x21, 0x00, 0x24,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 192, 0, 2, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+				0x00, 0x01, 0x00, 0x02,
+			},
+		},
+		{
+			"IPv4-mapped addresses are sent as IPv4",
+			tcpAddr("[::ffff:192.0.2.1]:1"), tcpAddr("[::ffff:192.0.2.2]:2"), nil,
+			[]byte{
+				0x21, 0x11, 0x00, 0x0C,
+				192, 0, 2, 1, 192, 0, 2, 2,
+				0x00, 0x01, 0x00, 0x02,
+			},
+		},
+		{
+			"LOCAL without TCP addresses",
+			&net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, tcpAddr("10.0.0.2:2"),
+			[]api.TLVEntry{{Type: 0xE1, Value: []byte{0xAB}}},
+			[]byte{
+				0x20, 0x00, 0x00, 0x04, // version 2 LOCAL, unspecified family, only the TLV
+				0xE1, 0x00, 0x01, 0xAB,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteV2Header(&buf, tt.src, tt.dst, tt.tlvs); err != nil {
+				t.Fatal(err)
+			}
+			want := append(bytes.Clone(signature), tt.want...)
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("header\n got % x\nwant % x", buf.Bytes(), want)
+			}
+		})
+	}
+}
+
+// TestWriteV2HeaderRoundTrip writes headers and reads them back as a backend would
+func TestWriteV2HeaderRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte{0x5A}, 1000)
+	tests := []struct {
+		name     string
+		src, dst string
+		tlvs     []api.TLVEntry
+	}{
+		{"IPv4", "203.0.113.9:40000", "10.99.0.2:8080", nil},
+		{"IPv6", "[2001:db8::9]:40000", "[fd99::2]:8080", nil},
+		{"peer key hash", "203.0.113.9:40000", "10.99.0.2:8080", []api.TLVEntry{{Type: 0xE0, Value: bytes.Repeat([]byte{0x01, 0x02}, 16)}}},
+		{"several TLVs in order", "[2001:db8::9]:1", "[fd99::2]:2", []api.TLVEntry{
+			{Type: 0x01, Value: []byte("h2")},
+			{Type: 0xEF, Value: big},
+			{Type: 0xE0, Value: []byte{}},
+			{Type: 0xE0, Value: []byte("again")},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteV2Header(&buf, tcpAddr(tt.src), tcpAddr(tt.dst), tt.tlvs); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			h, rest, err := parseV2Header(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.command != 0x1 || h.src.String() != tt.src || h.dst.String() != tt.dst {
+				t.Errorf("read command %d from %s to %s, want PROXY from %s to %s", h.command, h.src, h.dst, tt.src, tt.dst)
+			}
+			if !reflect.DeepEqual(h.tlvs, tt.tlvs) {
+				t.Errorf("read TLVs %v, want %v", h.tlvs, tt.tlvs)
+			}
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("data after the header = %q, want the connection's own", rest)
+			}
+		})
+	}
+}
+
+func TestWriteV2HeaderLimits(t *testing.T) {
+	src, dst := tcpAddr("[2001:db8::1]:1"), tcpAddr("[2001:db8::2]:2")
+
+	// The largest TLV that fits an IPv6 header's 16-bit length, which ValidateTLVs allows for any address
+	fits := []api.TLVEntry{{Type: 0xE0, Value: make([]byte, 0xFFFF-ipv6AddrsSize-tlvHeaderSize)}}
+	var buf bytes.Buffer
+	if err := WriteV2Header(&buf, src, dst, fits); err != nil {
+		t.Fatalf("TLV filling the header: %v", err)
+	}
+	if length := binary.BigEndian.Uint16(buf.Bytes()[14:16]); length != 0xFFFF {
+		t.Errorf("length = %d, want 65535", length)
+	}
+
+	tests := []struct {
+		name string
+		tlvs []api.TLVEntry
+		want string
+	}{
+		{"one byte too many", []api.TLVEntry{{Type: 0xE0, Value: make([]byte, len(fits[0].Value)+1)}}, "more than a header can hold"},
+		{"many small TLVs", repeatTLV(30000, api.TLVEntry{Type: 0xE0}), "more than a header can hold"},
+		{"checksum", []api.TLVEntry{{Type: TypeCRC32C, Value: make([]byte, 4)}}, "checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTLVs(tt.tlvs); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ValidateTLVs() = %v, want an error saying %q", err, tt.want)
+			}
+			var buf bytes.Buffer
+			if err := WriteV2Header(&buf, src, dst, tt.tlvs); err == nil || buf.Len() != 0 {
+				t.Errorf("WriteV2Header() = %v after writing %d bytes, want an error before writing", err, buf.Len())
+			}
+		})
+	}
+}
+
+// repeatTLV returns n copies of tlv
+func repeatTLV(n int, tlv api.TLVEntry) []api.TLVEntry {
+	tlvs := make([]api.TLVEntry, n)
+	for i := range tlvs {
+		tlvs[i] = tlv
+	}
+	return tlvs
+}
@@ -0,0 +1,107 @@
+// Package ratelimit shares a bandwidth limit among connections with a token bucket of bytes
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the least the bucket holds, so a relay buffer's worth of data can go out in one
+// write even at low rates
+const minBurst = 32 * 1024
+
+// BandwidthLimiter is a token bucket of bytes shared by the connections it limits. The bucket
+// holds one second's worth of bytes, at least minBurst. It is safe for concurrent use.
+type BandwidthLimiter struct {
+	limiter   *rate.Limiter
+	unlimited atomic.Bool // writes pass without taking the bucket's lock
+}
+
+// NewBandwidthLimiter creates a limiter for bytesPerSecond, 0 for no limit
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	l := &BandwidthLimiter{limiter: rate.NewLimiter(rate.Inf, minBurst)}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the rate to bytesPerSecond, 0 for no limit. Connections already limited by l
+// take the new rate with their next write.
+func (l *BandwidthLimiter) SetLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.unlimited.Store(true)
+		l.limiter.SetLimit(rate.Inf)
+		return
+	}
+	l.limiter.SetBurst(int(max(bytesPerSecond, minBurst)))
+	l.limiter.SetLimit(rate.Limit(bytesPerSecond))
+	l.unlimited.Store(false)
+}
+
+// Limit returns the rate in bytes per second, 0 for no limit
+func (l *BandwidthLimiter) Limit() int64 {
+	limit := l.limiter.Limit()
+	if limit == rate.Inf {
+		return 0
+	}
+	return int64(limit)
+}
+
+// WaitN blocks until n bytes may be sent or ctx is done, taking them from the bucket in pieces
+// of at most its size. Without a limit it returns at once.
+func (l *BandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	if l.unlimited.Load() {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, l.limiter.Burst())
+		if err := l.limiter.WaitN(ctx, chunk); err != nil {
+			// The bucket may have shrunk since its size was read; anything else ends the wait
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// RateLimitedConn is a connection whose writes wait for its limiter. Reads are not limited; to
+// limit both directions, limit the writes of both connections of a relay with the same limiter.
+type RateLimitedConn struct {
+	net.Conn
+	limiter *BandwidthLimiter
+	ctx     context.Context
+	cancel  context.CancelFunc // ends writes waiting for the limiter when the connection is closed
+}
+
+// NewRateLimitedConn wraps conn so that its writes wait for limiter
+func NewRateLimitedConn(conn net.Conn, limiter *BandwidthLimiter) *RateLimitedConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RateLimitedConn{Conn: conn, limiter: limiter, ctx: ctx, cancel: cancel}
+}
+
+// Write waits until the limiter allows len(b) bytes, then writes them
+func (c *RateLimitedConn) Write(b []byte) (int, error) {
+	if err := c.limiter.WaitN(c.ctx, len(b)); err != nil {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+// Close closes the connection, ending a write waiting for the limiter
+func (c *RateLimitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection if it can, and closes it otherwise
+func (c *RateLimitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
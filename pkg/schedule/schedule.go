@@ -0,0 +1,221 @@
+// Package schedule parses daily time windows and computes when they open and close
+package schedule
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxScanDays bounds how far ahead NextTransition looks; a week covers every weekly pattern
+const maxScanDays = 8
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// window is a daily time range in minutes after midnight. A window whose end is not after its
+// start runs past midnight into the next day.
+type window struct {
+	start, end int
+}
+
+// Schedule is a set of daily windows on selected weekdays in a time zone
+type Schedule struct {
+	spec    string
+	days    [7]bool
+	windows []window
+	loc     *time.Location
+}
+
+// Parse parses a schedule of the form "[days] HH:MM-HH:MM[,HH:MM-HH:MM...] [time zone]", e.g.
+// "Mon-Fri 09:00-17:00 Europe/Berlin", "22:00-06:00" or "Sat,Sun 10:00-12:00,14:00-18:00 UTC".
+// Days default to every day and the time zone to the server's local time.
+func Parse(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid schedule %q: expected [days] windows [time zone]", spec)
+	}
+
+	s := &Schedule{spec: spec, loc: time.Local}
+
+	// Find the windows field, everything before it is days and after it the time zone
+	i := slices.IndexFunc(fields, func(f string) bool {
+		return strings.Contains(f, ":")
+	})
+	if i < 0 || i > 1 || len(fields)-i > 2 {
+		return nil, fmt.Errorf("invalid schedule %q: expected [days] windows [time zone]", spec)
+	}
+
+	if i == 1 {
+		if err := s.parseDays(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+	} else {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	for _, w := range strings.Split(fields[i], ",") {
+		parsed, err := parseWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+		s.windows = append(s.windows, parsed)
+	}
+
+	if i+1 < len(fields) {
+		loc, err := time.LoadLocation(fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+		s.loc = loc
+	}
+
+	return s, nil
+}
+
+// parseDays parses "daily", a day ("Mon"), a range ("Mon-Fri") or a list of both ("Mon,Wed-Fri")
+func (s *Schedule) parseDays(spec string) error {
+	if strings.EqualFold(spec, "daily") {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+		return nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+
+		// Ranges may wrap around the week, e.g. Fri-Mon
+		for d := first; ; d = (d + 1) % 7 {
+			s.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseWindow parses "HH:MM-HH:MM"
+func parseWindow(spec string) (window, error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return window{}, fmt.Errorf("window %q must be HH:MM-HH:MM", spec)
+	}
+
+	start, err := parseClock(from)
+	if err != nil {
+		return window{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return window{}, err
+	}
+	if start == end {
+		return window{}, fmt.Errorf("window %q is empty", spec)
+	}
+
+	return window{start: start, end: end}, nil
+}
+
+// parseClock parses "HH:MM" (24:00 is allowed as the end of the day) into minutes after midnight
+func parseClock(spec string) (int, error) {
+	h, m, ok := strings.Cut(spec, ":")
+	if !ok {
+		return 0, fmt.Errorf("time %q must be HH:MM", spec)
+	}
+
+	hours, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, fmt.Errorf("time %q must be HH:MM", spec)
+	}
+	minutes, err := strconv.Atoi(m)
+	if err != nil || minutes < 0 || minutes > 59 || hours < 0 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("time %q is out of range", spec)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// String returns the schedule as it was given to Parse
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// bounds returns the instants a window opens and closes when it starts on the given day.
+// time.Date normalises clock times skipped by a DST change, so a window opening inside the gap
+// opens right after it.
+func (s *Schedule) bounds(day time.Time, w window) (time.Time, time.Time) {
+	y, mo, d := day.Date()
+	start := time.Date(y, mo, d, 0, w.start, 0, 0, s.loc)
+
+	endDay := d
+	if w.end <= w.start {
+		endDay++
+	}
+	end := time.Date(y, mo, endDay, 0, w.end, 0, 0, s.loc)
+	return start, end
+}
+
+// Active reports whether t falls inside one of the schedule's windows
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+
+	// A window that started yesterday may still be open
+	for offset := -1; offset <= 0; offset++ {
+		day := t.AddDate(0, 0, offset)
+		if !s.days[day.Weekday()] {
+			continue
+		}
+		for _, w := range s.windows {
+			start, end := s.bounds(day, w)
+			if !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NextTransition returns the first instant after t at which Active changes. It returns the zero
+// time if the schedule never changes, e.g. a window covering every minute of every day.
+func (s *Schedule) NextTransition(t time.Time) time.Time {
+	t = t.In(s.loc)
+	active := s.Active(t)
+
+	var candidates []time.Time
+	for offset := -1; offset <= maxScanDays; offset++ {
+		day := t.AddDate(0, 0, offset)
+		if !s.days[day.Weekday()] {
+			continue
+		}
+		for _, w := range s.windows {
+			start, end := s.bounds(day, w)
+			candidates = append(candidates, start, end)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	// Adjacent or overlapping windows produce boundaries that aren't transitions
+	for _, c := range candidates {
+		if c.After(t) && s.Active(c) != active {
+			return c
+		}
+	}
+	return time.Time{}
+}
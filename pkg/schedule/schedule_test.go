@@ -0,0 +1,234 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // the DST tests need zones that may not be installed
+)
+
+// utc returns a time in UTC for readable test tables
+func utc(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+}
+
+func mustParse(t *testing.T, spec string) *Schedule {
+	t.Helper()
+	s, err := Parse(spec)
+	if err != nil {
+		t.Fatalf("Parse(%q) = %v", spec, err)
+	}
+	return s
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"Mon-Fri",
+		"09:00",
+		"0900-1700",
+		"09:00-09:00",
+		"25:00-26:00",
+		"09:60-10:00",
+		"24:30-01:00",
+		"-1:00-02:00",
+		"Xyz 09:00-10:00",
+		"Mon-Xyz 09:00-10:00",
+		"09:00-10:00 Mars/Olympus_Mons",
+		"Mon 09:00-10:00 UTC extra",
+		"UTC Mon 09:00-10:00",
+		"09:00-10:00,",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	s := mustParse(t, "09:00-17:00")
+	if s.loc != time.Local {
+		t.Errorf("time zone = %v, want the local time zone", s.loc)
+	}
+	for d, on := range s.days {
+		if !on {
+			t.Errorf("day %v is off, want every day", time.Weekday(d))
+		}
+	}
+	if s.String() != "09:00-17:00" {
+		t.Errorf("String() = %q, want the spec", s.String())
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []time.Weekday
+	}{
+		{"Mon 09:00-10:00", []time.Weekday{time.Monday}},
+		{"mon-fri 09:00-10:00", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}},
+		{"Fri-Mon 09:00-10:00", []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}},
+		{"Sat,Sun 09:00-10:00", []time.Weekday{time.Saturday, time.Sunday}},
+		{"Mon,Wed-Thu 09:00-10:00", []time.Weekday{time.Monday, time.Wednesday, time.Thursday}},
+		{"Daily 09:00-10:00", []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			var want [7]bool
+			for _, d := range tt.want {
+				want[d] = true
+			}
+			if got := mustParse(t, tt.spec).days; got != want {
+				t.Errorf("days = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	// 2026-10-19 is a Monday
+	tests := []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{"Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 19, 9, 0), true},
+		{"Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 19, 16, 59), true},
+		{"Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 19, 17, 0), false},
+		{"Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 19, 8, 59), false},
+		{"Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 18, 12, 0), false},
+		{"Mon-Fri 09:00-17:00 Europe/Berlin", utc(2026, 10, 19, 7, 0), true},
+		{"Mon-Fri 09:00-17:00 Europe/Berlin", utc(2026, 10, 19, 15, 0), false},
+
+		// Overnight windows belong to the day they start on
+		{"22:00-06:00 UTC", utc(2026, 10, 19, 23, 0), true},
+		{"22:00-06:00 UTC", utc(2026, 10, 19, 5, 59), true},
+		{"22:00-06:00 UTC", utc(2026, 10, 19, 6, 0), false},
+		{"22:00-06:00 UTC", utc(2026, 10, 19, 12, 0), false},
+		{"Fri 22:00-06:00 UTC", utc(2026, 10, 24, 3, 0), true},
+		{"Fri 22:00-06:00 UTC", utc(2026, 10, 19, 3, 0), false},
+
+		{"Sat,Sun 10:00-12:00,14:00-18:00 UTC", utc(2026, 10, 18, 11, 0), true},
+		{"Sat,Sun 10:00-12:00,14:00-18:00 UTC", utc(2026, 10, 18, 13, 0), false},
+		{"Sat,Sun 10:00-12:00,14:00-18:00 UTC", utc(2026, 10, 18, 15, 0), true},
+		{"20:00-24:00 UTC", utc(2026, 10, 19, 23, 59), true},
+		{"20:00-24:00 UTC", utc(2026, 10, 20, 0, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := mustParse(t, tt.spec).Active(tt.at); got != tt.want {
+			t.Errorf("%q: Active(%v) = %v, want %v", tt.spec, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestNextTransition(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"opens later today", "Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 19, 8, 0), utc(2026, 10, 19, 9, 0)},
+		{"closes later today", "Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 19, 10, 0), utc(2026, 10, 19, 17, 0)},
+		{"boundary itself is not after t", "Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 19, 9, 0), utc(2026, 10, 19, 17, 0)},
+		{"skips the weekend", "Mon-Fri 09:00-17:00 UTC", utc(2026, 10, 23, 18, 0), utc(2026, 10, 26, 9, 0)},
+		{"once a week", "Wed 12:00-13:00 UTC", utc(2026, 10, 21, 13, 0), utc(2026, 10, 28, 12, 0)},
+		{"overnight closes tomorrow", "22:00-06:00 UTC", utc(2026, 10, 19, 23, 0), utc(2026, 10, 20, 6, 0)},
+		{"adjacent windows close once", "10:00-12:00,12:00-14:00 UTC", utc(2026, 10, 19, 11, 0), utc(2026, 10, 19, 14, 0)},
+		{"overlapping windows close once", "10:00-13:00,12:00-14:00 UTC", utc(2026, 10, 19, 11, 0), utc(2026, 10, 19, 14, 0)},
+		{"always open never changes", "00:00-24:00 UTC", utc(2026, 10, 19, 11, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustParse(t, tt.spec).NextTransition(tt.from); !got.Equal(tt.want) {
+				t.Errorf("NextTransition(%v) = %v, want %v", tt.from, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+// TestNextTransitionDST covers windows on the days clocks change. Europe/Berlin moves from
+// 02:00 CET to 03:00 CEST on 2026-03-29 and back from 03:00 CEST to 02:00 CET on 2026-10-25;
+// America/New_York moves from 02:00 EST to 03:00 EDT on 2026-03-08.
+func TestNextTransitionDST(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		// Wall-clock windows keep their local times across the change, not their UTC times
+		{"opens at local time after spring forward", "Mon-Fri 09:00-17:00 America/New_York", utc(2026, 3, 6, 23, 0), utc(2026, 3, 9, 13, 0)},
+		{"closed at local time before spring forward", "Mon-Fri 09:00-17:00 America/New_York", utc(2026, 3, 6, 15, 0), utc(2026, 3, 6, 22, 0)},
+		{"opens at local time after fall back", "09:00-17:00 Europe/Berlin", utc(2026, 10, 24, 16, 0), utc(2026, 10, 25, 8, 0)},
+		{"opens at local time before fall back", "09:00-17:00 Europe/Berlin", utc(2026, 10, 23, 16, 0), utc(2026, 10, 24, 7, 0)},
+
+		// An overnight window spanning the change is an hour shorter or longer
+		{"overnight window over spring forward", "22:00-06:00 Europe/Berlin", utc(2026, 3, 28, 21, 30), utc(2026, 3, 29, 4, 0)},
+		{"overnight window over fall back", "22:00-06:00 Europe/Berlin", utc(2026, 10, 24, 20, 30), utc(2026, 10, 25, 5, 0)},
+
+		// A window entirely inside the skipped hour is empty that day
+		{"window inside the gap is skipped", "02:00-03:00 Europe/Berlin", utc(2026, 3, 28, 12, 0), utc(2026, 3, 30, 0, 0)},
+		{"window inside the gap opens the day before", "02:00-03:00 Europe/Berlin", utc(2026, 3, 27, 12, 0), utc(2026, 3, 28, 1, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustParse(t, tt.spec).NextTransition(tt.from); !got.Equal(tt.want) {
+				t.Errorf("NextTransition(%v) = %v, want %v", tt.from, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+// TestWindowOverDSTGap checks that a window opening inside the skipped hour still opens that day
+// and closes at its local end time
+func TestWindowOverDSTGap(t *testing.T) {
+	s := mustParse(t, "02:30-04:00 Europe/Berlin")
+
+	// 04:00 CEST is 02:00 UTC
+	if !s.Active(utc(2026, 3, 29, 1, 45)) {
+		t.Error("window is not open before its end on the day of the change")
+	}
+	if s.Active(utc(2026, 3, 29, 2, 0)) {
+		t.Error("window is still open at its local end time")
+	}
+
+	opens := s.NextTransition(utc(2026, 3, 28, 12, 0))
+	closes := s.NextTransition(opens)
+	if !closes.Equal(utc(2026, 3, 29, 2, 0)) {
+		t.Errorf("window closes at %v, want 02:00 UTC", closes.UTC())
+	}
+	if !opens.Before(closes) || opens.Before(utc(2026, 3, 29, 1, 0)) {
+		t.Errorf("window opens at %v, want after the clocks changed at 01:00 UTC and before it closes", opens.UTC())
+	}
+}
+
+// TestTransitionsAlternate walks a schedule across both DST changes of a year and checks every
+// transition flips Active and moves forward
+func TestTransitionsAlternate(t *testing.T) {
+	for _, spec := range []string{
+		"Mon-Fri 09:00-17:00 Europe/Berlin",
+		"22:00-06:00 Europe/Berlin",
+		"Sat,Sun 01:30-02:30,02:45-03:15 America/New_York",
+	} {
+		s := mustParse(t, spec)
+		at := utc(2026, 1, 1, 0, 0)
+		active := s.Active(at)
+		for at.Year() == 2026 {
+			next := s.NextTransition(at)
+			if next.IsZero() {
+				t.Fatalf("%q: no transition after %v", spec, at)
+			}
+			if !next.After(at) {
+				t.Fatalf("%q: NextTransition(%v) = %v, not after it", spec, at, next)
+			}
+			if s.Active(next) == active {
+				t.Fatalf("%q: Active does not change at %v", spec, next)
+			}
+			at, active = next, !active
+		}
+	}
+}
@@ -1,33 +1,43 @@
 package server
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	wgrp "github.com/DevonTM/wg-rp"
 	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/capture"
+	"github.com/DevonTM/wg-rp/pkg/circuitbreaker"
+	"github.com/DevonTM/wg-rp/pkg/compress"
+	"github.com/DevonTM/wg-rp/pkg/httprewrite"
+	"github.com/DevonTM/wg-rp/pkg/proxyproto"
+	"github.com/DevonTM/wg-rp/pkg/schedule"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+	"github.com/DevonTM/wg-rp/pkg/webhook"
 )
 
-// StartAPIServer starts the REST API server on port 80 within the WireGuard netstack
+// StartAPIServer starts the REST API server on the configured API port within the WireGuard netstack
 func (ps *ProxyServer) StartAPIServer() error {
-	mux := http.NewServeMux()
-
-	// Heartbeat endpoint
-	mux.HandleFunc("/api/v1/heartbeat", ps.handleHeartbeat)
-
-	// Port mapping endpoints
-	mux.HandleFunc("/api/v1/port-mappings", ps.handlePortMapping)
-
-	listener, err := ps.tnet.ListenTCP(&net.TCPAddr{Port: 80})
+	listener, err := ps.tnet.ListenTCP(&net.TCPAddr{Port: ps.apiPort})
 	if err != nil {
-		return fmt.Errorf("failed to listen on port 80: %v", err)
+		return fmt.Errorf("failed to listen on port %d: %v", ps.apiPort, err)
 	}
 
-	log.Printf("API server listening on :80 within WireGuard netstack")
+	log.Printf("API server listening on :%d within WireGuard netstack", ps.apiPort)
 
 	// Use Protocols to enable HTTP/1 and HTTP/2 cleartext support
 	protocols := new(http.Protocols)
@@ -35,7 +45,7 @@ func (ps *ProxyServer) StartAPIServer() error {
 	protocols.SetUnencryptedHTTP2(true)
 
 	httpServer := &http.Server{
-		Handler:      mux,
+		Handler:      ps.apiHandler(),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  30 * time.Second,
@@ -51,15 +61,68 @@ func (ps *ProxyServer) StartAPIServer() error {
 	return nil
 }
 
+// apiHandler returns the REST API's routes behind its rate limit and authentication
+func (ps *ProxyServer) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Heartbeat endpoint
+	mux.HandleFunc("/api/v1/heartbeat", ps.handleHeartbeat)
+
+	// Server event stream
+	mux.HandleFunc("GET /api/v1/events", ps.handleEvents)
+
+	// Debug capture endpoints
+	mux.HandleFunc("/api/v1/captures", ps.handleStartCapture)
+	mux.HandleFunc("DELETE /api/v1/captures/{port}", ps.handleStopCapture)
+
+	// Server status and statistics endpoints
+	mux.HandleFunc("/api/v1/status", ps.handleStatus)
+	mux.HandleFunc("GET /api/v1/stats", ps.handleStats)
+
+	// Version endpoint, always answered so clients can check compatibility before anything else
+	mux.HandleFunc("GET /api/v1/version", ps.handleVersion)
+
+	// Echo endpoint, for clients probing which packet sizes get through the tunnel
+	mux.HandleFunc("POST /api/v1/echo", ps.handleEcho)
+
+	// Prometheus metrics endpoint
+	mux.Handle("GET /metrics", ps.MetricsHandler())
+
+	// Blocklist endpoint
+	mux.HandleFunc("GET /api/v1/blocklist", ps.handleBlocklist)
+
+	// Client listing endpoint
+	mux.HandleFunc("/api/v1/clients", ps.handleListClients)
+	mux.HandleFunc("PUT /api/v1/clients/{ip}/quota", ps.handleSetClientQuota)
+
+	// Connection endpoints
+	mux.HandleFunc("GET /api/v1/connections", ps.handleListConnections)
+	mux.HandleFunc("GET /api/v1/connections/history", ps.handleConnectionHistory)
+
+	// Port mapping endpoints
+	mux.HandleFunc("/api/v1/port-mappings", ps.handlePortMapping)
+	mux.HandleFunc("POST /api/v1/port-mappings/export", ps.handleExportMappings)
+
+	// Port reservation endpoints
+	mux.HandleFunc("/api/v1/port-reservations", ps.handleCreatePortReservation)
+	mux.HandleFunc("DELETE /api/v1/port-reservations/{port}", ps.handleDeletePortReservation)
+
+	return ps.limitAPIRate(ps.requireAuth(mux))
+}
+
 // handlePortMapping handles port mapping requests
 func (ps *ProxyServer) handlePortMapping(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	switch r.Method {
+	case http.MethodGet:
+		ps.handleListPortMappings(w, r)
 	case http.MethodPost:
 		ps.handleCreatePortMapping(w, r)
 	case http.MethodDelete:
 		ps.handleDeletePortMapping(w, r)
+	case http.MethodPatch:
+		ps.handleUpdatePortMapping(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -78,46 +141,286 @@ func (ps *ProxyServer) handleCreatePortMapping(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	response, status := ps.createMapping(r.Context(), req, r.RemoteAddr, false)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// createMapping validates a port mapping request and creates the mapping, returning the response
+// and HTTP status to answer with. remoteAddr is the address the request came from, which the
+// client's identity is resolved by. Preloaded mappings belong to the server's configuration.
+func (ps *ProxyServer) createMapping(ctx context.Context, req api.PortMappingRequest, remoteAddr string, preloaded bool) (api.PortMappingResponse, int) {
+	if err := ps.checkClientVersion(req.Version); err != nil {
+		log.Printf("Rejected port mapping for port %d from client %s: %v", req.RemotePort, req.ClientIP, err)
+		return api.PortMappingResponse{
+			Success: false,
+			Message: err.Error(),
+		}, http.StatusUpgradeRequired
+	}
+
+	if req.LocalProbe != "" && req.LocalProbe != api.LocalProbeAccept && req.LocalProbe != api.LocalProbeHTTP {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid local probe mode %q", req.LocalProbe),
+		}, http.StatusBadRequest
+	}
+
+	if req.HTTPHostRewrite != "" {
+		if err := httprewrite.ValidateHost(req.HTTPHostRewrite); err != nil {
+			return api.PortMappingResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid HTTP host rewrite: %v", err),
+			}, http.StatusBadRequest
+		}
+	}
+
+	if len(req.ProxyProtoTLVs) > 0 && !req.ProxyProtocol {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: "PROXY protocol TLVs need proxy_protocol",
+		}, http.StatusBadRequest
+	}
+
+	if err := proxyproto.ValidateTLVs(req.ProxyProtoTLVs); err != nil {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid PROXY protocol TLVs: %v", err),
+		}, http.StatusBadRequest
+	}
+
+	if req.Visibility != "" && req.Visibility != api.VisibilityPublic && req.Visibility != api.VisibilityTunnel {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid visibility %q", req.Visibility),
+		}, http.StatusBadRequest
+	}
+
+	routed := req.Mode == api.ModeHTTP || req.Mode == api.ModeSNI
+	if req.Mode != "" && req.Mode != api.ModeTCP && !routed {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid mode %q", req.Mode),
+		}, http.StatusBadRequest
+	}
+	if routed {
+		req.Hostname = strings.ToLower(req.Hostname)
+		err := utils.ValidateRoutedHostname(req.Hostname)
+		if req.Hostname == "" {
+			err = fmt.Errorf("%s mappings need a hostname", strings.ToUpper(req.Mode))
+		} else if req.Mode == api.ModeSNI && req.Hostname == api.SNIDefaultHost {
+			err = nil
+		}
+		if err != nil {
+			return api.PortMappingResponse{
+				Success: false,
+				Message: err.Error(),
+			}, http.StatusBadRequest
+		}
+	} else if req.Hostname != "" {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: "Only HTTP and SNI mappings have a hostname",
+		}, http.StatusBadRequest
+	}
+
+	if req.TTLSeconds < 0 {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: "TTL must not be negative",
+		}, http.StatusBadRequest
+	}
+
+	if req.SampleRate != nil && !validSampleRate(*req.SampleRate) {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: "Sample rate must be between 0 and 1",
+		}, http.StatusBadRequest
+	}
+
+	if req.WriteDeadlineSeconds < 0 {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: "Write deadline must not be negative",
+		}, http.StatusBadRequest
+	}
+
+	if req.MaxHalfOpen < 0 {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: "Half-open connection limit must not be negative",
+		}, http.StatusBadRequest
+	}
+
+	if req.BufferSizeKB < 0 || req.BufferSizeKB > api.MaxBufferSizeKB {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Buffer size must be between 1 and %d KB, or 0 for the server default", api.MaxBufferSizeKB),
+		}, http.StatusBadRequest
+	}
+
+	if req.TLSCert != "" || len(req.TLSALPN) > 0 {
+		var err error
+		switch {
+		case req.TLSCert == "":
+			err = fmt.Errorf("tls_alpn needs a tls_cert")
+		case req.Mode == api.ModeHTTP:
+			err = fmt.Errorf("HTTP mappings can't terminate TLS")
+		case req.TLSCert == api.TLSCertACME && ps.certIssuer == nil:
+			err = fmt.Errorf("the server doesn't obtain ACME certificates")
+		case req.TLSCert == api.TLSCertACME && req.Mode != api.ModeSNI:
+			err = fmt.Errorf("ACME certificates need an SNI mapping with a hostname")
+		case req.TLSCert == api.TLSCertACME && strings.Contains(req.Hostname, "*"):
+			err = fmt.Errorf("ACME certificates can't be obtained for wildcard hostname %q", req.Hostname)
+		case req.TLSCert != api.TLSCertACME && (ps.certs == nil || !ps.certs.has(req.TLSCert)):
+			err = fmt.Errorf("unknown certificate %q", req.TLSCert)
+		}
+		for _, proto := range req.TLSALPN {
+			if err == nil && !slices.Contains(tlsALPNProtocols, proto) {
+				err = fmt.Errorf("unsupported ALPN protocol %q (use %s)", proto, strings.Join(tlsALPNProtocols, " or "))
+			}
+		}
+		if err != nil {
+			return api.PortMappingResponse{
+				Success: false,
+				Message: err.Error(),
+			}, http.StatusBadRequest
+		}
+	}
+
+	if req.Name != "" {
+		if err := utils.ValidateMappingName(req.Name); err != nil {
+			return api.PortMappingResponse{
+				Success: false,
+				Message: err.Error(),
+			}, http.StatusBadRequest
+		}
+	}
+
+	if err := utils.ValidateMappingLabels(req.Labels); err != nil {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: err.Error(),
+		}, http.StatusBadRequest
+	}
+
+	var sched *schedule.Schedule
+	if req.Schedule != "" {
+		parsed, err := schedule.Parse(req.Schedule)
+		if err != nil {
+			return api.PortMappingResponse{
+				Success: false,
+				Message: err.Error(),
+			}, http.StatusBadRequest
+		}
+		sched = parsed
+	}
+
+	identity, err := ps.resolveIdentityFrom(ctx, remoteAddr, req.ClientIP)
+	if err != nil {
+		log.Printf("Rejected port mapping for port %d from client %s: %v", req.RemotePort, req.ClientIP, err)
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to resolve client identity: %v", err),
+		}, http.StatusForbidden
+	}
+
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
+	// An HTTP or SNI mapping shares its port with the other hostnames on it, but not with a TCP mapping.
+	// Public and tunnel-only ports are separate listeners, so each namespace has its own conflicts.
+	tunnelOnly := req.Visibility == api.VisibilityTunnel
+	key := portKey{port: req.RemotePort, tunnelOnly: tunnelOnly}
+	if routed {
+		if conflict := ps.checkHostConflict(req, key); conflict != "" {
+			return api.PortMappingResponse{
+				Success: false,
+				Message: conflict,
+			}, http.StatusConflict
+		}
+		if mapping, exists := ps.hostMapping(key, req.Hostname); exists {
+			log.Printf("Client %s is reclaiming its own hostname %s on port %d, cleaning up old mapping", req.ClientIP, req.Hostname, req.RemotePort)
+			preloaded = preloaded || mapping.Preloaded
+			ps.removeHostMapping(mapping)
+		}
+	} else if router, shared := ps.httpRouters[key]; shared {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Port %d is shared by %s mappings", req.RemotePort, strings.ToUpper(router.mode)),
+		}, http.StatusConflict
+	}
+
 	// Check if port is already mapped
-	if mapping, exists := ps.mappings[req.RemotePort]; exists {
+	if mapping, exists := ps.mappings[key]; exists {
 		// If the same client is trying to reclaim its own port, allow it by cleaning up the old mapping first
 		if mapping.ClientIP == req.ClientIP {
 			log.Printf("Client %s is reclaiming its own port %d, cleaning up old mapping", req.ClientIP, req.RemotePort)
 
-			// Stop the existing mapping
-			close(mapping.cancel)
-			mapping.Listener.Close()
-			delete(ps.mappings, req.RemotePort)
+			// A preloaded port stays preloaded when its client registers it
+			preloaded = preloaded || mapping.Preloaded
 
-			// Remove from client tracking
-			if client, exists := ps.clients[mapping.ClientIP]; exists {
-				delete(client.Mappings, req.RemotePort)
-			}
+			// Stop the existing mapping and remove it from client tracking
+			ps.removeMapping(mapping)
 		} else {
-			// Port is mapped by a different client
-			response := api.PortMappingResponse{
-				Success: false,
-				Message: fmt.Sprintf("Port %d is already mapped by another client", req.RemotePort),
+			// Port is mapped by a different client, or still held after it deleted its mapping
+			message := fmt.Sprintf("Port %d is already mapped by another client", req.RemotePort)
+			if mapping.grace.Load() {
+				message = fmt.Sprintf("Port %d was deleted by another client and is held until %s",
+					req.RemotePort, utils.FormatDateTime(mapping.graceEndsAt))
 			}
-			w.WriteHeader(http.StatusConflict)
-			json.NewEncoder(w).Encode(response)
-			return
+			return api.PortMappingResponse{
+				Success: false,
+				Message: message,
+			}, http.StatusConflict
 		}
 	}
 
-	// Start listening on the requested port
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", req.RemotePort))
+	// Check if port is reserved by a different client
+	if reservation, reserved := ps.activeReservation(req.RemotePort); reserved && reservation.ClientIP != req.ClientIP {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Port %d is reserved by another client", req.RemotePort),
+		}, http.StatusConflict
+	}
+
+	// Enforce the tenant's mapping quota
+	if identity.MaxMappings > 0 && ps.tenantMappings(identity.TenantID) >= identity.MaxMappings {
+		return api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Tenant %s already holds its maximum of %d port mappings", identity.TenantID, identity.MaxMappings),
+		}, http.StatusForbidden
+	}
+
+	// Start listening on the requested port, within the WireGuard netstack for tunnel-only mappings.
+	// HTTP and SNI mappings get their connections from the router of the shared port.
+	var listener net.Listener
+	var router *httpRouter
+	if routed {
+		router, err = ps.httpRouterFor(key, req.Mode)
+		if err == nil {
+			listener = newHostListener(router)
+		}
+	} else if tunnelOnly {
+		listener, err = ps.tnet.ListenTCP(&net.TCPAddr{Port: req.RemotePort})
+	} else {
+		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", req.RemotePort))
+	}
 	if err != nil {
-		response := api.PortMappingResponse{
+		// Tell the client the server is overloaded rather than that the port is broken
+		if isFDExhausted(err) {
+			ps.handleFDExhaustion(err)
+			open, limit := fdUsage()
+			return api.PortMappingResponse{
+				Success: false,
+				Message: fmt.Sprintf("Server is out of file descriptors (%d open, limit %d), try again later", open, limit),
+			}, http.StatusServiceUnavailable
+		}
+		return api.PortMappingResponse{
 			Success: false,
 			Message: fmt.Sprintf("Failed to listen on port %d: %v", req.RemotePort, err),
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
+		}, http.StatusInternalServerError
 	}
 
 	// Create mapping
@@ -128,36 +431,228 @@ func (ps *ProxyServer) handleCreatePortMapping(w http.ResponseWriter, r *http.Re
 		ClientPort: req.ClientPort,
 		Listener:   listener,
 		cancel:     make(chan struct{}),
+		history:    ps.historyFor(req.RemotePort),
+		identity:   identity,
+		breaker:    circuitbreaker.New(ps.breakerThreshold, ps.breakerRecovery),
+		Preloaded:  preloaded,
+		Name:       req.Name,
+		Labels:     maps.Clone(req.Labels),
+		tunnelOnly: tunnelOnly,
+		Hostname:   req.Hostname,
 	}
 
-	ps.mappings[req.RemotePort] = mapping
+	// Give up on unreachable clients after the server's timeout, or the mapping's own
+	mapping.dialTimeout = ps.tunnelDialTimeout
+	if req.TunnelDialTimeoutMillis > 0 {
+		mapping.dialTimeout = time.Duration(req.TunnelDialTimeoutMillis) * time.Millisecond
+	}
+
+	// Give up on external connections that stop taking data if the client asked for it
+	mapping.writeDeadline = time.Duration(req.WriteDeadlineSeconds) * time.Second
+
+	// Relay with buffers of the requested size, or share the server's pool
+	mapping.bufferPool = ps.bufferPool
+	mapping.bufferSizeKB = req.BufferSizeKB
+	if req.BufferSizeKB > 0 && req.BufferSizeKB*1024 != ps.bufferPool.Size() {
+		mapping.bufferPool = bufferpool.NewBufferPool(req.BufferSizeKB*1024, bufferpool.WithMemoryLimit(ps.bufferLimit))
+	}
+
+	// Terminate TLS with the operator's certificate if the client picked one, or one obtained for
+	// the hostname
+	if req.TLSCert != "" {
+		mapping.tlsCert = req.TLSCert
+		mapping.tlsALPN = req.TLSALPN
+		if req.TLSCert == api.TLSCertACME {
+			mapping.tlsConfig = issuerTLSConfig(ps.certIssuer, req.TLSALPN)
+		} else {
+			mapping.tlsConfig = ps.certs.tlsConfig(req.TLSCert, req.TLSALPN)
+		}
+	}
+
+	// Remove the mapping on its own once its TTL runs out
+	if req.TTLSeconds > 0 {
+		mapping.expiresAt = time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
+	}
+
+	// Use the multiplexed data path when both sides support it
+	mapping.multiplexed = ps.muxPort > 0 && req.Transport == api.TransportYamux
+
+	// Compress the tunnel leg if the client asked for an algorithm this server has, otherwise relay
+	// it raw; the client learns the outcome from the response
+	if req.Compression != "" && req.Compression != api.CompressionNone {
+		if compress.Supported(req.Compression) {
+			mapping.compression = req.Compression
+		} else {
+			log.Printf("Client %s asked for unsupported compression %q on port %d, relaying uncompressed", req.ClientIP, req.Compression, req.RemotePort)
+		}
+	}
+
+	// Answer health checks from the server host locally if the client opted in
+	mapping.localProbe = req.LocalProbe
+
+	// Set the Host header of forwarded HTTP requests if the client asked for it
+	mapping.httpHostRewrite = req.HTTPHostRewrite
+	mapping.proxyProtocol = req.ProxyProtocol
+	mapping.proxyProtoTLVs = req.ProxyProtoTLVs
+
+	// Limit the rate of new connections if the client asked for it
+	mapping.connRateLimiter = newConnRateLimiter(req.MaxConnsPerSecond, req.MaxConnsBurst)
+
+	// Log every connection, or the sample the client asked for
+	mapping.setSampleRate(1)
+	if req.SampleRate != nil {
+		mapping.setSampleRate(*req.SampleRate)
+	}
+
+	// Bound the connections being set up at once, by default or as the client asked
+	mapping.maxHalfOpen = req.MaxHalfOpen
+	mapping.sema = make(chan struct{}, cmp.Or(req.MaxHalfOpen, DefaultMaxHalfOpen))
+
+	// Start outside the window if the schedule says so, before the first connection is accepted
+	if sched != nil {
+		mapping.schedule = sched
+		mapping.closeOffSchedule = req.ScheduleCloseActive
+		mapping.offSchedule.Store(!sched.Active(time.Now()))
+	}
+
+	// Names need not be unique, but a shared name makes logs ambiguous
+	if mapping.Name != "" {
+		for _, other := range ps.mappings {
+			if other.Name == mapping.Name {
+				log.Printf("WARNING: port %d is named %q like port %d", mapping.RemotePort, mapping.Name, other.RemotePort)
+				break
+			}
+		}
+	}
+
+	if routed {
+		ps.addHostMapping(router, mapping)
+	} else {
+		ps.mappings[key] = mapping
+	}
+
+	// The mapping now owns the port, so any reservation for it is consumed
+	delete(ps.reservations, req.RemotePort)
 
 	// Track this mapping for the client
 	client, exists := ps.clients[req.ClientIP]
 	if !exists {
 		client = &ClientInfo{
-			Mappings: make(map[int]bool),
+			Mappings: make(map[portKey]bool),
 		}
 		ps.clients[req.ClientIP] = client
 	}
-	client.Mappings[req.RemotePort] = true
+	if !routed {
+		client.Mappings[key] = true // HTTP and SNI mappings are found through their router
+	}
 	client.LastHeartbeat = time.Now() // Update heartbeat on mapping creation
+	client.Identity = identity
 
 	// Start handling connections for this mapping
 	go ps.handleMappingConnections(mapping)
+	if mapping.schedule != nil {
+		go ps.runSchedule(mapping)
+	}
 
-	log.Printf("Created port mapping: external:%d -> %s:%d -> %s",
-		req.RemotePort, req.ClientIP, req.ClientPort, req.LocalAddr)
+	side := "external"
+	if tunnelOnly {
+		side = "tunnel"
+	}
+	log.Printf("Created port mapping: %s:%s -> %s:%d -> %s",
+		side, mapping.portLabel(), req.ClientIP, req.ClientPort, req.LocalAddr)
+	ps.audit(AuditCreate, mapping)
+	ps.saveStore()
+	ps.notifyWebhook(webhook.EventCreated, mapping)
 
 	response := api.PortMappingResponse{
 		Success: true,
-		Message: fmt.Sprintf("Port mapping created successfully for port %d", req.RemotePort),
+		Message: fmt.Sprintf("Port mapping created successfully for port %s", mapping.portLabel()),
+	}
+	if mapping.multiplexed {
+		response.Transport = api.TransportYamux
+		response.MuxPort = ps.muxPort
+	}
+	response.Compression = mapping.compression
+	return response, http.StatusOK
+}
+
+// handleListPortMappings lists the active port mappings with their state and counters, only those
+// with the name given by the name parameter if there is one
+func (ps *ProxyServer) handleListPortMappings(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	ps.mu.RLock()
+	all := append(ps.hostMappings(""), ps.tcpMappings()...)
+	mappings := make([]api.MappingStatus, 0, len(all))
+	for _, mapping := range all {
+		if name != "" && mapping.Name != name {
+			continue
+		}
+		state, failures := mapping.breaker.State()
+		status := api.MappingStatus{
+			RemotePort:      mapping.RemotePort,
+			ClientIP:        mapping.ClientIP,
+			ClientPort:      mapping.ClientPort,
+			LocalAddr:       mapping.LocalAddr,
+			Suspended:       mapping.Suspended(),
+			OffSchedule:     mapping.offSchedule.Load(),
+			BreakerState:    string(state),
+			BreakerFailures: failures,
+			MTUSuspects:     mapping.MTUSuspects(),
+			RateLimited:     mapping.RateLimited(),
+			HalfOpenLimited: mapping.HalfOpenLimited(),
+			Sampled:         mapping.sampledCount.Load(),
+			RelayErrors:     mapping.relayErrors.Snapshot(),
+			LocalProbes:     mapping.LocalProbes(),
+			Preloaded:       mapping.Preloaded,
+			Name:            mapping.Name,
+			Labels:          mapping.Labels,
+			HTTPHostRewrite: mapping.httpHostRewrite,
+			ProxyProtocol:   mapping.proxyProtocol,
+			ProxyProtoTLVs:  mapping.proxyProtoTLVs,
+			Visibility:      mapping.visibility(),
+			Mode:            mapping.mode(),
+			Hostname:        mapping.Hostname,
+			BufferSizeKB:    mapping.bufferPool.Size() / 1024,
+			TLSCert:         mapping.tlsCert,
+			Compression:     mapping.compression,
+		}
+		if !mapping.expiresAt.IsZero() {
+			status.ExpiresAt = mapping.expiresAt.Unix()
+		}
+		if mapping.grace.Load() {
+			status.GracePeriodEndsAt = mapping.graceEndsAt.Unix()
+		}
+		status.ActiveConnections, status.BytesIn, status.BytesOut = mapping.traffic()
+		if rate := mapping.SampleRate(); rate < 1 {
+			status.SampleRate = &rate
+		}
+		if mapping.tlsCert == api.TLSCertACME {
+			if err := ps.certIssuer.Err(mapping.Hostname); err != nil {
+				status.TLSError = err.Error()
+			}
+		}
+		mappings = append(mappings, status)
+	}
+	ps.mu.RUnlock()
+
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].RemotePort != mappings[j].RemotePort {
+			return mappings[i].RemotePort < mappings[j].RemotePort
+		}
+		return mappings[i].Hostname < mappings[j].Hostname
+	})
+
+	response := api.PortMappingListResponse{
+		Success:  true,
+		Mappings: mappings,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleDeletePortMapping deletes an existing port mapping
-func (ps *ProxyServer) handleDeletePortMapping(w http.ResponseWriter, r *http.Request) {
+// mappingFromQuery returns the mapping a request names with ?port=, and &hostname= for an HTTP or
+// SNI mapping on a shared port, or answers that it doesn't exist. Callers must hold ps.mu.
+func (ps *ProxyServer) mappingFromQuery(w http.ResponseWriter, r *http.Request) (*ProxyMapping, bool) {
 	portStr := r.URL.Query().Get("port")
 	if portStr == "" {
 		response := api.PortMappingResponse{
@@ -166,7 +661,7 @@ func (ps *ProxyServer) handleDeletePortMapping(w http.ResponseWriter, r *http.Re
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(response)
-		return
+		return nil, false
 	}
 
 	port, err := strconv.Atoi(portStr)
@@ -177,38 +672,300 @@ func (ps *ProxyServer) handleDeletePortMapping(w http.ResponseWriter, r *http.Re
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(response)
-		return
+		return nil, false
 	}
 
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
+	visibility := r.URL.Query().Get("visibility")
+	if visibility != "" && visibility != api.VisibilityPublic && visibility != api.VisibilityTunnel {
+		response := api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid visibility %q, expected %q or %q", visibility, api.VisibilityPublic, api.VisibilityTunnel),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return nil, false
+	}
+
+	// HTTP mappings share their port, so they are found by port and hostname
+	hostname := strings.ToLower(r.URL.Query().Get("hostname"))
 
-	mapping, exists := ps.mappings[port]
+	mapping, exists := ps.lookupMapping(port, hostname, visibility)
 	if !exists {
+		label := strconv.Itoa(port)
+		if hostname != "" {
+			label = fmt.Sprintf("%d for host %s", port, hostname)
+		}
+		if visibility != "" {
+			label += " with " + visibility + " visibility"
+		}
 		response := api.PortMappingResponse{
 			Success: false,
-			Message: fmt.Sprintf("No mapping found for port %d", port),
+			Message: fmt.Sprintf("No mapping found for port %s", label),
 		}
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(response)
+		return nil, false
+	}
+	return mapping, true
+}
+
+// lookupMapping returns the mapping of port, or of hostname on it for an HTTP or SNI mapping. A
+// port may be mapped both publicly and in the tunnel, so without a visibility the public mapping is
+// returned if there is one. Callers must hold ps.mu.
+func (ps *ProxyServer) lookupMapping(port int, hostname, visibility string) (*ProxyMapping, bool) {
+	keys := []portKey{{port: port}, {port: port, tunnelOnly: true}}
+	switch visibility {
+	case api.VisibilityPublic:
+		keys = keys[:1]
+	case api.VisibilityTunnel:
+		keys = keys[1:]
+	}
+	for _, key := range keys {
+		mapping, exists := ps.mappings[key]
+		if hostname != "" {
+			mapping, exists = ps.hostMapping(key, hostname)
+		}
+		if exists {
+			return mapping, true
+		}
+	}
+	return nil, false
+}
+
+// handleDeletePortMapping deletes an existing port mapping
+func (ps *ProxyServer) handleDeletePortMapping(w http.ResponseWriter, r *http.Request) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	mapping, ok := ps.mappingFromQuery(w, r)
+	if !ok {
+		return
+	}
+	port, hostname := mapping.RemotePort, mapping.Hostname
+
+	// Deleting a mapping again during its grace period changes nothing
+	if mapping.grace.Load() {
+		response := api.PortMappingResponse{
+			Success:           true,
+			Message:           fmt.Sprintf("Port mapping for port %s is already deleted", mapping.portLabel()),
+			GracePeriodEndsAt: mapping.graceEndsAt.Unix(),
+		}
+		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	// Stop the mapping
-	close(mapping.cancel)
-	mapping.Listener.Close()
-	delete(ps.mappings, port)
+	// Preloaded mappings belong to the server's configuration
+	if mapping.Preloaded && !ps.allowDeletePreloaded {
+		response := api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Port %d is preloaded by the server and can't be deleted", port),
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Stop the mapping, or hold its port for the grace period first
+	switch {
+	case ps.deleteGracePeriod > 0:
+		ps.startGrace(mapping)
+		log.Printf("Deleted port mapping for port %s, releasing the port in %s", mapping.portLabel(), ps.deleteGracePeriod)
+	case hostname != "":
+		ps.removeHostMapping(mapping)
+		log.Printf("Deleted port mapping for port %s", mapping.portLabel())
+	default:
+		ps.removeMapping(mapping)
+		log.Printf("Deleted port mapping for port %s", mapping.portLabel())
+	}
+	ps.audit(AuditDelete, mapping)
+	ps.saveStore()
+	ps.notifyWebhook(webhook.EventDeleted, mapping)
+	ps.events.publishMapping(api.EventMappingRemoved, mapping)
 
-	// Remove from client tracking
-	if client, exists := ps.clients[mapping.ClientIP]; exists {
-		delete(client.Mappings, port)
+	response := api.PortMappingResponse{
+		Success: true,
+		Message: fmt.Sprintf("Port mapping deleted successfully for port %s", mapping.portLabel()),
+	}
+	if mapping.grace.Load() {
+		response.GracePeriodEndsAt = mapping.graceEndsAt.Unix()
 	}
+	json.NewEncoder(w).Encode(response)
+}
 
-	log.Printf("Deleted port mapping for port %d", port)
+// handleUpdatePortMapping changes the settings of an existing port mapping that can change while
+// it is open
+func (ps *ProxyServer) handleUpdatePortMapping(w http.ResponseWriter, r *http.Request) {
+	var update api.PortMappingUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		response := api.PortMappingResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid request body: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if update.SampleRate != nil && !validSampleRate(*update.SampleRate) {
+		response := api.PortMappingResponse{
+			Success: false,
+			Message: "Sample rate must be between 0 and 1",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if update.Labels != nil {
+		if err := utils.ValidateMappingLabels(*update.Labels); err != nil {
+			response := api.PortMappingResponse{
+				Success: false,
+				Message: err.Error(),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	mapping, ok := ps.mappingFromQuery(w, r)
+	if !ok {
+		return
+	}
+
+	if update.SampleRate != nil {
+		mapping.setSampleRate(*update.SampleRate)
+		log.Printf("Logging %g of connections on port %s", *update.SampleRate, mapping.portLabel())
+	}
+	if update.Labels != nil {
+		mapping.Labels = maps.Clone(*update.Labels)
+		log.Printf("Set the labels of port %s to %v", mapping.portLabel(), mapping.Labels)
+	}
+	ps.saveStore()
 
 	response := api.PortMappingResponse{
 		Success: true,
-		Message: fmt.Sprintf("Port mapping deleted successfully for port %d", port),
+		Message: fmt.Sprintf("Port mapping updated successfully for port %s", mapping.portLabel()),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// validSampleRate reports whether rate is a fraction of connections, from none to all
+func validSampleRate(rate float64) bool {
+	return rate >= 0 && rate <= 1
+}
+
+// handleCreatePortReservation reserves a port for a client without starting a listener
+func (ps *ProxyServer) handleCreatePortReservation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req api.PortReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response := api.PortReservationResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid request body: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if req.RemotePort < 1 || req.RemotePort > 65535 {
+		response := api.PortReservationResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid port %d: must be between 1-65535", req.RemotePort),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	// A port that is already mapped, publicly or in the tunnel, or reserved by another client cannot be reserved
+	for _, key := range []portKey{{port: req.RemotePort}, {port: req.RemotePort, tunnelOnly: true}} {
+		if mapping, exists := ps.mappings[key]; exists && mapping.ClientIP != req.ClientIP {
+			response := api.PortReservationResponse{
+				Success: false,
+				Message: fmt.Sprintf("Port %d is already mapped by another client", req.RemotePort),
+			}
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+	if reservation, reserved := ps.activeReservation(req.RemotePort); reserved && reservation.ClientIP != req.ClientIP {
+		response := api.PortReservationResponse{
+			Success: false,
+			Message: fmt.Sprintf("Port %d is reserved by another client", req.RemotePort),
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Create or refresh the reservation
+	reservation := &PortReservation{
+		ClientIP:  req.ClientIP,
+		ExpiresAt: time.Now().Add(ps.reservationTTL),
+	}
+	ps.reservations[req.RemotePort] = reservation
+
+	log.Printf("Reserved port %d for client %s until %s",
+		req.RemotePort, req.ClientIP, utils.FormatDateTime(reservation.ExpiresAt))
+
+	response := api.PortReservationResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("Port %d reserved successfully", req.RemotePort),
+		ExpiresAt: reservation.ExpiresAt.Unix(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleDeletePortReservation releases a port reservation before it expires
+func (ps *ProxyServer) handleDeletePortReservation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		response := api.PortReservationResponse{
+			Success: false,
+			Message: "Invalid port number",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, reserved := ps.activeReservation(port); !reserved {
+		response := api.PortReservationResponse{
+			Success: false,
+			Message: fmt.Sprintf("No reservation found for port %d", port),
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	delete(ps.reservations, port)
+
+	log.Printf("Released reservation for port %d", port)
+
+	response := api.PortReservationResponse{
+		Success: true,
+		Message: fmt.Sprintf("Reservation released successfully for port %d", port),
 	}
 	json.NewEncoder(w).Encode(response)
 }
@@ -226,6 +983,7 @@ func (ps *ProxyServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 			Success:           false,
 			Message:           fmt.Sprintf("Invalid request body: %v", err),
 			ServerStartupTime: ps.startupTime.Unix(),
+			Version:           wgrp.VERSION,
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		w.Header().Set("Content-Type", "application/json")
@@ -233,6 +991,35 @@ func (ps *ProxyServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := ps.checkClientVersion(req.Version); err != nil {
+		log.Printf("Rejected heartbeat from client %s: %v", req.ClientIP, err)
+		response := api.HeartbeatResponse{
+			Success:           false,
+			Message:           err.Error(),
+			ServerStartupTime: ps.startupTime.Unix(),
+			Version:           wgrp.VERSION,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	identity, err := ps.resolveIdentity(r, req.ClientIP)
+	if err != nil {
+		log.Printf("Rejected heartbeat from client %s: %v", req.ClientIP, err)
+		response := api.HeartbeatResponse{
+			Success:           false,
+			Message:           fmt.Sprintf("Failed to resolve client identity: %v", err),
+			ServerStartupTime: ps.startupTime.Unix(),
+			Version:           wgrp.VERSION,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
@@ -240,19 +1027,366 @@ func (ps *ProxyServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	client, exists := ps.clients[req.ClientIP]
 	if !exists {
 		client = &ClientInfo{
-			Mappings: make(map[int]bool),
+			Mappings: make(map[portKey]bool),
 		}
 		ps.clients[req.ClientIP] = client
 	}
 
 	client.LastHeartbeat = time.Now()
+	client.Version = req.Version
+	client.Identity = identity
+	if req.Stats != nil {
+		client.Stats = req.Stats
+	}
+	if req.RTTMillis > 0 {
+		client.RTTMillis = req.RTTMillis
+	}
+	client.HeartbeatInterval = time.Duration(req.HeartbeatIntervalSeconds) * time.Second
+	if client.Suspended {
+		ps.setClientSuspended(req.ClientIP, false)
+	}
 
 	response := api.HeartbeatResponse{
-		Success:           true,
-		Message:           "Heartbeat received",
-		ServerStartupTime: ps.startupTime.Unix(),
+		Success:                  true,
+		Message:                  "Heartbeat received",
+		ServerStartupTime:        ps.startupTime.Unix(),
+		Version:                  wgrp.VERSION,
+		HeartbeatIntervalSeconds: int(ps.heartbeatInterval / time.Second),
+		ClientTimeoutSeconds:     int(ps.clientTimeout / time.Second),
+		ForwardPort:              ps.forwardPort,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleListClients lists known clients with their latest heartbeat snapshot
+func (ps *ProxyServer) handleListClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ps.mu.RLock()
+	clients := make([]api.ClientStatus, 0, len(ps.clients))
+	for clientIP, client := range ps.clients {
+		ports := make([]int, 0, len(client.Mappings))
+		for _, mapping := range ps.clientMappings(clientIP) {
+			if !slices.Contains(ports, mapping.RemotePort) {
+				ports = append(ports, mapping.RemotePort)
+			}
+		}
+		sort.Ints(ports)
+
+		var tenantID, namespace string
+		if client.Identity != nil {
+			tenantID, namespace = client.Identity.TenantID, client.Identity.Namespace
+		}
+
+		clients = append(clients, api.ClientStatus{
+			ClientIP:      clientIP,
+			TenantID:      tenantID,
+			Namespace:     namespace,
+			Version:       client.Version,
+			LastHeartbeat: client.LastHeartbeat.Unix(),
+			Mappings:      ports,
+			Stats:         client.Stats,
+			RTTMillis:     client.RTTMillis,
+
+			BandwidthQuotaBps: ps.clientQuotaBps(clientIP),
+		})
+	}
+	ps.mu.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientIP < clients[j].ClientIP
+	})
+
+	response := api.ClientListResponse{
+		Success: true,
+		Clients: clients,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// handleStartCapture starts a bounded debug capture on a port mapping
+func (ps *ProxyServer) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ps.allowCaptureRequest(w, r) {
+		return
+	}
+
+	var req api.CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response := api.CaptureResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid request body: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	// HTTP and SNI mappings share their port, so they are found by port and hostname
+	hostname := strings.ToLower(req.Hostname)
+	mapping, exists := ps.lookupMapping(req.RemotePort, hostname, req.Visibility)
+	if !exists {
+		label := strconv.Itoa(req.RemotePort)
+		if hostname != "" {
+			label = fmt.Sprintf("%d for host %s", req.RemotePort, hostname)
+		}
+		response := api.CaptureResponse{
+			Success: false,
+			Message: fmt.Sprintf("No mapping found for port %s", label),
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The relay sees the traffic of a mapping that terminates TLS decrypted, so capturing it writes
+	// plaintext to disk, which the admin has to ask for
+	if mapping.tlsConfig != nil && !req.AllowTLSPlaintext {
+		response := api.CaptureResponse{
+			Success: false,
+			Message: fmt.Sprintf("Port %s terminates TLS, so its capture would hold the decrypted traffic; set allow_tls_plaintext to capture it anyway", mapping.portLabel()),
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if mapping.tlsConfig != nil {
+		log.Printf("WARNING: capture on port %s holds the plaintext of its TLS connections, as %s asked", mapping.portLabel(), r.RemoteAddr)
+	}
+
+	c, err := ps.startCapture(mapping, time.Duration(req.DurationSeconds)*time.Second, req.MaxBytes)
+	if err != nil {
+		response := api.CaptureResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to start capture: %v", err),
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := api.CaptureResponse{
+		Success: true,
+		Message: fmt.Sprintf("Capture started for new connections on port %s", mapping.portLabel()),
+		File:    c.Path(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// allowCaptureRequest reports whether the server allows captures and the request carries the admin
+// token, answering the request with 403 if not. Captures write the traffic of any client to the
+// server's disk, so the auth token clients share isn't enough.
+func (ps *ProxyServer) allowCaptureRequest(w http.ResponseWriter, r *http.Request) bool {
+	message := ""
+	switch {
+	case !ps.allowCapture:
+		message = "Captures are disabled on this server (start it with -allow-capture)"
+	case !ps.isAdmin(r):
+		log.Printf("Rejected capture request from %s without the admin token", r.RemoteAddr)
+		message = "Captures require the admin token"
+	default:
+		return true
+	}
+	response := api.CaptureResponse{
+		Success: false,
+		Message: message,
+	}
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(response)
+	return false
+}
+
+// handleStopCapture stops a running capture before its limits are reached
+func (ps *ProxyServer) handleStopCapture(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ps.allowCaptureRequest(w, r) {
+		return
+	}
+
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		response := api.CaptureResponse{
+			Success: false,
+			Message: "Invalid port number",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	ps.mu.RLock()
+	mapping, exists := ps.lookupMapping(port, strings.ToLower(r.URL.Query().Get("hostname")), r.URL.Query().Get("visibility"))
+	ps.mu.RUnlock()
+
+	var c *capture.Capture
+	if exists {
+		c = mapping.capture.Load()
+	}
+	if c == nil {
+		response := api.CaptureResponse{
+			Success: false,
+			Message: fmt.Sprintf("No capture running on port %d", port),
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	c.Stop()
+
+	response := api.CaptureResponse{
+		Success: true,
+		Message: fmt.Sprintf("Capture stopped for port %s", mapping.portLabel()),
+		File:    c.Path(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleStatus reports the server version, timing configuration and counts
+func (ps *ProxyServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ps.mu.RLock()
+	status := api.ServerStatus{
+		Version:                  wgrp.VERSION,
+		StartupTime:              ps.startupTime.Unix(),
+		HeartbeatIntervalSeconds: int(ps.heartbeatInterval / time.Second),
+		ClientTimeoutSeconds:     int(ps.clientTimeout / time.Second),
+		Mappings:                 len(ps.mappings) + len(ps.hostMappings("")),
+		Clients:                  len(ps.clients),
+	}
+	ps.mu.RUnlock()
+	status.OpenFDs, status.MaxFDs = fdUsage()
+	if ps.peerStats != nil {
+		status.Peers = ps.peerStats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleStats reports totals since the server started. The counters are read without locking;
+// only the mapping and client counts take the read lock.
+func (ps *ProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	ps.mu.RLock()
+	stats := api.ServerStats{
+		UptimeSeconds: int64(time.Since(ps.startupTime) / time.Second),
+		TotalMappings: len(ps.mappings) + len(ps.hostMappings("")),
+		ClientCount:   len(ps.clients),
+	}
+	ps.mu.RUnlock()
+
+	ps.connections.Range(func(_, _ any) bool {
+		stats.ActiveConnections++
+		return true
+	})
+	stats.TotalConnectionsEver = ps.totalConnections.Load()
+	stats.TotalBytesIn = ps.totalBytesIn.Load()
+	stats.TotalBytesOut = ps.totalBytesOut.Load()
+	stats.DeadClientsEvicted = ps.deadClientsEvicted.Load()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleVersion reports the server version and the API version it speaks
+func (ps *ProxyServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	response := api.VersionResponse{
+		Version:     wgrp.VERSION,
+		GoVersion:   runtime.Version(),
+		StartupTime: ps.startupTime.UTC().Format(time.RFC3339),
+		APIVersion:  api.APIVersion,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// maxEchoSize bounds the body the echo endpoint sends back, the largest MTU a device may use
+const maxEchoSize = 9000
+
+// handleEcho answers with the request body, so a client can tell whether packets of its size
+// get through the tunnel both ways
+func (ps *ProxyServer) handleEcho(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEchoSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
+
+// handleConnectionHistory lists recently closed connections, optionally filtered by port and
+// by end time (?since= accepts unix seconds or RFC 3339)
+func (ps *ProxyServer) handleConnectionHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	port := 0
+	if portStr := r.URL.Query().Get("port"); portStr != "" {
+		p, err := strconv.Atoi(portStr)
+		if err != nil || p < 1 || p > 65535 {
+			response := api.ConnectionHistoryResponse{
+				Success: false,
+				Message: "Invalid port number",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		port = p
+	}
+
+	var since time.Time
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		t, err := parseSince(sinceStr)
+		if err != nil {
+			response := api.ConnectionHistoryResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid since value: %v", err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		since = t
+	}
+
+	records := ps.connectionHistory(port, since)
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].EndTime < records[j].EndTime
+	})
+
+	response := api.ConnectionHistoryResponse{
+		Success:     true,
+		Connections: records,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseSince parses a time given either as unix seconds or in RFC 3339 format
+func parseSince(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+func TestPublicAndTunnelMappingsShareAPort(t *testing.T) {
+	pair := wgtest.NewPair(t)
+	ps := NewProxyServer(pair.Server.Tnet, 1024)
+	t.Cleanup(func() { stopMappings(ps) })
+
+	port := freePorts(t, 1)[0]
+	request := func(clientIP, visibility string) api.PortMappingRequest {
+		return api.PortMappingRequest{LocalAddr: fmt.Sprintf("127.0.0.1:%d", port), RemotePort: port, ClientIP: clientIP, ClientPort: 40000, Visibility: visibility}
+	}
+	mapping := func(tunnelOnly bool) *ProxyMapping {
+		ps.mu.RLock()
+		defer ps.mu.RUnlock()
+		return ps.mappings[portKey{port: port, tunnelOnly: tunnelOnly}]
+	}
+
+	// A public and a tunnel-only port are different listeners, so different clients may map both
+	if err := ps.loadMapping(request("10.0.0.2", api.VisibilityPublic), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.loadMapping(request("10.0.0.3", api.VisibilityTunnel), false); err != nil {
+		t.Fatalf("tunnel registration of a publicly mapped port = %v, want success", err)
+	}
+	if mapping(false).ClientIP != "10.0.0.2" || mapping(true).ClientIP != "10.0.0.3" {
+		t.Fatal("the public and the tunnel mapping of the port don't both exist")
+	}
+	if _, err := pair.Client.Tnet.Dial("tcp", net.JoinHostPort(wgtest.ServerIP, strconv.Itoa(port))); err != nil {
+		t.Errorf("dialing the tunnel port: %v", err)
+	}
+
+	// Conflicts are still tracked within each namespace, and each client reclaims its own mapping
+	if err := ps.loadMapping(request("10.0.0.3", api.VisibilityPublic), false); err == nil || !strings.Contains(err.Error(), "another client") {
+		t.Errorf("public registration by another client = %v, want a conflict", err)
+	}
+	if err := ps.loadMapping(request("10.0.0.2", ""), false); err != nil {
+		t.Errorf("reclaiming the public port = %v, want success", err)
+	}
+
+	// Deleting names the namespace, and leaves the other mapping of the port alone
+	target := fmt.Sprintf("/api/v1/port-mappings?port=%d&visibility=tunnel", port)
+	if status := serveAPI(t, ps, http.MethodDelete, target, "", nil); status != http.StatusOK {
+		t.Fatalf("DELETE %s = %d, want 200", target, status)
+	}
+	if !mapping(true).grace.Load() || mapping(false).grace.Load() {
+		t.Error("deleting the tunnel mapping didn't leave only the public one")
+	}
+}
+
+func TestCreateMappingRejects(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithMinClientVersion("1.0.0"))
+	valid := api.PortMappingRequest{LocalAddr: "127.0.0.1:8080", RemotePort: 8080, ClientIP: "10.0.0.2", ClientPort: 40000}
+
+	tests := []struct {
+		name   string
+		modify func(*api.PortMappingRequest)
+		status int
+		want   string
+	}{
+		{"local probe", func(r *api.PortMappingRequest) { r.LocalProbe = "ping" }, http.StatusBadRequest, "Invalid local probe"},
+		{"visibility", func(r *api.PortMappingRequest) { r.Visibility = "private" }, http.StatusBadRequest, "Invalid visibility"},
+		{"mode", func(r *api.PortMappingRequest) { r.Mode = "udp" }, http.StatusBadRequest, "Invalid mode"},
+		{"HTTP without hostname", func(r *api.PortMappingRequest) { r.Mode = api.ModeHTTP }, http.StatusBadRequest, "need a hostname"},
+		{"TCP with hostname", func(r *api.PortMappingRequest) { r.Hostname = "app.example.com" }, http.StatusBadRequest, "Only HTTP and SNI"},
+		{"negative TTL", func(r *api.PortMappingRequest) { r.TTLSeconds = -1 }, http.StatusBadRequest, "TTL"},
+		{"sample rate", func(r *api.PortMappingRequest) { rate := 1.5; r.SampleRate = &rate }, http.StatusBadRequest, "Sample rate"},
+		{"buffer size", func(r *api.PortMappingRequest) { r.BufferSizeKB = api.MaxBufferSizeKB + 1 }, http.StatusBadRequest, "Buffer size"},
+		{"unknown certificate", func(r *api.PortMappingRequest) { r.TLSCert = "missing" }, http.StatusBadRequest, "unknown certificate"},
+		{"TLVs without PROXY protocol", func(r *api.PortMappingRequest) { r.ProxyProtoTLVs = []api.TLVEntry{{Type: 0xE0}} }, http.StatusBadRequest, "need proxy_protocol"},
+		{"schedule", func(r *api.PortMappingRequest) { r.Schedule = "always" }, http.StatusBadRequest, ""},
+		{"old client", func(r *api.PortMappingRequest) { r.Version = "0.0.1" }, http.StatusUpgradeRequired, "0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			req.Version = "1.0.0"
+			tt.modify(&req)
+
+			response, status := ps.createMapping(context.Background(), req, "10.0.0.2:0", false)
+			if status != tt.status || response.Success || !strings.Contains(response.Message, tt.want) {
+				t.Errorf("createMapping = %d %+v, want %d with a message containing %q", status, response, tt.status, tt.want)
+			}
+		})
+	}
+
+	// Nothing was created along the way
+	if len(ps.mappings) != 0 {
+		t.Errorf("%d mappings were created by rejected requests", len(ps.mappings))
+	}
+}
+
+// serveAPI sends a request with body to the API and decodes its JSON response into v
+func serveAPI(t *testing.T, ps *ProxyServer, method, target, body string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	ps.apiHandler().ServeHTTP(rec, req)
+	if v != nil {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestMappingLabels(t *testing.T) {
+	ps := NewProxyServer(nil, 1024)
+	t.Cleanup(func() { stopMappings(ps) })
+
+	port := freePorts(t, 1)[0]
+	req := testMapping(port)
+	req.Labels = map[string]string{"team": "web", "env": "prod"}
+	if err := ps.loadMapping(req, false); err != nil {
+		t.Fatal(err)
+	}
+	labels := func() map[string]string {
+		var list api.PortMappingListResponse
+		serveAPI(t, ps, http.MethodGet, "/api/v1/port-mappings", "", &list)
+		if len(list.Mappings) != 1 {
+			t.Fatalf("listed %d mappings, want 1", len(list.Mappings))
+		}
+		return list.Mappings[0].Labels
+	}
+	if got := labels(); !maps.Equal(got, req.Labels) {
+		t.Errorf("listed labels = %v, want %v", got, req.Labels)
+	}
+
+	// The export keeps the labels for -preload-mappings
+	ps.mu.RLock()
+	exported := mappingRequests(ps.tcpMappings(), time.Now())
+	ps.mu.RUnlock()
+	if len(exported) != 1 || !maps.Equal(exported[0].Labels, req.Labels) {
+		t.Errorf("exported %+v, want the labels %v", exported, req.Labels)
+	}
+
+	// An update replaces them, leaving them alone unless it has labels, and {} removes them
+	target := fmt.Sprintf("/api/v1/port-mappings?port=%d", port)
+	updates := []struct {
+		body string
+		want map[string]string
+	}{
+		{`{"labels": {"team": "ops"}}`, map[string]string{"team": "ops"}},
+		{`{"sample_rate": 0.5}`, map[string]string{"team": "ops"}},
+		{`{"labels": {}}`, nil},
+	}
+	for _, u := range updates {
+		var response api.PortMappingResponse
+		if code := serveAPI(t, ps, http.MethodPatch, target, u.body, &response); code != http.StatusOK {
+			t.Fatalf("PATCH %s: %d %s", u.body, code, response.Message)
+		}
+		if got := labels(); !maps.Equal(got, u.want) {
+			t.Errorf("labels after PATCH %s = %v, want %v", u.body, got, u.want)
+		}
+	}
+
+	// Invalid labels are rejected on registration and update alike
+	var response api.PortMappingResponse
+	if code := serveAPI(t, ps, http.MethodPatch, target, `{"labels": {"bad key": "x"}}`, &response); code != http.StatusBadRequest {
+		t.Errorf("PATCH with an invalid label key: %d, want 400", code)
+	}
+	req.Labels = map[string]string{"team": "line\nbreak"}
+	if err := ps.loadMapping(req, false); err == nil || !strings.Contains(err.Error(), "unprintable") {
+		t.Errorf("registering with an unprintable label value = %v, want an error", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	pair := wgtest.NewPair(t)
+	ps := NewProxyServer(pair.Server.Tnet, 1024)
+	t.Cleanup(func() { stopMappings(ps) })
+
+	// The client side echoes what the mapping relays
+	listener, err := pair.Client.Tnet.ListenTCP(&net.TCPAddr{Port: 40000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn)
+		}
+	}()
+
+	port := freePorts(t, 1)[0]
+	req := testMapping(port)
+	req.ClientIP = wgtest.ClientIP
+	if err := ps.loadMapping(req, false); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Bytes are counted when the connection closes, after the relay notices
+	var stats api.ServerStats
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if status := serveAPI(t, ps, http.MethodGet, "/api/v1/stats", "", &stats); status != http.StatusOK {
+			t.Fatalf("GET /api/v1/stats = %d, want 200", status)
+		}
+		if stats.ActiveConnections == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats.TotalMappings != 1 || stats.ClientCount != 1 || stats.ActiveConnections != 0 {
+		t.Errorf("got %d mappings, %d clients and %d open connections, want 1, 1 and 0", stats.TotalMappings, stats.ClientCount, stats.ActiveConnections)
+	}
+	if stats.TotalConnectionsEver != 1 || stats.TotalBytesIn != 5 || stats.TotalBytesOut != 5 {
+		t.Errorf("got %d connections, %d bytes in and %d out, want 1, 5 and 5", stats.TotalConnectionsEver, stats.TotalBytesIn, stats.TotalBytesOut)
+	}
+}
+
+func TestUpdateSampleRate(t *testing.T) {
+	ps := NewProxyServer(nil, 1024)
+	t.Cleanup(func() { stopMappings(ps) })
+
+	port := freePorts(t, 1)[0]
+	if err := ps.loadMapping(testMapping(port), false); err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/v1/port-mappings?port=%d", port)
+
+	var response api.PortMappingResponse
+	if code := serveAPI(t, ps, http.MethodPatch, target, `{"sample_rate": 0.25}`, &response); code != http.StatusOK {
+		t.Fatalf("PATCH: %d %s", code, response.Message)
+	}
+	var list api.PortMappingListResponse
+	serveAPI(t, ps, http.MethodGet, "/api/v1/port-mappings", "", &list)
+	if len(list.Mappings) != 1 || list.Mappings[0].SampleRate == nil || *list.Mappings[0].SampleRate != 0.25 {
+		t.Errorf("listed %+v, want a sample rate of 0.25", list.Mappings)
+	}
+
+	// Rates outside 0 to 1 and unknown ports are rejected
+	if code := serveAPI(t, ps, http.MethodPatch, target, `{"sample_rate": 2}`, &response); code != http.StatusBadRequest {
+		t.Errorf("PATCH with a sample rate of 2: %d, want 400", code)
+	}
+	if code := serveAPI(t, ps, http.MethodPatch, fmt.Sprintf("/api/v1/port-mappings?port=%d", port+1), `{"sample_rate": 1}`, &response); code != http.StatusNotFound {
+		t.Errorf("PATCH of an unmapped port: %d, want 404", code)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	ps := NewProxyServer(nil, 1024)
+
+	body := strings.Repeat("x", maxEchoSize)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/echo", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	ps.apiHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("echo of %d bytes = %d with %d bytes, want them back", len(body), rec.Code, rec.Body.Len())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/echo", strings.NewReader(body+"x"))
+	rec = httptest.NewRecorder()
+	ps.apiHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("echo of %d bytes = %d, want %d", len(body)+1, rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultAPIRateLimit is how many API requests per second each client IP may make
+	DefaultAPIRateLimit = 100
+
+	// DefaultAPIRateBurst is how many API requests a client IP may make at once above the rate
+	DefaultAPIRateBurst = 20
+
+	// apiLimiterIdle is how long a client IP's API limiter is kept after its last request
+	apiLimiterIdle = 10 * time.Minute
+)
+
+// apiLimiter limits the API requests of one client IP
+type apiLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen atomic.Int64 // Unix nanoseconds of the last request
+	rejected atomic.Int64 // requests answered with 429
+}
+
+// limitAPIRate answers API requests over the per-client-IP rate with 429 Too Many Requests,
+// whether or not they are authenticated
+func (ps *ProxyServer) limitAPIRate(next http.Handler) http.Handler {
+	if ps.apiRateLimit <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+
+		limiter := ps.apiLimiterFor(clientIP)
+		if !limiter.limiter.Allow() {
+			if limiter.rejected.Add(1)%100 == 1 {
+				log.Printf("Rate limiting API requests from %s (%d rejected so far)", clientIP, limiter.rejected.Load())
+			}
+
+			// Answer in the shape of the API's responses so clients report the reason
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": false,
+				"message": "too many API requests, slow down",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiLimiterFor returns the API limiter of a client IP, creating it on its first request
+func (ps *ProxyServer) apiLimiterFor(clientIP string) *apiLimiter {
+	value, ok := ps.apiLimiters.Load(clientIP)
+	if !ok {
+		value, _ = ps.apiLimiters.LoadOrStore(clientIP, &apiLimiter{
+			limiter: rate.NewLimiter(rate.Limit(ps.apiRateLimit), ps.apiRateBurst),
+		})
+	}
+	limiter := value.(*apiLimiter)
+	limiter.lastSeen.Store(time.Now().UnixNano())
+	return limiter
+}
+
+// pruneAPILimiters forgets the limiters of client IPs that made no API request for a while, so
+// that addresses seen once don't hold memory forever
+func (ps *ProxyServer) pruneAPILimiters() {
+	cutoff := time.Now().Add(-apiLimiterIdle).UnixNano()
+	ps.apiLimiters.Range(func(key, value any) bool {
+		if value.(*apiLimiter).lastSeen.Load() < cutoff {
+			ps.apiLimiters.Delete(key)
+		}
+		return true
+	})
+}
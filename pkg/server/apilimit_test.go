@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getVersion requests the version from remoteAddr, returning the response
+func getVersion(ps *ProxyServer, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/version", nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	ps.apiHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIRateLimitPerClientIP(t *testing.T) {
+	// A rate this low refills no token while the test runs, leaving the burst alone
+	ps := NewProxyServer(nil, 1024, WithAPIRateLimit(0.001, 3))
+
+	for i := range 3 {
+		if rec := getVersion(ps, "10.0.0.2:40000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: status %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+	rec := getVersion(ps, "10.0.0.2:40001")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("request over the burst: status %d, Retry-After %q, want %d and 1", rec.Code, rec.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	// Each client IP has a limiter of its own, whatever its source port
+	if rec := getVersion(ps, "10.0.0.3:40000"); rec.Code != http.StatusOK {
+		t.Errorf("request of another client IP: status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// Limiters idle for longer than apiLimiterIdle are forgotten, and with them the spent burst
+	limiter := ps.apiLimiterFor("10.0.0.2")
+	limiter.lastSeen.Store(time.Now().Add(-apiLimiterIdle - time.Minute).UnixNano())
+	ps.pruneAPILimiters()
+	if rec := getVersion(ps, "10.0.0.2:40000"); rec.Code != http.StatusOK {
+		t.Errorf("request after pruning: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAPIRateLimitDisabled(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAPIRateLimit(0, 0))
+	for i := range 50 {
+		if rec := getVersion(ps, "10.0.0.2:40000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d without a limit: status %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+}
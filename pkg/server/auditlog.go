@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit log actions
+const (
+	AuditCreate = "create" // a client created a port mapping
+	AuditDelete = "delete" // a port mapping was deleted through the API
+	AuditExpire = "expire" // a port mapping was removed because its client stopped heartbeating or its TTL ran out
+)
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time      string `json:"time"`
+	Action    string `json:"action"`
+	Port      int    `json:"port"`
+	ClientIP  string `json:"client_ip"`
+	LocalAddr string `json:"local_addr"`
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+// AuditLogger appends a JSON line for every port mapping change to a file
+type AuditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewAuditLogger opens path for appending, creating it if needed
+func NewAuditLogger(path string) (*AuditLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %v", path, err)
+	}
+
+	return &AuditLogger{file: file}, nil
+}
+
+// Log records a port mapping change. It does nothing on a nil logger, so callers don't need to
+// check whether auditing is enabled.
+func (a *AuditLogger) Log(action string, port int, clientIP, localAddr, tenant string) error {
+	if a == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(auditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Action:    action,
+		Port:      port,
+		ClientIP:  clientIP,
+		LocalAddr: localAddr,
+		Tenant:    tenant,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.file.Write(line)
+	return err
+}
+
+// Close closes the audit log file
+func (a *AuditLogger) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+// audit records a change to a mapping in the audit log, logging failures to write it
+func (ps *ProxyServer) audit(action string, mapping *ProxyMapping) {
+	var tenant string
+	if mapping.identity != nil {
+		tenant = mapping.identity.TenantID
+	}
+
+	if err := ps.auditLog.Log(action, mapping.RemotePort, mapping.ClientIP, mapping.LocalAddr, tenant); err != nil {
+		log.Printf("Failed to write audit log entry: %v", err)
+	}
+}
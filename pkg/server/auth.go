@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// bearerPrefix starts the Authorization header of a request carrying a bearer token
+const bearerPrefix = "Bearer "
+
+// requireAuth rejects API requests without the server's bearer token in their Authorization
+// header. The version endpoint stays open so clients can check compatibility first.
+func (ps *ProxyServer) requireAuth(next http.Handler) http.Handler {
+	if ps.authToken == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/version" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !ps.authorized(r) {
+			log.Printf("Rejected unauthenticated API request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+
+			// Answer in the shape of the API's responses so clients report the reason
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wg-rp"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": false,
+				"message": "missing or invalid bearer token",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether a request carries the server's bearer token or its admin token, or
+// the server needs none
+func (ps *ProxyServer) authorized(r *http.Request) bool {
+	return ps.authToken == "" || hasBearer(r, ps.authToken) || ps.isAdmin(r)
+}
+
+// isAdmin reports whether a request carries the server's admin token. Without one, no request is
+// privileged.
+func (ps *ProxyServer) isAdmin(r *http.Request) bool {
+	return ps.adminToken != "" && hasBearer(r, ps.adminToken)
+}
+
+// hasBearer reports whether the Authorization header of a request carries token
+func hasBearer(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
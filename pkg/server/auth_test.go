@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAuthToken("secret"))
+	open := NewProxyServer(nil, 1024)
+
+	tests := []struct {
+		name   string
+		ps     *ProxyServer
+		target string
+		header string
+		status int
+	}{
+		{"no token", ps, "/api/v1/blocklist", "", http.StatusUnauthorized},
+		{"wrong token", ps, "/api/v1/blocklist", "Bearer wrong", http.StatusUnauthorized},
+		{"not a bearer token", ps, "/api/v1/blocklist", "Basic secret", http.StatusUnauthorized},
+		{"right token", ps, "/api/v1/blocklist", "Bearer secret", http.StatusOK},
+		{"version check", ps, "/api/v1/version", "", http.StatusOK},
+		{"server without a token", open, "/api/v1/blocklist", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			tt.ps.apiHandler().ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Code != http.StatusUnauthorized {
+				return
+			}
+
+			// Rejections are in the shape of the API's responses
+			var response struct {
+				Success bool   `json:"success"`
+				Message string `json:"message"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Success || response.Message == "" {
+				t.Errorf("got %+v, want a failure with a message", response)
+			}
+		})
+	}
+}
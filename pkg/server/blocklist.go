@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// isBlocked reports whether an external connection comes from a blocked range
+func (ps *ProxyServer) isBlocked(addr net.Addr) bool {
+	if len(ps.blockedCIDRs) == 0 {
+		return false
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, cidr := range ps.blockedCIDRs {
+		if cidr.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectBlocked closes a connection from a blocked range and reports whether it did
+func (ps *ProxyServer) rejectBlocked(conn net.Conn, mapping *ProxyMapping) bool {
+	if !ps.isBlocked(conn.RemoteAddr()) {
+		return false
+	}
+
+	slog.Debug("Rejected connection from blocked address", "remote_addr", conn.RemoteAddr(), "port", mapping.RemotePort, "name", mapping.Name)
+	conn.Close()
+	return true
+}
+
+// handleBlocklist returns the server-wide blocklist
+func (ps *ProxyServer) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	cidrs := make([]string, 0, len(ps.blockedCIDRs))
+	for _, cidr := range ps.blockedCIDRs {
+		cidrs = append(cidrs, cidr.String())
+	}
+
+	response := api.BlocklistResponse{
+		Success: true,
+		CIDRs:   cidrs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// recordDialFailure counts a failed tunnel dial on the mapping's circuit breaker
+func (ps *ProxyServer) recordDialFailure(mapping *ProxyMapping) {
+	if mapping.breaker.RecordFailure() {
+		log.Printf("Circuit opened for port %s after %d failed dials to client %s, closing new connections",
+			mapping.portLabel(), mapping.breaker.Threshold(), mapping.ClientIP)
+	}
+}
+
+// circuitsOpenSinceHeartbeat reports whether a mapping of the client has had its circuit open for
+// a full heartbeat interval without the client heartbeating since, so the client can be treated
+// as dead before its heartbeat timeout. Callers must hold ps.mu.
+func (ps *ProxyServer) circuitsOpenSinceHeartbeat(clientIP string, client *ClientInfo, now time.Time) bool {
+	for _, mapping := range ps.clientMappings(clientIP) {
+		openSince := mapping.breaker.OpenSince()
+		if openSince.IsZero() || now.Sub(openSince) < ps.heartbeatInterval {
+			continue
+		}
+		if client.LastHeartbeat.Before(openSince) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/capture"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+const (
+	defaultCaptureDuration = time.Minute
+	maxCaptureDuration     = 10 * time.Minute
+	defaultCaptureBytes    = 10 << 20
+	maxCaptureBytes        = 256 << 20
+
+	// captureQueueSize bounds the records buffered between the relay and the capture writer
+	captureQueueSize = 1024
+)
+
+// captureWriter tees every successful write into a capture
+type captureWriter struct {
+	w       io.Writer
+	capture *capture.Capture
+	connID  uint64
+	dir     capture.Direction
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.capture.Record(cw.connID, cw.dir, p[:n])
+	}
+	return n, err
+}
+
+// captureFileLabel names the mapping in capture file names: its port, followed by its hostname on a
+// shared port and whether it is tunnel-only, so captures of mappings on the same port don't collide
+func captureFileLabel(mapping *ProxyMapping) string {
+	label := strconv.Itoa(mapping.RemotePort)
+	if mapping.Hostname != "" {
+		label += "-" + strings.ReplaceAll(mapping.Hostname, "*", "wildcard")
+	}
+	if mapping.tunnelOnly {
+		label += "-tunnel"
+	}
+	return label
+}
+
+// startCapture starts a bounded capture of new connections on a mapping.
+// Caller must hold ps.mu.
+func (ps *ProxyServer) startCapture(mapping *ProxyMapping, duration time.Duration, maxBytes int64) (*capture.Capture, error) {
+	if mapping.capture.Load() != nil {
+		return nil, fmt.Errorf("a capture is already running on port %s", mapping.portLabel())
+	}
+
+	if duration <= 0 {
+		duration = defaultCaptureDuration
+	}
+	duration = min(duration, maxCaptureDuration)
+	if maxBytes <= 0 {
+		maxBytes = defaultCaptureBytes
+	}
+	maxBytes = min(maxBytes, maxCaptureBytes)
+
+	name := fmt.Sprintf("wg-rp-port%s-%s.cap", captureFileLabel(mapping), time.Now().Format("20060102-150405"))
+	c, err := capture.New(filepath.Join(ps.captureDir, name), duration, maxBytes, captureQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	mapping.capture.Store(c)
+
+	log.Printf("Started capture on port %s to %s (max %s, %s)",
+		mapping.portLabel(), c.Path(), utils.FormatBytes(uint64(maxBytes)), utils.FormatDuration(duration))
+
+	// Detach the capture from the mapping once it stops on its own
+	go func() {
+		<-c.Done()
+		mapping.capture.CompareAndSwap(c, nil)
+		log.Printf("Capture on port %s finished: %s written to %s, %d records dropped",
+			mapping.portLabel(), utils.FormatBytes(uint64(c.BytesWritten())), c.Path(), c.Dropped())
+	}()
+
+	return c, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// requestCapture sends a capture request with token, returning the status code and the response
+func requestCapture(t *testing.T, ps *ProxyServer, method, target, token, body string) (int, api.CaptureResponse) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ps.apiHandler().ServeHTTP(rec, req)
+
+	var response api.CaptureResponse
+	if rec.Code != http.StatusUnauthorized {
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return rec.Code, response
+}
+
+func TestCaptureRequiresAdmin(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAuthToken("client-token"), WithAdminToken("admin-token"), WithCapture(true, t.TempDir()))
+	t.Cleanup(func() { stopMappings(ps) })
+	port := freePorts(t, 1)[0]
+	if err := ps.loadMapping(testMapping(port), false); err != nil {
+		t.Fatal(err)
+	}
+
+	body := fmt.Sprintf(`{"remote_port": %d}`, port)
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"client token", "client-token", http.StatusForbidden},
+		{"admin token", "admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got, _ := requestCapture(t, ps, http.MethodPost, "/api/v1/captures", tt.token, body); got != tt.want {
+			t.Errorf("start with %s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Stopping a capture takes the admin token as well
+	target := fmt.Sprintf("/api/v1/captures/%d", port)
+	if got, _ := requestCapture(t, ps, http.MethodDelete, target, "client-token", ""); got != http.StatusForbidden {
+		t.Errorf("stop with the client token: status %d, want %d", got, http.StatusForbidden)
+	}
+	if got, _ := requestCapture(t, ps, http.MethodDelete, target, "admin-token", ""); got != http.StatusOK {
+		t.Errorf("stop with the admin token: status %d, want %d", got, http.StatusOK)
+	}
+
+	// Without an admin token configured, nobody may capture, whatever the auth token
+	ps = NewProxyServer(nil, 1024, WithCapture(true, t.TempDir()))
+	if got, _ := requestCapture(t, ps, http.MethodPost, "/api/v1/captures", "", body); got != http.StatusForbidden {
+		t.Errorf("without an admin token: status %d, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestCaptureHostMapping(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAdminToken("admin"), WithCapture(true, t.TempDir()))
+	t.Cleanup(func() { stopMappings(ps) })
+	port := freePorts(t, 1)[0]
+	for _, hostname := range []string{"app.example.com", "*.example.com"} {
+		req := testMapping(port)
+		req.Mode = api.ModeHTTP
+		req.Hostname = hostname
+		if err := ps.loadMapping(req, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A mapping routed by hostname is named by its hostname, and gets a file of its own
+	body := fmt.Sprintf(`{"remote_port": %d, "hostname": "App.example.com"}`, port)
+	status, response := requestCapture(t, ps, http.MethodPost, "/api/v1/captures", "admin", body)
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d, want 200: %s", status, response.Message)
+	}
+	if want := fmt.Sprintf("wg-rp-port%d-app.example.com-", port); !strings.HasPrefix(filepath.Base(response.File), want) {
+		t.Errorf("capture file %s, want a name starting with %s", response.File, want)
+	}
+	ps.mu.RLock()
+	app, _ := ps.hostMapping(portKey{port: port}, "app.example.com")
+	wildcard, _ := ps.hostMapping(portKey{port: port}, "*.example.com")
+	ps.mu.RUnlock()
+	if app.capture.Load() == nil || wildcard.capture.Load() != nil {
+		t.Fatal("the capture didn't start on the mapping of app.example.com alone")
+	}
+
+	// Without the hostname the port has no mapping of its own
+	if status, _ := requestCapture(t, ps, http.MethodPost, "/api/v1/captures", "admin", fmt.Sprintf(`{"remote_port": %d}`, port)); status != http.StatusNotFound {
+		t.Errorf("start without a hostname: status %d, want %d", status, http.StatusNotFound)
+	}
+
+	target := fmt.Sprintf("/api/v1/captures/%d?hostname=app.example.com", port)
+	if status, response := requestCapture(t, ps, http.MethodDelete, target, "admin", ""); status != http.StatusOK {
+		t.Fatalf("stop: status %d, want 200: %s", status, response.Message)
+	}
+}
+
+func TestCaptureOfTLSMappingNeedsAcknowledgment(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAdminToken("admin"), WithCapture(true, t.TempDir()))
+	t.Cleanup(func() { stopMappings(ps) })
+	port := freePorts(t, 1)[0]
+	if err := ps.loadMapping(testMapping(port), false); err != nil {
+		t.Fatal(err)
+	}
+	ps.mu.Lock()
+	mapping := ps.mappings[portKey{port: port}]
+	mapping.tlsConfig = &tls.Config{}
+	ps.mu.Unlock()
+
+	// The relay sees the plaintext of a mapping that terminates TLS, which only an explicit request captures
+	status, response := requestCapture(t, ps, http.MethodPost, "/api/v1/captures", "admin", fmt.Sprintf(`{"remote_port": %d}`, port))
+	if status != http.StatusForbidden || !strings.Contains(response.Message, "allow_tls_plaintext") {
+		t.Fatalf("start without the acknowledgment: status %d %q, want 403 naming allow_tls_plaintext", status, response.Message)
+	}
+	if mapping.capture.Load() != nil {
+		t.Fatal("a refused capture started")
+	}
+
+	body := fmt.Sprintf(`{"remote_port": %d, "allow_tls_plaintext": true}`, port)
+	if status, response := requestCapture(t, ps, http.MethodPost, "/api/v1/captures", "admin", body); status != http.StatusOK {
+		t.Fatalf("start with the acknowledgment: status %d, want 200: %s", status, response.Message)
+	}
+	mapping.capture.Load().Stop()
+}
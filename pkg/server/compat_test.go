@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// The frozen v1 client below speaks the API exactly as the first clients did: it only registers,
+// deletes and heartbeats, and decodes the responses into its own copies of the original types.
+// It stands for the clients already installed, so don't change it to follow the API: a change to
+// the server that breaks these tests breaks those clients.
+
+type v1PortMappingRequest struct {
+	LocalAddr  string `json:"local_addr"`
+	RemotePort int    `json:"remote_port"`
+	ClientIP   string `json:"client_ip"`
+	ClientPort int    `json:"client_port"`
+}
+
+type v1PortMappingResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+type v1HeartbeatRequest struct {
+	ClientIP string `json:"client_ip"`
+}
+
+type v1HeartbeatResponse struct {
+	Success           bool   `json:"success"`
+	Message           string `json:"message"`
+	ServerStartupTime int64  `json:"server_startup_time"`
+}
+
+// v1Client is a frozen v1 client with the mappings it registered
+type v1Client struct {
+	t                 *testing.T
+	serverURL         string
+	clientIP          string
+	mappings          []v1PortMappingRequest
+	serverStartupTime int64
+}
+
+// register registers a mapping and remembers it for re-registration on success
+func (c *v1Client) register(remotePort int) (v1PortMappingResponse, int) {
+	request := v1PortMappingRequest{
+		LocalAddr:  fmt.Sprintf("127.0.0.1:%d", remotePort),
+		RemotePort: remotePort,
+		ClientIP:   c.clientIP,
+		ClientPort: 40000 + remotePort%10000,
+	}
+	var response v1PortMappingResponse
+	status := c.do(http.MethodPost, "/api/v1/port-mappings", request, &response)
+	if response.Success {
+		c.mappings = append(c.mappings, request)
+	}
+	return response, status
+}
+
+// delete deletes the mapping of a remote port
+func (c *v1Client) delete(remotePort int) (v1PortMappingResponse, int) {
+	var response v1PortMappingResponse
+	status := c.do(http.MethodDelete, fmt.Sprintf("/api/v1/port-mappings?port=%d", remotePort), nil, &response)
+	return response, status
+}
+
+// heartbeat sends a heartbeat and, like the first clients, registers every mapping again when
+// the server's startup time changed. It reports whether it re-registered.
+func (c *v1Client) heartbeat() (v1HeartbeatResponse, bool) {
+	var response v1HeartbeatResponse
+	c.do(http.MethodPost, "/api/v1/heartbeat", v1HeartbeatRequest{ClientIP: c.clientIP}, &response)
+	if !response.Success {
+		return response, false
+	}
+
+	restarted := c.serverStartupTime != 0 && response.ServerStartupTime != c.serverStartupTime
+	c.serverStartupTime = response.ServerStartupTime
+	if restarted {
+		mappings := c.mappings
+		c.mappings = nil
+		for _, m := range mappings {
+			if response, _ := c.register(m.RemotePort); !response.Success {
+				c.t.Errorf("re-registering port %d after the restart failed: %s", m.RemotePort, response.Message)
+			}
+		}
+	}
+	return response, restarted
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response
+func (c *v1Client) do(method, path string, body, response any) int {
+	c.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.serverURL+path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		c.t.Fatalf("%s %s: failed to decode response: %v", method, path, err)
+	}
+	return resp.StatusCode
+}
+
+// v1Harness serves the API of a server in memory, to each client from an address of its own so
+// requests appear to come from its tunnel IP. The server can be replaced to simulate a restart.
+type v1Harness struct {
+	t      *testing.T
+	server atomic.Pointer[ProxyServer]
+}
+
+func newV1Harness(t *testing.T) *v1Harness {
+	h := &v1Harness{t: t}
+	h.restart()
+	t.Cleanup(func() { stopMappings(h.server.Load()) })
+	return h
+}
+
+// restart replaces the server with a new one that started later and has none of the previous
+// one's mappings. Features old clients don't know about are enabled on it.
+func (h *v1Harness) restart() *ProxyServer {
+	ps := NewProxyServer(nil, 32*1024, WithMuxPort(7000), WithDeleteGracePeriod(time.Minute))
+	if previous := h.server.Load(); previous != nil {
+		stopMappings(previous)
+		ps.startupTime = previous.startupTime.Add(time.Minute)
+	}
+	h.server.Store(ps)
+	return ps
+}
+
+// client returns a frozen v1 client with the given tunnel IP
+func (h *v1Harness) client(clientIP string) *v1Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = net.JoinHostPort(clientIP, "40000")
+		h.server.Load().apiHandler().ServeHTTP(w, r)
+	}))
+	h.t.Cleanup(srv.Close)
+	return &v1Client{t: h.t, serverURL: srv.URL, clientIP: clientIP}
+}
+
+// stopMappings stops every mapping of a server, releasing their ports
+func stopMappings(ps *ProxyServer) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, mapping := range ps.mappings {
+		ps.removeMapping(mapping)
+	}
+	for _, mapping := range ps.hostMappings("") {
+		ps.removeHostMapping(mapping)
+	}
+}
+
+// freePorts returns n TCP ports nothing listens on
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	ports := make([]int, 0, n)
+	for range n {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+	}
+	return ports
+}
+
+// mappingStatus returns the current server's view of a mapping in the current API's terms
+func (h *v1Harness) mappingStatus(port int) (api.MappingStatus, bool) {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/port-mappings", nil)
+	rec := httptest.NewRecorder()
+	h.server.Load().apiHandler().ServeHTTP(rec, req)
+
+	var list api.PortMappingListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		h.t.Fatal(err)
+	}
+	for _, m := range list.Mappings {
+		if m.RemotePort == port {
+			return m, true
+		}
+	}
+	return api.MappingStatus{}, false
+}
+
+func TestV1ClientRegisterHeartbeatDelete(t *testing.T) {
+	h := newV1Harness(t)
+	c := h.client("10.0.0.2")
+	port := freePorts(t, 1)[0]
+
+	if response, status := c.register(port); !response.Success || status != http.StatusOK {
+		t.Fatalf("register = %d %+v, want success", status, response)
+	}
+
+	// The port is exposed on the server host like it always was
+	if ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port)); err == nil {
+		ln.Close()
+		t.Fatal("mapped port is not listening on the server host")
+	}
+
+	// Features the client never asked for stay off
+	status, ok := h.mappingStatus(port)
+	if !ok {
+		t.Fatal("mapping is not listed")
+	}
+	if status.Mode != api.ModeTCP || status.Visibility != api.VisibilityPublic || status.Compression != "" ||
+		status.ProxyProtocol || status.TLSCert != "" || status.ExpiresAt != 0 || status.OffSchedule {
+		t.Errorf("mapping of a v1 client has new features enabled: %+v", status)
+	}
+	ps := h.server.Load()
+	ps.mu.RLock()
+	multiplexed := ps.mappings[portKey{port: port}].multiplexed
+	ps.mu.RUnlock()
+	if multiplexed {
+		t.Error("mapping of a v1 client is multiplexed")
+	}
+
+	heartbeat, restarted := c.heartbeat()
+	if !heartbeat.Success || heartbeat.ServerStartupTime != h.server.Load().startupTime.Unix() || restarted {
+		t.Fatalf("heartbeat = %+v, restarted %v, want success with the server's startup time", heartbeat, restarted)
+	}
+
+	if response, status := c.delete(port); !response.Success || status != http.StatusOK {
+		t.Fatalf("delete = %d %+v, want success", status, response)
+	}
+
+	// The same client can take its port back at once
+	if response, _ := c.register(port); !response.Success {
+		t.Fatalf("registering the deleted port again = %+v, want success", response)
+	}
+}
+
+func TestV1ClientConflicts(t *testing.T) {
+	h := newV1Harness(t)
+	owner, other := h.client("10.0.0.2"), h.client("10.0.0.3")
+	port := freePorts(t, 1)[0]
+
+	if response, _ := owner.register(port); !response.Success {
+		t.Fatalf("register = %+v, want success", response)
+	}
+
+	// Another client is turned away with a conflict, the owner may register again
+	response, status := other.register(port)
+	if response.Success || status != http.StatusConflict || response.Message == "" {
+		t.Errorf("other client's register = %d %+v, want a 409 with a message", status, response)
+	}
+	if response, _ := owner.register(port); !response.Success {
+		t.Errorf("owner registering again = %+v, want success", response)
+	}
+
+	// Deleting a port that isn't mapped fails with a message
+	response, status = owner.delete(freePorts(t, 1)[0])
+	if response.Success || status != http.StatusNotFound || response.Message == "" {
+		t.Errorf("delete of an unmapped port = %d %+v, want a 404 with a message", status, response)
+	}
+
+	// Malformed requests still get a JSON answer the client can report
+	var malformed v1PortMappingResponse
+	status = owner.do(http.MethodPost, "/api/v1/port-mappings", "not a mapping", &malformed)
+	if malformed.Success || status != http.StatusBadRequest || malformed.Message == "" {
+		t.Errorf("malformed register = %d %+v, want a 400 with a message", status, malformed)
+	}
+}
+
+func TestV1ClientReregistersAfterRestart(t *testing.T) {
+	h := newV1Harness(t)
+	c := h.client("10.0.0.2")
+	ports := freePorts(t, 2)
+
+	for _, port := range ports {
+		if response, _ := c.register(port); !response.Success {
+			t.Fatalf("register = %+v, want success", response)
+		}
+	}
+	if _, restarted := c.heartbeat(); restarted {
+		t.Fatal("first heartbeat reported a restart")
+	}
+
+	// The new server knows nothing of the mappings until the client notices the restart
+	ps := h.restart()
+	if _, exists := h.mappingStatus(ports[0]); exists {
+		t.Fatal("restarted server still has the mapping")
+	}
+
+	heartbeat, restarted := c.heartbeat()
+	if !heartbeat.Success || !restarted {
+		t.Fatalf("heartbeat after the restart = %+v, restarted %v, want a detected restart", heartbeat, restarted)
+	}
+	for _, port := range ports {
+		if _, exists := h.mappingStatus(port); !exists {
+			t.Errorf("port %d was not registered again after the restart", port)
+		}
+	}
+	if clients := len(ps.clients); clients != 1 {
+		t.Errorf("restarted server tracks %d clients, want 1", clients)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+)
+
+// liveConnection is an open proxy connection tracked for the connections endpoint
+type liveConnection struct {
+	id          uint64
+	remoteAddr  net.Addr
+	tunnelAddr  net.Addr
+	mappingPort int
+	startTime   time.Time
+	counter     *conntrack.CountingConn // counts bytes of the external side
+}
+
+// trackConnection registers an open connection and returns the function that removes it
+func (ps *ProxyServer) trackConnection(conn *liveConnection) func() {
+	ps.connections.Store(conn.id, conn)
+	return func() { ps.connections.Delete(conn.id) }
+}
+
+// handleListConnections lists the open proxy connections, optionally filtered by ?port=
+func (ps *ProxyServer) handleListConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	port := 0
+	if portStr := r.URL.Query().Get("port"); portStr != "" {
+		p, err := strconv.Atoi(portStr)
+		if err != nil || p < 1 || p > 65535 {
+			response := api.ConnectionListResponse{
+				Success: false,
+				Message: "Invalid port number",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		port = p
+	}
+
+	connections := make([]api.ConnectionInfo, 0)
+	ps.connections.Range(func(_, value any) bool {
+		conn := value.(*liveConnection)
+		if port != 0 && conn.mappingPort != port {
+			return true
+		}
+		connections = append(connections, api.ConnectionInfo{
+			ID:          conn.id,
+			RemoteAddr:  conn.remoteAddr.String(),
+			TunnelAddr:  conn.tunnelAddr.String(),
+			MappingPort: conn.mappingPort,
+			StartTime:   conn.startTime.UnixMilli(),
+			BytesIn:     conn.counter.BytesRead(),
+			BytesOut:    conn.counter.BytesWritten(),
+		})
+		return true
+	})
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ID < connections[j].ID
+	})
+
+	json.NewEncoder(w).Encode(api.ConnectionListResponse{
+		Success:     true,
+		Connections: connections,
+	})
+}
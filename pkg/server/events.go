@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+const (
+	// eventPingInterval is how often an idle event stream gets a keep-alive comment
+	eventPingInterval = 15 * time.Second
+
+	// eventQueueSize is how many events may be pending for a subscriber before it is dropped
+	eventQueueSize = 16
+)
+
+// eventBroker fans events out to the event streams of connected clients
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan api.Event]struct{} // clientIP -> streams
+	nextID      atomic.Uint64
+	startupTime int64
+}
+
+// newEventBroker creates an event broker for a server started at startupTime
+func newEventBroker(startupTime time.Time) *eventBroker {
+	return &eventBroker{
+		subscribers: make(map[string]map[chan api.Event]struct{}),
+		startupTime: startupTime.Unix(),
+	}
+}
+
+// newEvent creates an event with the next event ID
+func (b *eventBroker) newEvent(eventType string, port int) api.Event {
+	return api.Event{
+		ID:                b.nextID.Add(1),
+		Type:              eventType,
+		Port:              port,
+		ServerStartupTime: b.startupTime,
+	}
+}
+
+// subscribe registers a new event stream for a client
+func (b *eventBroker) subscribe(clientIP string) chan api.Event {
+	ch := make(chan api.Event, eventQueueSize)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers[clientIP] == nil {
+		b.subscribers[clientIP] = make(map[chan api.Event]struct{})
+	}
+	b.subscribers[clientIP][ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe removes an event stream, closing its channel if it is still registered
+func (b *eventBroker) unsubscribe(clientIP string, ch chan api.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(clientIP, ch)
+}
+
+// remove drops a subscriber. Callers must hold b.mu.
+func (b *eventBroker) remove(clientIP string, ch chan api.Event) {
+	subs := b.subscribers[clientIP]
+	if _, exists := subs[ch]; !exists {
+		return
+	}
+
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(b.subscribers, clientIP)
+	}
+}
+
+// publish sends an event to every stream of a client
+func (b *eventBroker) publish(clientIP string, eventType string, port int) {
+	ev := b.newEvent(eventType, port)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.send(clientIP, ev)
+}
+
+// publishMapping sends an event about a mapping to its client
+func (b *eventBroker) publishMapping(eventType string, mapping *ProxyMapping) {
+	ev := b.newEvent(eventType, mapping.RemotePort)
+	ev.Hostname = mapping.Hostname
+	ev.Visibility = mapping.visibility()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.send(mapping.ClientIP, ev)
+}
+
+// broadcast sends an event to every connected client
+func (b *eventBroker) broadcast(eventType string) {
+	ev := b.newEvent(eventType, 0)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for clientIP := range b.subscribers {
+		b.send(clientIP, ev)
+	}
+}
+
+// send queues an event on a client's streams. A stream that can't keep up is dropped; the client
+// reconnects and resynchronises from the restarted event. Callers must hold b.mu.
+func (b *eventBroker) send(clientIP string, ev api.Event) {
+	for ch := range b.subscribers[clientIP] {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("Event stream of client %s is not keeping up, dropping it", clientIP)
+			b.remove(clientIP, ch)
+		}
+	}
+}
+
+// NotifyShutdown tells all connected clients that the server is shutting down
+func (ps *ProxyServer) NotifyShutdown() {
+	ps.events.broadcast(api.EventShuttingDown)
+}
+
+// handleEvents streams server events to a client as server-sent events
+func (ps *ProxyServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.URL.Query().Get("client_ip")
+	if clientIP == "" {
+		http.Error(w, "client_ip parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// The stream outlives the API server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	events := ps.events.subscribe(clientIP)
+	defer ps.events.unsubscribe(clientIP, events)
+
+	log.Printf("Client %s subscribed to events", clientIP)
+
+	// Start every stream by announcing which server instance the client is talking to
+	if err := writeEvent(w, rc, ps.events.newEvent(api.EventRestarted, 0)); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, rc, ev); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes a single server-sent event and flushes it to the client
+func writeEvent(w http.ResponseWriter, rc *http.ResponseController, ev api.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// MappingsToJSON returns the mappings as a JSON array of api.PortMappingRequest, sorted by port,
+// that PreloadMappings accepts. A mapping with a TTL is exported with the time it has left.
+func MappingsToJSON(mappings []*ProxyMapping) ([]byte, error) {
+	return requestsToJSON(mappingRequests(mappings, time.Now()))
+}
+
+// mappingRequests returns the requests that create the mappings again, sorted by port with a public
+// mapping ahead of a tunnel-only one and then by hostname, leaving out deleted mappings. A mapping with
+// a TTL gets the time it has left at now.
+func mappingRequests(mappings []*ProxyMapping, now time.Time) []api.PortMappingRequest {
+	// A deleted mapping only holds its port until its grace period ends
+	mappings = slices.DeleteFunc(slices.Clone(mappings), func(m *ProxyMapping) bool {
+		return m.grace.Load()
+	})
+	slices.SortFunc(mappings, func(a, b *ProxyMapping) int {
+		return cmp.Or(cmp.Compare(a.RemotePort, b.RemotePort), compareBool(a.tunnelOnly, b.tunnelOnly),
+			cmp.Compare(a.Hostname, b.Hostname))
+	})
+
+	requests := make([]api.PortMappingRequest, 0, len(mappings))
+	for _, m := range mappings {
+		req := api.PortMappingRequest{
+			LocalAddr:               m.LocalAddr,
+			RemotePort:              m.RemotePort,
+			ClientIP:                m.ClientIP,
+			ClientPort:              m.ClientPort,
+			LocalProbe:              m.localProbe,
+			TunnelDialTimeoutMillis: int(m.dialTimeout.Milliseconds()),
+			Name:                    m.Name,
+			Labels:                  m.Labels,
+			HTTPHostRewrite:         m.httpHostRewrite,
+		}
+		req.BufferSizeKB = m.bufferSizeKB
+		req.TLSCert = m.tlsCert
+		req.TLSALPN = m.tlsALPN
+		req.Compression = m.compression
+		req.ProxyProtocol = m.proxyProtocol
+		req.ProxyProtoTLVs = m.proxyProtoTLVs
+		if m.tunnelOnly {
+			req.Visibility = api.VisibilityTunnel
+		}
+		if m.Hostname != "" {
+			req.Mode = m.mode()
+			req.Hostname = m.Hostname
+		}
+		if m.multiplexed {
+			req.Transport = api.TransportYamux
+		}
+		if m.schedule != nil {
+			req.Schedule = m.schedule.String()
+			req.ScheduleCloseActive = m.closeOffSchedule
+		}
+		if m.connRateLimiter != nil {
+			req.MaxConnsPerSecond = float64(m.connRateLimiter.Limit())
+			req.MaxConnsBurst = m.connRateLimiter.Burst()
+		}
+		req.MaxHalfOpen = m.maxHalfOpen
+		req.WriteDeadlineSeconds = int(m.writeDeadline / time.Second)
+		if rate := m.SampleRate(); rate < 1 {
+			req.SampleRate = &rate
+		}
+		if !m.expiresAt.IsZero() {
+			req.TTLSeconds = max(1, int(math.Ceil(m.expiresAt.Sub(now).Seconds())))
+		}
+		requests = append(requests, req)
+	}
+	return requests
+}
+
+// compareBool orders false ahead of true
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// requestsToJSON formats port mapping requests as a file for -preload-mappings
+func requestsToJSON(requests []api.PortMappingRequest) ([]byte, error) {
+	data, err := json.MarshalIndent(requests, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal port mappings: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// ExportStore returns the mappings saved in the store at path as a JSON file for
+// -preload-mappings, like MappingsToJSON does for a running server
+func ExportStore(path string) ([]byte, error) {
+	requests, err := ReadStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return requestsToJSON(requests)
+}
+
+// handleExportMappings returns the active port mappings, those routed by hostname included, as a JSON
+// file for -preload-mappings
+func (ps *ProxyServer) handleExportMappings(w http.ResponseWriter, r *http.Request) {
+	ps.mu.RLock()
+	mappings := ps.allMappings()
+	data, err := MappingsToJSON(mappings)
+	count := len(mappings)
+	ps.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Exported %d port mappings for %s", count, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="port-mappings.json"`)
+	w.Write(data)
+}
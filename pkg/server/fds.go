@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// fdReserveSize is how many spare descriptors are held to be released when the process runs out
+	fdReserveSize = 4
+
+	// acceptMinBackoff and acceptMaxBackoff bound the pause between accepts while out of descriptors
+	acceptMinBackoff = 5 * time.Millisecond
+	acceptMaxBackoff = time.Second
+)
+
+// isFDExhausted reports whether err means the process or system ran out of file descriptors
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// fdReserve holds spare file descriptors that are released when the process runs out, so closing
+// connections, answering the API and logging keep working until load drops
+type fdReserve struct {
+	mu       sync.Mutex
+	files    []*os.File
+	size     int
+	released bool // the reserve was released and not refilled yet
+}
+
+// newFDReserve opens size spare descriptors
+func newFDReserve(size int) *fdReserve {
+	r := &fdReserve{size: size}
+	r.fill()
+	return r
+}
+
+// fill opens spare descriptors up to the reserve size. Callers must hold r.mu or own r.
+func (r *fdReserve) fill() bool {
+	for len(r.files) < r.size {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			return false
+		}
+		r.files = append(r.files, f)
+	}
+	return true
+}
+
+// release closes the spare descriptors and reports whether this is the first release since
+// the reserve was last full
+func (r *fdReserve) release() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.files {
+		f.Close()
+	}
+	r.files = nil
+
+	first := !r.released
+	r.released = true
+	return first
+}
+
+// refill reopens the spare descriptors after a release and reports whether the reserve is
+// full again for the first time since
+func (r *fdReserve) refill() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.released || !r.fill() {
+		return false
+	}
+	r.released = false
+	return true
+}
+
+// handleFDExhaustion frees the descriptor reserve and logs a single warning per exhaustion
+func (ps *ProxyServer) handleFDExhaustion(err error) {
+	if !ps.fdReserve.release() {
+		return
+	}
+
+	open, limit := fdUsage()
+	log.Printf("Out of file descriptors (%v, %d open, limit %d): pausing accepts and released %d reserved descriptors. "+
+		"Raise the limit (ulimit -n, or LimitNOFILE= for systemd) if this happens under normal load",
+		err, open, limit, fdReserveSize)
+}
+
+// recoverFDReserve refills the descriptor reserve once descriptors are available again
+func (ps *ProxyServer) recoverFDReserve() {
+	if ps.fdReserve.refill() {
+		open, limit := fdUsage()
+		log.Printf("File descriptors available again (%d open, limit %d), accepts resumed normally", open, limit)
+	}
+}
+
+// acceptBackoff returns the pause before the next accept after running out of descriptors
+func acceptBackoff(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return acceptMinBackoff
+	}
+	return min(previous*2, acceptMaxBackoff)
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdUsage returns how many file descriptors the process has open and its soft limit,
+// or zeros where they can't be determined
+func fdUsage() (open, limit int) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil {
+		limit = int(rlimit.Cur)
+	}
+
+	// Linux exposes open descriptors in /proc, the BSDs and macOS in /dev/fd
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// Don't count the descriptor used to read the directory
+			return max(len(entries)-1, 0), limit
+		}
+	}
+	return 0, limit
+}
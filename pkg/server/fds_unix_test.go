@@ -0,0 +1,180 @@
+//go:build !windows
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// fdHarnessEnv tells the test binary it runs as the child of TestFDExhaustion
+const fdHarnessEnv = "WGRP_FD_HARNESS"
+
+// TestFDExhaustion runs the server out of file descriptors in a child process, whose lowered
+// RLIMIT_NOFILE can't starve the other tests
+func TestFDExhaustion(t *testing.T) {
+	if os.Getenv(fdHarnessEnv) == "1" {
+		runFDExhaustion(t)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFDExhaustion$", "-test.v")
+	cmd.Env = append(os.Environ(), fdHarnessEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("harness failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "--- PASS: TestFDExhaustion") {
+		t.Fatalf("harness did not run the scenario:\n%s", out)
+	}
+}
+
+// fdHog holds descriptors to run the process out of them
+type fdHog []*os.File
+
+// exhaust opens descriptors until the process is out of them, leaving spare free
+func (h *fdHog) exhaust(t *testing.T, spare int) {
+	t.Helper()
+	for {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			if !isFDExhausted(err) {
+				t.Fatal(err)
+			}
+			break
+		}
+		*h = append(*h, f)
+	}
+	h.free(spare)
+}
+
+// free closes n of the held descriptors
+func (h *fdHog) free(n int) {
+	for ; n > 0 && len(*h) > 0; n-- {
+		(*h)[len(*h)-1].Close()
+		*h = (*h)[:len(*h)-1]
+	}
+}
+
+// reserveState returns whether the server's descriptor reserve is released and how many it holds
+func reserveState(ps *ProxyServer) (released bool, held int) {
+	ps.fdReserve.mu.Lock()
+	defer ps.fdReserve.mu.Unlock()
+	return ps.fdReserve.released, len(ps.fdReserve.files)
+}
+
+// callAPI sends a request to the server's API as client 10.0.0.2, without using a descriptor
+func callAPI(t *testing.T, ps *ProxyServer, method, path string, body, response any) int {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.RemoteAddr = "10.0.0.2:40000"
+	rec := httptest.NewRecorder()
+	ps.apiHandler().ServeHTTP(rec, req)
+	if err := json.NewDecoder(rec.Body).Decode(response); err != nil {
+		t.Fatalf("%s %s: failed to decode response: %v", method, path, err)
+	}
+	return rec.Code
+}
+
+// registerMapping registers a mapping of client 10.0.0.2 on port
+func registerMapping(t *testing.T, ps *ProxyServer, port int) (api.PortMappingResponse, int) {
+	t.Helper()
+	req := api.PortMappingRequest{LocalAddr: fmt.Sprintf("127.0.0.1:%d", port), RemotePort: port, ClientIP: "10.0.0.2", ClientPort: 40000}
+	var response api.PortMappingResponse
+	status := callAPI(t, ps, http.MethodPost, "/api/v1/port-mappings", req, &response)
+	return response, status
+}
+
+func runFDExhaustion(t *testing.T) {
+	ports := freePorts(t, 2)
+
+	// Leave room for the server, its reserve and a few connections
+	open, _ := fdUsage()
+	limit := uint64(open + 32)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+		t.Skipf("can't lower RLIMIT_NOFILE: %v", err)
+	}
+
+	ps := NewProxyServer(nil, 1024)
+	t.Cleanup(func() { stopMappings(ps) })
+
+	if response, status := registerMapping(t, ps, ports[0]); status != http.StatusOK {
+		t.Fatalf("register = %d %+v, want success", status, response)
+	}
+
+	// Connections are closed right after being accepted, so the test needs no tunnel
+	ps.mu.RLock()
+	mapping := ps.mappings[portKey{port: ports[0]}]
+	ps.mu.RUnlock()
+	mapping.suspended.Store(true)
+
+	var hog fdHog
+	defer func() { hog.free(len(hog)) }()
+
+	// A registration without a descriptor left for its listener is told the server is overloaded,
+	// and the reserve is released so the API keeps answering
+	hog.exhaust(t, 0)
+	response, status := registerMapping(t, ps, ports[1])
+	if status != http.StatusServiceUnavailable || !strings.Contains(response.Message, "out of file descriptors") {
+		t.Errorf("register while out of descriptors = %d %+v, want a 503 saying so", status, response)
+	}
+	if released, _ := reserveState(ps); !released {
+		t.Fatal("descriptor reserve was not released")
+	}
+
+	var serverStatus api.ServerStatus
+	if status := callAPI(t, ps, http.MethodGet, "/api/v1/status", nil, &serverStatus); status != http.StatusOK {
+		t.Fatalf("status = %d, want the API to keep answering", status)
+	}
+	if serverStatus.MaxFDs != int(limit) || serverStatus.OpenFDs < int(limit)-fdReserveSize-1 {
+		t.Errorf("status reports %d of %d descriptors open, want about %d of %d", serverStatus.OpenFDs, serverStatus.MaxFDs, limit-fdReserveSize, limit)
+	}
+
+	// Connect with the last free descriptor, leaving none for the mapping to accept with
+	hog.exhaust(t, 1)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ports[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read before descriptors are free = %v, want the connection to wait in the backlog", err)
+	}
+
+	// Once descriptors are free again the accept loop picks the connection up where it paused
+	hog.free(len(hog))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("mapping did not accept the connection after descriptors were freed")
+	}
+
+	ps.recoverFDReserve()
+	if released, held := reserveState(ps); released || held != fdReserveSize {
+		t.Errorf("descriptor reserve holds %d descriptors after recovering, want %d", held, fdReserveSize)
+	}
+	if response, status := registerMapping(t, ps, ports[1]); status != http.StatusOK {
+		t.Errorf("register after recovering = %d %+v, want success", status, response)
+	}
+}
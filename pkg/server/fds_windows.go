@@ -0,0 +1,8 @@
+//go:build windows
+
+package server
+
+// fdUsage is not available on Windows, where handles are not limited by an rlimit
+func fdUsage() (open, limit int) {
+	return 0, 0
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+// forwardHeaderTimeout bounds how long a forward connection may take to send its request
+const forwardHeaderTimeout = 10 * time.Second
+
+// StartForwardListener accepts forwards from clients on the forward port within the WireGuard
+// netstack. A forward starts with an HTTP CONNECT request naming its target; once the server has
+// connected to the target on the host network, the connection carries the forwarded data.
+func (ps *ProxyServer) StartForwardListener() error {
+	listener, err := ps.tnet.ListenTCP(&net.TCPAddr{Port: ps.forwardPort})
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %v", ps.forwardPort, err)
+	}
+
+	log.Printf("Forward listener listening on :%d within WireGuard netstack", ps.forwardPort)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Forward listener error: %v", err)
+				return
+			}
+
+			go ps.handleForwardConnection(conn)
+		}
+	}()
+
+	return nil
+}
+
+// handleForwardConnection authorizes a client's forward, connects to its target and relays
+// between the two
+func (ps *ProxyServer) handleForwardConnection(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(forwardHeaderTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.Printf("Rejected forward from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if req.Method != http.MethodConnect {
+		writeForwardResponse(conn, http.StatusMethodNotAllowed, "forwards must use CONNECT")
+		return
+	}
+	if !ps.authorized(req) {
+		log.Printf("Rejected forward from %s to %s: missing or invalid bearer token", conn.RemoteAddr(), req.Host)
+		writeForwardResponse(conn, http.StatusUnauthorized, "missing or invalid bearer token")
+		return
+	}
+
+	start := time.Now()
+	targetConn, err := ps.dialForwardTarget(req.Host)
+	if err != nil {
+		log.Printf("Rejected forward from %s to %s: %v", conn.RemoteAddr(), req.Host, err)
+		status := http.StatusBadGateway
+		if _, ok := err.(forwardDeniedError); ok {
+			status = http.StatusForbidden
+		}
+		writeForwardResponse(conn, status, err.Error())
+		return
+	}
+	defer targetConn.Close()
+
+	if err := writeForwardResponse(conn, http.StatusOK, ""); err != nil {
+		return
+	}
+
+	log.Printf("Established forward: %s -> %s (%s)", conn.RemoteAddr(), req.Host, targetConn.RemoteAddr())
+
+	result := ps.bufferPool.Relay(conntrack.NewBufferedConn(conn, reader), targetConn)
+
+	logSuffix := ""
+	if err := result.Err(); err != nil {
+		logSuffix = fmt.Sprintf(" (%s: %v)", conntrack.ClassifyError(err), err)
+	}
+	log.Printf("Forward closed: %s -> %s (in: %s, out: %s, duration: %s)%s", conn.RemoteAddr(), req.Host,
+		utils.FormatBytes(uint64(result.AToB)), utils.FormatBytes(uint64(result.BToA)),
+		utils.FormatDuration(time.Since(start)), logSuffix)
+}
+
+// forwardDeniedError reports a forward target outside the allowed networks
+type forwardDeniedError struct {
+	target string
+}
+
+func (e forwardDeniedError) Error() string {
+	return fmt.Sprintf("target %s is not in an allowed network", e.target)
+}
+
+// dialForwardTarget connects to host:port on the host network. A hostname is resolved first, and
+// only the addresses within the allowed networks are dialed.
+func (ps *ProxyServer) dialForwardTarget(hostPort string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %v", hostPort, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ps.tunnelDialTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	allowed := slices.DeleteFunc(addrs, func(addr netip.Addr) bool { return !ps.forwardAllowed(addr) })
+	if len(allowed) == 0 {
+		return nil, forwardDeniedError{target: hostPort}
+	}
+
+	var dialer net.Dialer
+	for _, addr := range allowed {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// forwardAllowed reports whether forwards may connect to addr
+func (ps *ProxyServer) forwardAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range ps.forwardAllow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeForwardResponse answers a forward request, with message as the reason of a refusal
+func writeForwardResponse(conn net.Conn, status int, message string) error {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if status == http.StatusOK {
+		resp = "HTTP/1.1 200 Connection established\r\n\r\n"
+	} else {
+		resp += fmt.Sprintf("Content-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(message), message)
+	}
+	_, err := conn.Write([]byte(resp))
+	return err
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// startGrace puts a deleted mapping into its grace period: it stays registered, so no other client
+// can map its port or hostname, while its accept loop resets new connections. The mapping is
+// removed when the period ends, unless its client registers it again first. Callers must hold ps.mu.
+func (ps *ProxyServer) startGrace(mapping *ProxyMapping) {
+	mapping.graceEndsAt = time.Now().Add(ps.deleteGracePeriod)
+	mapping.grace.Store(true)
+	time.AfterFunc(ps.deleteGracePeriod, func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		ps.endGrace(mapping)
+	})
+}
+
+// endGrace removes a mapping whose grace period ended, if it's still registered. A mapping that was
+// reclaimed or removed with its client in the meantime is already stopped. Callers must hold ps.mu.
+func (ps *ProxyServer) endGrace(mapping *ProxyMapping) {
+	if mapping.Hostname != "" {
+		if current, exists := ps.hostMapping(mapping.key(), mapping.Hostname); !exists || current != mapping {
+			return
+		}
+		ps.removeHostMapping(mapping)
+	} else {
+		if ps.mappings[mapping.key()] != mapping {
+			return
+		}
+		ps.removeMapping(mapping)
+	}
+	log.Printf("Released port %s after the grace period of its deletion", mapping.portLabel())
+}
+
+// removeMapping stops a mapping that owns its port and forgets it. Callers must hold ps.mu.
+func (ps *ProxyServer) removeMapping(mapping *ProxyMapping) {
+	mapping.stop()
+	delete(ps.mappings, mapping.key())
+
+	// Remove from client tracking
+	if client, exists := ps.clients[mapping.ClientIP]; exists {
+		delete(client.Mappings, mapping.key())
+	}
+	ps.pruneQuota(mapping.ClientIP)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+func TestDeleteGracePeriod(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithDeleteGracePeriod(time.Minute))
+	t.Cleanup(func() { stopMappings(ps) })
+
+	port := freePorts(t, 1)[0]
+	req := testMapping(port)
+	if err := ps.loadMapping(req, false); err != nil {
+		t.Fatal(err)
+	}
+
+	target := fmt.Sprintf("/api/v1/port-mappings?port=%d", port)
+	var deleted api.PortMappingResponse
+	if code := serveAPI(t, ps, http.MethodDelete, target, "", &deleted); code != http.StatusOK || deleted.GracePeriodEndsAt == 0 {
+		t.Fatalf("DELETE = %d %+v, want success with the end of the grace period", code, deleted)
+	}
+
+	// The mapping is listed until it's released, but not exported
+	var list api.PortMappingListResponse
+	serveAPI(t, ps, http.MethodGet, "/api/v1/port-mappings", "", &list)
+	if len(list.Mappings) != 1 || list.Mappings[0].GracePeriodEndsAt != deleted.GracePeriodEndsAt {
+		t.Errorf("listed %+v, want the mapping with its grace period", list.Mappings)
+	}
+	ps.mu.RLock()
+	exported := mappingRequests(ps.tcpMappings(), time.Now())
+	ps.mu.RUnlock()
+	if len(exported) != 0 {
+		t.Errorf("exported %+v, want nothing", exported)
+	}
+
+	// New connections are reset instead of relayed, while being set up or on their first read
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err != io.EOF && !isReset(err) {
+		t.Errorf("connection during the grace period ended with %v, want a reset or close", err)
+	}
+
+	// Deleting again changes nothing, and other clients can't take the port
+	var again api.PortMappingResponse
+	if code := serveAPI(t, ps, http.MethodDelete, target, "", &again); code != http.StatusOK || again.GracePeriodEndsAt != deleted.GracePeriodEndsAt {
+		t.Errorf("second DELETE = %d %+v, want the same grace period", code, again)
+	}
+	other := req
+	other.ClientIP = "10.0.0.3"
+	response, status := ps.createMapping(context.Background(), other, "10.0.0.3:0", false)
+	if status != http.StatusConflict || !strings.Contains(response.Message, "held until") {
+		t.Errorf("registration by another client = %d %+v, want a conflict naming the grace period", status, response)
+	}
+
+	// When the period ends the mapping is released
+	ps.mu.Lock()
+	ps.endGrace(ps.mappings[portKey{port: port}])
+	_, exists := ps.mappings[portKey{port: port}]
+	ps.mu.Unlock()
+	if exists {
+		t.Error("mapping is still registered after its grace period")
+	}
+}
+
+func TestDeleteGracePeriodReclaimed(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithDeleteGracePeriod(time.Minute))
+	t.Cleanup(func() { stopMappings(ps) })
+
+	port := freePorts(t, 1)[0]
+	req := testMapping(port)
+	if err := ps.loadMapping(req, false); err != nil {
+		t.Fatal(err)
+	}
+	serveAPI(t, ps, http.MethodDelete, fmt.Sprintf("/api/v1/port-mappings?port=%d", port), "", nil)
+	ps.mu.RLock()
+	deleted := ps.mappings[portKey{port: port}]
+	ps.mu.RUnlock()
+
+	// The client that deleted the mapping can register the port again right away
+	if err := ps.loadMapping(req, false); err != nil {
+		t.Fatalf("registering the port again during the grace period: %v", err)
+	}
+	ps.mu.RLock()
+	mapping := ps.mappings[portKey{port: port}]
+	ps.mu.RUnlock()
+	if mapping == nil || mapping.grace.Load() {
+		t.Fatal("reclaimed mapping is missing or still in its grace period")
+	}
+
+	// The old mapping's grace period ending leaves the new one alone
+	ps.mu.Lock()
+	ps.endGrace(deleted)
+	ps.mu.Unlock()
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if ps.mappings[portKey{port: port}] != mapping {
+		t.Error("end of the old grace period removed the reclaimed mapping")
+	}
+}
+
+// isReset reports whether err is a connection reset by the peer
+func isReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "reset")
+}
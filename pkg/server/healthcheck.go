@@ -2,19 +2,51 @@ package server
 
 import (
 	"log"
+	"log/slog"
 	"time"
 
+	"github.com/DevonTM/wg-rp/pkg/api"
 	"github.com/DevonTM/wg-rp/pkg/utils"
+	"github.com/DevonTM/wg-rp/pkg/webhook"
+)
+
+const (
+	// DefaultHeartbeatInterval is the heartbeat interval advertised to clients
+	DefaultHeartbeatInterval = 20 * time.Second
+
+	// DefaultClientTimeout is how long a client may go without a heartbeat before it is considered dead
+	DefaultClientTimeout = 60 * time.Second
+
+	// maxHealthCheckInterval caps how often the health checker runs
+	maxHealthCheckInterval = 30 * time.Second
+
+	// missedHeartbeatsAllowed is how many heartbeats at a client's own interval may be missed
+	// before it is considered dead, so clients still on an older, longer interval aren't evicted
+	missedHeartbeatsAllowed = 3
+)
+
+// Dead client policies decide what happens to a dead client's mappings
+const (
+	// DeadClientRemove closes the mappings' listeners and frees their ports
+	DeadClientRemove = "remove"
+
+	// DeadClientSuspend keeps the listeners open but rejects connections until the client heartbeats again
+	DeadClientSuspend = "suspend"
 )
 
 // StartHealthChecker starts a background goroutine that periodically checks client health
 func (ps *ProxyServer) StartHealthChecker() {
 	go func() {
-		ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
+		// Check at least twice per timeout period
+		ticker := time.NewTicker(min(ps.clientTimeout/2, maxHealthCheckInterval))
 		defer ticker.Stop()
 
 		for range ticker.C {
 			ps.checkClientHealth()
+			ps.removeExpiredMappings()
+			ps.removeExpiredReservations()
+			ps.recoverFDReserve()
+			ps.pruneAPILimiters()
 		}
 	}()
 }
@@ -24,22 +56,98 @@ func (ps *ProxyServer) checkClientHealth() {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
-	deadlineTimeout := 60 * time.Second // Consider client dead if no heartbeat for 60 seconds
 	now := time.Now()
 
 	var deadClients []string
 
 	for clientIP, client := range ps.clients {
-		if now.Sub(client.LastHeartbeat) > deadlineTimeout {
+		if client.Suspended {
+			continue
+		}
+		// A client whose circuits opened and that stopped heartbeating is evicted early
+		if now.Sub(client.LastHeartbeat) > ps.clientDeadline(client) || ps.circuitsOpenSinceHeartbeat(clientIP, client, now) {
 			timeSinceHeartbeat := now.Sub(client.LastHeartbeat)
-			log.Printf("Client %s appears to be dead (no heartbeat for %s), removing all mappings",
-				clientIP, utils.FormatDuration(timeSinceHeartbeat))
+			if ps.deadClientPolicy == DeadClientSuspend {
+				log.Printf("Client %s appears to be dead (no heartbeat for %s), suspending all mappings",
+					clientIP, utils.FormatDuration(timeSinceHeartbeat))
+			} else {
+				log.Printf("Client %s appears to be dead (no heartbeat for %s), removing all mappings",
+					clientIP, utils.FormatDuration(timeSinceHeartbeat))
+			}
 			deadClients = append(deadClients, clientIP)
 		}
 	}
 
-	// Remove all mappings for dead clients
+	// Suspend or remove all mappings for dead clients
 	for _, clientIP := range deadClients {
-		ps.removeClientMappings(clientIP)
+		for _, mapping := range ps.clientMappings(clientIP) {
+			ps.notifyWebhook(webhook.EventClientDied, mapping)
+		}
+		if ps.deadClientPolicy == DeadClientSuspend {
+			ps.setClientSuspended(clientIP, true)
+		} else {
+			ps.removeClientMappings(clientIP)
+		}
 	}
 }
+
+// removeExpiredMappings removes mappings whose TTL has run out and tells their clients
+func (ps *ProxyServer) removeExpiredMappings() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := time.Now()
+	for _, mapping := range ps.tcpMappings() {
+		if mapping.expiresAt.IsZero() || !now.After(mapping.expiresAt) {
+			continue
+		}
+
+		ps.removeMapping(mapping)
+
+		slog.Info("mapping expired", "port", mapping.RemotePort, "visibility", mapping.visibility(), "name", mapping.Name, "client_ip", mapping.ClientIP)
+		ps.audit(AuditExpire, mapping)
+		ps.notifyWebhook(webhook.EventExpired, mapping)
+		ps.events.publishMapping(api.EventMappingRemoved, mapping)
+	}
+	for _, mapping := range ps.hostMappings("") {
+		if mapping.expiresAt.IsZero() || !now.After(mapping.expiresAt) {
+			continue
+		}
+
+		ps.removeHostMapping(mapping)
+
+		slog.Info("mapping expired", "port", mapping.RemotePort, "hostname", mapping.Hostname, "name", mapping.Name, "client_ip", mapping.ClientIP)
+		ps.audit(AuditExpire, mapping)
+		ps.notifyWebhook(webhook.EventExpired, mapping)
+		ps.events.publishMapping(api.EventMappingRemoved, mapping)
+	}
+	ps.saveStore()
+}
+
+// setClientSuspended suspends or resumes all mappings of a client. Callers must hold ps.mu.
+func (ps *ProxyServer) setClientSuspended(clientIP string, suspended bool) {
+	client, exists := ps.clients[clientIP]
+	if !exists {
+		return
+	}
+
+	client.Suspended = suspended
+	mappings := ps.clientMappings(clientIP)
+	for _, mapping := range mappings {
+		if !mapping.Preloaded {
+			mapping.suspended.Store(suspended)
+		}
+	}
+
+	if suspended {
+		log.Printf("Suspended %d mappings of client %s until it heartbeats again", len(mappings), clientIP)
+	} else {
+		log.Printf("Client %s is back, resumed %d mappings", clientIP, len(mappings))
+	}
+}
+
+// clientDeadline returns how long a client may go without a heartbeat. A client that hasn't
+// adopted the advertised interval yet gets enough time for its own interval as well.
+func (ps *ProxyServer) clientDeadline(client *ClientInfo) time.Duration {
+	return max(ps.clientTimeout, missedHeartbeatsAllowed*client.HeartbeatInterval)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+const (
+	// defaultHistorySize is how many closed connections are remembered per mapping
+	defaultHistorySize = 256
+
+	// defaultHistoryRetention is how long a closed connection stays queryable
+	defaultHistoryRetention = 24 * time.Hour
+
+	// historyPeerEstimate approximates the heap used by a record's peer address string
+	historyPeerEstimate = 48
+)
+
+// Close reasons recorded in the connection history
+const (
+	closeReasonClosed       = "closed"
+	closeReasonDialFailed   = "tunnel dial failed"
+	closeReasonMTUBlackhole = "possible MTU blackhole"
+)
+
+// connHistory is a fixed-size ring of the most recently closed connections on one port.
+// Each port has its own ring and lock so recording never contends across mappings.
+type connHistory struct {
+	mu      sync.Mutex
+	records []api.ConnectionRecord
+	next    int
+	full    bool
+}
+
+// newConnHistory creates a ring holding up to size records
+func newConnHistory(size int) *connHistory {
+	return &connHistory{records: make([]api.ConnectionRecord, size)}
+}
+
+// add records a closed connection, overwriting the oldest once the ring is full
+func (h *connHistory) add(rec api.ConnectionRecord) {
+	h.mu.Lock()
+	h.records[h.next] = rec
+	h.next++
+	if h.next == len(h.records) {
+		h.next = 0
+		h.full = true
+	}
+	h.mu.Unlock()
+}
+
+// since returns the records that ended at or after t, oldest first
+func (h *connHistory) since(t time.Time) []api.ConnectionRecord {
+	cutoff := t.UnixMilli()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	start, count := 0, h.next
+	if h.full {
+		start, count = h.next, len(h.records)
+	}
+
+	var records []api.ConnectionRecord
+	for i := range count {
+		rec := h.records[(start+i)%len(h.records)]
+		if rec.EndTime >= cutoff {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// historyFor returns the connection history for a port, creating it on first use.
+// History is kept per port so it outlives the mapping that produced it. Callers must hold ps.mu.
+func (ps *ProxyServer) historyFor(port int) *connHistory {
+	h, exists := ps.history[port]
+	if !exists {
+		h = newConnHistory(ps.historySize)
+		ps.history[port] = h
+	}
+	return h
+}
+
+// connectionHistory returns closed connections within the retention window that ended at or after
+// since, for a single port or for all ports when port is 0
+func (ps *ProxyServer) connectionHistory(port int, since time.Time) []api.ConnectionRecord {
+	if oldest := time.Now().Add(-ps.historyRetention); since.Before(oldest) {
+		since = oldest
+	}
+
+	ps.mu.RLock()
+	var rings []*connHistory
+	for p, h := range ps.history {
+		if port == 0 || p == port {
+			rings = append(rings, h)
+		}
+	}
+	ps.mu.RUnlock()
+
+	records := []api.ConnectionRecord{}
+	for _, h := range rings {
+		records = append(records, h.since(since)...)
+	}
+	return records
+}
+
+// HistoryMemoryEstimate approximates the memory a single port's full history ring uses
+func (ps *ProxyServer) HistoryMemoryEstimate() uint64 {
+	return uint64(ps.historySize) * (uint64(unsafe.Sizeof(api.ConnectionRecord{})) + historyPeerEstimate)
+}
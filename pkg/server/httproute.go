@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// httpRouteTimeout bounds how long a connection to a shared HTTP port may take to send the
+// header that names its host
+const httpRouteTimeout = 10 * time.Second
+
+// maxRoutedHeaderBytes bounds how much of a connection is buffered while looking for its host
+const maxRoutedHeaderBytes = 64 << 10
+
+// h2cPreface starts HTTP/2 connections without TLS that skip the HTTP/1.1 upgrade
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// httpRouter is the listener of a port shared by HTTP or SNI mappings. It reads the host each
+// connection asks for, from its first HTTP request or its TLS ClientHello, and hands the
+// connection to the mapping of that host.
+type httpRouter struct {
+	port       int
+	listener   net.Listener
+	mode       string // api.ModeHTTP or api.ModeSNI, shared by all mappings on the port
+	tunnelOnly bool
+	hosts      map[string]*ProxyMapping // hostname -> mapping, guarded by ps.mu
+}
+
+// hostListener is the listener of an HTTP or SNI mapping. Its connections are handed over by the
+// router of the shared port, so mappings are served the same way whatever their mode.
+type hostListener struct {
+	addr  net.Addr
+	mode  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newHostListener(router *httpRouter) *hostListener {
+	return &hostListener{addr: router.listener.Addr(), mode: router.mode, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Accept waits for the router to hand over a connection
+func (l *hostListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener; the shared port stays open for other hosts
+func (l *hostListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the address of the shared port
+func (l *hostListener) Addr() net.Addr {
+	return l.addr
+}
+
+// deliver hands conn to the mapping, closing it if the mapping is stopped meanwhile
+func (l *hostListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// normalizeHostname lower-cases a hostname and strips its port and trailing dot
+func normalizeHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// lookup returns the mapping serving host: the mapping of the host itself, else that of the
+// most specific wildcard covering it. Callers must hold ps.mu.
+func (r *httpRouter) lookup(host string) *ProxyMapping {
+	if mapping, exists := r.hosts[host]; exists {
+		return mapping
+	}
+	for {
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			return nil
+		}
+		if mapping, exists := r.hosts["*."+parent]; exists {
+			return mapping
+		}
+		host = parent
+	}
+}
+
+// httpRouterFor returns the router of a shared port, starting one that routes by mode if the port
+// has none yet. Callers must hold ps.mu.
+func (ps *ProxyServer) httpRouterFor(key portKey, mode string) (*httpRouter, error) {
+	if router, exists := ps.httpRouters[key]; exists {
+		return router, nil
+	}
+
+	var listener net.Listener
+	var err error
+	if key.tunnelOnly {
+		listener, err = ps.tnet.ListenTCP(&net.TCPAddr{Port: key.port})
+	} else {
+		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", key.port))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	router := &httpRouter{
+		port:       key.port,
+		listener:   listener,
+		mode:       mode,
+		tunnelOnly: key.tunnelOnly,
+		hosts:      make(map[string]*ProxyMapping),
+	}
+	ps.httpRouters[key] = router
+	go ps.serveHTTPRouter(router)
+
+	log.Printf("Routing %s by hostname on port %d", strings.ToUpper(mode), key.port)
+	return router, nil
+}
+
+// serveHTTPRouter accepts connections on a shared port until its last mapping is removed
+func (ps *ProxyServer) serveHTTPRouter(router *httpRouter) {
+	var backoff time.Duration
+	for {
+		conn, err := router.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if isFDExhausted(err) {
+				ps.handleFDExhaustion(err)
+				backoff = acceptBackoff(backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			log.Printf("Failed to accept connection on shared port %d: %v", router.port, err)
+			continue
+		}
+		backoff = 0
+
+		if router.mode == api.ModeSNI {
+			go ps.routeTLSConnection(router, conn)
+		} else {
+			go ps.routeHTTPConnection(router, conn)
+		}
+	}
+}
+
+// routeHTTPConnection reads the host a connection asks for and hands it to that host's mapping.
+// Connections for unknown hosts are answered with 404.
+func (ps *ProxyServer) routeHTTPConnection(router *httpRouter, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(httpRouteTimeout))
+	reader := bufio.NewReaderSize(conn, maxRoutedHeaderBytes)
+	host, err := readRequestHost(reader)
+	if err != nil {
+		log.Printf("Rejected connection from %s on shared HTTP port %d: %v", conn.RemoteAddr(), router.port, err)
+		writeRouteError(conn, http.StatusBadRequest, "Bad request")
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ps.mu.RLock()
+	mapping := router.lookup(normalizeHostname(host))
+	ps.mu.RUnlock()
+
+	if mapping == nil {
+		writeRouteError(conn, http.StatusNotFound, fmt.Sprintf("No mapping for host %s", host))
+		conn.Close()
+		return
+	}
+	mapping.Listener.(*hostListener).deliver(conntrack.NewBufferedConn(conn, reader))
+}
+
+// readRequestHost returns the host of the first request on a connection without consuming it:
+// the Host header of an HTTP/1.x request, or the :authority of the first request of an HTTP/2
+// connection started with the h2c preface
+func readRequestHost(reader *bufio.Reader) (string, error) {
+	start, err := reader.Peek(3)
+	if err != nil {
+		return "", err
+	}
+	if string(start) == h2cPreface[:3] {
+		if preface, err := reader.Peek(len(h2cPreface)); err == nil && string(preface) == h2cPreface {
+			return readH2Authority(reader)
+		}
+	}
+
+	header, err := peekUntil(reader, []byte("\r\n\r\n"))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return "", err
+	}
+	if req.Host == "" {
+		return "", fmt.Errorf("request has no Host header")
+	}
+	return req.Host, nil
+}
+
+// peekUntil peeks at the buffered data until it contains sep, reading more as needed, and
+// returns the data up to and including sep
+func peekUntil(reader *bufio.Reader, sep []byte) ([]byte, error) {
+	for {
+		buf, _ := reader.Peek(reader.Buffered())
+		if i := bytes.Index(buf, sep); i >= 0 {
+			return buf[:i+len(sep)], nil
+		}
+		if reader.Buffered() == reader.Size() {
+			return nil, fmt.Errorf("request header is larger than %d bytes", reader.Size())
+		}
+		if _, err := reader.Peek(reader.Buffered() + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// HTTP/2 frame types and flags needed to find the first request's headers
+const (
+	h2FrameHeaders      = 0x1
+	h2FrameContinuation = 0x9
+	h2FlagEndHeaders    = 0x4
+	h2FlagPadded        = 0x8
+	h2FlagPriority      = 0x20
+	h2FrameHeaderLen    = 9
+)
+
+// readH2Authority peeks at the frames following the h2c preface up to the first request's
+// header block and returns its :authority, or its Host header if it has none
+func readH2Authority(reader *bufio.Reader) (string, error) {
+	offset := len(h2cPreface)
+	var block []byte
+	for {
+		frame, err := peekN(reader, offset+h2FrameHeaderLen)
+		if err != nil {
+			return "", err
+		}
+		header := frame[offset:]
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		frameType, flags := header[3], header[4]
+
+		payloadStart := offset + h2FrameHeaderLen
+		frame, err = peekN(reader, payloadStart+length)
+		if err != nil {
+			return "", err
+		}
+		payload := frame[payloadStart:]
+		offset = payloadStart + length
+
+		switch {
+		case frameType == h2FrameHeaders && block == nil:
+			if flags&h2FlagPadded != 0 {
+				if len(payload) < 1 || int(payload[0]) >= len(payload) {
+					return "", fmt.Errorf("malformed HTTP/2 HEADERS frame")
+				}
+				payload = payload[1 : len(payload)-int(payload[0])]
+			}
+			if flags&h2FlagPriority != 0 {
+				if len(payload) < 5 {
+					return "", fmt.Errorf("malformed HTTP/2 HEADERS frame")
+				}
+				payload = payload[5:]
+			}
+			block = append([]byte{}, payload...)
+		case frameType == h2FrameContinuation && block != nil:
+			block = append(block, payload...)
+		case block != nil:
+			return "", fmt.Errorf("HTTP/2 header block is not continued")
+		default:
+			continue // SETTINGS, WINDOW_UPDATE and the like before the first request
+		}
+
+		if flags&h2FlagEndHeaders != 0 {
+			return h2Authority(block)
+		}
+	}
+}
+
+// peekN peeks at the first n bytes, failing if they don't fit in the reader's buffer
+func peekN(reader *bufio.Reader, n int) ([]byte, error) {
+	if n > reader.Size() {
+		return nil, fmt.Errorf("request header is larger than %d bytes", reader.Size())
+	}
+	return reader.Peek(n)
+}
+
+// h2Authority decodes an HPACK header block and returns its :authority or Host
+func h2Authority(block []byte) (string, error) {
+	fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+	if err != nil {
+		return "", fmt.Errorf("malformed HTTP/2 header block: %v", err)
+	}
+	var host string
+	for _, f := range fields {
+		switch f.Name {
+		case ":authority":
+			return f.Value, nil
+		case "host":
+			host = f.Value
+		}
+	}
+	if host == "" {
+		return "", fmt.Errorf("request has no :authority")
+	}
+	return host, nil
+}
+
+// writeRouteError answers a connection that can't be routed. HTTP/2 clients see the HTTP/1.1
+// response as a protocol error, which is as much as can be done without an HTTP/2 server.
+func writeRouteError(conn net.Conn, status int, message string) {
+	conn.SetWriteDeadline(time.Now().Add(httpRouteTimeout))
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(message)+1, message+"\n")
+}
+
+// addHostMapping routes hostname on a shared port to mapping. Callers must hold ps.mu.
+func (ps *ProxyServer) addHostMapping(router *httpRouter, mapping *ProxyMapping) {
+	router.hosts[mapping.Hostname] = mapping
+	if mapping.tlsCert == api.TLSCertACME {
+		ps.certIssuer.Allow(mapping.Hostname)
+	}
+}
+
+// removeHostMapping stops an HTTP or SNI mapping and closes its shared port once no hosts are left on
+// it. Callers must hold ps.mu.
+func (ps *ProxyServer) removeHostMapping(mapping *ProxyMapping) {
+	mapping.stop()
+	router, exists := ps.httpRouters[mapping.key()]
+	if !exists || router.hosts[mapping.Hostname] != mapping {
+		return
+	}
+	delete(router.hosts, mapping.Hostname)
+	if mapping.tlsCert == api.TLSCertACME {
+		ps.certIssuer.Forget(mapping.Hostname)
+	}
+	if len(router.hosts) == 0 {
+		router.listener.Close()
+		delete(ps.httpRouters, mapping.key())
+		log.Printf("Stopped routing %s on port %d, its last hostname was removed", strings.ToUpper(router.mode), mapping.RemotePort)
+	}
+	ps.pruneQuota(mapping.ClientIP)
+}
+
+// checkHostConflict reports why an HTTP or SNI mapping can't be routed on the requested port in its
+// namespace, or "" if it can. A hostname mapped by the same client is reclaimed by the caller. Callers
+// must hold ps.mu.
+func (ps *ProxyServer) checkHostConflict(req api.PortMappingRequest, key portKey) string {
+	if _, exists := ps.mappings[key]; exists {
+		return fmt.Sprintf("Port %d is already mapped over TCP", req.RemotePort)
+	}
+	router, exists := ps.httpRouters[key]
+	if !exists {
+		return ""
+	}
+	if router.mode != req.Mode {
+		return fmt.Sprintf("Port %d routes %s connections by hostname", req.RemotePort, strings.ToUpper(router.mode))
+	}
+	if mapping, exists := router.hosts[req.Hostname]; exists && mapping.ClientIP != req.ClientIP {
+		return fmt.Sprintf("Hostname %s on port %d is already mapped by client %s", req.Hostname, req.RemotePort, mapping.ClientIP)
+	}
+	return ""
+}
+
+// hostMapping returns the HTTP or SNI mapping of hostname on a port. Callers must hold ps.mu.
+func (ps *ProxyServer) hostMapping(key portKey, hostname string) (*ProxyMapping, bool) {
+	router, exists := ps.httpRouters[key]
+	if !exists {
+		return nil, false
+	}
+	mapping, exists := router.hosts[hostname]
+	return mapping, exists
+}
+
+// hostMappings returns the HTTP and SNI mappings of all shared ports, those of clientIP only if it isn't
+// empty. Callers must hold ps.mu.
+func (ps *ProxyServer) hostMappings(clientIP string) []*ProxyMapping {
+	var mappings []*ProxyMapping
+	for _, router := range ps.httpRouters {
+		for _, mapping := range router.hosts {
+			if clientIP == "" || mapping.ClientIP == clientIP {
+				mappings = append(mappings, mapping)
+			}
+		}
+	}
+	return mappings
+}
+
+// tcpMappings returns the mappings that own their port. Callers must hold ps.mu.
+func (ps *ProxyServer) tcpMappings() []*ProxyMapping {
+	mappings := make([]*ProxyMapping, 0, len(ps.mappings))
+	for _, mapping := range ps.mappings {
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// allMappings returns the mappings that own their port and those routed by hostname. Callers must
+// hold ps.mu.
+func (ps *ProxyServer) allMappings() []*ProxyMapping {
+	return append(ps.tcpMappings(), ps.hostMappings("")...)
+}
+
+// clientMappings returns all mappings of a client, those that own their port and those routed
+// by hostname. Callers must hold ps.mu.
+func (ps *ProxyServer) clientMappings(clientIP string) []*ProxyMapping {
+	mappings := ps.hostMappings(clientIP)
+	if client, exists := ps.clients[clientIP]; exists {
+		for key := range client.Mappings {
+			if mapping, exists := ps.mappings[key]; exists {
+				mappings = append(mappings, mapping)
+			}
+		}
+	}
+	return mappings
+}
+
+// mode returns how connections reach the mapping: api.ModeTCP, or the mode of its shared port
+func (m *ProxyMapping) mode() string {
+	if listener, ok := m.Listener.(*hostListener); ok {
+		return listener.mode
+	}
+	return api.ModeTCP
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Identity is who a client is, as far as tenancy, quotas and auditing are concerned
+type Identity struct {
+	TenantID    string `json:"tenant_id"`
+	Namespace   string `json:"namespace,omitempty"`
+	MaxMappings int    `json:"max_mappings,omitempty"` // Mappings the tenant may hold at once (0 = unlimited)
+}
+
+// IdentityResolver maps a client to its identity. sourceAddr is the tunnel address the request
+// came from, publicKey the WireGuard peer owning that address (empty if unknown) and claimedIP
+// the client IP stated in the request.
+type IdentityResolver interface {
+	ResolveClient(ctx context.Context, sourceAddr netip.Addr, publicKey string, claimedIP string) (*Identity, error)
+}
+
+// defaultResolver gives every client its own unlimited tenant named after its client IP, which
+// is how clients were told apart before identities existed
+type defaultResolver struct{}
+
+func (defaultResolver) ResolveClient(_ context.Context, _ netip.Addr, _ string, claimedIP string) (*Identity, error) {
+	return &Identity{TenantID: claimedIP}, nil
+}
+
+// identityRequest is sent to an external identity resolver
+type identityRequest struct {
+	SourceAddr string `json:"source_addr"`
+	PublicKey  string `json:"public_key,omitempty"`
+	ClaimedIP  string `json:"claimed_ip"`
+}
+
+// maxCachedIdentities bounds the identities an HTTPResolver keeps, so clients that come and go
+// with changing addresses or keys can't grow the cache without limit
+const maxCachedIdentities = 4096
+
+// cachedIdentity is a resolved identity and when it stops being reused
+type cachedIdentity struct {
+	identity  *Identity
+	expiresAt time.Time
+}
+
+// HTTPResolver resolves identities by POSTing the client details as JSON to an external endpoint,
+// which answers with an Identity. Answers are cached, and when the endpoint fails the client
+// either gets the default identity (fail open) or is rejected (fail closed).
+type HTTPResolver struct {
+	url        string
+	httpClient *http.Client
+	cacheTTL   time.Duration
+	failClosed bool
+
+	mu        sync.Mutex
+	cache     map[identityRequest]cachedIdentity
+	lastSweep time.Time // when expired entries were last dropped from the cache
+}
+
+// NewHTTPResolver creates a resolver for the endpoint at url
+func NewHTTPResolver(url string, cacheTTL time.Duration, failClosed bool) *HTTPResolver {
+	return &HTTPResolver{
+		url:        url,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		cacheTTL:   cacheTTL,
+		failClosed: failClosed,
+		cache:      make(map[identityRequest]cachedIdentity),
+	}
+}
+
+// ResolveClient implements IdentityResolver
+func (r *HTTPResolver) ResolveClient(ctx context.Context, sourceAddr netip.Addr, publicKey string, claimedIP string) (*Identity, error) {
+	req := identityRequest{SourceAddr: sourceAddr.String(), PublicKey: publicKey, ClaimedIP: claimedIP}
+
+	r.mu.Lock()
+	cached, exists := r.cache[req]
+	if exists && !time.Now().Before(cached.expiresAt) {
+		delete(r.cache, req)
+		exists = false
+	}
+	r.mu.Unlock()
+	if exists {
+		return cached.identity, nil
+	}
+
+	identity, err := r.query(ctx, req)
+	if err != nil {
+		if r.failClosed {
+			return nil, err
+		}
+		// Fail open without caching so the next request asks again
+		return defaultResolver{}.ResolveClient(ctx, sourceAddr, publicKey, claimedIP)
+	}
+
+	r.mu.Lock()
+	r.store(req, identity)
+	r.mu.Unlock()
+
+	return identity, nil
+}
+
+// store caches an identity. Expired entries are swept out once per TTL, and a full cache makes
+// room by dropping the entry closest to expiring. Callers must hold r.mu.
+func (r *HTTPResolver) store(req identityRequest, identity *Identity) {
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= r.cacheTTL || len(r.cache) >= maxCachedIdentities {
+		for key, cached := range r.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(r.cache, key)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	if _, exists := r.cache[req]; !exists && len(r.cache) >= maxCachedIdentities {
+		var oldest identityRequest
+		var oldestExpiry time.Time
+		for key, cached := range r.cache {
+			if oldestExpiry.IsZero() || cached.expiresAt.Before(oldestExpiry) {
+				oldest, oldestExpiry = key, cached.expiresAt
+			}
+		}
+		delete(r.cache, oldest)
+	}
+
+	r.cache[req] = cachedIdentity{identity: identity, expiresAt: now.Add(r.cacheTTL)}
+}
+
+// query asks the external endpoint for an identity
+func (r *HTTPResolver) query(ctx context.Context, req identityRequest) (*Identity, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("identity resolver unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("identity resolver returned %s", resp.Status)
+	}
+
+	var identity Identity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return nil, fmt.Errorf("invalid identity resolver response: %v", err)
+	}
+	if identity.TenantID == "" {
+		return nil, fmt.Errorf("identity resolver returned no tenant for %s", req.ClaimedIP)
+	}
+
+	return &identity, nil
+}
+
+// resolveIdentity resolves the identity of the client making an API request
+func (ps *ProxyServer) resolveIdentity(r *http.Request, claimedIP string) (*Identity, error) {
+	return ps.resolveIdentityFrom(r.Context(), r.RemoteAddr, claimedIP)
+}
+
+// resolveIdentityFrom resolves the identity of a client whose request came from remoteAddr
+func (ps *ProxyServer) resolveIdentityFrom(ctx context.Context, remoteAddr string, claimedIP string) (*Identity, error) {
+	var sourceAddr netip.Addr
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		sourceAddr = addrPort.Addr().Unmap()
+	}
+
+	var publicKey string
+	if ps.peerLookup != nil && sourceAddr.IsValid() {
+		publicKey = ps.peerLookup(sourceAddr)
+	}
+
+	return ps.identities.ResolveClient(ctx, sourceAddr, publicKey, claimedIP)
+}
+
+// tenantMappings counts the mappings held by a tenant. Callers must hold ps.mu.
+func (ps *ProxyServer) tenantMappings(tenantID string) int {
+	count := 0
+	for _, mapping := range append(ps.hostMappings(""), ps.tcpMappings()...) {
+		if mapping.identity != nil && mapping.identity.TenantID == tenantID && !mapping.grace.Load() {
+			count++
+		}
+	}
+	return count
+}
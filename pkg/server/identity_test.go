@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeIdentityEndpoint answers identity requests with answer and counts them
+type fakeIdentityEndpoint struct {
+	answer   func(w http.ResponseWriter, req identityRequest)
+	requests atomic.Int64
+}
+
+func (f *fakeIdentityEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	var req identityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.answer(w, req)
+}
+
+// tenantPerClaimedIP answers every client with a tenant named after its claimed IP
+func tenantPerClaimedIP(w http.ResponseWriter, req identityRequest) {
+	json.NewEncoder(w).Encode(Identity{TenantID: "tenant-" + req.ClaimedIP, MaxMappings: 3})
+}
+
+// newFakeResolver returns a resolver asking an endpoint that answers with answer
+func newFakeResolver(t *testing.T, answer func(w http.ResponseWriter, req identityRequest), failClosed bool) (*HTTPResolver, *fakeIdentityEndpoint) {
+	t.Helper()
+	endpoint := &fakeIdentityEndpoint{answer: answer}
+	srv := httptest.NewServer(endpoint)
+	t.Cleanup(srv.Close)
+	return NewHTTPResolver(srv.URL, time.Minute, failClosed), endpoint
+}
+
+var testSource = netip.MustParseAddr("10.0.0.2")
+
+// cacheKey returns the cache key of a client claiming claimedIP from testSource
+func cacheKey(claimedIP string) identityRequest {
+	return identityRequest{SourceAddr: testSource.String(), ClaimedIP: claimedIP}
+}
+
+func TestHTTPResolverResolvesAndCaches(t *testing.T) {
+	var got identityRequest
+	r, endpoint := newFakeResolver(t, func(w http.ResponseWriter, req identityRequest) {
+		got = req
+		tenantPerClaimedIP(w, req)
+	}, false)
+
+	identity, err := r.ResolveClient(context.Background(), testSource, "abcd", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.TenantID != "tenant-10.0.0.2" || identity.MaxMappings != 3 {
+		t.Errorf("identity = %+v, want the endpoint's answer", identity)
+	}
+	if want := (identityRequest{SourceAddr: "10.0.0.2", PublicKey: "abcd", ClaimedIP: "10.0.0.2"}); got != want {
+		t.Errorf("endpoint got %+v, want %+v", got, want)
+	}
+
+	// The same client is answered from the cache, a different one asks again
+	r.ResolveClient(context.Background(), testSource, "abcd", "10.0.0.2")
+	if n := endpoint.requests.Load(); n != 1 {
+		t.Errorf("endpoint was asked %d times for a cached client, want 1", n)
+	}
+	r.ResolveClient(context.Background(), testSource, "abcd", "10.0.0.3")
+	if n := endpoint.requests.Load(); n != 2 {
+		t.Errorf("endpoint was asked %d times for a new client, want 2", n)
+	}
+}
+
+func TestHTTPResolverFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer func(w http.ResponseWriter, req identityRequest)
+	}{
+		{"error status", func(w http.ResponseWriter, _ identityRequest) {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		}},
+		{"forbidden", func(w http.ResponseWriter, _ identityRequest) {
+			http.Error(w, "unknown peer", http.StatusForbidden)
+		}},
+		{"invalid JSON", func(w http.ResponseWriter, _ identityRequest) {
+			w.Write([]byte("<html>oops</html>"))
+		}},
+		{"no tenant", func(w http.ResponseWriter, _ identityRequest) {
+			json.NewEncoder(w).Encode(Identity{Namespace: "prod"})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/fail closed", func(t *testing.T) {
+			r, _ := newFakeResolver(t, tt.answer, true)
+			if identity, err := r.ResolveClient(context.Background(), testSource, "", "10.0.0.2"); err == nil {
+				t.Errorf("ResolveClient() = %+v, want an error", identity)
+			}
+		})
+
+		t.Run(tt.name+"/fail open", func(t *testing.T) {
+			r, endpoint := newFakeResolver(t, tt.answer, false)
+			for range 2 {
+				identity, err := r.ResolveClient(context.Background(), testSource, "", "10.0.0.2")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if identity.TenantID != "10.0.0.2" || identity.MaxMappings != 0 {
+					t.Errorf("identity = %+v, want the default identity", identity)
+				}
+			}
+
+			// Failures aren't cached, so the endpoint is asked again once it recovers
+			if n := endpoint.requests.Load(); n != 2 {
+				t.Errorf("endpoint was asked %d times, want 2", n)
+			}
+		})
+	}
+}
+
+func TestHTTPResolverUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	r := NewHTTPResolver(url, time.Minute, true)
+	if _, err := r.ResolveClient(context.Background(), testSource, "", "10.0.0.2"); err == nil {
+		t.Error("fail-closed resolver accepted a client while its endpoint is unreachable")
+	}
+
+	r = NewHTTPResolver(url, time.Minute, false)
+	identity, err := r.ResolveClient(context.Background(), testSource, "", "10.0.0.2")
+	if err != nil || identity.TenantID != "10.0.0.2" {
+		t.Errorf("fail-open resolver = %+v, %v, want the default identity", identity, err)
+	}
+}
+
+func TestHTTPResolverTimeout(t *testing.T) {
+	release := make(chan struct{})
+	r, _ := newFakeResolver(t, func(w http.ResponseWriter, req identityRequest) {
+		<-release
+		tenantPerClaimedIP(w, req)
+	}, true)
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.ResolveClient(ctx, testSource, "", "10.0.0.2"); err == nil {
+		t.Error("ResolveClient() succeeded although the endpoint never answered")
+	}
+}
+
+func TestHTTPResolverCacheExpiry(t *testing.T) {
+	r, endpoint := newFakeResolver(t, tenantPerClaimedIP, false)
+	r.ResolveClient(context.Background(), testSource, "", "10.0.0.2")
+	r.ResolveClient(context.Background(), testSource, "", "10.0.0.3")
+
+	// Expire the first entry: it is dropped when looked up and resolved again
+	key := cacheKey("10.0.0.2")
+	r.mu.Lock()
+	r.cache[key] = cachedIdentity{identity: r.cache[key].identity, expiresAt: time.Now().Add(-time.Second)}
+	r.mu.Unlock()
+
+	r.ResolveClient(context.Background(), testSource, "", "10.0.0.2")
+	if n := endpoint.requests.Load(); n != 3 {
+		t.Errorf("endpoint was asked %d times, want 3 with the expired entry resolved again", n)
+	}
+
+	// Entries of clients that never come back are swept out when others are cached
+	stale := cacheKey("10.0.0.3")
+	r.mu.Lock()
+	r.cache[stale] = cachedIdentity{identity: r.cache[stale].identity, expiresAt: time.Now().Add(-time.Second)}
+	r.lastSweep = time.Now().Add(-time.Hour)
+	r.mu.Unlock()
+
+	r.ResolveClient(context.Background(), testSource, "", "10.0.0.4")
+	r.mu.Lock()
+	_, kept := r.cache[stale]
+	size := len(r.cache)
+	r.mu.Unlock()
+	if kept || size != 2 {
+		t.Errorf("cache holds %d entries and the expired one: %v, want 2 without it", size, kept)
+	}
+}
+
+func TestHTTPResolverCacheIsBounded(t *testing.T) {
+	r, _ := newFakeResolver(t, tenantPerClaimedIP, false)
+
+	// Fill the cache with live entries, the first closest to expiring
+	r.mu.Lock()
+	now := time.Now()
+	for i := range maxCachedIdentities {
+		key := cacheKey(netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)}).String())
+		r.cache[key] = cachedIdentity{identity: &Identity{TenantID: key.ClaimedIP}, expiresAt: now.Add(time.Minute + time.Duration(i)*time.Millisecond)}
+	}
+	r.lastSweep = now
+	r.mu.Unlock()
+
+	r.ResolveClient(context.Background(), testSource, "", "10.0.0.2")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) != maxCachedIdentities {
+		t.Errorf("cache holds %d entries, want at most %d", len(r.cache), maxCachedIdentities)
+	}
+	if _, exists := r.cache[cacheKey("10.1.0.0")]; exists {
+		t.Error("entry closest to expiring was kept in a full cache")
+	}
+	if _, exists := r.cache[cacheKey("10.0.0.2")]; !exists {
+		t.Error("new entry was not cached")
+	}
+}
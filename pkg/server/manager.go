@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// shutdownNotifyDelay gives event streams a moment to deliver the shutdown notification
+const shutdownNotifyDelay = 500 * time.Millisecond
+
+// Network is an independent WireGuard network served by its own proxy server. Its clients,
+// mappings and reservations are not visible to other networks.
+type Network struct {
+	Name   string // identifies the network in logs, e.g. its configuration file
+	Device *wireguard.WireGuardDevice
+	Server *ProxyServer
+}
+
+// ServerManager owns the proxy servers of all WireGuard networks of a server process and starts
+// and shuts them down together
+type ServerManager struct {
+	networks []*Network
+}
+
+// NewServerManager creates a manager without networks
+func NewServerManager() *ServerManager {
+	return &ServerManager{}
+}
+
+// Add adds a network. It must be called before Start.
+func (m *ServerManager) Add(name string, device *wireguard.WireGuardDevice, server *ProxyServer) {
+	m.networks = append(m.networks, &Network{Name: name, Device: device, Server: server})
+}
+
+// Networks returns the networks in the order they were added
+func (m *ServerManager) Networks() []*Network {
+	return m.networks
+}
+
+// Start starts the API server, the mux and forward listeners if enabled and the health checker of
+// every network
+func (m *ServerManager) Start() error {
+	for _, n := range m.networks {
+		if err := n.Server.StartAPIServer(); err != nil {
+			return fmt.Errorf("network %s: failed to start API server: %v", n.Name, err)
+		}
+		if n.Server.muxPort > 0 {
+			if err := n.Server.StartMuxListener(); err != nil {
+				return fmt.Errorf("network %s: failed to start mux listener: %v", n.Name, err)
+			}
+		}
+		if n.Server.forwardPort > 0 {
+			if err := n.Server.StartForwardListener(); err != nil {
+				return fmt.Errorf("network %s: failed to start forward listener: %v", n.Name, err)
+			}
+		}
+		n.Server.StartHealthChecker()
+	}
+	return nil
+}
+
+// MetricsHandler serves the metrics of the first network at /metrics and those of the n-th
+// network, counting from 1, at /metrics/n
+func (m *ServerManager) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	for i, n := range m.networks {
+		if i == 0 {
+			mux.Handle("GET /metrics", n.Server.MetricsHandler())
+		}
+		mux.Handle(fmt.Sprintf("GET /metrics/%d", i+1), n.Server.MetricsHandler())
+	}
+	return mux
+}
+
+// Shutdown tells the clients of every network that the server is shutting down, gives the
+// notifications a moment to be delivered and closes the WireGuard devices
+func (m *ServerManager) Shutdown() {
+	for _, n := range m.networks {
+		n.Server.NotifyShutdown()
+	}
+
+	time.Sleep(shutdownNotifyDelay)
+
+	for _, n := range m.networks {
+		n.Device.Close()
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// connectionDurationBuckets span short HTTP requests to hour-long database sessions, in seconds
+var connectionDurationBuckets = []float64{0.01, 0.1, 1, 10, 60, 300, 3600}
+
+// serverMetrics holds the Prometheus collectors of a server
+type serverMetrics struct {
+	registry           *prometheus.Registry
+	connectionDuration *prometheus.HistogramVec
+	relayErrors        *prometheus.CounterVec
+}
+
+// newServerMetrics creates the collectors and registers them with a registry of their own
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		connectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "wgrp",
+			Name:      "connection_duration_seconds",
+			Help:      "Duration of relayed proxy connections by mapped port.",
+			Buckets:   connectionDurationBuckets,
+		}, []string{"remote_port"}),
+		relayErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wgrp",
+			Name:      "relay_errors_total",
+			Help:      "Proxy connections that ended with an error, by mapped port and error class.",
+		}, []string{"remote_port", "class"}),
+	}
+	m.registry.MustRegister(m.connectionDuration, m.relayErrors)
+	return m
+}
+
+// registerBufferGauges exports the relay buffers stats reports as gauges
+func (m *serverMetrics) registerBufferGauges(stats func() bufferpool.Stats) {
+	gauge := func(name, help string, value func(bufferpool.Stats) int64) prometheus.GaugeFunc {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "wgrp",
+			Name:      name,
+			Help:      help,
+		}, func() float64 {
+			return float64(value(stats()))
+		})
+	}
+	m.registry.MustRegister(
+		gauge("buffers_outstanding", "Relay buffers in use by connections.", func(s bufferpool.Stats) int64 { return s.Outstanding }),
+		gauge("buffers_pooled", "Relay buffers idle in the pools.", func(s bufferpool.Stats) int64 { return s.Pooled }),
+		gauge("buffers_overflow", "Throwaway relay buffers in use because -max-buffer-mem was reached.", func(s bufferpool.Stats) int64 { return s.Overflow }),
+	)
+}
+
+// tunnelHealthStates are the states of the peer health gauge, those the handshake monitor reports
+var tunnelHealthStates = []wireguard.TunnelHealth{wireguard.TunnelUp, wireguard.TunnelDegraded, wireguard.TunnelDown}
+
+// peerHealthDesc describes the gauge of the health of the tunnel to each WireGuard peer
+var peerHealthDesc = prometheus.NewDesc("wgrp_wireguard_peer_health",
+	"Health of the WireGuard tunnel to each peer by its last handshake: 1 for the state it is in, 0 for the others.",
+	[]string{"peer", "state"}, nil)
+
+// peerHealthCollector exports the health of the tunnels to the WireGuard peers, read when scraped
+type peerHealthCollector struct {
+	peers func() []api.PeerStats
+}
+
+// Describe implements prometheus.Collector
+func (c *peerHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- peerHealthDesc
+}
+
+// Collect implements prometheus.Collector. Peers the handshake monitor hasn't checked yet are left out.
+func (c *peerHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, peer := range c.peers() {
+		if peer.Health == "" {
+			continue
+		}
+		for _, state := range tunnelHealthStates {
+			value := 0.0
+			if string(state) == peer.Health {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(peerHealthDesc, prometheus.GaugeValue, value, peer.PublicKey, string(state))
+		}
+	}
+}
+
+// bufferStats adds up the buffers of the server's pool and of the mappings with their own
+func (ps *ProxyServer) bufferStats() bufferpool.Stats {
+	total := ps.bufferPool.Stats()
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, mapping := range ps.allMappings() {
+		if mapping.bufferPool == ps.bufferPool {
+			continue
+		}
+		s := mapping.bufferPool.Stats()
+		total.Outstanding += s.Outstanding
+		total.Pooled += s.Pooled
+		total.Overflow += s.Overflow
+	}
+	return total
+}
+
+// observeConnection records the duration of a relayed connection
+func (m *serverMetrics) observeConnection(remotePort int, d time.Duration) {
+	m.connectionDuration.WithLabelValues(strconv.Itoa(remotePort)).Observe(d.Seconds())
+}
+
+// observeRelayError counts a connection that ended with an error of class
+func (m *serverMetrics) observeRelayError(remotePort int, class string) {
+	m.relayErrors.WithLabelValues(strconv.Itoa(remotePort), class).Inc()
+}
+
+// MetricsHandler returns the HTTP handler serving the server's metrics in the Prometheus format
+func (ps *ProxyServer) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(ps.metrics.registry, promhttp.HandlerOpts{})
+}
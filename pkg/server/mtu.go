@@ -0,0 +1,106 @@
+package server
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// defaultTunnelMTU matches the MTU used when the WireGuard config doesn't set one
+	defaultTunnelMTU = 1420
+
+	// tcpIPOverhead is the worst-case IPv6 + TCP header size subtracted from the MTU
+	tcpIPOverhead = 60
+
+	// mtuBlackholeMinStall is how long the reply direction must stay silent before a
+	// connection is considered stalled rather than just idle
+	mtuBlackholeMinStall = 10 * time.Second
+
+	// mtuBlackholeThreshold is the number of suspect connections on a mapping before
+	// the server recommends lowering the MTU
+	mtuBlackholeThreshold = 3
+)
+
+// directionStats records write activity for one direction of a relayed connection
+type directionStats struct {
+	bytes             int64
+	firstLargeWriteAt time.Time
+	lastWriteAt       time.Time
+}
+
+// record adds a write of n bytes at the given time; writes above largeWrite bytes are
+// larger than a single tunnel packet can carry
+func (d *directionStats) record(n int, largeWrite int, at time.Time) {
+	d.bytes += int64(n)
+	d.lastWriteAt = at
+	if n > largeWrite && d.firstLargeWriteAt.IsZero() {
+		d.firstLargeWriteAt = at
+	}
+}
+
+// statsWriter wraps a writer and records every successful write in stats
+type statsWriter struct {
+	w          io.Writer
+	stats      *directionStats
+	largeWrite int
+}
+
+func (sw *statsWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if n > 0 {
+		sw.stats.record(n, sw.largeWrite, time.Now())
+	}
+	return n, err
+}
+
+// relayObservation holds the write activity of both directions of a relayed connection
+type relayObservation struct {
+	intoTunnel  directionStats // external -> tunnel
+	outOfTunnel directionStats // tunnel -> external
+	closedAt    time.Time
+}
+
+// possibleMTUBlackhole reports whether the connection looks like it was stalled by a path
+// MTU blackhole inside the tunnel: small packets made it back out of the tunnel, then the
+// first write too large for a single packet went in and nothing ever came back out again
+// for at least minStall. The rules are deliberately strict so that idle connections and
+// one-way transfers are not flagged.
+func (o *relayObservation) possibleMTUBlackhole(minStall time.Duration) bool {
+	largeAt := o.intoTunnel.firstLargeWriteAt
+	if largeAt.IsZero() {
+		return false
+	}
+
+	// The reply direction must have worked before, proving the path carries small packets
+	if o.outOfTunnel.bytes == 0 || o.outOfTunnel.lastWriteAt.IsZero() {
+		return false
+	}
+
+	// Any reply after the large write means data is getting through
+	if o.outOfTunnel.lastWriteAt.After(largeAt) {
+		return false
+	}
+
+	return o.closedAt.Sub(largeAt) >= minStall
+}
+
+// mtuPayloadSize returns the largest TCP payload that fits in a single tunnel packet
+func mtuPayloadSize(mtu int) int {
+	if mtu <= tcpIPOverhead {
+		return mtu
+	}
+	return mtu - tcpIPOverhead
+}
+
+// recordMTUSuspect counts a possible MTU blackhole on a mapping and recommends lowering
+// the MTU once the threshold is crossed
+func (ps *ProxyServer) recordMTUSuspect(mapping *ProxyMapping) {
+	count := mapping.mtuSuspects.Add(1)
+	if count == mtuBlackholeThreshold {
+		log.Printf("WARNING: %d connections on port %s stalled after large writes into the tunnel. "+
+			"This usually means the tunnel MTU (%d) is larger than the path supports; "+
+			"try lowering MTU in both WireGuard configs (e.g. to 1280)",
+			count, mapping.portLabel(), ps.tunnelMTU)
+	}
+}
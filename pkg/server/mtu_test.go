@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// write is one write of a synthetic transfer, at an offset from the start of the connection
+type write struct {
+	at         time.Duration
+	intoTunnel bool
+	size       int
+}
+
+func TestPossibleMTUBlackhole(t *testing.T) {
+	const largeWrite = 1360 // payload of a 1420-byte tunnel packet
+
+	tests := []struct {
+		name     string
+		writes   []write
+		closedAt time.Duration
+		want     bool
+	}{
+		{
+			name: "reply stalls after the first large write",
+			writes: []write{
+				{0, true, 300},
+				{100 * time.Millisecond, false, 200},
+				{time.Second, true, 8000},
+			},
+			closedAt: 20 * time.Second,
+			want:     true,
+		},
+		{
+			name: "reply after the large write",
+			writes: []write{
+				{0, true, 300},
+				{100 * time.Millisecond, false, 200},
+				{time.Second, true, 8000},
+				{2 * time.Second, false, 200},
+			},
+			closedAt: 20 * time.Second,
+		},
+		{
+			name: "stall shorter than the minimum",
+			writes: []write{
+				{0, true, 300},
+				{100 * time.Millisecond, false, 200},
+				{time.Second, true, 8000},
+			},
+			closedAt: 5 * time.Second,
+		},
+		{
+			name: "no reply ever, e.g. a one-way upload",
+			writes: []write{
+				{0, true, 300},
+				{time.Second, true, 8000},
+			},
+			closedAt: 20 * time.Second,
+		},
+		{
+			name: "only small writes into the tunnel, e.g. an idle session",
+			writes: []write{
+				{0, true, 300},
+				{100 * time.Millisecond, false, 200},
+				{time.Second, true, largeWrite},
+			},
+			closedAt: time.Minute,
+		},
+		{
+			name: "large response out of the tunnel only, e.g. a download",
+			writes: []write{
+				{0, true, 300},
+				{100 * time.Millisecond, false, 64 * 1024},
+			},
+			closedAt: time.Minute,
+		},
+		{
+			name:     "no traffic",
+			closedAt: time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			var obs relayObservation
+			for _, w := range tt.writes {
+				stats := &obs.outOfTunnel
+				if w.intoTunnel {
+					stats = &obs.intoTunnel
+				}
+				stats.record(w.size, largeWrite, start.Add(w.at))
+			}
+			obs.closedAt = start.Add(tt.closedAt)
+
+			if got := obs.possibleMTUBlackhole(mtuBlackholeMinStall); got != tt.want {
+				t.Errorf("possibleMTUBlackhole() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsWriterRecordsWrites(t *testing.T) {
+	var buf bytes.Buffer
+	var stats directionStats
+	sw := &statsWriter{w: &buf, stats: &stats, largeWrite: 10}
+
+	sw.Write(make([]byte, 5))
+	if !stats.firstLargeWriteAt.IsZero() {
+		t.Fatal("small write was recorded as large")
+	}
+	sw.Write(make([]byte, 20))
+	if stats.firstLargeWriteAt.IsZero() {
+		t.Fatal("large write was not recorded")
+	}
+	if stats.bytes != 25 || buf.Len() != 25 {
+		t.Errorf("recorded %d bytes and wrote %d, want 25", stats.bytes, buf.Len())
+	}
+}
+
+func TestRecordMTUSuspectCountsPerMapping(t *testing.T) {
+	ps := &ProxyServer{tunnelMTU: defaultTunnelMTU}
+	mapping := &ProxyMapping{RemotePort: 8080}
+	for range mtuBlackholeThreshold + 1 {
+		ps.recordMTUSuspect(mapping)
+	}
+	if got := mapping.MTUSuspects(); got != mtuBlackholeThreshold+1 {
+		t.Errorf("MTUSuspects() = %d, want %d", got, mtuBlackholeThreshold+1)
+	}
+}
+
+func TestMTUPayloadSize(t *testing.T) {
+	for mtu, want := range map[int]int{1420: 1360, 1280: 1220, 40: 40} {
+		if got := mtuPayloadSize(mtu); got != want {
+			t.Errorf("mtuPayloadSize(%d) = %d, want %d", mtu, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/hashicorp/yamux"
+)
+
+// StartMuxListener accepts multiplexed sessions from clients on the mux port within the
+// WireGuard netstack. Connections to mappings registered with the yamux transport are opened
+// as streams over the client's session instead of dialing the client through the tunnel.
+func (ps *ProxyServer) StartMuxListener() error {
+	listener, err := ps.tnet.ListenTCP(&net.TCPAddr{Port: ps.muxPort})
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %v", ps.muxPort, err)
+	}
+
+	log.Printf("Mux listener listening on :%d within WireGuard netstack", ps.muxPort)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Mux listener error: %v", err)
+				return
+			}
+
+			go ps.handleMuxSession(conn)
+		}
+	}()
+
+	return nil
+}
+
+// handleMuxSession tracks a client's multiplexed session until it closes
+func (ps *ProxyServer) handleMuxSession(conn net.Conn) {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("Rejected mux session from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	clientIP := addrPort.Addr().Unmap().String()
+
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		log.Printf("Failed to start mux session with client %s: %v", clientIP, err)
+		conn.Close()
+		return
+	}
+
+	// A reconnecting client replaces its previous session
+	ps.mu.Lock()
+	if old, exists := ps.muxSessions[clientIP]; exists {
+		old.Close()
+	}
+	ps.muxSessions[clientIP] = session
+	ps.mu.Unlock()
+
+	log.Printf("Client %s opened a multiplexed session", clientIP)
+
+	<-session.CloseChan()
+
+	ps.mu.Lock()
+	if ps.muxSessions[clientIP] == session {
+		delete(ps.muxSessions, clientIP)
+	}
+	ps.mu.Unlock()
+
+	log.Printf("Multiplexed session with client %s closed", clientIP)
+}
+
+// dialClient connects to the client side of a mapping, over the client's multiplexed session
+// when it has one and by dialing its route listener through the tunnel otherwise
+func (ps *ProxyServer) dialClient(mapping *ProxyMapping) (net.Conn, error) {
+	if mapping.multiplexed {
+		ps.mu.RLock()
+		session := ps.muxSessions[mapping.ClientIP]
+		ps.mu.RUnlock()
+
+		if session != nil {
+			return openMuxStream(session, mapping.RemotePort)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mapping.dialTimeout)
+	defer cancel()
+	return ps.tnet.DialContext(ctx, "tcp", net.JoinHostPort(mapping.ClientIP, strconv.Itoa(mapping.ClientPort)))
+}
+
+// openMuxStream opens a stream for a mapping. The stream starts with the mapping's remote port
+// so the client knows which local service to connect it to.
+func openMuxStream(session *yamux.Session, remotePort int) (net.Conn, error) {
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(remotePort))
+	if _, err := stream.Write(header[:]); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	benchMuxPort    = 7000
+	benchClientPort = 9000
+)
+
+// echo copies everything read from conn back to it until the other side closes
+func echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+// startDirectEcho listens on the client's end of the tunnel like a route listener
+func startDirectEcho(b *testing.B, pair *wgtest.Pair) {
+	listener, err := pair.Client.Tnet.ListenTCP(&net.TCPAddr{Port: benchClientPort})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn)
+		}
+	}()
+}
+
+// startMuxEcho opens a multiplexed session from the client and echoes every stream after its header
+func startMuxEcho(b *testing.B, pair *wgtest.Pair, ps *ProxyServer) {
+	if err := ps.StartMuxListener(); err != nil {
+		b.Fatal(err)
+	}
+	conn, err := pair.Client.Tnet.Dial("tcp", net.JoinHostPort(wgtest.ServerIP, strconv.Itoa(benchMuxPort)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { session.Close() })
+
+	go func() {
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				var header [2]byte
+				if _, err := io.ReadFull(stream, header[:]); err != nil {
+					stream.Close()
+					return
+				}
+				echo(stream)
+			}()
+		}
+	}()
+
+	// Wait for the server to track the session
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ps.mu.RLock()
+		_, ok := ps.muxSessions[wgtest.ClientIP]
+		ps.mu.RUnlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			b.Fatal("server did not accept the multiplexed session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkDialClient measures connection setup to a client through the tunnel: a dial and one
+// round trip, either as a new TCP connection or as a stream over the multiplexed session
+func BenchmarkDialClient(b *testing.B) {
+	for _, multiplexed := range []bool{false, true} {
+		name := "direct"
+		if multiplexed {
+			name = "mux"
+		}
+		b.Run(name, func(b *testing.B) {
+			pair := wgtest.NewPair(b)
+			ps := NewProxyServer(pair.Server.Tnet, 32*1024, WithMuxPort(benchMuxPort))
+			mapping := &ProxyMapping{
+				RemotePort:  8080,
+				ClientIP:    wgtest.ClientIP,
+				ClientPort:  benchClientPort,
+				multiplexed: multiplexed,
+				dialTimeout: DefaultTunnelDialTimeout,
+			}
+			if multiplexed {
+				startMuxEcho(b, pair, ps)
+			} else {
+				startDirectEcho(b, pair)
+			}
+
+			var buf [1]byte
+			for b.Loop() {
+				conn, err := ps.dialClient(mapping)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := conn.Write(buf[:]); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, buf[:]); err != nil {
+					b.Fatal(err)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
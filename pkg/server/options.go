@@ -0,0 +1,268 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/webhook"
+)
+
+// ServerOption configures optional ProxyServer settings
+type ServerOption func(*ProxyServer)
+
+// WithAPIPort sets the port the REST API listens on within the WireGuard netstack
+func WithAPIPort(port int) ServerOption {
+	return func(ps *ProxyServer) {
+		if port > 0 {
+			ps.apiPort = port
+		}
+	}
+}
+
+// WithMuxPort enables multiplexed client sessions on port within the WireGuard netstack
+func WithMuxPort(port int) ServerOption {
+	return func(ps *ProxyServer) {
+		if port > 0 {
+			ps.muxPort = port
+		}
+	}
+}
+
+// WithReservationTTL sets how long a port reservation is held before a mapping must claim it
+func WithReservationTTL(ttl time.Duration) ServerOption {
+	return func(ps *ProxyServer) {
+		if ttl > 0 {
+			ps.reservationTTL = ttl
+		}
+	}
+}
+
+// WithMinClientVersion rejects heartbeats and registrations from clients older than version
+func WithMinClientVersion(version string) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.minClientVersion = version
+	}
+}
+
+// WithTunnelMTU sets the WireGuard MTU used to size packets when detecting MTU blackholes
+func WithTunnelMTU(mtu int) ServerOption {
+	return func(ps *ProxyServer) {
+		if mtu > 0 {
+			ps.tunnelMTU = mtu
+		}
+	}
+}
+
+// WithCapture allows debug captures of mapping traffic to be written to dir
+func WithCapture(allowed bool, dir string) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.allowCapture = allowed
+		ps.captureDir = dir
+	}
+}
+
+// WithHeartbeatTiming sets the heartbeat interval advertised to clients and how long a client
+// may go without a heartbeat before its mappings are removed
+func WithHeartbeatTiming(interval, clientTimeout time.Duration) ServerOption {
+	return func(ps *ProxyServer) {
+		if interval > 0 {
+			ps.heartbeatInterval = interval
+		}
+		if clientTimeout > 0 {
+			ps.clientTimeout = clientTimeout
+		}
+	}
+}
+
+// WithAllowDeletePreloaded lets the delete API remove mappings created by PreloadMappings
+func WithAllowDeletePreloaded(allow bool) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.allowDeletePreloaded = allow
+	}
+}
+
+// WithDeleteGracePeriod sets how long a mapping deleted through the API keeps its port, resetting
+// new connections, so that another client can't take the port over right away. 0 releases the
+// port at once.
+func WithDeleteGracePeriod(period time.Duration) ServerOption {
+	return func(ps *ProxyServer) {
+		if period >= 0 {
+			ps.deleteGracePeriod = period
+		}
+	}
+}
+
+// WithTunnelDialTimeout sets how long the server waits to connect to a client through the tunnel,
+// unless a mapping asks for its own timeout
+func WithTunnelDialTimeout(timeout time.Duration) ServerOption {
+	return func(ps *ProxyServer) {
+		if timeout > 0 {
+			ps.tunnelDialTimeout = timeout
+		}
+	}
+}
+
+// WithCircuitBreaker sets how many consecutive failed dials to a client open a mapping's circuit
+// and how long the circuit stays open before a trial connection is let through
+func WithCircuitBreaker(threshold int, recoveryTimeout time.Duration) ServerOption {
+	return func(ps *ProxyServer) {
+		if threshold > 0 {
+			ps.breakerThreshold = threshold
+		}
+		if recoveryTimeout > 0 {
+			ps.breakerRecovery = recoveryTimeout
+		}
+	}
+}
+
+// WithDeadClientPolicy sets whether a dead client's mappings are removed (DeadClientRemove)
+// or kept open but suspended until it heartbeats again (DeadClientSuspend)
+func WithDeadClientPolicy(policy string) ServerOption {
+	return func(ps *ProxyServer) {
+		if policy == DeadClientRemove || policy == DeadClientSuspend {
+			ps.deadClientPolicy = policy
+		}
+	}
+}
+
+// WithWebhook posts a notification to a webhook for every port mapping creation, deletion and
+// expiry and for every port mapping of a client that stopped heartbeating
+func WithWebhook(notifier *webhook.Notifier) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.webhook = notifier
+	}
+}
+
+// WithAuthToken requires every API request except the version check to carry token in an
+// "Authorization: Bearer" header
+func WithAuthToken(token string) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.authToken = token
+	}
+}
+
+// WithAdminToken lets API requests carrying token in an "Authorization: Bearer" header make
+// privileged changes, such as setting client quotas, which are refused without it. It also
+// passes WithAuthToken's check.
+func WithAdminToken(token string) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.adminToken = token
+	}
+}
+
+// WithForwarding accepts forwards from clients on port within the WireGuard netstack, to targets
+// in the allowed networks only
+func WithForwarding(port int, allowed []netip.Prefix) ServerOption {
+	return func(ps *ProxyServer) {
+		if port > 0 {
+			ps.forwardPort = port
+			ps.forwardAllow = allowed
+		}
+	}
+}
+
+// WithCertIssuer lets SNI mappings terminate TLS with certificates obtained for their hostname
+// from issuer, by asking for api.TLSCertACME
+func WithCertIssuer(issuer CertIssuer) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.certIssuer = issuer
+	}
+}
+
+// WithAPIRateLimit limits each client IP to perSecond API requests, with burst requests at once
+// above the rate. A rate of 0 disables the limit.
+func WithAPIRateLimit(perSecond float64, burst int) ServerOption {
+	return func(ps *ProxyServer) {
+		if perSecond >= 0 {
+			ps.apiRateLimit = perSecond
+		}
+		if burst > 0 {
+			ps.apiRateBurst = burst
+		}
+	}
+}
+
+// WithBufferMemoryLimit counts the relay buffers of the server and of mappings with their own
+// buffer size against limit, which servers may share. Beyond it connections relay with throwaway
+// buffers instead of pooled ones.
+func WithBufferMemoryLimit(limit *bufferpool.MemoryLimit) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.bufferLimit = limit
+		ps.bufferPool = bufferpool.NewBufferPool(ps.bufferPool.Size(), bufferpool.WithMemoryLimit(limit))
+	}
+}
+
+// WithCertStore lets mappings terminate TLS with the certificates in store, selected by name
+func WithCertStore(store *CertStore) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.certs = store
+	}
+}
+
+// WithAuditLog records every port mapping creation, deletion and expiry to an audit log
+func WithAuditLog(auditLog *AuditLogger) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.auditLog = auditLog
+	}
+}
+
+// WithStore keeps the port mappings in the file at path whenever they change, so RestoreStore can
+// recreate them after a restart
+func WithStore(path string) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.storePath = path
+	}
+}
+
+// WithBlockedCIDRs refuses external connections from the given CIDR ranges on every mapped port.
+// Invalid ranges are skipped, so callers should validate them first.
+func WithBlockedCIDRs(cidrs []string) ServerOption {
+	return func(ps *ProxyServer) {
+		for _, cidr := range cidrs {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				ps.blockedCIDRs = append(ps.blockedCIDRs, ipNet)
+			}
+		}
+	}
+}
+
+// WithIdentityResolver resolves clients to tenant identities with resolver instead of treating
+// every client IP as its own unlimited tenant
+func WithIdentityResolver(resolver IdentityResolver) ServerOption {
+	return func(ps *ProxyServer) {
+		if resolver != nil {
+			ps.identities = resolver
+		}
+	}
+}
+
+// WithPeerLookup sets how the WireGuard peer public key for a tunnel address is found, so identity
+// resolvers can key off the peer rather than the IP a client claims
+func WithPeerLookup(lookup func(netip.Addr) string) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.peerLookup = lookup
+	}
+}
+
+// WithPeerStats sets how the WireGuard peers reported by the status API and snapshots are found
+func WithPeerStats(stats func() []api.PeerStats) ServerOption {
+	return func(ps *ProxyServer) {
+		ps.peerStats = stats
+	}
+}
+
+// WithConnectionHistory sets how many closed connections are remembered per mapping and how
+// long they remain queryable
+func WithConnectionHistory(size int, retention time.Duration) ServerOption {
+	return func(ps *ProxyServer) {
+		if size > 0 {
+			ps.historySize = size
+		}
+		if retention > 0 {
+			ps.historyRetention = retention
+		}
+	}
+}
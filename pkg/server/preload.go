@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	wgrp "github.com/DevonTM/wg-rp"
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// PreloadMappings creates the port mappings in a JSON file holding an array of
+// api.PortMappingRequest, exactly as if their clients had registered them. Preloaded mappings
+// stay active while their client is away and, unless allowed with WithAllowDeletePreloaded,
+// can't be deleted through the API.
+func (ps *ProxyServer) PreloadMappings(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var requests []api.PortMappingRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	for _, req := range requests {
+		if err := ps.loadMapping(req, true); err != nil {
+			return fmt.Errorf("failed to preload mapping for port %d: %v", req.RemotePort, err)
+		}
+	}
+
+	log.Printf("Preloaded %d port mappings from %s", len(requests), path)
+	return nil
+}
+
+// loadMapping creates a port mapping the server is configured with, exactly as if its client had
+// registered it
+func (ps *ProxyServer) loadMapping(req api.PortMappingRequest, preloaded bool) error {
+	// Mappings the server creates itself are part of its own configuration
+	if req.Version == "" {
+		req.Version = wgrp.VERSION
+	}
+
+	// Resolve the client's identity as if the request came from its tunnel address
+	remoteAddr := net.JoinHostPort(strings.Trim(req.ClientIP, "[]"), "0")
+	response, status := ps.createMapping(context.Background(), req, remoteAddr, preloaded)
+	if status != http.StatusOK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// writePreload writes a -preload-mappings file holding requests
+func writePreload(t *testing.T, requests ...api.PortMappingRequest) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "preload.json")
+	data, err := json.Marshal(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPreloadMappings(t *testing.T) {
+	port := freePorts(t, 1)[0]
+	ps := NewProxyServer(nil, 1024)
+	t.Cleanup(func() { stopMappings(ps) })
+
+	if err := ps.PreloadMappings(writePreload(t, testMapping(port))); err != nil {
+		t.Fatal(err)
+	}
+	ps.mu.RLock()
+	mapping, exists := ps.mappings[portKey{port: port}]
+	ps.mu.RUnlock()
+	if !exists || !mapping.Preloaded || mapping.ClientIP != "10.0.0.2" {
+		t.Fatalf("preloaded mapping exists: %v, want a preloaded mapping of 10.0.0.2 on port %d", exists, port)
+	}
+}
+
+func TestPreloadMappingsRejectsInvalid(t *testing.T) {
+	req := testMapping(freePorts(t, 1)[0])
+	req.Mode = "udp"
+	ps := NewProxyServer(nil, 1024)
+
+	// The file is checked like a client's registration
+	err := ps.PreloadMappings(writePreload(t, req))
+	if err == nil || !strings.Contains(err.Error(), "Invalid mode") {
+		t.Errorf("PreloadMappings = %v, want the registration's validation error", err)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// localProbeTimeout bounds how long a local probe may take to send its request
+const localProbeTimeout = 2 * time.Second
+
+// localProbeResponse is the reply to HTTP health checks answered by the fast path
+const localProbeResponse = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 3\r\nConnection: close\r\n\r\nOK\n"
+
+var (
+	hostAddrsOnce sync.Once
+	hostAddrs     map[netip.Addr]bool
+)
+
+// isHostLocal reports whether a connection comes from the server host itself: a loopback
+// address or one of the host's interface addresses
+func isHostLocal(addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() {
+		return true
+	}
+
+	hostAddrsOnce.Do(func() {
+		hostAddrs = make(map[netip.Addr]bool)
+		ifaceAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			log.Printf("Failed to list host addresses for local probe detection: %v", err)
+			return
+		}
+		for _, a := range ifaceAddrs {
+			if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+				hostAddrs[prefix.Addr().Unmap()] = true
+			}
+		}
+	})
+
+	return hostAddrs[ip]
+}
+
+// answerLocalProbe answers a health check from the server host without relaying it to the client
+func answerLocalProbe(conn net.Conn, mode string) {
+	defer conn.Close()
+
+	if mode != api.LocalProbeHTTP {
+		return
+	}
+
+	// Consume the request so closing doesn't reset the connection before the response is read
+	conn.SetDeadline(time.Now().Add(localProbeTimeout))
+	if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+		io.Copy(io.Discard, req.Body)
+	}
+	io.WriteString(conn, localProbeResponse)
+}
@@ -1,37 +1,150 @@
 package server
 
 import (
+	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DevonTM/wg-rp/pkg/api"
 	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/circuitbreaker"
+	"github.com/DevonTM/wg-rp/pkg/webhook"
 
+	"github.com/hashicorp/yamux"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
+// DefaultAPIPort is the port the REST API listens on within the WireGuard netstack
+const DefaultAPIPort = 80
+
+// DefaultTunnelDialTimeout is how long the server waits to connect to a client through the tunnel
+const DefaultTunnelDialTimeout = 10 * time.Second
+
+// DefaultDeleteGracePeriod is how long a deleted mapping keeps its port, resetting new connections,
+// before the port is released
+const DefaultDeleteGracePeriod = 30 * time.Second
+
 // ProxyServer manages port mappings and proxy connections
 type ProxyServer struct {
-	tnet        *netstack.Net
-	mappings    map[int]*ProxyMapping  // port -> mapping
-	clients     map[string]*ClientInfo // clientIP -> client info
-	mu          sync.RWMutex
-	startupTime time.Time
-	bufferPool  *bufferpool.BufferPool
+	tnet                 *netstack.Net
+	apiPort              int
+	muxPort              int                       // 0 disables multiplexed sessions
+	muxSessions          map[string]*yamux.Session // clientIP -> multiplexed session
+	mappings             map[portKey]*ProxyMapping // port and namespace -> mapping
+	httpRouters          map[portKey]*httpRouter   // port and namespace -> router of the HTTP mappings sharing it
+	clients              map[string]*ClientInfo    // clientIP -> client info
+	reservations         map[int]*PortReservation  // port -> reservation
+	reservationTTL       time.Duration
+	minClientVersion     string
+	tunnelMTU            int
+	tunnelDialTimeout    time.Duration // how long a direct dial to a client may take
+	heartbeatInterval    time.Duration
+	clientTimeout        time.Duration
+	deadClientPolicy     string
+	allowDeletePreloaded bool
+	deleteGracePeriod    time.Duration // how long a deleted mapping holds its port, 0 to release it at once
+	breakerThreshold     int           // consecutive dial failures that open a mapping's circuit
+	breakerRecovery      time.Duration // how long an open circuit waits before a trial connection
+	allowCapture         bool
+	captureDir           string
+	nextConnID           atomic.Uint64
+	connections          sync.Map      // connID -> *liveConnection, open proxy connections
+	totalConnections     atomic.Uint64 // proxy connections established since startup
+	totalBytesIn         atomic.Uint64 // bytes received from external connections since startup
+	totalBytesOut        atomic.Uint64 // bytes sent to external connections since startup
+	deadClientsEvicted   atomic.Uint64 // clients whose mappings were removed for missing heartbeats
+	events               *eventBroker
+	auditLog             *AuditLogger // nil when auditing is disabled
+	storePath            string       // file the port mappings are kept in across restarts, empty for none
+	storeMu              sync.Mutex
+	storeSaved           []byte            // mappings last written to storePath, to skip writes that change nothing
+	webhook              *webhook.Notifier // nil when no webhook is configured
+	authToken            string            // bearer token API requests must carry, empty for none
+	adminToken           string            // bearer token of privileged API requests, empty for none
+	forwardPort          int               // 0 disables forwards from clients
+	forwardAllow         []netip.Prefix    // networks forwards may connect to
+	certs                *CertStore        // certificates mappings may terminate TLS with, nil for none
+	certIssuer           CertIssuer        // obtains certificates for api.TLSCertACME mappings, nil for none
+	apiRateLimit         float64           // API requests per second per client IP, 0 for no limit
+	apiRateBurst         int
+	apiLimiters          sync.Map // client IP -> *apiLimiter
+	identities           IdentityResolver
+	peerLookup           func(netip.Addr) string // tunnel address -> WireGuard peer public key
+	peerStats            func() []api.PeerStats  // WireGuard peers of the device, nil if unknown
+	blockedCIDRs         []*net.IPNet            // external sources never allowed to connect
+	history              map[int]*connHistory    // port -> recently closed connections
+	quotas               map[string]*clientQuota // client IP -> bandwidth quota, kept across registrations while set
+	quotasMu             sync.Mutex              // guards quotas apart from ps.mu, which new connections don't take
+	historySize          int
+	historyRetention     time.Duration
+	fdReserve            *fdReserve // spare descriptors released when the process runs out
+	metrics              *serverMetrics
+	mu                   sync.RWMutex
+	startupTime          time.Time
+	bufferPool           *bufferpool.BufferPool
+	bufferLimit          *bufferpool.MemoryLimit // caps the buffers of bufferPool and the mappings' own pools, nil for none
 }
 
 // ClientInfo tracks information about connected clients
 type ClientInfo struct {
-	LastHeartbeat time.Time
-	Mappings      map[int]bool // ports mapped by this client
+	LastHeartbeat     time.Time
+	Mappings          map[portKey]bool // ports mapped by this client
+	Version           string           // version reported in the last heartbeat
+	Stats             *api.ClientStats // client-side counters from the last heartbeat
+	RTTMillis         float64          // heartbeat round-trip time reported by the client
+	HeartbeatInterval time.Duration    // heartbeat interval the client reports using
+	Suspended         bool             // mappings are suspended because the client stopped heartbeating
+	Identity          *Identity        // identity resolved on the last heartbeat or registration
 }
 
 // NewProxyServer creates a new proxy server
-func NewProxyServer(tnet *netstack.Net, bufferSize int) *ProxyServer {
-	return &ProxyServer{
-		tnet:        tnet,
-		mappings:    make(map[int]*ProxyMapping),
-		clients:     make(map[string]*ClientInfo),
-		startupTime: time.Now(),
-		bufferPool:  bufferpool.NewBufferPool(bufferSize),
+func NewProxyServer(tnet *netstack.Net, bufferSize int, opts ...ServerOption) *ProxyServer {
+	startupTime := time.Now()
+	ps := &ProxyServer{
+		tnet:              tnet,
+		apiPort:           DefaultAPIPort,
+		mappings:          make(map[portKey]*ProxyMapping),
+		httpRouters:       make(map[portKey]*httpRouter),
+		muxSessions:       make(map[string]*yamux.Session),
+		clients:           make(map[string]*ClientInfo),
+		reservations:      make(map[int]*PortReservation),
+		reservationTTL:    defaultReservationTTL,
+		tunnelMTU:         defaultTunnelMTU,
+		tunnelDialTimeout: DefaultTunnelDialTimeout,
+		deleteGracePeriod: DefaultDeleteGracePeriod,
+		heartbeatInterval: DefaultHeartbeatInterval,
+		clientTimeout:     DefaultClientTimeout,
+		deadClientPolicy:  DeadClientRemove,
+		breakerThreshold:  circuitbreaker.DefaultThreshold,
+		breakerRecovery:   circuitbreaker.DefaultRecoveryTimeout,
+		identities:        defaultResolver{},
+		history:           make(map[int]*connHistory),
+		quotas:            make(map[string]*clientQuota),
+		historySize:       defaultHistorySize,
+		historyRetention:  defaultHistoryRetention,
+		events:            newEventBroker(startupTime),
+		fdReserve:         newFDReserve(fdReserveSize),
+		metrics:           newServerMetrics(),
+		startupTime:       startupTime,
+		bufferPool:        bufferpool.NewBufferPool(bufferSize),
+		apiRateLimit:      DefaultAPIRateLimit,
+		apiRateBurst:      DefaultAPIRateBurst,
+	}
+
+	for _, opt := range opts {
+		opt(ps)
 	}
+	ps.metrics.registerBufferGauges(ps.bufferStats)
+	if ps.peerStats != nil {
+		ps.metrics.registry.MustRegister(&peerHealthCollector{peers: ps.peerStats})
+	}
+
+	return ps
+}
+
+// APIPort returns the port the REST API listens on within the WireGuard netstack
+func (ps *ProxyServer) APIPort() int {
+	return ps.apiPort
 }
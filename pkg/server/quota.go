@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/ratelimit"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+// clientQuota is the bandwidth quota of a client IP and the limiter all its connections share
+type clientQuota struct {
+	bps     int64 // bits per second, 0 for unlimited
+	limiter *ratelimit.BandwidthLimiter
+}
+
+// quotaKey returns the key of a client IP in ps.quotas: the address without brackets or zone, so
+// that the forms clients register and admins type find the same quota
+func quotaKey(clientIP string) (string, bool) {
+	addr, err := netip.ParseAddr(strings.Trim(clientIP, "[]"))
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().WithZone("").String(), true
+}
+
+// handleSetClientQuota sets the bandwidth quota of a client IP, whether or not the client is
+// connected. Only the admin token may set quotas, or clients could lift their own. The quota is
+// kept when the client is removed or re-registers, and open connections take it with their next
+// write.
+func (ps *ProxyServer) handleSetClientQuota(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ps.isAdmin(r) {
+		log.Printf("Rejected quota change from %s without the admin token", r.RemoteAddr)
+		response := api.ClientQuotaResponse{
+			Success: false,
+			Message: "Setting quotas requires the admin token",
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req api.ClientQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response := api.ClientQuotaResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid request body: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if req.BandwidthQuotaBps < 0 {
+		response := api.ClientQuotaResponse{
+			Success: false,
+			Message: "Bandwidth quota must not be negative",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	clientIP, ok := quotaKey(r.PathValue("ip"))
+	if !ok {
+		response := api.ClientQuotaResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid client IP %q", r.PathValue("ip")),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	bytesPerSecond := (req.BandwidthQuotaBps + 7) / 8
+	quota := ps.clientQuota(clientIP)
+	ps.quotasMu.Lock()
+	quota.bps = req.BandwidthQuotaBps
+	ps.quotasMu.Unlock()
+	quota.limiter.SetLimit(bytesPerSecond)
+
+	message := fmt.Sprintf("Removed the bandwidth quota of client %s", clientIP)
+	if req.BandwidthQuotaBps > 0 {
+		message = fmt.Sprintf("Set the bandwidth quota of client %s to %s/s", clientIP, utils.FormatBytes(uint64(bytesPerSecond)))
+	}
+	log.Print(message)
+
+	response := api.ClientQuotaResponse{
+		Success:           true,
+		Message:           message,
+		BandwidthQuotaBps: req.BandwidthQuotaBps,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// clientQuota returns the quota of a client IP, creating an unlimited one on first use. Every
+// connection of the client is limited by its limiter, so a quota set later applies to connections
+// already open. It takes only ps.quotasMu, as every new connection calls it.
+func (ps *ProxyServer) clientQuota(clientIP string) *clientQuota {
+	key, ok := quotaKey(clientIP)
+	if !ok {
+		key = clientIP
+	}
+
+	ps.quotasMu.Lock()
+	defer ps.quotasMu.Unlock()
+	quota, exists := ps.quotas[key]
+	if !exists {
+		quota = &clientQuota{limiter: ratelimit.NewBandwidthLimiter(0)}
+		ps.quotas[key] = quota
+	}
+	return quota
+}
+
+// clientQuotaBps returns the bandwidth quota of a client IP in bits per second, 0 for none
+func (ps *ProxyServer) clientQuotaBps(clientIP string) int64 {
+	key, ok := quotaKey(clientIP)
+	if !ok {
+		return 0
+	}
+	ps.quotasMu.Lock()
+	defer ps.quotasMu.Unlock()
+	if quota, exists := ps.quotas[key]; exists {
+		return quota.bps
+	}
+	return 0
+}
+
+// pruneQuota forgets the quota of a client IP once its last mapping is removed, unless an admin
+// set one, so that clients passing through don't accumulate entries. Connections still open keep
+// the limiter they have. Callers must hold ps.mu.
+func (ps *ProxyServer) pruneQuota(clientIP string) {
+	if len(ps.clientMappings(clientIP)) > 0 {
+		return
+	}
+	key, ok := quotaKey(clientIP)
+	if !ok {
+		key = clientIP
+	}
+
+	ps.quotasMu.Lock()
+	defer ps.quotasMu.Unlock()
+	if quota, exists := ps.quotas[key]; exists && quota.bps == 0 {
+		delete(ps.quotas, key)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setQuota sends a quota request for clientIP with token, returning the status code
+func setQuota(ps *ProxyServer, clientIP, token, body string) int {
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/clients/"+clientIP+"/quota", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ps.apiHandler().ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestSetClientQuotaRequiresAdmin(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAuthToken("client-token"), WithAdminToken("admin-token"))
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"client token", "client-token", http.StatusForbidden},
+		{"wrong token", "admin-token2", http.StatusUnauthorized},
+		{"admin token", "admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := setQuota(ps, "10.99.0.2", tt.token, `{"bandwidth_quota_bps": 8000000}`); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Without an admin token configured, nobody may set quotas, whatever the auth token
+	ps = NewProxyServer(nil, 1024)
+	if got := setQuota(ps, "10.99.0.2", "", `{"bandwidth_quota_bps": 0}`); got != http.StatusForbidden {
+		t.Errorf("without an admin token: status %d, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestClientQuotaOutlivesClient(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAdminToken("admin"))
+
+	// A connection open before the quota is set is limited by it
+	limiter := ps.clientQuota("[fd99::2]").limiter
+	if limiter.Limit() != 0 {
+		t.Fatalf("limit before any quota = %d, want unlimited", limiter.Limit())
+	}
+	if got := setQuota(ps, "fd99::2", "admin", `{"bandwidth_quota_bps": 8000000}`); got != http.StatusOK {
+		t.Fatalf("status %d, want 200", got)
+	}
+	if limiter.Limit() != 1000000 {
+		t.Errorf("limit of the open connection = %d bytes/s, want 1000000", limiter.Limit())
+	}
+
+	// The quota stays when the client is evicted and applies again once it registers
+	ps.mu.Lock()
+	ps.clients["[fd99::2]"] = &ClientInfo{LastHeartbeat: time.Now(), Mappings: map[portKey]bool{}}
+	ps.removeClientMappings("[fd99::2]")
+	delete(ps.clients, "[fd99::2]")
+	ps.clients["[fd99::2]"] = &ClientInfo{LastHeartbeat: time.Now(), Mappings: map[portKey]bool{}}
+	bps := ps.clientQuotaBps("[fd99::2]")
+	ps.mu.Unlock()
+	if bps != 8000000 {
+		t.Errorf("quota after re-registering = %d, want 8000000", bps)
+	}
+	if again := ps.clientQuota("[fd99::2]").limiter; again != limiter || again.Limit() != 1000000 {
+		t.Errorf("new connections get limit %d, want the client's shared limiter at 1000000", again.Limit())
+	}
+
+	if got := setQuota(ps, "[fd99::2]", "admin", `{"bandwidth_quota_bps": 0}`); got != http.StatusOK {
+		t.Fatalf("status %d, want 200", got)
+	}
+	if limiter.Limit() != 0 {
+		t.Errorf("limit after removing the quota = %d, want unlimited", limiter.Limit())
+	}
+}
+
+func TestQuotaPrunedWithLastMapping(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAdminToken("admin"))
+	t.Cleanup(func() { stopMappings(ps) })
+	ports := freePorts(t, 2)
+	for _, port := range ports {
+		if err := ps.loadMapping(testMapping(port), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quotas := func() int {
+		ps.quotasMu.Lock()
+		defer ps.quotasMu.Unlock()
+		return len(ps.quotas)
+	}
+	remove := func(port int) {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		ps.removeMapping(ps.mappings[portKey{port: port}])
+	}
+
+	// A connection gives the client an unlimited entry, which goes with its last mapping
+	ps.clientQuota("10.0.0.2")
+	remove(ports[0])
+	if n := quotas(); n != 1 {
+		t.Fatalf("%d quota entries while the client has a mapping, want 1", n)
+	}
+	remove(ports[1])
+	if n := quotas(); n != 0 {
+		t.Fatalf("%d quota entries after the client's last mapping was removed, want 0", n)
+	}
+
+	// A quota an admin set stays for the client's return
+	if got := setQuota(ps, "10.0.0.2", "admin", `{"bandwidth_quota_bps": 8000000}`); got != http.StatusOK {
+		t.Fatalf("status %d, want 200", got)
+	}
+	if err := ps.loadMapping(testMapping(ports[0]), false); err != nil {
+		t.Fatal(err)
+	}
+	remove(ports[0])
+	if bps := ps.clientQuotaBps("10.0.0.2"); bps != 8000000 {
+		t.Errorf("quota after the last mapping was removed = %d, want 8000000", bps)
+	}
+}
+
+func TestSetClientQuotaInvalid(t *testing.T) {
+	ps := NewProxyServer(nil, 1024, WithAdminToken("admin"))
+	for _, tt := range []struct{ ip, body string }{
+		{"10.99.0.2", `{"bandwidth_quota_bps": -1}`},
+		{"10.99.0.2", `{"bandwidth_quota_bps": "fast"}`},
+		{"client-a", `{"bandwidth_quota_bps": 1000}`},
+	} {
+		if got := setQuota(ps, tt.ip, "admin", tt.body); got != http.StatusBadRequest {
+			t.Errorf("quota %s for %s: status %d, want 400", tt.body, tt.ip, got)
+		}
+	}
+}
+
+func TestQuotaKey(t *testing.T) {
+	for _, ip := range []string{"fd99::2", "[fd99::2]", "[fd99:0::2]", "fd99::2%wg0"} {
+		if key, ok := quotaKey(ip); !ok || key != "fd99::2" {
+			t.Errorf("quotaKey(%q) = %q, %v, want fd99::2", ip, key, ok)
+		}
+	}
+	if key, ok := quotaKey("::ffff:10.99.0.2"); !ok || key != "10.99.0.2" {
+		t.Errorf("quotaKey of a mapped address = %q, %v, want 10.99.0.2", key, ok)
+	}
+	if _, ok := quotaKey("client-a"); ok {
+		t.Error("quotaKey accepted a name")
+	}
+}
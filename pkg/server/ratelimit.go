@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// connRateWait is how long an incoming connection may wait for the rate limiter before it is rejected
+	connRateWait = 250 * time.Millisecond
+
+	// connRejectDelay is how long a rejected connection is held before it is reset, so a client
+	// retrying in a tight loop is slowed down as well
+	connRejectDelay = 100 * time.Millisecond
+
+	// DefaultMaxHalfOpen is how many connections to a mapping may be set up at once, accepted but
+	// not yet connected to the client, unless the client asks for another limit
+	DefaultMaxHalfOpen = 100
+)
+
+// newConnRateLimiter creates a limiter for new connections on a mapping, or nil for no limit.
+// Without an explicit burst, one second's worth of connections may arrive at once.
+func newConnRateLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(perSecond)))
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// allowConnection waits briefly for the mapping's rate limiter and reports whether a new
+// connection may be handled
+func (m *ProxyMapping) allowConnection() bool {
+	if m.connRateLimiter == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connRateWait)
+	defer cancel()
+
+	return m.connRateLimiter.Wait(ctx) == nil
+}
+
+// rejectConnection resets a connection after a short delay without blocking the accept loop
+func rejectConnection(conn net.Conn) {
+	time.AfterFunc(connRejectDelay, func() {
+		resetConnection(conn)
+	})
+}
+
+// resetConnection closes a connection with a TCP reset instead of an orderly shutdown
+func resetConnection(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
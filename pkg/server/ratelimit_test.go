@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+func TestHalfOpenLimit(t *testing.T) {
+	ps := NewProxyServer(nil, 1024)
+	t.Cleanup(func() { stopMappings(ps) })
+
+	port := freePorts(t, 1)[0]
+	req := testMapping(port)
+	req.MaxHalfOpen = 2
+	if err := ps.loadMapping(req, false); err != nil {
+		t.Fatal(err)
+	}
+	ps.mu.RLock()
+	mapping := ps.mappings[portKey{port: port}]
+	ps.mu.RUnlock()
+	if cap(mapping.sema) != 2 {
+		t.Fatalf("semaphore has %d slots, want the 2 asked for", cap(mapping.sema))
+	}
+
+	// Connections that never reach the client hold every slot
+	for range cap(mapping.sema) {
+		mapping.sema <- struct{}{}
+	}
+
+	// On loopback the reset may even beat the end of the dial
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	// A reset rather than a close, which reads as io.EOF
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection over the limit got %v, want it reset", err)
+	}
+
+	var list api.PortMappingListResponse
+	serveAPI(t, ps, http.MethodGet, "/api/v1/port-mappings", "", &list)
+	if len(list.Mappings) != 1 || list.Mappings[0].HalfOpenLimited != 1 {
+		t.Errorf("mappings %+v, want one with a half-open rejection", list.Mappings)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// defaultReservationTTL is how long an unused port reservation is kept
+const defaultReservationTTL = 5 * time.Minute
+
+// PortReservation represents a port claimed by a client before its mapping is created
+type PortReservation struct {
+	ClientIP  string
+	ExpiresAt time.Time
+}
+
+// activeReservation returns the reservation for a port if it exists and has not expired.
+// Caller must hold ps.mu.
+func (ps *ProxyServer) activeReservation(port int) (*PortReservation, bool) {
+	reservation, exists := ps.reservations[port]
+	if !exists || time.Now().After(reservation.ExpiresAt) {
+		return nil, false
+	}
+	return reservation, true
+}
+
+// removeExpiredReservations releases reservations that were not claimed by a mapping in time
+func (ps *ProxyServer) removeExpiredReservations() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := time.Now()
+	for port, reservation := range ps.reservations {
+		if now.After(reservation.ExpiresAt) {
+			delete(ps.reservations, port)
+			log.Printf("Reservation for port %d (client %s) expired", port, reservation.ClientIP)
+		}
+	}
+}
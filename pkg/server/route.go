@@ -1,10 +1,32 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/bufferpool"
+	"github.com/DevonTM/wg-rp/pkg/capture"
+	"github.com/DevonTM/wg-rp/pkg/circuitbreaker"
+	"github.com/DevonTM/wg-rp/pkg/compress"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+	"github.com/DevonTM/wg-rp/pkg/httprewrite"
+	"github.com/DevonTM/wg-rp/pkg/proxyproto"
+	"github.com/DevonTM/wg-rp/pkg/ratelimit"
+	"github.com/DevonTM/wg-rp/pkg/schedule"
+	"github.com/DevonTM/wg-rp/pkg/utils"
+
+	"golang.org/x/time/rate"
 )
 
 // ProxyMapping represents an active port mapping
@@ -15,12 +37,170 @@ type ProxyMapping struct {
 	ClientPort int
 	Listener   net.Listener
 	cancel     chan struct{}
+	Preloaded  bool              // created from the server's preload file, kept while the client is away
+	Name       string            // service name given by the client, empty if none
+	Labels     map[string]string // free-form labels given by the client, guarded by ps.mu
+	tunnelOnly bool              // listens within the WireGuard netstack instead of on the host
+	Hostname   string            // host routed to the mapping on a shared port, empty for a TCP mapping
+
+	identity    *Identity     // identity of the client that created the mapping
+	multiplexed bool          // connections go over the client's mux session when it has one
+	dialTimeout time.Duration // how long to wait for a direct dial to the client
+	expiresAt   time.Time     // when the mapping is removed, zero for never
+
+	grace       atomic.Bool // deleted, holding its port and resetting connections until graceEndsAt
+	graceEndsAt time.Time   // when the port of a deleted mapping is released
+
+	writeDeadline time.Duration // how long a write to an external connection may block, 0 for no limit
+
+	sampleRate   atomic.Uint64 // bits of the fraction of connections whose open and close are logged
+	sampledCount atomic.Int64  // connections whose open and close were logged
+
+	bufferPool   *bufferpool.BufferPool // relays the mapping's connections, the server's pool unless the client asked for a size
+	bufferSizeKB int                    // buffer size the client asked for, 0 for the server default
+
+	tlsCert   string      // name of the certificate TLS is terminated with, empty for raw TCP
+	tlsALPN   []string    // protocols offered to TLS clients
+	tlsConfig *tls.Config // wraps external connections in TLS, nil for raw TCP
+
+	compression string // algorithm the tunnel leg is compressed with, empty for none
+
+	schedule         *schedule.Schedule              // windows the mapping accepts connections in, nil for always
+	closeOffSchedule bool                            // close open connections when the schedule window closes
+	offSchedule      atomic.Bool                     // connections are rejected outside the schedule window
+	activeConns      sync.Map                        // connID -> *conntrack.CountingConn of the external connection
+	connRateLimiter  *rate.Limiter                   // limits new external connections, nil for no limit
+	rateLimited      atomic.Int64                    // connections rejected by the rate limiter
+	sema             chan struct{}                   // one slot per connection accepted but not yet connected to the client
+	maxHalfOpen      int                             // capacity of sema the client asked for, 0 for DefaultMaxHalfOpen
+	halfOpenLimited  atomic.Int64                    // connections rejected because sema was full
+	localProbe       string                          // answer connections from the server host locally, empty to relay
+	httpHostRewrite  string                          // Host header to set on the first HTTP request, empty to leave it
+	proxyProtocol    bool                            // send a PROXY protocol v2 header ahead of each connection's data
+	proxyProtoTLVs   []api.TLVEntry                  // application data added to the PROXY protocol header
+	localProbes      atomic.Int64                    // connections answered by the local probe fast path
+	breaker          *circuitbreaker.CircuitBreaker  // fails connections fast while the client can't be dialed
+	history          *connHistory                    // recently closed connections on this port
+	suspended        atomic.Bool                     // connections are rejected while the client is dead
+	mtuSuspects      atomic.Int64                    // connections that looked like MTU blackholes
+	relayErrors      conntrack.ErrorCounts           // connections that ended with an error, by class
+	capture          atomic.Pointer[capture.Capture] // active debug capture, if any
+
+	bytesIn  atomic.Uint64 // received from external peers by closed connections
+	bytesOut atomic.Uint64 // sent to external peers by closed connections
+}
+
+// portLabel names the mapping in log lines: its port with the hostname of an HTTP mapping and
+// whether it is tunnel-only, followed by its name if it has one
+func (m *ProxyMapping) portLabel() string {
+	label := strconv.Itoa(m.RemotePort)
+	if m.Hostname != "" {
+		label += " for " + m.Hostname
+	}
+	if m.tunnelOnly {
+		label += " in the tunnel"
+	}
+	if m.Name == "" {
+		return label
+	}
+	return fmt.Sprintf("%s (%s)", label, m.Name)
+}
+
+// portKey identifies a port within its namespace: a public port on the host and a tunnel-only
+// port in the WireGuard netstack are different listeners, so both may be mapped at once
+type portKey struct {
+	port       int
+	tunnelOnly bool
+}
+
+// key returns the port the mapping listens on and its namespace
+func (m *ProxyMapping) key() portKey {
+	return portKey{port: m.RemotePort, tunnelOnly: m.tunnelOnly}
+}
+
+// visibility returns where the mapping's port is exposed, api.VisibilityPublic or api.VisibilityTunnel
+func (m *ProxyMapping) visibility() string {
+	if m.tunnelOnly {
+		return api.VisibilityTunnel
+	}
+	return api.VisibilityPublic
+}
+
+// stop closes the mapping's listener and ends any capture running on it
+func (m *ProxyMapping) stop() {
+	close(m.cancel)
+	m.Listener.Close()
+	if c := m.capture.Load(); c != nil {
+		c.Stop()
+	}
+}
+
+// MTUSuspects returns how many connections on this mapping looked like MTU blackholes
+func (m *ProxyMapping) MTUSuspects() int64 {
+	return m.mtuSuspects.Load()
+}
+
+// traffic returns how many connections the mapping is relaying and the bytes received from and
+// sent to external peers, those of open connections included
+func (m *ProxyMapping) traffic() (active int, bytesIn, bytesOut uint64) {
+	bytesIn, bytesOut = m.bytesIn.Load(), m.bytesOut.Load()
+	m.activeConns.Range(func(_, conn any) bool {
+		counter := conn.(*conntrack.CountingConn)
+		active++
+		bytesIn += counter.BytesRead()
+		bytesOut += counter.BytesWritten()
+		return true
+	})
+	return active, bytesIn, bytesOut
+}
+
+// LocalProbes returns how many connections on this mapping were answered locally as health checks.
+// They are not relayed and don't appear in the connection history.
+func (m *ProxyMapping) LocalProbes() int64 {
+	return m.localProbes.Load()
+}
+
+// RateLimited returns how many connections on this mapping were rejected by its rate limiter
+func (m *ProxyMapping) RateLimited() int64 {
+	return m.rateLimited.Load()
+}
+
+// SampleRate returns the fraction of the mapping's connections whose open and close are logged
+func (m *ProxyMapping) SampleRate() float64 {
+	return math.Float64frombits(m.sampleRate.Load())
+}
+
+// setSampleRate changes the fraction of connections whose open and close are logged
+func (m *ProxyMapping) setSampleRate(rate float64) {
+	m.sampleRate.Store(math.Float64bits(rate))
+}
+
+// sample decides whether the open and close of a new connection are logged
+func (m *ProxyMapping) sample() bool {
+	rate := m.SampleRate()
+	if rate < 1 && rand.Float64() >= rate {
+		return false
+	}
+	m.sampledCount.Add(1)
+	return true
+}
+
+// HalfOpenLimited returns how many connections on this mapping were rejected because too many were
+// still being set up
+func (m *ProxyMapping) HalfOpenLimited() int64 {
+	return m.halfOpenLimited.Load()
+}
+
+// Suspended reports whether the mapping is rejecting connections because its client stopped heartbeating
+func (m *ProxyMapping) Suspended() bool {
+	return m.suspended.Load()
 }
 
 // handleMappingConnections handles incoming connections for a specific mapping
 func (ps *ProxyServer) handleMappingConnections(mapping *ProxyMapping) {
 	defer mapping.Listener.Close()
 
+	var backoff time.Duration
 	for {
 		select {
 		case <-mapping.cancel:
@@ -33,9 +213,74 @@ func (ps *ProxyServer) handleMappingConnections(mapping *ProxyMapping) {
 				case <-mapping.cancel:
 					return
 				default:
-					log.Printf("Failed to accept connection on port %d: %v", mapping.RemotePort, err)
+				}
+
+				// Out of descriptors: free the reserve and pause instead of spinning on Accept
+				if isFDExhausted(err) {
+					ps.handleFDExhaustion(err)
+					backoff = acceptBackoff(backoff)
+					select {
+					case <-mapping.cancel:
+						return
+					case <-time.After(backoff):
+					}
 					continue
 				}
+
+				log.Printf("Failed to accept connection on port %s: %v", mapping.portLabel(), err)
+				continue
+			}
+			backoff = 0
+
+			// A deleted mapping only holds its port until the grace period ends
+			if mapping.grace.Load() {
+				resetConnection(conn)
+				continue
+			}
+
+			// Keep the port but turn connections away while the client is gone or outside the schedule
+			if mapping.suspended.Load() || mapping.offSchedule.Load() {
+				conn.Close()
+				continue
+			}
+
+			// Never serve blocked ranges, whatever the mapping allows
+			if ps.rejectBlocked(conn, mapping) {
+				continue
+			}
+
+			// Answer health checks from the server host without going through the tunnel
+			if mapping.localProbe != "" && isHostLocal(conn.RemoteAddr()) {
+				mapping.localProbes.Add(1)
+				go answerLocalProbe(conn, mapping.localProbe)
+				continue
+			}
+
+			// Fail fast while the client can't be reached
+			if !mapping.breaker.Allow() {
+				conn.Close()
+				continue
+			}
+
+			// Throttle connection floods, resetting what exceeds the limit
+			if !mapping.allowConnection() {
+				if mapping.rateLimited.Add(1)%100 == 1 {
+					log.Printf("Rate limiting connections on port %s (%d rejected so far)", mapping.portLabel(), mapping.rateLimited.Load())
+				}
+				rejectConnection(conn)
+				continue
+			}
+
+			// Bound the connections still handshaking or waiting for the client, so that a flood
+			// of connections that never get anywhere can't pile up goroutines
+			select {
+			case mapping.sema <- struct{}{}:
+			default:
+				if mapping.halfOpenLimited.Add(1)%100 == 1 {
+					log.Printf("Too many half-open connections on port %s, resetting new ones (%d rejected so far)", mapping.portLabel(), mapping.halfOpenLimited.Load())
+				}
+				resetConnection(conn)
+				continue
 			}
 
 			go ps.handleProxyConnection(conn, mapping)
@@ -43,41 +288,165 @@ func (ps *ProxyServer) handleMappingConnections(mapping *ProxyMapping) {
 	}
 }
 
-// handleProxyConnection handles a single proxy connection
+// handleProxyConnection handles a single proxy connection. It holds a slot of the mapping's
+// half-open semaphore until the tunnel to the client is established.
 func (ps *ProxyServer) handleProxyConnection(clientConn net.Conn, mapping *ProxyMapping) {
 	defer clientConn.Close()
+	halfOpen := true
+	releaseHalfOpen := func() {
+		if halfOpen {
+			<-mapping.sema
+			halfOpen = false
+		}
+	}
+	defer releaseHalfOpen()
+
+	// Terminate TLS before dialing, so failed handshakes never reach the client
+	start := time.Now()
+	if mapping.tlsConfig != nil {
+		tlsConn := tls.Server(clientConn, mapping.tlsConfig)
+		ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("TLS handshake failed on port %s from %s: %v", mapping.portLabel(), clientConn.RemoteAddr(), err)
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == acmeALPNProtocol {
+			return // a CA validating the hostname, answered by the handshake itself
+		}
+		clientConn = tlsConn
+	}
 
 	// Connect to client through WireGuard tunnel
-	tunnelAddr := fmt.Sprintf("%s:%d", mapping.ClientIP, mapping.ClientPort)
-	tunnelConn, err := ps.tnet.Dial("tcp", tunnelAddr)
+	connID := ps.nextConnID.Add(1)
+	tunnelConn, err := ps.dialClient(mapping)
 	if err != nil {
-		log.Printf("Failed to connect to client at %s:%d: %v", mapping.ClientIP, mapping.ClientPort, err)
+		log.Printf("Failed to connect to client at %s for port %s: %v", net.JoinHostPort(mapping.ClientIP, strconv.Itoa(mapping.ClientPort)), mapping.portLabel(), err)
+		mapping.recordHistory(connID, clientConn, start, time.Now(), 0, 0, closeReasonDialFailed)
+		ps.recordDialFailure(mapping)
 		return
 	}
 	defer tunnelConn.Close()
+	if mapping.compression != "" {
+		compressed, err := compress.NewConn(tunnelConn, mapping.compression)
+		if err != nil {
+			log.Printf("Failed to set up %s compression on port %s: %v", mapping.compression, mapping.portLabel(), err)
+			return
+		}
+		tunnelConn = compressed
+	}
+	if mapping.proxyProtocol {
+		if err := proxyproto.WriteV2Header(tunnelConn, clientConn.RemoteAddr(), clientConn.LocalAddr(), mapping.proxyProtoTLVs); err != nil {
+			log.Printf("Failed to send the PROXY protocol header on port %s: %v", mapping.portLabel(), err)
+			return
+		}
+	}
+	if mapping.breaker.RecordSuccess() {
+		log.Printf("Circuit closed for port %s, client %s is reachable again", mapping.portLabel(), mapping.ClientIP)
+	}
+	releaseHalfOpen()
+
+	// Share the client's bandwidth quota among all its connections, counting writes both ways. The
+	// limiter is attached even without a quota, so that one set later applies to this connection;
+	// until then writes pass it without locking.
+	limiter := ps.clientQuota(mapping.ClientIP).limiter
+	clientConn = ratelimit.NewRateLimitedConn(clientConn, limiter)
+	tunnelConn = ratelimit.NewRateLimitedConn(tunnelConn, limiter)
+
+	// Log only a sample of connections if the client asked for it; they are all counted regardless
+	sampled := mapping.sample()
+	if sampled {
+		log.Printf("Established proxy connection on port %s: %s -> %s -> %s:%d -> %s", mapping.portLabel(),
+			clientConn.RemoteAddr(), clientConn.LocalAddr(), mapping.ClientIP, mapping.ClientPort, mapping.LocalAddr)
+	}
+
+	ps.totalConnections.Add(1)
+	countingConn := conntrack.NewCountingConn(clientConn)
+	countingConn.SetWriteTimeout(mapping.writeDeadline)
+	mapping.activeConns.Store(connID, countingConn)
+	defer mapping.activeConns.Delete(connID)
+	defer ps.trackConnection(&liveConnection{
+		id:          connID,
+		remoteAddr:  clientConn.RemoteAddr(),
+		tunnelAddr:  tunnelConn.LocalAddr(),
+		mappingPort: mapping.RemotePort,
+		startTime:   start,
+		counter:     countingConn,
+	})()
+
+	// Bidirectional copy, observing writes to detect MTU blackholes
+	var obs relayObservation
+	largeWrite := mtuPayloadSize(ps.tunnelMTU)
+
+	var intoTunnel, outOfTunnel io.Writer = tunnelConn, countingConn
+	var fromExternal io.Reader = countingConn
+	if mapping.httpHostRewrite != "" {
+		fromExternal = httprewrite.NewReader(countingConn, mapping.httpHostRewrite)
+	}
+	if c := mapping.capture.Load(); c != nil {
+		intoTunnel = &captureWriter{w: intoTunnel, capture: c, connID: connID, dir: capture.IntoTunnel}
+		outOfTunnel = &captureWriter{w: outOfTunnel, capture: c, connID: connID, dir: capture.OutOfTunnel}
+	}
 
-	log.Printf("Established proxy connection: %s -> %s -> %s:%d -> %s",
-		clientConn.RemoteAddr(), clientConn.LocalAddr(), mapping.ClientIP, mapping.ClientPort, mapping.LocalAddr)
+	// Copy both ways, passing a half-close on to the other side
+	result := mapping.bufferPool.RelayWith(clientConn, tunnelConn,
+		bufferpool.Direction{
+			Dst: &statsWriter{w: intoTunnel, stats: &obs.intoTunnel, largeWrite: largeWrite},
+			Src: fromExternal,
+		},
+		bufferpool.Direction{
+			Dst: &statsWriter{w: outOfTunnel, stats: &obs.outOfTunnel, largeWrite: largeWrite},
+		})
+	obs.closedAt = time.Now()
+	ps.metrics.observeConnection(mapping.RemotePort, obs.closedAt.Sub(start))
 
-	// Bidirectional copy
-	var wg sync.WaitGroup
-	wg.Add(2)
+	closeReason := closeReasonClosed
+	logSuffix := ""
+	if err := result.Err(); err != nil {
+		class := conntrack.ClassifyError(err)
+		mapping.relayErrors.Add(class)
+		ps.metrics.observeRelayError(mapping.RemotePort, class)
+		logSuffix = fmt.Sprintf(" (%s: %v)", class, err)
+	}
+	if obs.possibleMTUBlackhole(mtuBlackholeMinStall) {
+		closeReason = closeReasonMTUBlackhole
+		logSuffix += " (possible MTU blackhole)"
+		ps.recordMTUSuspect(mapping)
+	}
+
+	mapping.recordHistory(connID, clientConn, start, obs.closedAt,
+		countingConn.BytesRead(), countingConn.BytesWritten(), closeReason)
+	ps.totalBytesIn.Add(countingConn.BytesRead())
+	ps.totalBytesOut.Add(countingConn.BytesWritten())
+	mapping.bytesIn.Add(countingConn.BytesRead())
+	mapping.bytesOut.Add(countingConn.BytesWritten())
 
-	go func() {
-		defer wg.Done()
-		ps.bufferPool.CopyWithBuffer(tunnelConn, clientConn)
-		tunnelConn.Close()
-	}()
+	if sampled {
+		log.Printf("Proxy connection closed on port %s: %s -> %s -> %s:%d -> %s (in: %s, out: %s, duration: %s)%s",
+			mapping.portLabel(), clientConn.RemoteAddr(), clientConn.LocalAddr(), mapping.ClientIP, mapping.ClientPort, mapping.LocalAddr,
+			utils.FormatBytes(countingConn.BytesRead()), utils.FormatBytes(countingConn.BytesWritten()),
+			utils.FormatDuration(obs.closedAt.Sub(start)), logSuffix)
+	}
+}
 
-	go func() {
-		defer wg.Done()
-		ps.bufferPool.CopyWithBuffer(clientConn, tunnelConn)
-		clientConn.Close()
-	}()
+// recordHistory adds a closed connection to the mapping's connection history
+func (m *ProxyMapping) recordHistory(connID uint64, conn net.Conn, start, end time.Time, bytesIn, bytesOut uint64, reason string) {
+	if m.history == nil {
+		return
+	}
 
-	wg.Wait()
-	log.Printf("Proxy connection closed: %s -> %s -> %s:%d -> %s",
-		clientConn.RemoteAddr(), clientConn.LocalAddr(), mapping.ClientIP, mapping.ClientPort, mapping.LocalAddr)
+	m.history.add(api.ConnectionRecord{
+		ID:             connID,
+		RemotePort:     m.RemotePort,
+		Peer:           conn.RemoteAddr().String(),
+		StartTime:      start.UnixMilli(),
+		EndTime:        end.UnixMilli(),
+		DurationMillis: end.Sub(start).Milliseconds(),
+		BytesIn:        bytesIn,
+		BytesOut:       bytesOut,
+		CloseReason:    reason,
+	})
 }
 
 // removeClientMappings removes all port mappings for a specific client
@@ -86,18 +455,36 @@ func (ps *ProxyServer) removeClientMappings(clientIP string) {
 	if !exists {
 		return
 	}
+	ps.deadClientsEvicted.Add(1)
 
-	// Close all mappings for this client
-	for port := range client.Mappings {
-		if mapping, exists := ps.mappings[port]; exists {
-			close(mapping.cancel)
-			mapping.Listener.Close()
-			delete(ps.mappings, port)
-			log.Printf("Removed stale port mapping for port %d (client %s)", port, clientIP)
+	// Close all mappings for this client, except preloaded ones that stay for its return
+	for key := range client.Mappings {
+		if mapping, exists := ps.mappings[key]; exists {
+			if mapping.Preloaded {
+				continue
+			}
+			mapping.stop()
+			delete(ps.mappings, key)
+			log.Printf("Removed stale port mapping for port %s (client %s)", mapping.portLabel(), clientIP)
+			ps.audit(AuditExpire, mapping)
+		}
+	}
+	for _, mapping := range ps.hostMappings(clientIP) {
+		if mapping.Preloaded {
+			continue
 		}
+		ps.removeHostMapping(mapping)
+		log.Printf("Removed stale port mapping for port %s (client %s)", mapping.portLabel(), clientIP)
+		ps.audit(AuditExpire, mapping)
 	}
 
+	ps.saveStore()
+	ps.pruneQuota(clientIP)
+
 	// Remove client from tracking
 	delete(ps.clients, clientIP)
 	log.Printf("Removed dead client %s and all its mappings", clientIP)
+
+	// If the client is still listening, it should register its mappings again
+	ps.events.publish(clientIP, api.EventReRegister, 0)
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// runSchedule pauses and resumes a mapping as its schedule windows close and open, until the
+// mapping is stopped
+func (ps *ProxyServer) runSchedule(mapping *ProxyMapping) {
+	first := true
+	for {
+		now := time.Now()
+		ps.applySchedule(mapping, mapping.schedule.Active(now), first)
+		first = false
+
+		next := mapping.schedule.NextTransition(now)
+		if next.IsZero() {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-mapping.cancel:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// applySchedule moves a mapping into or out of its schedule window, logging and notifying the
+// owning client on every change
+func (ps *ProxyServer) applySchedule(mapping *ProxyMapping, active bool, initial bool) {
+	wasOff := mapping.offSchedule.Swap(!active)
+	if !initial && wasOff == !active {
+		return
+	}
+
+	if active {
+		log.Printf("Port %s is inside its schedule window (%s), accepting connections", mapping.portLabel(), mapping.schedule)
+		if !initial {
+			ps.events.publishMapping(api.EventMappingResumed, mapping)
+		}
+		return
+	}
+
+	log.Printf("Port %s is outside its schedule window (%s), rejecting connections", mapping.portLabel(), mapping.schedule)
+	if !initial {
+		ps.events.publishMapping(api.EventMappingPaused, mapping)
+	}
+
+	if mapping.closeOffSchedule {
+		closed := 0
+		mapping.activeConns.Range(func(_, conn any) bool {
+			conn.(net.Conn).Close()
+			closed++
+			return true
+		})
+		if closed > 0 {
+			log.Printf("Closed %d open connections on port %s outside its schedule window", closed, mapping.portLabel())
+		}
+	}
+}
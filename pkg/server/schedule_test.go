@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+	"github.com/DevonTM/wg-rp/pkg/schedule"
+)
+
+// newScheduledMapping returns a mapping of client 10.0.0.2 with the given schedule
+func newScheduledMapping(t *testing.T, spec string) *ProxyMapping {
+	t.Helper()
+	s, err := schedule.Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ProxyMapping{RemotePort: 8080, ClientIP: "10.0.0.2", schedule: s, cancel: make(chan struct{})}
+}
+
+// nextEvent returns the next event queued on ch, or fails if there is none
+func nextEvent(t *testing.T, ch chan api.Event) api.Event {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	default:
+		t.Fatal("no event was published")
+		return api.Event{}
+	}
+}
+
+func TestApplySchedule(t *testing.T) {
+	ps := NewProxyServer(nil, 1024)
+	mapping := newScheduledMapping(t, "09:00-17:00 UTC")
+	events := ps.events.subscribe(mapping.ClientIP)
+
+	// The initial state is applied without telling the client, which registered it just now
+	ps.applySchedule(mapping, false, true)
+	if !mapping.offSchedule.Load() {
+		t.Fatal("mapping accepts connections outside its window")
+	}
+	if len(events) != 0 {
+		t.Fatalf("initial state published %d events, want none", len(events))
+	}
+
+	ps.applySchedule(mapping, true, false)
+	if mapping.offSchedule.Load() {
+		t.Fatal("mapping rejects connections inside its window")
+	}
+	if ev := nextEvent(t, events); ev.Type != api.EventMappingResumed || ev.Port != 8080 {
+		t.Errorf("event = %s on port %d, want %s on 8080", ev.Type, ev.Port, api.EventMappingResumed)
+	}
+
+	// Applying the same state again is not a transition
+	ps.applySchedule(mapping, true, false)
+	if len(events) != 0 {
+		t.Fatalf("repeated state published %d events, want none", len(events))
+	}
+
+	ps.applySchedule(mapping, false, false)
+	if ev := nextEvent(t, events); ev.Type != api.EventMappingPaused {
+		t.Errorf("event = %s, want %s", ev.Type, api.EventMappingPaused)
+	}
+}
+
+func TestApplyScheduleClosesConnections(t *testing.T) {
+	for _, closeOffSchedule := range []bool{false, true} {
+		ps := NewProxyServer(nil, 1024)
+		mapping := newScheduledMapping(t, "09:00-17:00 UTC")
+		mapping.closeOffSchedule = closeOffSchedule
+
+		server, client := net.Pipe()
+		defer client.Close()
+		mapping.activeConns.Store(uint64(1), conntrack.NewCountingConn(server))
+
+		ps.applySchedule(mapping, true, true)
+		ps.applySchedule(mapping, false, false)
+
+		// Reading from the other end of the pipe fails once the connection is closed
+		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := client.Read(make([]byte, 1))
+		closed := err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+		if closed != closeOffSchedule {
+			t.Errorf("closeOffSchedule=%v: connection closed = %v (%v)", closeOffSchedule, closed, err)
+		}
+		server.Close()
+	}
+}
+
+func TestRunScheduleStopsWithMapping(t *testing.T) {
+	ps := NewProxyServer(nil, 1024)
+
+	// Whatever the time, the window is either open or closed for at least the next minutes
+	mapping := newScheduledMapping(t, "Mon 00:00-00:01 UTC")
+
+	done := make(chan struct{})
+	go func() {
+		ps.runSchedule(mapping)
+		close(done)
+	}()
+
+	close(mapping.cancel)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runSchedule did not return after the mapping was stopped")
+	}
+	if got, want := !mapping.offSchedule.Load(), mapping.schedule.Active(time.Now()); got != want {
+		t.Errorf("mapping accepts connections = %v, want %v", got, want)
+	}
+}
+
+func TestRunScheduleReturnsForAlwaysOpen(t *testing.T) {
+	ps := NewProxyServer(nil, 1024)
+	mapping := newScheduledMapping(t, "00:00-24:00 UTC")
+
+	done := make(chan struct{})
+	go func() {
+		ps.runSchedule(mapping)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runSchedule waits for a transition that never comes")
+	}
+	if mapping.offSchedule.Load() {
+		t.Error("mapping with an always-open window rejects connections")
+	}
+}
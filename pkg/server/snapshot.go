@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// Snapshot is a point-in-time view of the server's mappings and clients
+type Snapshot struct {
+	Time     time.Time
+	Mappings []MappingSnapshot
+	Clients  []ClientSnapshot
+	Peers    []api.PeerStats // WireGuard peers of the device, nil if unknown
+}
+
+// MappingSnapshot describes a port mapping in a Snapshot
+type MappingSnapshot struct {
+	RemotePort        int
+	ClientIP          string
+	ClientPort        int
+	LocalAddr         string
+	ListenAddr        string // host address external connections arrive on
+	ActiveConnections int
+	Suspended         bool
+	Preloaded         bool
+}
+
+// ClientSnapshot describes a connected client in a Snapshot
+type ClientSnapshot struct {
+	ClientIP     string
+	Version      string
+	HeartbeatAge time.Duration // time since the last heartbeat
+	Mappings     int
+	Suspended    bool
+}
+
+// Snapshot returns the current mappings with their open connections and the clients with the
+// age of their last heartbeat, sorted by port and client address, and the WireGuard peers
+func (ps *ProxyServer) Snapshot() Snapshot {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	now := time.Now()
+	snapshot := Snapshot{
+		Time:     now,
+		Mappings: make([]MappingSnapshot, 0, len(ps.mappings)),
+		Clients:  make([]ClientSnapshot, 0, len(ps.clients)),
+	}
+
+	for _, mapping := range append(ps.hostMappings(""), ps.tcpMappings()...) {
+		active := 0
+		mapping.activeConns.Range(func(_, _ any) bool {
+			active++
+			return true
+		})
+		snapshot.Mappings = append(snapshot.Mappings, MappingSnapshot{
+			RemotePort:        mapping.RemotePort,
+			ClientIP:          mapping.ClientIP,
+			ClientPort:        mapping.ClientPort,
+			LocalAddr:         mapping.LocalAddr,
+			ListenAddr:        mapping.Listener.Addr().String(),
+			ActiveConnections: active,
+			Suspended:         mapping.Suspended(),
+			Preloaded:         mapping.Preloaded,
+		})
+	}
+
+	for clientIP, client := range ps.clients {
+		snapshot.Clients = append(snapshot.Clients, ClientSnapshot{
+			ClientIP:     clientIP,
+			Version:      client.Version,
+			HeartbeatAge: now.Sub(client.LastHeartbeat),
+			Mappings:     len(ps.clientMappings(clientIP)),
+			Suspended:    client.Suspended,
+		})
+	}
+
+	sort.Slice(snapshot.Mappings, func(i, j int) bool {
+		return snapshot.Mappings[i].RemotePort < snapshot.Mappings[j].RemotePort
+	})
+	sort.Slice(snapshot.Clients, func(i, j int) bool {
+		return snapshot.Clients[i].ClientIP < snapshot.Clients[j].ClientIP
+	})
+	if ps.peerStats != nil {
+		snapshot.Peers = ps.peerStats()
+	}
+	return snapshot
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+	"github.com/DevonTM/wg-rp/pkg/conntrack"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLS record, handshake and extension values needed to read the server name of a ClientHello
+const (
+	tlsRecordHandshake       = 0x16
+	tlsRecordAlert           = 0x15
+	tlsRecordHeaderLen       = 5
+	tlsHandshakeClientHello  = 0x01
+	tlsHandshakeHeaderLen    = 4
+	tlsExtServerName         = 0x0000
+	tlsExtECH                = 0xfe0d // Encrypted Client Hello
+	tlsExtESNI               = 0xffce // draft Encrypted SNI, superseded by ECH
+	tlsNameTypeHostName      = 0x00
+	tlsAlertFatal            = 0x02
+	tlsAlertUnrecognizedName = 0x70
+)
+
+// errMalformedHello is returned for a ClientHello that can't be parsed
+var errMalformedHello = errors.New("malformed TLS ClientHello")
+
+// routeTLSConnection reads the server name of a TLS connection from its ClientHello, without
+// terminating TLS, and hands the connection with the ClientHello still unread to the mapping of
+// that name. Connections without a server name go to the port's default mapping, if a client
+// registered one. So do connections using Encrypted Client Hello whose public server name matches
+// no mapping, since their real server name can't be read. Other unknown server names are refused
+// with an unrecognized_name alert.
+func (ps *ProxyServer) routeTLSConnection(router *httpRouter, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(httpRouteTimeout))
+	reader := bufio.NewReaderSize(conn, maxRoutedHeaderBytes)
+	serverName, encrypted, err := readServerName(reader)
+	if err != nil {
+		log.Printf("Rejected connection from %s on shared SNI port %d: %v", conn.RemoteAddr(), router.port, err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ps.mu.RLock()
+	var mapping *ProxyMapping
+	if serverName != "" {
+		mapping = router.lookup(normalizeHostname(serverName))
+	}
+	if mapping == nil && (serverName == "" || encrypted) {
+		mapping = router.hosts[api.SNIDefaultHost]
+	}
+	ps.mu.RUnlock()
+
+	if mapping == nil {
+		writeTLSAlert(conn, tlsAlertUnrecognizedName)
+		conn.Close()
+		return
+	}
+	mapping.Listener.(*hostListener).deliver(conntrack.NewBufferedConn(conn, reader))
+}
+
+// readServerName peeks at the ClientHello that starts a TLS connection, which may span several
+// records, and returns its server name, empty if it has none, and whether it uses Encrypted
+// Client Hello
+func readServerName(reader *bufio.Reader) (string, bool, error) {
+	var hello []byte
+	helloLen := -1
+	offset := 0
+	for helloLen < 0 || len(hello) < helloLen {
+		header, err := peekN(reader, offset+tlsRecordHeaderLen)
+		if err != nil {
+			return "", false, err
+		}
+		record := header[offset:]
+		if record[0] != tlsRecordHandshake {
+			return "", false, fmt.Errorf("connection does not start with a TLS handshake")
+		}
+		length := int(record[3])<<8 | int(record[4])
+
+		payloadStart := offset + tlsRecordHeaderLen
+		data, err := peekN(reader, payloadStart+length)
+		if err != nil {
+			return "", false, err
+		}
+		hello = append(hello, data[payloadStart:]...)
+		offset = payloadStart + length
+
+		if helloLen < 0 && len(hello) >= tlsHandshakeHeaderLen {
+			if hello[0] != tlsHandshakeClientHello {
+				return "", false, fmt.Errorf("TLS handshake does not start with a ClientHello")
+			}
+			helloLen = tlsHandshakeHeaderLen + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+		}
+	}
+	return parseClientHello(hello[tlsHandshakeHeaderLen:helloLen])
+}
+
+// parseClientHello returns the server name of a ClientHello body and whether it carries an
+// Encrypted Client Hello (or draft ESNI) extension
+func parseClientHello(body []byte) (string, bool, error) {
+	s := cryptobyte.String(body)
+	var sessionID, cipherSuites, compression cryptobyte.String
+	if !s.Skip(2+32) || // legacy version and random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return "", false, errMalformedHello
+	}
+	if s.Empty() {
+		return "", false, nil // no extensions, so no server name
+	}
+
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return "", false, errMalformedHello
+	}
+	var serverName string
+	var encrypted bool
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return "", false, errMalformedHello
+		}
+		switch extType {
+		case tlsExtECH, tlsExtESNI:
+			encrypted = true
+		case tlsExtServerName:
+			var names cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&names) {
+				return "", false, errMalformedHello
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					return "", false, errMalformedHello
+				}
+				if nameType == tlsNameTypeHostName {
+					serverName = string(name)
+				}
+			}
+		}
+	}
+	return serverName, encrypted, nil
+}
+
+// writeTLSAlert answers a ClientHello with a fatal alert, as a TLS server refusing it would
+func writeTLSAlert(conn net.Conn, description byte) {
+	conn.SetWriteDeadline(time.Now().Add(httpRouteTimeout))
+	conn.Write([]byte{tlsRecordAlert, 0x03, 0x03, 0x00, 0x02, tlsAlertFatal, description})
+}
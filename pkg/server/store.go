@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// storeFile is the persistent store of a server's port mappings
+type storeFile struct {
+	SavedAt  int64                    `json:"saved_at"` // Unix time the mappings were saved, which their TTLs count from
+	Mappings []api.PortMappingRequest `json:"mappings"`
+}
+
+// saveStore writes the active port mappings to the store, if there is one and they changed since
+// they were last written. Callers must hold ps.mu.
+func (ps *ProxyServer) saveStore() {
+	if ps.storePath == "" {
+		return
+	}
+
+	ps.storeMu.Lock()
+	defer ps.storeMu.Unlock()
+
+	// TTLs counted from the startup time don't change as time passes, so only a change to the
+	// mappings causes a write
+	mappings, err := json.Marshal(mappingRequests(ps.allMappings(), ps.startupTime))
+	if err != nil {
+		log.Printf("Failed to save port mappings to %s: %v", ps.storePath, err)
+		return
+	}
+	if bytes.Equal(mappings, ps.storeSaved) {
+		return
+	}
+
+	now := time.Now()
+	data, err := json.MarshalIndent(storeFile{SavedAt: now.Unix(), Mappings: mappingRequests(ps.allMappings(), now)}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(ps.storePath, append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("Failed to save port mappings to %s: %v", ps.storePath, err)
+		return
+	}
+	ps.storeSaved = mappings
+}
+
+// writeFileAtomic replaces the file at path with data, so a crash leaves either the old or the
+// new file and never a partial one
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadStore returns the port mappings saved in the store at path. TTLs are reduced by the time
+// since the mappings were saved, and mappings whose TTL ran out since are left out. A store that
+// doesn't exist yet holds no mappings.
+func ReadStore(path string) ([]api.PortMappingRequest, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var store storeFile
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	elapsed := time.Since(time.Unix(store.SavedAt, 0)).Seconds()
+	requests := make([]api.PortMappingRequest, 0, len(store.Mappings))
+	for _, req := range store.Mappings {
+		if req.TTLSeconds > 0 {
+			left := float64(req.TTLSeconds) - max(elapsed, 0)
+			if left <= 0 {
+				continue
+			}
+			req.TTLSeconds = int(math.Ceil(left))
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+// RestoreStore recreates the port mappings saved in the store, exactly as if their clients had
+// registered them again. Their clients have the client timeout to come back before the mappings
+// are handled like those of any dead client. A mapping that can't be restored, e.g. because its
+// port is now taken, is logged and skipped.
+func (ps *ProxyServer) RestoreStore() error {
+	requests, err := ReadStore(ps.storePath)
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	for _, req := range requests {
+		if err := ps.loadMapping(req, false); err != nil {
+			log.Printf("Failed to restore port mapping for port %d from %s: %v", req.RemotePort, ps.storePath, err)
+			continue
+		}
+		restored++
+	}
+
+	log.Printf("Restored %d of %d port mappings from %s", restored, len(requests), ps.storePath)
+	ps.mu.RLock()
+	ps.saveStore()
+	ps.mu.RUnlock()
+	return nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/api"
+)
+
+// writeStore writes a store saved at savedAt holding mappings
+func writeStore(t *testing.T, path string, savedAt time.Time, mappings ...api.PortMappingRequest) {
+	t.Helper()
+	data, err := json.Marshal(storeFile{SavedAt: savedAt.Unix(), Mappings: mappings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedPorts returns the remote ports of the mappings in the store at path
+func storedPorts(t *testing.T, path string) []int {
+	t.Helper()
+	requests, err := ReadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ports []int
+	for _, req := range requests {
+		ports = append(ports, req.RemotePort)
+	}
+	return ports
+}
+
+func testMapping(port int) api.PortMappingRequest {
+	return api.PortMappingRequest{LocalAddr: fmt.Sprintf("127.0.0.1:%d", port), RemotePort: port, ClientIP: "10.0.0.2", ClientPort: 40000}
+}
+
+func TestStoreRestoresMappings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	ports := freePorts(t, 2)
+	slices.Sort(ports)
+
+	ps := NewProxyServer(nil, 1024, WithStore(path))
+	for _, port := range ports {
+		if err := ps.loadMapping(testMapping(port), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := storedPorts(t, path); len(got) != 2 || got[0] != ports[0] || got[1] != ports[1] {
+		t.Fatalf("store holds ports %v, want %v", got, ports)
+	}
+
+	// A deleted mapping leaves the store with it
+	ps.mu.Lock()
+	ps.removeMapping(ps.mappings[portKey{port: ports[1]}])
+	ps.saveStore()
+	ps.mu.Unlock()
+	stopMappings(ps)
+	if got := storedPorts(t, path); len(got) != 1 || got[0] != ports[0] {
+		t.Fatalf("store holds ports %v after a delete, want [%d]", got, ports[0])
+	}
+
+	// A restarted server maps the stored ports again for the same client
+	ps = NewProxyServer(nil, 1024, WithStore(path))
+	t.Cleanup(func() { stopMappings(ps) })
+	if err := ps.RestoreStore(); err != nil {
+		t.Fatal(err)
+	}
+	ps.mu.RLock()
+	mapping, exists := ps.mappings[portKey{port: ports[0]}]
+	ps.mu.RUnlock()
+	if !exists || mapping.ClientIP != "10.0.0.2" || mapping.Preloaded {
+		t.Errorf("restored mapping exists: %v, want port %d of 10.0.0.2, not preloaded", exists, ports[0])
+	}
+}
+
+func TestStoreWritesOnlyChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	ps := NewProxyServer(nil, 1024, WithStore(path))
+	t.Cleanup(func() { stopMappings(ps) })
+
+	req := testMapping(freePorts(t, 1)[0])
+	req.TTLSeconds = 3600
+	if err := ps.loadMapping(req, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving again without a change, e.g. on a health check tick, leaves the file alone
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	ps.mu.RLock()
+	ps.saveStore()
+	ps.mu.RUnlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Error("store was rewritten although its mappings didn't change")
+	}
+}
+
+func TestReadStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	// A store that doesn't exist yet holds no mappings
+	if requests, err := ReadStore(path); err != nil || len(requests) != 0 {
+		t.Fatalf("ReadStore() of a missing store = %v, %v, want no mappings", requests, err)
+	}
+
+	// TTLs count down while the server is down, and mappings whose TTL ran out are dropped
+	permanent, short, long := testMapping(8080), testMapping(8081), testMapping(8082)
+	short.TTLSeconds = 60
+	long.TTLSeconds = 3600
+	writeStore(t, path, time.Now().Add(-10*time.Minute), permanent, short, long)
+
+	requests, err := ReadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[0].RemotePort != 8080 || requests[1].RemotePort != 8082 {
+		t.Fatalf("ReadStore() = %+v, want ports 8080 and 8082", requests)
+	}
+	if requests[0].TTLSeconds != 0 {
+		t.Errorf("permanent mapping got a TTL of %ds", requests[0].TTLSeconds)
+	}
+	if ttl := requests[1].TTLSeconds; ttl < 2999 || ttl > 3000 {
+		t.Errorf("TTL = %ds, want about 3000s left", ttl)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadStore(path); err == nil {
+		t.Error("ReadStore() accepted a corrupt store")
+	}
+}
+
+func TestExportStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	writeStore(t, path, time.Now(), testMapping(8080), testMapping(8081))
+
+	data, err := ExportStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The export is a plain list of requests, as -preload-mappings reads it
+	var requests []api.PortMappingRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		t.Fatalf("export is not in the -preload-mappings format: %v", err)
+	}
+	if !reflect.DeepEqual(requests, []api.PortMappingRequest{testMapping(8080), testMapping(8081)}) {
+		t.Errorf("export = %+v, want both stored mappings", requests)
+	}
+}
+
+func TestStoreAndExportKeepHostMappings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	ports := freePorts(t, 2)
+	slices.Sort(ports)
+	tcp := testMapping(ports[0])
+	host := testMapping(ports[1])
+	host.Mode = api.ModeHTTP
+	host.Hostname = "app.example.com"
+	host.Visibility = api.VisibilityPublic
+
+	ps := NewProxyServer(nil, 1024, WithStore(path))
+	for _, req := range []api.PortMappingRequest{tcp, host} {
+		if err := ps.loadMapping(req, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The store and the export both hold the mapping routed by hostname, with its mode
+	stored, err := ReadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported []api.PortMappingRequest
+	serveAPI(t, ps, http.MethodPost, "/api/v1/port-mappings/export", "", &exported)
+	stopMappings(ps)
+	for name, requests := range map[string][]api.PortMappingRequest{"store": stored, "export": exported} {
+		if len(requests) != 2 || requests[1].Mode != api.ModeHTTP || requests[1].Hostname != "app.example.com" {
+			t.Fatalf("%s = %+v, want the TCP mapping and the HTTP mapping of app.example.com", name, requests)
+		}
+	}
+
+	// A restarted server restores it from the store, and another one preloads it from the export
+	restored := NewProxyServer(nil, 1024, WithStore(path))
+	t.Cleanup(func() { stopMappings(restored) })
+	if err := restored.RestoreStore(); err != nil {
+		t.Fatal(err)
+	}
+	restored.mu.RLock()
+	mapping, exists := restored.hostMapping(portKey{port: ports[1]}, "app.example.com")
+	restored.mu.RUnlock()
+	if !exists || mapping.mode() != api.ModeHTTP || mapping.ClientIP != "10.0.0.2" {
+		t.Fatalf("restored host mapping exists: %v, want the HTTP mapping of 10.0.0.2", exists)
+	}
+	stopMappings(restored)
+
+	preloaded := NewProxyServer(nil, 1024)
+	t.Cleanup(func() { stopMappings(preloaded) })
+	if err := preloaded.PreloadMappings(writePreload(t, exported...)); err != nil {
+		t.Fatal(err)
+	}
+	preloaded.mu.RLock()
+	mapping, exists = preloaded.hostMapping(portKey{port: ports[1]}, "app.example.com")
+	preloaded.mu.RUnlock()
+	if !exists || !mapping.Preloaded {
+		t.Errorf("preloaded host mapping exists: %v, want a preloaded HTTP mapping", exists)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long an external connection to a mapping with TLS termination
+// may take to complete its handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsALPNProtocols are the application protocols a mapping may offer to TLS clients
+var tlsALPNProtocols = []string{"h2", "http/1.1"}
+
+// acmeALPNProtocol is negotiated by ACME CAs validating a hostname with the tls-alpn-01 challenge
+const acmeALPNProtocol = "acme-tls/1"
+
+// CertIssuer obtains certificates on demand for the hostnames of SNI mappings that terminate TLS
+// with api.TLSCertACME, such as from an ACME CA. Mappings register their hostname with Allow
+// while they exist and unregister it with Forget.
+type CertIssuer interface {
+	Allow(hostname string)
+	Forget(hostname string)
+	Err(hostname string) error // why the last attempt to obtain the certificate failed, nil if it didn't
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// CertStore holds the certificates the operator made available for TLS termination, by name.
+// Clients select a certificate by its name and never send keys over the API. Reload re-reads
+// the files, and mappings pick up the new certificates with their next handshake.
+type CertStore struct {
+	mu    sync.RWMutex
+	files map[string][2]string // name -> certificate and key file
+	certs map[string]*tls.Certificate
+}
+
+// NewCertStore creates an empty certificate store
+func NewCertStore() *CertStore {
+	return &CertStore{
+		files: make(map[string][2]string),
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+// Add loads a certificate and its key from PEM files and makes them available under name
+func (s *CertStore) Add(name, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %v", name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = [2]string{certFile, keyFile}
+	s.certs[name] = &cert
+	return nil
+}
+
+// Reload re-reads the files of all certificates. A certificate that fails to load keeps its
+// previous version, so a bad file never takes a mapping down.
+func (s *CertStore) Reload() error {
+	s.mu.RLock()
+	files := make(map[string][2]string, len(s.files))
+	for name, f := range s.files {
+		files[name] = f
+	}
+	s.mu.RUnlock()
+
+	var errs []error
+	for name, f := range files {
+		cert, err := tls.LoadX509KeyPair(f[0], f[1])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload certificate %s, keeping the previous one: %v", name, err))
+			continue
+		}
+		s.mu.Lock()
+		s.certs[name] = &cert
+		s.mu.Unlock()
+	}
+	log.Printf("Reloaded %d of %d TLS certificates", len(files)-len(errs), len(files))
+	return errors.Join(errs...)
+}
+
+// Names returns the names of the certificates in the store, sorted
+func (s *CertStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.certs))
+	for name := range s.certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// has reports whether the store holds a certificate called name
+func (s *CertStore) has(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.certs[name]
+	return exists
+}
+
+// get returns the current certificate called name
+func (s *CertStore) get(name string) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert, exists := s.certs[name]
+	if !exists {
+		return nil, fmt.Errorf("no certificate %s", name)
+	}
+	return cert, nil
+}
+
+// tlsConfig returns the TLS configuration of a mapping terminating TLS with the certificate
+// called name. The certificate is looked up at each handshake so that reloads apply to open
+// listeners, and alpn lists the protocols the backend speaks, offered to clients in that order.
+func (s *CertStore) tlsConfig(name string, alpn []string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: slices.Clone(alpn),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.get(name)
+		},
+	}
+}
+
+// issuerTLSConfig returns the TLS configuration of a mapping terminating TLS with certificates
+// from issuer. Handshakes of CAs validating the hostname negotiate only the challenge protocol, so
+// that alpn needn't offer it to other clients.
+func issuerTLSConfig(issuer CertIssuer, alpn []string) *tls.Config {
+	challenge := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{acmeALPNProtocol},
+		GetCertificate: issuer.GetCertificate,
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     slices.Clone(alpn),
+		GetCertificate: issuer.GetCertificate,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if slices.Contains(hello.SupportedProtos, acmeALPNProtocol) {
+				return challenge, nil
+			}
+			return nil, nil
+		},
+	}
+}
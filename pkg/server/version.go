@@ -0,0 +1,26 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/DevonTM/wg-rp/pkg/utils"
+)
+
+// checkClientVersion returns an error if the client version is older than the configured minimum.
+// Clients that don't report a version are treated as "0.0.0".
+func (ps *ProxyServer) checkClientVersion(version string) error {
+	if ps.minClientVersion == "" {
+		return nil
+	}
+
+	if utils.CompareVersions(version, ps.minClientVersion) < 0 {
+		reported := version
+		if reported == "" {
+			reported = "unknown"
+		}
+		return fmt.Errorf("client version %s is older than the minimum supported version %s, please upgrade the client",
+			reported, ps.minClientVersion)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"context"
+	"log"
+)
+
+// notifyWebhook posts event for a mapping to the webhook, if one is configured. It doesn't
+// block; failures are logged and not retried.
+func (ps *ProxyServer) notifyWebhook(event string, mapping *ProxyMapping) {
+	if ps.webhook == nil {
+		return
+	}
+
+	port, clientIP := mapping.RemotePort, mapping.ClientIP
+	go func() {
+		if err := ps.webhook.Send(context.Background(), event, port, clientIP); err != nil {
+			log.Printf("Failed to notify webhook of %s for port %d: %v", event, port, err)
+		}
+	}()
+}
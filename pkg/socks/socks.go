@@ -0,0 +1,192 @@
+// Package socks implements the server side of the SOCKS5 handshake (RFC 1928) with optional
+// username/password authentication (RFC 1929). Only CONNECT is supported.
+package socks
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+)
+
+const version5 = 0x05
+
+// Authentication methods
+const (
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// cmdConnect is the CONNECT command; BIND (0x02) and UDP ASSOCIATE (0x03) are not supported
+const cmdConnect = 0x01
+
+// Address types
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes of a request
+const (
+	ReplySucceeded               byte = 0x00
+	ReplyGeneralFailure          byte = 0x01
+	ReplyNotAllowed              byte = 0x02 // Connection not allowed by ruleset
+	ReplyNetworkUnreachable      byte = 0x03
+	ReplyHostUnreachable         byte = 0x04
+	ReplyConnectionRefused       byte = 0x05
+	ReplyTTLExpired              byte = 0x06
+	ReplyCommandNotSupported     byte = 0x07
+	ReplyAddressTypeNotSupported byte = 0x08
+)
+
+// userPassVersion is the version of the username/password subnegotiation
+const userPassVersion = 0x01
+
+// ErrAuthFailed is returned by Handshake when a client's credentials don't match
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Credentials are the username and password clients must authenticate with
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Handshake negotiates authentication with a client and reads its request, returning the target
+// as host:port. When creds is nil clients need not authenticate. Requests other than CONNECT and
+// failed authentication are answered before an error is returned; after a successful Handshake
+// the caller connects to the target and answers with Reply.
+func Handshake(conn net.Conn, creds *Credentials) (string, error) {
+	// Greeting: version, number of methods, methods
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != version5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(methodNoAuth)
+	if creds != nil {
+		method = methodUserPass
+	}
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{version5, methodNoAcceptable})
+		return "", fmt.Errorf("client offers no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{version5, method}); err != nil {
+		return "", err
+	}
+	if creds != nil {
+		if err := authenticate(conn, creds); err != nil {
+			return "", err
+		}
+	}
+
+	// Request: version, command, reserved, address
+	var request [3]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", err
+	}
+	if request[0] != version5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	target, err := readAddr(conn)
+	if err != nil {
+		return "", err
+	}
+
+	// BIND and UDP ASSOCIATE are not supported
+	if request[1] != cmdConnect {
+		Reply(conn, ReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+	return target, nil
+}
+
+// authenticate runs the username/password subnegotiation
+func authenticate(conn net.Conn, creds *Credentials) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != userPassVersion {
+		return fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	var passwordLen [1]byte
+	if _, err := io.ReadFull(conn, passwordLen[:]); err != nil {
+		return err
+	}
+	password := make([]byte, passwordLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	userOK := subtle.ConstantTimeCompare(username, []byte(creds.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(password, []byte(creds.Password)) == 1
+	if !userOK || !passOK {
+		conn.Write([]byte{userPassVersion, 0x01})
+		return ErrAuthFailed
+	}
+	_, err := conn.Write([]byte{userPassVersion, 0x00})
+	return err
+}
+
+// readAddr reads the address type, address and port of a request
+func readAddr(conn net.Conn) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(conn, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		Reply(conn, ReplyAddressTypeNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// Reply answers a client's request with code. The bound address is always reported as
+// 0.0.0.0:0, since the connection to the target is made elsewhere.
+func Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{version5, code, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,164 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// connectRequest is a request header for CONNECT, followed by its address
+var connectRequest = []byte{version5, cmdConnect, 0x00}
+
+// userPass is a username/password subnegotiation message
+func userPass(username, password string) []byte {
+	msg := append([]byte{userPassVersion, byte(len(username))}, username...)
+	return append(append(msg, byte(len(password))), password...)
+}
+
+// runClient plays the client side of a handshake over conn, offering methods, authenticating with
+// auth if the server picks username/password and then sending request. It returns everything the
+// server answered.
+func runClient(conn net.Conn, methods, auth, request []byte) <-chan []byte {
+	answers := make(chan []byte, 1)
+	go func() {
+		var got []byte
+		defer func() { answers <- got }()
+
+		conn.Write(append([]byte{version5, byte(len(methods))}, methods...))
+		var choice [2]byte
+		if _, err := io.ReadFull(conn, choice[:]); err != nil {
+			return
+		}
+		got = append(got, choice[:]...)
+		switch choice[1] {
+		case methodNoAcceptable:
+			return
+		case methodUserPass:
+			conn.Write(auth)
+			var status [2]byte
+			if _, err := io.ReadFull(conn, status[:]); err != nil {
+				return
+			}
+			got = append(got, status[:]...)
+			if status[1] != 0x00 {
+				return
+			}
+		}
+
+		conn.Write(request)
+		rest, _ := io.ReadAll(conn)
+		got = append(got, rest...)
+	}()
+	return answers
+}
+
+func TestHandshake(t *testing.T) {
+	creds := &Credentials{Username: "user", Password: "secret"}
+	commandNotSupported := []byte{version5, ReplyCommandNotSupported, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}
+
+	tests := []struct {
+		name    string
+		creds   *Credentials
+		methods []byte
+		auth    []byte
+		request []byte
+		target  string
+		err     string // part of the error, empty if the handshake succeeds
+		answers []byte
+	}{
+		{
+			name:    "IPv4 target",
+			methods: []byte{methodNoAuth},
+			request: append(connectRequest, atypIPv4, 10, 0, 0, 5, 0x1f, 0x90),
+			target:  "10.0.0.5:8080",
+			answers: []byte{version5, methodNoAuth},
+		},
+		{
+			name:    "domain target",
+			methods: []byte{methodNoAuth},
+			request: append(append(connectRequest, atypDomain, 11), append([]byte("example.com"), 0x01, 0xbb)...),
+			target:  "example.com:443",
+			answers: []byte{version5, methodNoAuth},
+		},
+		{
+			name:    "IPv6 target",
+			methods: []byte{methodNoAuth},
+			request: append(append(connectRequest, atypIPv6), append(net.ParseIP("fd00::5"), 0x00, 0x50)...),
+			target:  "[fd00::5]:80",
+			answers: []byte{version5, methodNoAuth},
+		},
+		{
+			name:    "authenticated",
+			creds:   creds,
+			methods: []byte{methodNoAuth, methodUserPass},
+			auth:    userPass("user", "secret"),
+			request: append(connectRequest, atypIPv4, 10, 0, 0, 5, 0x00, 0x50),
+			target:  "10.0.0.5:80",
+			answers: []byte{version5, methodUserPass, userPassVersion, 0x00},
+		},
+		{
+			name:    "wrong password",
+			creds:   creds,
+			methods: []byte{methodUserPass},
+			auth:    userPass("user", "wrong"),
+			err:     ErrAuthFailed.Error(),
+			answers: []byte{version5, methodUserPass, userPassVersion, 0x01},
+		},
+		{
+			name:    "no authentication offered",
+			creds:   creds,
+			methods: []byte{methodNoAuth},
+			err:     "no acceptable authentication method",
+			answers: []byte{version5, methodNoAcceptable},
+		},
+		{
+			name:    "UDP ASSOCIATE",
+			methods: []byte{methodNoAuth},
+			request: []byte{version5, 0x03, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0},
+			err:     "unsupported SOCKS command 3",
+			answers: append([]byte{version5, methodNoAuth}, commandNotSupported...),
+		},
+		{
+			name:    "BIND",
+			methods: []byte{methodNoAuth},
+			request: []byte{version5, 0x02, 0x00, atypIPv4, 10, 0, 0, 5, 0x00, 0x50},
+			err:     "unsupported SOCKS command 2",
+			answers: append([]byte{version5, methodNoAuth}, commandNotSupported...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			answers := runClient(client, tt.methods, tt.auth, tt.request)
+
+			target, err := Handshake(server, tt.creds)
+			server.Close()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error = %v, want %q", err, tt.err)
+			}
+			if target != tt.target {
+				t.Errorf("target = %q, want %q", target, tt.target)
+			}
+			if got := <-answers; !bytes.Equal(got, tt.answers) {
+				t.Errorf("server answered %v, want %v", got, tt.answers)
+			}
+		})
+	}
+
+	// Failed authentication is told apart from other errors
+	server, client := net.Pipe()
+	defer client.Close()
+	runClient(client, []byte{methodUserPass}, userPass("other", "secret"), nil)
+	if _, err := Handshake(server, creds); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("error = %v, want ErrAuthFailed", err)
+	}
+	server.Close()
+}
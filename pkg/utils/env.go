@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvFallback describes how a flag is read from the environment
+type EnvFallback struct {
+	Var    string // environment variable, empty to never read the flag from the environment
+	Secret bool   // don't report the value
+	List   bool   // split the value on commas as well as newlines into repeated flag values
+}
+
+// ApplyEnv sets every flag of fs that wasn't given on the command line from the environment, so
+// that a flag takes precedence over its variable, and the variable over the flag's default.
+// Flags without an entry in fallbacks are read from prefix followed by the flag name in upper case
+// with dashes as underscores. Repeatable flags take one value per line. ApplyEnv returns a
+// description of each setting taken from the environment, with secrets redacted.
+func ApplyEnv(fs *flag.FlagSet, prefix string, fallbacks map[string]EnvFallback) ([]string, error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var applied []string
+	var firstErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || firstErr != nil {
+			return
+		}
+
+		fallback, ok := fallbacks[f.Name]
+		if !ok {
+			fallback.Var = prefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		}
+		if fallback.Var == "" {
+			return
+		}
+
+		value, set := os.LookupEnv(fallback.Var)
+		if !set {
+			return
+		}
+
+		values := []string{value}
+		if _, repeatable := f.Value.(*ArrayFlags); repeatable {
+			values = splitEnvList(value, fallback.List)
+		}
+		for _, v := range values {
+			if err := fs.Set(f.Name, v); err != nil {
+				firstErr = fmt.Errorf("invalid value %q for %s: %v", v, fallback.Var, err)
+				return
+			}
+		}
+
+		if fallback.Secret {
+			applied = append(applied, fmt.Sprintf("-%s from %s (value hidden)", f.Name, fallback.Var))
+		} else {
+			applied = append(applied, fmt.Sprintf("-%s=%s from %s", f.Name, strings.Join(values, ","), fallback.Var))
+		}
+	})
+
+	return applied, firstErr
+}
+
+// splitEnvList splits a list from the environment on newlines, and on commas if commas is set,
+// dropping empty entries
+func splitEnvList(value string, commas bool) []string {
+	separators := "\n"
+	if commas {
+		separators = ",\n"
+	}
+
+	var values []string
+	for _, v := range strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(separators, r) }) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
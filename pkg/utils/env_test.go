@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFlags are the flags of a small command reading its settings from the environment
+type testFlags struct {
+	fs      *flag.FlagSet
+	config  *string
+	port    *int
+	verbose *bool
+	token   *string
+	routes  ArrayFlags
+	hosts   ArrayFlags
+}
+
+func newTestFlags() *testFlags {
+	f := &testFlags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.config = f.fs.String("c", "wg0.conf", "")
+	f.port = f.fs.Int("api-port", 8080, "")
+	f.verbose = f.fs.Bool("v", false, "")
+	f.token = f.fs.String("auth-token", "", "")
+	f.fs.Var(&f.routes, "r", "")
+	f.fs.Var(&f.hosts, "host", "")
+	return f
+}
+
+var testFallbacks = map[string]EnvFallback{
+	"c":          {Var: "TEST_CONFIG"},
+	"v":          {},
+	"auth-token": {Var: "TEST_AUTH_TOKEN", Secret: true},
+	"r":          {Var: "TEST_ROUTES", List: true},
+}
+
+func TestApplyEnvPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		config string
+		port   int
+	}{
+		{"default", nil, nil, "wg0.conf", 8080},
+		{"environment", nil, map[string]string{"TEST_CONFIG": "env.conf", "TEST_API_PORT": "9090"}, "env.conf", 9090},
+		{"flag", []string{"-c", "flag.conf", "-api-port", "7070"}, nil, "flag.conf", 7070},
+		{"flag over environment", []string{"-c", "flag.conf"}, map[string]string{"TEST_CONFIG": "env.conf", "TEST_API_PORT": "9090"}, "flag.conf", 9090},
+		{"flag equal to the default", []string{"-api-port", "8080"}, map[string]string{"TEST_API_PORT": "9090"}, "wg0.conf", 8080},
+		{"empty variable", nil, map[string]string{"TEST_CONFIG": ""}, "", 8080},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			f := newTestFlags()
+			if err := f.fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ApplyEnv(f.fs, "TEST_", testFallbacks); err != nil {
+				t.Fatal(err)
+			}
+			if *f.config != tt.config || *f.port != tt.port {
+				t.Errorf("config %q port %d, want %q %d", *f.config, *f.port, tt.config, tt.port)
+			}
+		})
+	}
+}
+
+func TestApplyEnvNames(t *testing.T) {
+	// The derived name of a flag with an explicit variable and of an excluded flag are ignored
+	t.Setenv("TEST_C", "derived.conf")
+	t.Setenv("TEST_V", "true")
+	t.Setenv("TEST_AUTH_TOKEN", "s3cret")
+
+	f := newTestFlags()
+	applied, err := ApplyEnv(f.fs, "TEST_", testFallbacks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f.config != "wg0.conf" || *f.verbose {
+		t.Errorf("config %q verbose %v, want neither read from derived names", *f.config, *f.verbose)
+	}
+	if *f.token != "s3cret" {
+		t.Errorf("token = %q, want it read from TEST_AUTH_TOKEN", *f.token)
+	}
+
+	// Secrets are reported without their value
+	want := []string{"-auth-token from TEST_AUTH_TOKEN (value hidden)"}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied = %q, want %q", applied, want)
+	}
+	for _, setting := range applied {
+		if strings.Contains(setting, "s3cret") {
+			t.Errorf("secret leaked in %q", setting)
+		}
+	}
+}
+
+func TestApplyEnvLists(t *testing.T) {
+	tests := []struct {
+		name       string
+		routes     string
+		hosts      string
+		wantRoutes ArrayFlags
+		wantHosts  ArrayFlags
+	}{
+		{"single", "127.0.0.1:80-8080", "a.example", ArrayFlags{"127.0.0.1:80-8080"}, ArrayFlags{"a.example"}},
+		{"commas", "127.0.0.1:80-8080,127.0.0.1:443-8443", "a.example,b.example", ArrayFlags{"127.0.0.1:80-8080", "127.0.0.1:443-8443"}, ArrayFlags{"a.example,b.example"}},
+		{"newlines", "127.0.0.1:80-8080\n127.0.0.1:443-8443\n", "a.example\nb.example", ArrayFlags{"127.0.0.1:80-8080", "127.0.0.1:443-8443"}, ArrayFlags{"a.example", "b.example"}},
+		{"mixed with blanks", " 127.0.0.1:80-8080 ,\n\n, 127.0.0.1:443-8443", "\n", ArrayFlags{"127.0.0.1:80-8080", "127.0.0.1:443-8443"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_ROUTES", tt.routes)
+			t.Setenv("TEST_HOST", tt.hosts)
+			f := newTestFlags()
+			if _, err := ApplyEnv(f.fs, "TEST_", testFallbacks); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.routes, tt.wantRoutes) {
+				t.Errorf("routes = %q, want %q", f.routes, tt.wantRoutes)
+			}
+			// Only lists marked as such are split on commas
+			if !reflect.DeepEqual(f.hosts, tt.wantHosts) {
+				t.Errorf("hosts = %q, want %q", f.hosts, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestApplyEnvListFlagsReplaceEnvironment(t *testing.T) {
+	t.Setenv("TEST_ROUTES", "127.0.0.1:80-8080,127.0.0.1:443-8443")
+	f := newTestFlags()
+	if err := f.fs.Parse([]string{"-r", "127.0.0.1:22-2222"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyEnv(f.fs, "TEST_", testFallbacks); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ArrayFlags{"127.0.0.1:22-2222"}); !reflect.DeepEqual(f.routes, want) {
+		t.Errorf("routes = %q, want only the flag's %q", f.routes, want)
+	}
+}
+
+func TestApplyEnvInvalidValue(t *testing.T) {
+	t.Setenv("TEST_API_PORT", "eighty")
+	f := newTestFlags()
+	_, err := ApplyEnv(f.fs, "TEST_", testFallbacks)
+	if err == nil || !strings.Contains(err.Error(), "TEST_API_PORT") {
+		t.Errorf("err = %v, want an error naming TEST_API_PORT", err)
+	}
+}
@@ -53,3 +53,19 @@ func FormatDateTimeFromUnix(ts int64) string {
 	t := time.Unix(ts, 0)
 	return FormatDateTime(t)
 }
+
+// FormatBytes formats a byte count in a human-readable way using binary units
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// hostnameLabelRe matches a single DNS label; underscores are allowed for names from /etc/hosts
+var hostnameLabelRe = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?$`)
+
+// ValidateHost checks that host, taken from a host:port address with any brackets removed, is an
+// IP address or a hostname. IPv6 addresses may carry a zone, e.g. "fe80::1%eth0".
+func ValidateHost(host string) error {
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return fmt.Errorf("invalid IPv6 address %q", host)
+		}
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+
+	// Only digits and dots is a mistyped IPv4 address rather than a hostname
+	if strings.Trim(host, "0123456789.") == "" {
+		return fmt.Errorf("invalid IPv4 address %q", host)
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("invalid hostname %q: longer than 253 characters", host)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) > 63 || !hostnameLabelRe.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q: use labels of letters, digits and '-'", host)
+		}
+	}
+	return nil
+}
+
+// routedLabelRe matches a label of a hostname routed by HTTP mappings, which is kept in lower case
+var routedLabelRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidateRoutedHostname checks the hostname of an HTTP mapping: a lower-case DNS name, or a
+// wildcard like "*.dev.example.com" covering the subdomains of one
+func ValidateRoutedHostname(hostname string) error {
+	name := strings.TrimPrefix(hostname, "*.")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid hostname %q: must be 1 to 253 characters", hostname)
+	}
+	for label := range strings.SplitSeq(name, ".") {
+		if !routedLabelRe.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q: use lower-case labels of letters, digits and '-', optionally after a leading \"*.\"", hostname)
+		}
+	}
+	return nil
+}
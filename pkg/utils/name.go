@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"unicode"
+)
+
+// MaxMappingNameLength is the longest name a port mapping may have
+const MaxMappingNameLength = 63
+
+// mappingNameRe allows letters, digits, dots, dashes and underscores, starting with a letter or digit
+var mappingNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidateMappingName checks that a port mapping name is short and safe to show in logs and URLs
+func ValidateMappingName(name string) error {
+	if len(name) > MaxMappingNameLength {
+		return fmt.Errorf("invalid name %q: longer than %d characters", name, MaxMappingNameLength)
+	}
+	if !mappingNameRe.MatchString(name) {
+		return fmt.Errorf("invalid name %q: use letters, digits, '.', '-' and '_', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// Limits of the labels of a port mapping
+const (
+	MaxMappingLabels           = 16
+	MaxMappingLabelValueLength = 255
+)
+
+// ValidateMappingLabels checks that a port mapping has few labels, keyed like names, with short
+// printable values
+func ValidateMappingLabels(labels map[string]string) error {
+	if len(labels) > MaxMappingLabels {
+		return fmt.Errorf("invalid labels: more than %d", MaxMappingLabels)
+	}
+	for key, value := range labels {
+		if err := ValidateMappingName(key); err != nil {
+			return fmt.Errorf("invalid label: %v", err)
+		}
+		if len(value) > MaxMappingLabelValueLength {
+			return fmt.Errorf("invalid label %s: value longer than %d characters", key, MaxMappingLabelValueLength)
+		}
+		for _, r := range value {
+			if !unicode.IsPrint(r) {
+				return fmt.Errorf("invalid label %s: value has unprintable characters", key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMappingLabels(t *testing.T) {
+	many := make(map[string]string)
+	for i := range MaxMappingLabels + 1 {
+		many[string(rune('a'+i))] = "x"
+	}
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"valid", map[string]string{"team": "web", "tier.name": "front end", "owner_id": ""}, ""},
+		{"too many", many, "more than"},
+		{"key with a space", map[string]string{"team name": "web"}, "invalid label"},
+		{"empty key", map[string]string{"": "web"}, "invalid label"},
+		{"long value", map[string]string{"team": strings.Repeat("x", MaxMappingLabelValueLength+1)}, "longer than"},
+		{"control character", map[string]string{"team": "web\x00"}, "unprintable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMappingLabels(tt.labels)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("ValidateMappingLabels(%v) = %v, want nil", tt.labels, err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("ValidateMappingLabels(%v) = %v, want an error containing %q", tt.labels, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version represents a parsed semantic version
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease string
+}
+
+// ParseVersion parses a semantic version string such as "1.2.3", "v1.2.3" or "1.2.3-rc.1".
+// An empty version is treated as "0.0.0" so old peers that don't report a version can be compared.
+func ParseVersion(s string) (Version, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if s == "" {
+		return Version{}, nil
+	}
+
+	// Drop build metadata, it doesn't affect precedence
+	s, _, _ = strings.Cut(s, "+")
+
+	core, preRelease, _ := strings.Cut(s, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q: too many components", s)
+	}
+
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q: bad component %q", s, part)
+		}
+		nums[i] = n
+	}
+
+	return Version{
+		Major:      nums[0],
+		Minor:      nums[1],
+		Patch:      nums[2],
+		PreRelease: preRelease,
+	}, nil
+}
+
+// Compare returns -1, 0 or 1 depending on whether v is lower than, equal to or higher than other
+func (v Version) Compare(other Version) int {
+	for _, d := range [][2]int{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		if d[0] != d[1] {
+			if d[0] < d[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A pre-release version has lower precedence than the release itself
+	switch {
+	case v.PreRelease == other.PreRelease:
+		return 0
+	case v.PreRelease == "":
+		return 1
+	case other.PreRelease == "":
+		return -1
+	default:
+		return comparePreRelease(v.PreRelease, other.PreRelease)
+	}
+}
+
+// comparePreRelease compares dot-separated pre-release identifiers per semver precedence rules
+func comparePreRelease(a, b string) int {
+	aIDs := strings.Split(a, ".")
+	bIDs := strings.Split(b, ".")
+
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		aNum, aErr := strconv.Atoi(aIDs[i])
+		bNum, bErr := strconv.Atoi(bIDs[i])
+
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum != bNum {
+				if aNum < bNum {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			// Numeric identifiers have lower precedence than alphanumeric ones
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(aIDs[i], bIDs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	switch {
+	case len(aIDs) < len(bIDs):
+		return -1
+	case len(aIDs) > len(bIDs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (v Version) String() string {
+	if v.PreRelease != "" {
+		return fmt.Sprintf("%d.%d.%d-%s", v.Major, v.Minor, v.Patch, v.PreRelease)
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// CompareVersions compares two version strings, treating unparseable versions as "0.0.0"
+func CompareVersions(a, b string) int {
+	va, _ := ParseVersion(a)
+	vb, _ := ParseVersion(b)
+	return va.Compare(vb)
+}
@@ -0,0 +1,93 @@
+// Package webhook posts JSON notifications about port mapping changes to an HTTP endpoint
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	wgrp "github.com/DevonTM/wg-rp"
+)
+
+// Timeout is how long a single notification may take, including reading the response
+const Timeout = 5 * time.Second
+
+// Webhook events
+const (
+	EventCreated    = "created"     // a client created a port mapping
+	EventDeleted    = "deleted"     // a port mapping was deleted through the API
+	EventExpired    = "expired"     // a port mapping was removed because its TTL ran out
+	EventClientDied = "client_died" // the client of a port mapping stopped heartbeating
+)
+
+// Payload is the JSON body of a notification
+type Payload struct {
+	Event     string `json:"event"`
+	Port      int    `json:"port"`
+	ClientIP  string `json:"client_ip"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Notifier posts payloads to a single webhook URL
+type Notifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewNotifier creates a notifier for url, which must be an http or https URL
+func NewNotifier(url string) (*Notifier, error) {
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL %q: %v", url, err)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook URL %q: scheme must be http or https", url)
+	}
+
+	return &Notifier{
+		url:    url,
+		client: &http.Client{Timeout: Timeout},
+	}, nil
+}
+
+// URL returns the URL notifications are posted to
+func (n *Notifier) URL() string {
+	return n.url
+}
+
+// Send posts a notification for event and waits for the response. A response status outside
+// 2xx is an error. Failed notifications are not retried.
+func (n *Notifier) Send(ctx context.Context, event string, port int, clientIP string) error {
+	body, err := json.Marshal(Payload{
+		Event:     event,
+		Port:      port,
+		ClientIP:  clientIP,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wg-rp/"+wgrp.VERSION)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
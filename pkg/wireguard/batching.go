@@ -0,0 +1,147 @@
+package wireguard
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// MaxBatchSize is the most packets wireguard-go's bind moves per system call, on Linux; it sizes
+// the bind's message buffers, so a batch size can only lower it
+const MaxBatchSize = conn.IdealBatchSize
+
+// WithBatchSize caps the packets WireGuard sends and hands on per batch at size, between 1 and
+// MaxBatchSize; by default the bind's own size is used. The bind still reads as many as the kernel
+// has queued, and GSO and GRO stay as the platform supports them.
+func WithBatchSize(size int) DeviceOption {
+	return func(w *WireGuardDevice) {
+		w.batchSize = size
+	}
+}
+
+// batchBind is a bind moving at most size packets per batch
+type batchBind struct {
+	conn.Bind
+	size int
+}
+
+func (b *batchBind) BatchSize() int {
+	return min(b.size, b.Bind.BatchSize())
+}
+
+// Open opens the bind and splits what its receive functions return into batches of the smaller
+// size. A bind must be offered its own batch size to receive into, since with GRO one read can
+// return that many packets.
+func (b *batchBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil || b.size >= b.Bind.BatchSize() {
+		return fns, actualPort, err
+	}
+	for i, fn := range fns {
+		fns[i] = newBatchReceiver(fn, b.Bind.BatchSize()).receive
+	}
+	return fns, actualPort, nil
+}
+
+// batchReceiver receives full batches from a bind and hands them out in smaller ones. Each receive
+// function is only called by one goroutine at a time, so it needs no lock.
+type batchReceiver struct {
+	recv  conn.ReceiveFunc
+	bufs  [][]byte
+	sizes []int
+	eps   []conn.Endpoint
+	next  int // first packet of bufs not handed out yet
+	n     int // packets in bufs
+}
+
+func newBatchReceiver(recv conn.ReceiveFunc, batchSize int) *batchReceiver {
+	r := &batchReceiver{
+		recv:  recv,
+		bufs:  make([][]byte, batchSize),
+		sizes: make([]int, batchSize),
+		eps:   make([]conn.Endpoint, batchSize),
+	}
+	for i := range r.bufs {
+		r.bufs[i] = make([]byte, device.MaxMessageSize)
+	}
+	return r
+}
+
+func (r *batchReceiver) receive(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	if r.next == r.n {
+		n, err := r.recv(r.bufs, r.sizes, r.eps)
+		if err != nil {
+			return 0, err
+		}
+		r.next, r.n = 0, n
+	}
+	count := 0
+	for ; count < len(bufs) && r.next < r.n; count++ {
+		sizes[count] = copy(bufs[count], r.bufs[r.next][:r.sizes[r.next]])
+		eps[count] = r.eps[r.next]
+		r.next++
+	}
+	return count, nil
+}
+
+// describeBatching reports how many packets the bind moves per system call and whether its UDP
+// sockets offload segmentation (GSO) and receive coalescing (GRO) to the kernel. wireguard-go
+// chooses both when the bind is opened, from what the platform and kernel support, and turns
+// GSO off by itself if the kernel rejects it later.
+func describeBatching(bind conn.Bind) string {
+	batch := "one packet per system call"
+	if size := bind.BatchSize(); size > 1 {
+		batch = fmt.Sprintf("up to %d packets per system call", size)
+	}
+
+	if b, ok := bind.(*batchBind); ok {
+		bind = b.Bind
+	}
+	offloads, ok := udpOffloads(bind)
+	if !ok {
+		return batch
+	}
+	if len(offloads) == 0 {
+		return batch + ", no UDP offload"
+	}
+	return batch + ", " + strings.Join(offloads, ", ")
+}
+
+// udpOffloads lists the offloads a StdNetBind found for its sockets. Its fields aren't exported,
+// so they are read by name; ok is false for other binds or if the fields are gone.
+func udpOffloads(bind conn.Bind) (offloads []string, ok bool) {
+	v := reflect.ValueOf(bind)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	v = v.Elem()
+
+	mu := v.FieldByName("mu")
+	if !mu.IsValid() || mu.Type() != reflect.TypeFor[sync.Mutex]() {
+		return nil, false
+	}
+	lock := (*sync.Mutex)(unsafe.Pointer(mu.UnsafeAddr()))
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, f := range []struct{ field, name string }{
+		{"ipv4TxOffload", "GSO on IPv4"},
+		{"ipv4RxOffload", "GRO on IPv4"},
+		{"ipv6TxOffload", "GSO on IPv6"},
+		{"ipv6RxOffload", "GRO on IPv6"},
+	} {
+		field := v.FieldByName(f.field)
+		if !field.IsValid() || field.Kind() != reflect.Bool {
+			return nil, false
+		}
+		if field.Bool() {
+			offloads = append(offloads, f.name)
+		}
+	}
+	return offloads, true
+}
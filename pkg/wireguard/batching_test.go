@@ -0,0 +1,64 @@
+package wireguard
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// fakeReceive returns the batches of packets in order, filling as many of bufs as each has
+func fakeReceive(batches ...[]string) conn.ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		if len(batches) == 0 {
+			return 0, errors.New("closed")
+		}
+		batch := batches[0]
+		batches = batches[1:]
+		for i, packet := range batch {
+			sizes[i] = copy(bufs[i], packet)
+			eps[i] = &conn.StdNetEndpoint{}
+		}
+		return len(batch), nil
+	}
+}
+
+func TestBatchReceiver(t *testing.T) {
+	r := newBatchReceiver(fakeReceive([]string{"a", "bb", "", "dddd"}, []string{"e"}), 4)
+
+	// Each receive hands on at most two packets, finishing a batch before reading the next
+	bufs := [][]byte{make([]byte, 16), make([]byte, 16)}
+	sizes := make([]int, 2)
+	eps := make([]conn.Endpoint, 2)
+	var got [][]string
+	for {
+		n, err := r.receive(bufs, sizes, eps)
+		if err != nil {
+			break
+		}
+		var batch []string
+		for i := range n {
+			if eps[i] == nil {
+				t.Errorf("packet %q has no endpoint", bufs[i][:sizes[i]])
+			}
+			batch = append(batch, string(bufs[i][:sizes[i]]))
+		}
+		got = append(got, batch)
+	}
+
+	want := [][]string{{"a", "bb"}, {"", "dddd"}, {"e"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+func TestBatchBindSize(t *testing.T) {
+	bind := conn.NewDefaultBind()
+	for _, size := range []int{1, 16, MaxBatchSize, MaxBatchSize + 1} {
+		b := &batchBind{Bind: bind, size: size}
+		if got, want := b.BatchSize(), min(size, bind.BatchSize()); got != want {
+			t.Errorf("BatchSize() with size %d = %d, want %d", size, got, want)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package wireguard
 
 import (
 	"log"
+	"net"
 	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/DevonTM/wg-rp/pkg/config"
 
@@ -16,24 +19,89 @@ type WireGuardDevice struct {
 	Device *device.Device
 	Tnet   *netstack.Net
 	Config *config.WireGuardConfig
+
+	name        string        // what %i stands for in hook commands
+	runHooks    bool          // run the config's PreUp, PostUp, PreDown and PostDown commands
+	hookTimeout time.Duration // how long each hook command may run
+	tcpTuning   *TCPTuning    // TCP buffers of the netstack, nil for gVisor's defaults
+	batchSize   int           // packets per batch of the bind, 0 for its own size
+
+	mtu       int    // MTU replacing the config's, 0 to keep it
+	probeMTU  bool   // probe the path to a peer for the MTU before creating the netstack
+	probePeer string // tunnel address probed, empty for the first host route of the peers
 }
 
-// NewWireGuardDevice creates and configures a new WireGuard device
-func NewWireGuardDevice(configData string, verbose bool) (*WireGuardDevice, error) {
+// NewWireGuardDevice creates and configures a new WireGuard device. The PreUp hooks of the config
+// run before the device is created and the PostUp hooks once it is up, if hooks are allowed; a
+// failing hook aborts the startup.
+func NewWireGuardDevice(configData string, verbose bool, opts ...DeviceOption) (*WireGuardDevice, error) {
+	w := &WireGuardDevice{name: "wg-rp", hookTimeout: DefaultHookTimeout}
+	for _, opt := range opts {
+		opt(w)
+	}
+
 	// Parse WireGuard config
 	wgConfig, err := config.ParseWireGuardConfig(configData)
 	if err != nil {
 		return nil, err
 	}
+	w.Config = wgConfig
+	w.warnSkippedHooks()
+
+	if err := w.hook("PreUp", wgConfig.PreUp); err != nil {
+		return nil, err
+	}
+
+	if w.mtu > 0 {
+		if wgConfig.MTU > 0 && wgConfig.MTU != w.mtu {
+			log.Printf("MTU %d set by option, replacing %d from the config", w.mtu, wgConfig.MTU)
+		}
+		wgConfig.MTU = w.mtu
+	}
+
+	// Without an MTU in the config, derive it from the interface the first peer is reached through
+	if wgConfig.MTU == 0 {
+		var mtu int
+		if len(wgConfig.Endpoints) > 0 {
+			mtu = DetectMTU(wgConfig.Endpoints[0])
+		}
+		if mtu > 0 {
+			log.Printf("MTU not set, detected %d from the interface towards %s", mtu, wgConfig.Endpoints[0])
+		} else {
+			mtu = config.DefaultMTU
+			log.Printf("MTU not set and not detectable, using %d", mtu)
+		}
+		wgConfig.MTU = mtu
+	}
+
+	// Replace the MTU with the largest packet that actually reaches the peer
+	if w.probeMTU {
+		mtu, err := w.probePathMTU(wgConfig)
+		if err != nil {
+			log.Printf("WARNING: MTU probe failed, keeping %d: %v", wgConfig.MTU, err)
+		} else {
+			log.Printf("Probed path MTU %d, replacing %d", mtu, wgConfig.MTU)
+			wgConfig.MTU = mtu
+		}
+	}
 
 	// Create netstack device with the interface IP and MTU
 	tun, tnet, err := netstack.CreateNetTUN(wgConfig.InterfaceIPs, []netip.Addr{}, wgConfig.MTU)
 	if err != nil {
 		return nil, err
 	}
+	if w.tcpTuning != nil {
+		if err := applyTCPTuning(tnet, *w.tcpTuning); err != nil {
+			tun.Close()
+			return nil, err
+		}
+	}
 
 	// Create WireGuard device
-	bind := conn.NewDefaultBind()
+	var bind conn.Bind = conn.NewDefaultBind()
+	if w.batchSize > 0 {
+		bind = &batchBind{Bind: bind, size: w.batchSize}
+	}
 
 	// Set log level based on verbose flag
 	logLevel := device.LogLevelError
@@ -56,17 +124,116 @@ func NewWireGuardDevice(configData string, verbose bool) (*WireGuardDevice, erro
 	}
 
 	log.Printf("WireGuard device initialized with IPs: %v", wgConfig.InterfaceIPs)
+	log.Printf("WireGuard UDP I/O: %s", describeBatching(bind))
+
+	w.Device = dev
+	w.Tnet = tnet
+	if err := w.hook("PostUp", wgConfig.PostUp); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// WireGuard encapsulation overhead per packet: outer IP header, UDP header and the 32 bytes of
+// WireGuard's header and authentication tag
+const (
+	overheadIPv4 = 60
+	overheadIPv6 = 80
+)
+
+// MTU bounds of a detected MTU; 1280 is the minimum IPv6 allows
+const (
+	minDetectedMTU = 1280
+	maxDetectedMTU = 9000
+)
 
-	return &WireGuardDevice{
-		Device: dev,
-		Tnet:   tnet,
-		Config: wgConfig,
-	}, nil
+// DetectMTU returns the MTU for a WireGuard device whose packets go to endpoint (ip:port): the MTU
+// of the local interface the OS routes them through, less the encapsulation overhead, clamped to
+// 1280-9000. It returns 0 if the interface can't be determined.
+func DetectMTU(endpoint string) int {
+	addr, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return 0
+	}
+
+	// Connecting a UDP socket sends nothing but has the OS pick the route and source address
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return 0
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	iface := interfaceWithIP(localIP)
+	if iface == nil || iface.MTU <= 0 {
+		return 0
+	}
+
+	overhead := overheadIPv4
+	if !addr.Addr().Unmap().Is4() {
+		overhead = overheadIPv6
+	}
+	return min(max(iface.MTU-overhead, minDetectedMTU), maxDetectedMTU)
 }
 
-// Close shuts down the WireGuard device
+// interfaceWithIP returns the local interface that has ip, or nil
+func interfaceWithIP(ip net.IP) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return &ifaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+// PeerForAddr returns the public key (hex) of the peer whose allowed IPs contain addr, or an
+// empty string if no peer routes it
+func (w *WireGuardDevice) PeerForAddr(addr netip.Addr) string {
+	ipc, err := w.Device.IpcGet()
+	if err != nil {
+		return ""
+	}
+
+	var peer string
+	for line := range strings.SplitSeq(ipc, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "public_key":
+			peer = value
+		case "allowed_ip":
+			if prefix, err := netip.ParsePrefix(value); err == nil && prefix.Contains(addr) {
+				return peer
+			}
+		}
+	}
+	return ""
+}
+
+// Close shuts down the WireGuard device, running the PreDown hooks before and the PostDown hooks
+// after if hooks are allowed. Failing hooks are logged and don't stop the shutdown.
 func (w *WireGuardDevice) Close() {
+	if err := w.hook("PreDown", w.Config.PreDown); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
 	if w.Device != nil {
 		w.Device.Close()
 	}
+	if err := w.hook("PostDown", w.Config.PostDown); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
 }
@@ -0,0 +1,8 @@
+package wireguard
+
+// NetstackStack exposes netstackStack to the external tests, which wgtest's import of this
+// package keeps out of it
+var NetstackStack = netstackStack
+
+// FirstPeerHost exposes firstPeerHost to the external tests
+var FirstPeerHost = firstPeerHost
@@ -0,0 +1,73 @@
+package wireguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout is how long each PreUp, PostUp, PreDown or PostDown command may run
+const DefaultHookTimeout = 30 * time.Second
+
+// DeviceOption configures optional WireGuardDevice settings
+type DeviceOption func(*WireGuardDevice)
+
+// WithName sets the name %i stands for in hook commands, like the interface name of wg-quick
+func WithName(name string) DeviceOption {
+	return func(w *WireGuardDevice) {
+		w.name = name
+	}
+}
+
+// WithHooks runs the PreUp, PostUp, PreDown and PostDown commands of the config, each with the
+// given timeout (0 for DefaultHookTimeout). Without it they are skipped with a warning, since
+// they run arbitrary commands with the privileges of the process.
+func WithHooks(timeout time.Duration) DeviceOption {
+	return func(w *WireGuardDevice) {
+		w.runHooks = true
+		if timeout > 0 {
+			w.hookTimeout = timeout
+		}
+	}
+}
+
+// warnSkippedHooks logs that the config has hooks that won't run
+func (w *WireGuardDevice) warnSkippedHooks() {
+	count := len(w.Config.PreUp) + len(w.Config.PostUp) + len(w.Config.PreDown) + len(w.Config.PostDown)
+	if count > 0 && !w.runHooks {
+		log.Printf("WARNING: skipping %d PreUp/PostUp/PreDown/PostDown hooks of the WireGuard config, hooks are not allowed", count)
+	}
+}
+
+// hook runs the commands of one hook stage in order through the system shell, with %i replaced by
+// the device name, logging their output. It stops at the first command that fails.
+func (w *WireGuardDevice) hook(stage string, commands []string) error {
+	if !w.runHooks {
+		return nil
+	}
+	for _, command := range commands {
+		command = strings.ReplaceAll(command, "%i", w.name)
+		log.Printf("Running %s hook: %s", stage, command)
+
+		ctx, cancel := context.WithTimeout(context.Background(), w.hookTimeout)
+		cmd := shellCommand(ctx, command)
+		cmd.WaitDelay = time.Second // don't wait on children of a killed command that hold its output open
+		output, err := cmd.CombinedOutput()
+		cancel()
+		for line := range strings.SplitSeq(strings.TrimRight(string(output), "\n"), "\n") {
+			if line != "" {
+				log.Printf("%s: %s", stage, line)
+			}
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%s hook %q timed out after %s", stage, command, w.hookTimeout)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %v", stage, command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package wireguard
+
+import (
+	"context"
+	"os/exec"
+)
+
+// shellCommand runs command with sh, as wg-quick runs its hooks with bash
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
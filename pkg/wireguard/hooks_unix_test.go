@@ -0,0 +1,91 @@
+//go:build !windows
+
+package wireguard
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hookConfig returns a device config without peers whose hooks append their stage and %i to log
+func hookConfig(t *testing.T, log string) string {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = 10.99.0.1/24\nMTU = 1420\n", base64.StdEncoding.EncodeToString(key.Bytes()))
+	for _, stage := range []string{"PreUp", "PostUp", "PreDown", "PostDown"} {
+		config += fmt.Sprintf("%s = echo %s %%i >> %s\n", stage, stage, log)
+	}
+	return config
+}
+
+// readHookLog returns the lines the hooks appended to log
+func readHookLog(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestHooksRunInOrder(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	w, err := NewWireGuardDevice(hookConfig(t, log), false, WithName("wg-test"), WithHooks(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"PreUp wg-test", "PostUp wg-test"}
+	if got := readHookLog(t, log); !slices.Equal(got, want) {
+		t.Errorf("hooks after startup = %q, want %q", got, want)
+	}
+
+	w.Close()
+	want = append(want, "PreDown wg-test", "PostDown wg-test")
+	if got := readHookLog(t, log); !slices.Equal(got, want) {
+		t.Errorf("hooks after Close = %q, want %q", got, want)
+	}
+}
+
+func TestHooksSkippedWithoutPermission(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	w, err := NewWireGuardDevice(hookConfig(t, log), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if lines := readHookLog(t, log); lines != nil {
+		t.Errorf("hooks ran without WithHooks: %q", lines)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	w := &WireGuardDevice{name: "wg-test", runHooks: true, hookTimeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	err := w.hook("PostUp", []string{"sleep 10", "echo never"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("hook error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hook returned after %v, want soon after its timeout", elapsed)
+	}
+
+	// A failing command stops the stage with its error
+	if err := w.hook("PreUp", []string{"exit 3"}); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("hook error = %v, want the command's failure", err)
+	}
+}
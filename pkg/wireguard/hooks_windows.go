@@ -0,0 +1,13 @@
+//go:build windows
+
+package wireguard
+
+import (
+	"context"
+	"os/exec"
+)
+
+// shellCommand runs command with cmd.exe
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd.exe", "/C", command)
+}
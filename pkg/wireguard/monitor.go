@@ -0,0 +1,178 @@
+package wireguard
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// DefaultHandshakeCheckInterval is how often the handshake monitor polls the device
+	DefaultHandshakeCheckInterval = 30 * time.Second
+
+	// DefaultMaxHandshakeAge is how old a peer's last handshake may get before it is considered unreachable
+	DefaultMaxHandshakeAge = 3 * time.Minute
+
+	// DefaultTunnelDownAge is how old a peer's last handshake may get before the tunnel to it is
+	// considered down rather than degraded
+	DefaultTunnelDownAge = 5 * time.Minute
+)
+
+// TunnelHealth is the state of the tunnel to a peer, judged by the age of its last handshake
+type TunnelHealth string
+
+const (
+	// TunnelUp means the peer completed a handshake within DefaultMaxHandshakeAge. WireGuard
+	// renews the handshake every two minutes while packets flow.
+	TunnelUp TunnelHealth = "up"
+
+	// TunnelDegraded means the session with the peer expired and no new handshake has completed
+	// yet, so no packets get through while WireGuard retries
+	TunnelDegraded TunnelHealth = "degraded"
+
+	// TunnelDown means the peer went DefaultTunnelDownAge without a handshake
+	TunnelDown TunnelHealth = "down"
+)
+
+// healthRank orders the states from worst to best
+var healthRank = map[TunnelHealth]int{TunnelDown: 0, TunnelDegraded: 1, TunnelUp: 2}
+
+// HandshakeMonitor watches the WireGuard peers' handshakes and tracks the health of the tunnel
+// to each of them. The tunnel interface stays up when the remote peer disappears, so this is the
+// only local signal that the other side can no longer be reached.
+type HandshakeMonitor struct {
+	dev      *device.Device
+	interval time.Duration
+	onChange func(publicKey string, health TunnelHealth, age time.Duration)
+	started  time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu        sync.Mutex
+	peers     map[string]TunnelHealth // by base64 public key
+	observers []func(now time.Time, peers []PeerStats)
+}
+
+// NewHandshakeMonitor creates a monitor that calls onChange whenever the tunnel to a peer changes
+// state, with the age of the peer's last handshake. Peers start out up, so the first call for a
+// peer is when its tunnel degrades.
+func NewHandshakeMonitor(dev *device.Device, onChange func(publicKey string, health TunnelHealth, age time.Duration)) *HandshakeMonitor {
+	return &HandshakeMonitor{
+		dev:      dev,
+		interval: DefaultHandshakeCheckInterval,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+		peers:    make(map[string]TunnelHealth),
+	}
+}
+
+// Start checks the peers once and then keeps polling the device in the background
+func (m *HandshakeMonitor) Start() {
+	m.started = time.Now()
+	m.check()
+
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.check()
+			}
+		}
+	}()
+}
+
+// Stop stops the monitor
+func (m *HandshakeMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Health returns the best state of the tunnels to the peers: up while any peer completes
+// handshakes, down only when none has for DefaultTunnelDownAge. A device without peers is up.
+func (m *HandshakeMonitor) Health() TunnelHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.peers) == 0 {
+		return TunnelUp
+	}
+	best := TunnelDown
+	for _, health := range m.peers {
+		if healthRank[health] > healthRank[best] {
+			best = health
+		}
+	}
+	return best
+}
+
+// Peers returns the state of the tunnel to each peer by base64 public key, as of the last check
+func (m *HandshakeMonitor) Peers() map[string]TunnelHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.peers)
+}
+
+// Observe has fn called with the peers read by every check of the monitor from now on, in the
+// monitor's goroutine, so that other checks on the handshakes share its polls
+func (m *HandshakeMonitor) Observe(fn func(now time.Time, peers []PeerStats)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, fn)
+}
+
+// check updates the state of every peer, reports those that changed through the callback and
+// hands the peers to the observers
+func (m *HandshakeMonitor) check() {
+	ipc, err := m.dev.IpcGet()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	peers := parsePeerStats(ipc)
+	defer m.notify(now, peers)
+	for _, peer := range peers {
+		// A peer that never completed a handshake is timed from when monitoring started
+		lastHandshake := peer.LastHandshake
+		if lastHandshake.IsZero() {
+			lastHandshake = m.started
+		}
+		age := now.Sub(lastHandshake)
+
+		health := TunnelUp
+		switch {
+		case age > DefaultTunnelDownAge:
+			health = TunnelDown
+		case age > DefaultMaxHandshakeAge:
+			health = TunnelDegraded
+		}
+
+		m.mu.Lock()
+		previous, known := m.peers[peer.PublicKey]
+		m.peers[peer.PublicKey] = health
+		m.mu.Unlock()
+
+		if health != previous && (known || health != TunnelUp) && m.onChange != nil {
+			m.onChange(peer.PublicKey, health, age)
+		}
+	}
+}
+
+// notify hands the peers of a check to the observers
+func (m *HandshakeMonitor) notify(now time.Time, peers []PeerStats) {
+	m.mu.Lock()
+	observers := slices.Clone(m.observers)
+	m.mu.Unlock()
+	for _, fn := range observers {
+		fn(now, peers)
+	}
+}
@@ -0,0 +1,34 @@
+package wireguard_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+func TestHandshakeMonitorObserve(t *testing.T) {
+	pair := wgtest.NewPair(t)
+	monitor := wireguard.NewHandshakeMonitor(pair.Client.Device, nil)
+	defer monitor.Stop()
+
+	// Observers get the peers the monitor read on its poll
+	polled := make(chan []wireguard.PeerStats, 1)
+	monitor.Observe(func(now time.Time, peers []wireguard.PeerStats) {
+		polled <- peers
+	})
+	monitor.Start()
+
+	select {
+	case peers := <-polled:
+		if len(peers) != 1 || peers[0].PublicKey == "" {
+			t.Errorf("observer got peers %+v, want the server", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("observer was not called on the first poll")
+	}
+	if health := monitor.Health(); health != wireguard.TunnelUp {
+		t.Errorf("Health() = %s, want up", health)
+	}
+}
@@ -0,0 +1,208 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DevonTM/wg-rp/pkg/config"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// Sizes ProbePathMTU searches between: the smallest packet every IPv4 host must accept (IPv6
+// requires 1280) and the largest that fits an Ethernet frame
+const (
+	minProbeMTU     = 576
+	minProbeMTUIPv6 = 1280
+	maxProbeMTU     = 1500
+)
+
+// IP and ICMP header sizes of an echo request
+const (
+	echoHeaderIPv4 = 20 + 8
+	echoHeaderIPv6 = 40 + 8
+)
+
+// How long ProbePathMTU waits for the reply to each probe: the first one has the device complete its
+// handshake, so it gets longer
+const (
+	firstProbeTimeout = 5 * time.Second
+	probeTimeout      = time.Second
+	probeAttempts     = 2
+)
+
+// WithMTU sets the MTU of the device, in place of the one in the config or detected
+func WithMTU(mtu int) DeviceOption {
+	return func(w *WireGuardDevice) {
+		w.mtu = mtu
+	}
+}
+
+// WithPathMTUProbe has the device probe the path to peerIP for the largest packet that gets through
+// and use it as its MTU, in place of the one in the config or detected. peerIP is a tunnel address
+// of a peer, empty for the first host route in the AllowedIPs of the peers. If the probe fails, the
+// MTU is kept.
+func WithPathMTUProbe(peerIP string) DeviceOption {
+	return func(w *WireGuardDevice) {
+		w.probeMTU = true
+		w.probePeer = peerIP
+	}
+}
+
+// ProbePathMTU finds the largest IP packet, between 576 (1280 for IPv6) and 1500 bytes, that reaches
+// peerIP through tnet and gets an ICMP echo reply, by binary search. tnet must not fragment packets
+// up to 1500 bytes, so its MTU has to be at least that; packets too large for the path between the
+// peers are then dropped on the way instead of split.
+func ProbePathMTU(tnet *netstack.Net, peerIP string) (int, error) {
+	addr, err := netip.ParseAddr(strings.Trim(peerIP, "[]"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid peer IP %q: %v", peerIP, err)
+	}
+	addr = addr.Unmap()
+
+	pc, err := tnet.DialPingAddr(netip.Addr{}, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	p := &pinger{conn: pc, v6: addr.Is6()}
+	lo, hi := minProbeMTU, maxProbeMTU
+	if p.v6 {
+		lo = minProbeMTUIPv6
+	}
+	if !p.echo(lo, firstProbeTimeout) {
+		return 0, fmt.Errorf("%s doesn't answer pings of %d bytes", addr, lo)
+	}
+
+	// lo is known to get through; find the largest size above it that does
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if p.echo(mid, probeTimeout) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// pinger sends echo requests of a given size over a ping connection
+type pinger struct {
+	conn *netstack.PingConn
+	v6   bool
+	seq  int
+}
+
+// echo reports whether an echo request of size bytes, IP header included, gets a reply within
+// timeout, trying probeAttempts times
+func (p *pinger) echo(size int, timeout time.Duration) bool {
+	for range probeAttempts {
+		p.seq++
+		if p.send(size) == nil && p.awaitReply(timeout) {
+			return true
+		}
+	}
+	return false
+}
+
+// send writes an echo request of size bytes with the current sequence number. The netstack sets
+// its identifier and checksum.
+func (p *pinger) send(size int) error {
+	var msgType icmp.Type = ipv4.ICMPTypeEcho
+	header := echoHeaderIPv4
+	if p.v6 {
+		msgType, header = ipv6.ICMPTypeEchoRequest, echoHeaderIPv6
+	}
+	msg := icmp.Message{
+		Type: msgType,
+		Body: &icmp.Echo{Seq: p.seq, Data: make([]byte, size-header)},
+	}
+	data, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.Write(data)
+	return err
+}
+
+// awaitReply waits for the echo reply to the current sequence number, skipping late replies to
+// earlier probes
+func (p *pinger) awaitReply(timeout time.Duration) bool {
+	proto, replyType := 1, icmp.Type(ipv4.ICMPTypeEchoReply)
+	if p.v6 {
+		proto, replyType = 58, ipv6.ICMPTypeEchoReply
+	}
+
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, maxProbeMTU)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			return false
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != replyType {
+			continue
+		}
+		if echo, ok := msg.Body.(*icmp.Echo); ok && echo.Seq == p.seq {
+			return true
+		}
+	}
+}
+
+// probePathMTU brings up a throwaway device whose netstack takes packets of up to 1500 bytes,
+// probes the path to the peer through it and closes it again
+func (w *WireGuardDevice) probePathMTU(wgConfig *config.WireGuardConfig) (int, error) {
+	peerIP := w.probePeer
+	if peerIP == "" {
+		peer, ok := firstPeerHost(wgConfig)
+		if !ok {
+			return 0, errors.New("no peer has a host route to probe, set the peer IP")
+		}
+		peerIP = peer.String()
+	}
+
+	tun, tnet, err := netstack.CreateNetTUN(wgConfig.InterfaceIPs, []netip.Addr{}, maxProbeMTU)
+	if err != nil {
+		return 0, err
+	}
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.IpcSet(wgConfig.IPCConfig); err != nil {
+		return 0, err
+	}
+	if err := dev.Up(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Probing the path MTU to %s...", peerIP)
+	return ProbePathMTU(tnet, peerIP)
+}
+
+// firstPeerHost returns the first host route (a /32 or /128) in the AllowedIPs of the peers that
+// isn't an address of the interface and is in the family of one
+func firstPeerHost(wgConfig *config.WireGuardConfig) (netip.Addr, bool) {
+	for _, peer := range wgConfig.Peers {
+		for _, prefix := range peer.AllowedIPs {
+			addr := prefix.Addr().Unmap()
+			if !prefix.IsSingleIP() || slices.Contains(wgConfig.InterfaceIPs, addr) {
+				continue
+			}
+			if slices.ContainsFunc(wgConfig.InterfaceIPs, func(ip netip.Addr) bool { return ip.Is4() == addr.Is4() }) {
+				return addr, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,73 @@
+package wireguard_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/DevonTM/wg-rp/pkg/config"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+func TestProbePathMTU(t *testing.T) {
+	pair := wgtest.NewPair(t)
+
+	// Loopback carries packets of every size probed, so the search ends at the top of its range
+	for _, peerIP := range []string{wgtest.ServerIP, wgtest.ServerIPv6} {
+		mtu, err := wireguard.ProbePathMTU(pair.Client.Tnet, peerIP)
+		if err != nil {
+			t.Fatalf("probing %s: %v", peerIP, err)
+		}
+		if mtu != 1500 {
+			t.Errorf("path MTU to %s = %d, want 1500", peerIP, mtu)
+		}
+	}
+
+	if _, err := wireguard.ProbePathMTU(pair.Client.Tnet, "not an IP"); err == nil {
+		t.Error("probing an invalid peer IP succeeded")
+	}
+}
+
+func TestFirstPeerHost(t *testing.T) {
+	addrs := func(s ...string) []netip.Addr {
+		var a []netip.Addr
+		for _, v := range s {
+			a = append(a, netip.MustParseAddr(v))
+		}
+		return a
+	}
+	peer := func(prefixes ...string) config.PeerConfig {
+		var p config.PeerConfig
+		for _, v := range prefixes {
+			p.AllowedIPs = append(p.AllowedIPs, netip.MustParsePrefix(v))
+		}
+		return p
+	}
+
+	tests := []struct {
+		name  string
+		iface []netip.Addr
+		peers []config.PeerConfig
+		want  string // empty for none
+	}{
+		{"host route", addrs("10.0.0.2"), []config.PeerConfig{peer("10.0.0.0/24", "10.0.0.1/32")}, "10.0.0.1"},
+		{"later peer", addrs("10.0.0.2"), []config.PeerConfig{peer("0.0.0.0/0"), peer("10.0.0.3/32")}, "10.0.0.3"},
+		{"own address skipped", addrs("10.0.0.2"), []config.PeerConfig{peer("10.0.0.2/32", "10.0.0.1/32")}, "10.0.0.1"},
+		{"family without an address skipped", addrs("10.0.0.2"), []config.PeerConfig{peer("fd00::1/128", "10.0.0.1/32")}, "10.0.0.1"},
+		{"IPv6", addrs("fd00::2"), []config.PeerConfig{peer("fd00::1/128")}, "fd00::1"},
+		{"no host route", addrs("10.0.0.2"), []config.PeerConfig{peer("10.0.0.0/24")}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, ok := wireguard.FirstPeerHost(&config.WireGuardConfig{InterfaceIPs: tt.iface, Peers: tt.peers})
+			got := ""
+			if ok {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("firstPeerHost = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package wireguard
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReresolveAfter is how old a peer's last handshake may get before the hostname of its
+// endpoint is looked up again: by then the session expired, so packets to a stale address are lost
+const DefaultReresolveAfter = DefaultMaxHandshakeAge
+
+// EndpointResolver looks up the hostnames of the peers' endpoints again and moves the device to
+// the new address if one changed, e.g. a server on a dynamic DNS name whose public IP changed.
+// The config resolves each hostname once, and WireGuard keeps sending to that address otherwise.
+// It checks the peers on the polls of a HandshakeMonitor.
+type EndpointResolver struct {
+	dev        *WireGuardDevice
+	monitor    *HandshakeMonitor
+	staleAfter time.Duration // re-resolve a peer whose last handshake is older, 0 to disable
+	interval   time.Duration // re-resolve every peer this often regardless, 0 to disable
+	peers      []*resolvedPeer
+	started    time.Time
+	stopped    atomic.Bool
+
+	// resolve looks up a peer's hostname, resolveEndpoint but in tests
+	resolve func(host, port string, v4 bool) (string, error)
+}
+
+// resolvedPeer is a peer whose endpoint was given as a hostname
+type resolvedPeer struct {
+	publicKey    string // base64
+	hexKey       string // as the IPC interface takes it
+	host         string
+	port         string
+	v4           bool      // the hostname first resolved to IPv4, the family preferred later
+	lastResolved time.Time // zero until re-resolved
+	failing      bool      // the last lookup failed, so further failures aren't logged
+}
+
+// NewEndpointResolver creates a resolver for the peers of w with a hostname endpoint, checked
+// whenever monitor polls the device. A peer is re-resolved when its last handshake gets older
+// than staleAfter, at most once per staleAfter while it stays so, and every peer each interval;
+// either is disabled with 0.
+func NewEndpointResolver(w *WireGuardDevice, monitor *HandshakeMonitor, staleAfter, interval time.Duration) *EndpointResolver {
+	r := &EndpointResolver{
+		dev:        w,
+		monitor:    monitor,
+		staleAfter: staleAfter,
+		interval:   interval,
+		resolve:    resolveEndpoint,
+	}
+	for _, peer := range w.Config.Peers {
+		if peer.EndpointHost == "" || peer.PublicKey == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(peer.PublicKey)
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddrPort(peer.Endpoint)
+		if err != nil {
+			continue
+		}
+		r.peers = append(r.peers, &resolvedPeer{
+			publicKey: peer.PublicKey,
+			hexKey:    hex.EncodeToString(key),
+			host:      peer.EndpointHost,
+			port:      fmt.Sprint(addr.Port()),
+			v4:        addr.Addr().Unmap().Is4(),
+		})
+	}
+	return r
+}
+
+// Start has the resolver check the peers on each poll of the monitor, every
+// DefaultHandshakeCheckInterval, so an interval is kept to within one poll. It does nothing if no
+// peer has a hostname endpoint or both triggers are disabled.
+func (r *EndpointResolver) Start() {
+	if len(r.peers) == 0 || (r.staleAfter <= 0 && r.interval <= 0) {
+		return
+	}
+	r.started = time.Now()
+	r.monitor.Observe(r.check)
+}
+
+// Stop stops the resolver
+func (r *EndpointResolver) Stop() {
+	r.stopped.Store(true)
+}
+
+// check re-resolves the peers that are due: those without a recent handshake that weren't looked
+// up within staleAfter, and all of them once per interval
+func (r *EndpointResolver) check(now time.Time, stats []PeerStats) {
+	if r.stopped.Load() {
+		return
+	}
+	current := make(map[string]PeerStats, len(stats))
+	for _, s := range stats {
+		current[s.PublicKey] = s
+	}
+
+	for _, peer := range r.peers {
+		s, ok := current[peer.publicKey]
+		if !ok {
+			continue
+		}
+
+		// A peer that never completed a handshake, or was never re-resolved, is timed from when
+		// the resolver started
+		lastHandshake := s.LastHandshake
+		if lastHandshake.IsZero() {
+			lastHandshake = r.started
+		}
+		lastResolved := peer.lastResolved
+		if lastResolved.IsZero() {
+			lastResolved = r.started
+		}
+
+		// While the peer stays without handshakes, e.g. a server that is down, its hostname is
+		// looked up once per staleAfter rather than on every poll
+		stale := r.staleAfter > 0 && now.Sub(lastHandshake) > r.staleAfter && now.Sub(lastResolved) >= r.staleAfter
+		due := r.interval > 0 && now.Sub(lastResolved) >= r.interval
+		if !stale && !due {
+			continue
+		}
+		peer.lastResolved = now
+		r.refresh(peer, s.Endpoint, stale)
+	}
+}
+
+// refresh looks up the peer's hostname and points the device at the new address if it differs
+// from endpoint, the one the device sends to
+func (r *EndpointResolver) refresh(peer *resolvedPeer, endpoint string, stale bool) {
+	resolved, err := r.resolve(peer.host, peer.port, peer.v4)
+	if err != nil {
+		if !peer.failing {
+			log.Printf("WARNING: failed to re-resolve endpoint %s of peer %s: %v", peer.host, peer.publicKey, err)
+		}
+		peer.failing = true
+		return
+	}
+	if peer.failing {
+		log.Printf("Endpoint %s of peer %s resolves again", peer.host, peer.publicKey)
+		peer.failing = false
+	}
+	if resolved == endpoint {
+		return
+	}
+
+	// update_only leaves the peer's keys, allowed IPs and keepalive as they are
+	ipc := fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peer.hexKey, resolved)
+	if err := r.dev.Device.IpcSet(ipc); err != nil {
+		log.Printf("WARNING: failed to update endpoint of peer %s to %s: %v", peer.publicKey, resolved, err)
+		return
+	}
+	reason := "periodic re-resolution"
+	if stale {
+		reason = "no recent handshake"
+	}
+	log.Printf("Endpoint %s of peer %s moved from %s to %s (%s)", peer.host, peer.publicKey, endpoint, resolved, reason)
+}
+
+// resolveEndpoint looks up host and returns the first address in the preferred family, IPv4 if
+// v4 is set, with port as ip:port. If host no longer has an address in that family, the first of
+// the other is used.
+func resolveEndpoint(host, port string, v4 bool) (string, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+
+	chosen := ips[0]
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			chosen = ip
+			break
+		}
+	}
+	return net.JoinHostPort(chosen.String(), port), nil
+}
@@ -0,0 +1,94 @@
+package wireguard
+
+import (
+	"testing"
+	"time"
+)
+
+// countingResolver returns a resolver for one peer whose lookups return the endpoint the device
+// already sends to, counting them
+func countingResolver(staleAfter, interval time.Duration, started time.Time) (*EndpointResolver, *int) {
+	lookups := 0
+	r := &EndpointResolver{
+		staleAfter: staleAfter,
+		interval:   interval,
+		started:    started,
+		peers:      []*resolvedPeer{{publicKey: "peer", host: "vpn.example.com", port: "51820", v4: true}},
+		resolve: func(host, port string, v4 bool) (string, error) {
+			lookups++
+			return "192.0.2.1:51820", nil
+		},
+	}
+	return r, &lookups
+}
+
+func TestEndpointResolverRateLimitsStaleLookups(t *testing.T) {
+	started := time.Unix(1792294492, 0)
+	r, lookups := countingResolver(3*time.Minute, 0, started)
+	handshake := started.Add(time.Minute)
+
+	// Poll every 30 seconds for 20 minutes after the last handshake, as the monitor does while the
+	// server is down: the hostname is looked up once the handshake is stale, then every 3 minutes
+	var at []time.Duration
+	for now := started; now.Before(handshake.Add(20 * time.Minute)); now = now.Add(DefaultHandshakeCheckInterval) {
+		before := *lookups
+		r.check(now, []PeerStats{{PublicKey: "peer", Endpoint: "192.0.2.1:51820", LastHandshake: handshake}})
+		if *lookups > before {
+			at = append(at, now.Sub(handshake))
+		}
+	}
+
+	want := []time.Duration{3*time.Minute + 30*time.Second, 6*time.Minute + 30*time.Second, 9*time.Minute + 30*time.Second,
+		12*time.Minute + 30*time.Second, 15*time.Minute + 30*time.Second, 18*time.Minute + 30*time.Second}
+	if len(at) != len(want) {
+		t.Fatalf("looked up at %v after the handshake, want %v", at, want)
+	}
+	for i := range want {
+		if at[i] != want[i] {
+			t.Errorf("lookup %d at %v after the handshake, want %v", i, at[i], want[i])
+		}
+	}
+}
+
+func TestEndpointResolverTriggers(t *testing.T) {
+	started := time.Unix(1792294492, 0)
+	tests := []struct {
+		name              string
+		staleAfter        time.Duration
+		interval          time.Duration
+		handshakeAge      time.Duration // at the check, 10 minutes after starting
+		lastResolvedSince time.Duration // before the check, 0 for never
+		want              int
+	}{
+		{"recent handshake", 3 * time.Minute, 0, time.Minute, 0, 0},
+		{"stale handshake", 3 * time.Minute, 0, 4 * time.Minute, 0, 1},
+		{"stale but just looked up", 3 * time.Minute, 0, 4 * time.Minute, time.Minute, 0},
+		{"stale trigger disabled", 0, 0, time.Hour, 0, 0},
+		{"interval due", 0, 5 * time.Minute, time.Minute, 6 * time.Minute, 1},
+		{"interval not due", 0, 5 * time.Minute, time.Minute, 4 * time.Minute, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, lookups := countingResolver(tt.staleAfter, tt.interval, started)
+			now := started.Add(10 * time.Minute)
+			if tt.lastResolvedSince > 0 {
+				r.peers[0].lastResolved = now.Add(-tt.lastResolvedSince)
+			}
+			r.check(now, []PeerStats{{PublicKey: "peer", Endpoint: "192.0.2.1:51820", LastHandshake: now.Add(-tt.handshakeAge)}})
+			if *lookups != tt.want {
+				t.Errorf("looked up %d times, want %d", *lookups, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpointResolverStopped(t *testing.T) {
+	started := time.Unix(1792294492, 0)
+	r, lookups := countingResolver(3*time.Minute, time.Minute, started)
+	r.Stop()
+	r.check(started.Add(time.Hour), []PeerStats{{PublicKey: "peer"}})
+	if *lookups != 0 {
+		t.Errorf("stopped resolver looked up %d times", *lookups)
+	}
+}
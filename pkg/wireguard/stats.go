@@ -0,0 +1,93 @@
+package wireguard
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PeerStats describes a peer of the device as its IPC interface reports it
+type PeerStats struct {
+	PublicKey     string    // base64, as in WireGuard configs
+	Endpoint      string    // ip:port packets are sent to, empty until the peer's address is known
+	LastHandshake time.Time // zero if no handshake has completed
+	RxBytes       uint64
+	TxBytes       uint64
+}
+
+// HandshakeStale reports whether the peer went longer than DefaultMaxHandshakeAge without a
+// handshake, counting one that never completed. WireGuard renews the handshake every two minutes
+// while packets flow, so an older one almost always means the tunnel is down.
+func (p PeerStats) HandshakeStale(now time.Time) bool {
+	return p.LastHandshake.IsZero() || now.Sub(p.LastHandshake) > DefaultMaxHandshakeAge
+}
+
+// Stats returns the peers of the device with their endpoints, last handshakes and traffic
+func (w *WireGuardDevice) Stats() ([]PeerStats, error) {
+	ipc, err := w.Device.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+	return parsePeerStats(ipc), nil
+}
+
+// parsePeerStats extracts the peers from the device's IPC output, in its order. Each peer's
+// section starts with its public_key line; the device settings before the first are skipped.
+func parsePeerStats(ipc string) []PeerStats {
+	var peers []PeerStats
+	var handshakeSec, handshakeNsec int64
+
+	// finishPeer sets the last handshake of the peer being parsed, which takes two lines
+	finishPeer := func() {
+		if len(peers) > 0 && handshakeSec > 0 {
+			peers[len(peers)-1].LastHandshake = time.Unix(handshakeSec, handshakeNsec)
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(ipc))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if key == "public_key" {
+			finishPeer()
+			peers = append(peers, PeerStats{PublicKey: base64Key(value)})
+			continue
+		}
+		if len(peers) == 0 {
+			continue
+		}
+
+		peer := &peers[len(peers)-1]
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "last_handshake_time_sec":
+			handshakeSec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, _ = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.RxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+	finishPeer()
+
+	return peers
+}
+
+// base64Key converts a key from the hex of the IPC interface to base64, or returns it unchanged
+// if it isn't hex
+func base64Key(hexKey string) string {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return hexKey
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
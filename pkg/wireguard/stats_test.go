@@ -0,0 +1,86 @@
+package wireguard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestParsePeerStats parses IPC output captured from devices, with the private keys replaced
+func TestParsePeerStats(t *testing.T) {
+	client := []PeerStats{{
+		PublicKey:     "KhzXlmA0eXLAlOwTckD4HaYSAodLTCon2OREe0AIaUc=",
+		Endpoint:      "127.0.0.1:56824",
+		LastHandshake: time.Unix(1792294492, 260301104),
+		RxBytes:       92,
+		TxBytes:       212,
+	}}
+	tests := []struct {
+		fixture string
+		want    []PeerStats
+	}{
+		{"client.txt", client},
+		{"uapi_socket.txt", client},
+		{"no_peers.txt", nil},
+		{"server.txt", []PeerStats{
+			{
+				PublicKey:     "ekqFg9t+eZxd5tQY7IM7OrrkPyUj2yrsL5zRrzM94yU=",
+				Endpoint:      "198.51.100.20:41394",
+				LastHandshake: time.Unix(1792294492, 261156934),
+				RxBytes:       5368709120,
+				TxBytes:       18446744073709551615,
+			},
+			{
+				PublicKey:     "wanzstBOim9bfC0eD5qLfG1eTzAhEgOUhXamtcTT4vE=",
+				Endpoint:      "[2001:db8::5]:51820",
+				LastHandshake: time.Unix(1792294310, 0),
+				RxBytes:       4096,
+				TxBytes:       1048576,
+			},
+			{PublicKey: "Xm9wgZKjtMXW5/gJGis8TV5vcIGSo7TF1uf4CRorPE0="},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			ipc, err := os.ReadFile(filepath.Join("testdata", "ipc", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parsePeerStats(string(ipc)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePeerStats() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePeerStatsMalformed(t *testing.T) {
+	// Lines that aren't key=value, values that aren't numbers and keys the device doesn't send
+	// are skipped, and a key that isn't hex is kept as it is
+	ipc := "garbage\npublic_key=not-hex\nrx_bytes=lots\ntx_bytes=-1\nlast_handshake_time_sec=x\nfuture_key=1\nendpoint=10.0.0.1:1\n"
+	want := []PeerStats{{PublicKey: "not-hex", Endpoint: "10.0.0.1:1"}}
+	if got := parsePeerStats(ipc); !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePeerStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestHandshakeStale(t *testing.T) {
+	now := time.Unix(1792294492, 0)
+	tests := []struct {
+		name          string
+		lastHandshake time.Time
+		want          bool
+	}{
+		{"never", time.Time{}, true},
+		{"just now", now, false},
+		{"at the limit", now.Add(-DefaultMaxHandshakeAge), false},
+		{"past the limit", now.Add(-DefaultMaxHandshakeAge - time.Second), true},
+	}
+	for _, tt := range tests {
+		if got := (PeerStats{LastHandshake: tt.lastHandshake}).HandshakeStale(now); got != tt.want {
+			t.Errorf("%s: HandshakeStale() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// Netstack TCP buffer sizes in bytes, gVisor's own: each connection starts with DefaultTCPBuffer
+// for sending and receiving, and receive buffer moderation grows the receive buffer up to
+// MaxTCPBuffer as the link's bandwidth-delay product requires
+const (
+	MinTCPBuffer     = tcp.MinBufferSize
+	DefaultTCPBuffer = tcp.DefaultReceiveBufferSize
+	MaxTCPBuffer     = tcp.MaxBufferSize
+)
+
+// TCPTuning sizes the TCP buffers of the netstack. Zero fields keep DefaultTCPBuffer.
+type TCPTuning struct {
+	SendBuffer    int // bytes each connection may have in flight unacknowledged
+	ReceiveBuffer int // initial receive window of each connection, grown up to MaxTCPBuffer or this size
+}
+
+// WithTCPTuning sets the TCP buffer sizes of the netstack, with SACK and receive buffer moderation
+// enabled. They apply to connections accepted by listeners and dialed alike.
+func WithTCPTuning(tuning TCPTuning) DeviceOption {
+	return func(w *WireGuardDevice) {
+		w.tcpTuning = &tuning
+	}
+}
+
+// applyTCPTuning sets the TCP options of the netstack behind tnet. The stack's connections take
+// them when they're created, so they must be set before the first one is.
+func applyTCPTuning(tnet *netstack.Net, tuning TCPTuning) error {
+	s, err := netstackStack(tnet)
+	if err != nil {
+		return err
+	}
+
+	sack := tcpip.TCPSACKEnabled(true)
+	moderate := tcpip.TCPModerateReceiveBufferOption(true)
+	send := bufferRange(tuning.SendBuffer)
+	receive := tcpip.TCPReceiveBufferSizeRangeOption(bufferRange(tuning.ReceiveBuffer))
+	for _, opt := range []struct {
+		name  string
+		value tcpip.SettableTransportProtocolOption
+	}{
+		{"SACK", &sack},
+		{"receive buffer moderation", &moderate},
+		{"send buffer size", &send},
+		{"receive buffer size", &receive},
+	} {
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt.value); err != nil {
+			return fmt.Errorf("failed to set netstack TCP %s: %v", opt.name, err)
+		}
+	}
+	return nil
+}
+
+// bufferRange returns the buffer range of a connection starting with size bytes, 0 for
+// DefaultTCPBuffer
+func bufferRange(size int) tcpip.TCPSendBufferSizeRangeOption {
+	if size == 0 {
+		size = DefaultTCPBuffer
+	}
+	return tcpip.TCPSendBufferSizeRangeOption{
+		Min:     MinTCPBuffer,
+		Default: size,
+		Max:     max(size, MaxTCPBuffer),
+	}
+}
+
+// netstackStack returns the gVisor stack behind tnet, which wireguard-go doesn't export
+func netstackStack(tnet *netstack.Net) (*stack.Stack, error) {
+	field := reflect.ValueOf(tnet).Elem().FieldByName("stack")
+	if !field.IsValid() || field.Type() != reflect.TypeFor[*stack.Stack]() {
+		return nil, errors.New("the netstack of this wireguard-go version can't be tuned")
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface().(*stack.Stack), nil
+}
@@ -0,0 +1,45 @@
+package wireguard_test
+
+import (
+	"testing"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+func TestWithTCPTuning(t *testing.T) {
+	tuning := wireguard.TCPTuning{SendBuffer: 4 << 20, ReceiveBuffer: 2 << 20}
+	pair := wgtest.NewPair(t, wireguard.WithTCPTuning(tuning))
+
+	// Both ends take the sizes, so listeners' and dialers' connections get them alike
+	for name, dev := range map[string]*wireguard.WireGuardDevice{"server": pair.Server, "client": pair.Client} {
+		s, err := wireguard.NetstackStack(dev.Tnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var send tcpip.TCPSendBufferSizeRangeOption
+		var receive tcpip.TCPReceiveBufferSizeRangeOption
+		var sack tcpip.TCPSACKEnabled
+		var moderate tcpip.TCPModerateReceiveBufferOption
+		for _, opt := range []tcpip.GettableTransportProtocolOption{&send, &receive, &sack, &moderate} {
+			if err := s.TransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if send.Default != tuning.SendBuffer || receive.Default != tuning.ReceiveBuffer || !bool(sack) || !bool(moderate) {
+			t.Errorf("%s send %+v, receive %+v, SACK %v, moderation %v, want %d and %d bytes with both on",
+				name, send, receive, sack, moderate, tuning.SendBuffer, tuning.ReceiveBuffer)
+		}
+		if send.Max < tuning.SendBuffer || receive.Max < wireguard.MaxTCPBuffer {
+			t.Errorf("%s maximums send %d, receive %d, below the sizes set", name, send.Max, receive.Max)
+		}
+	}
+
+	conn := dialPair(t, pair)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,99 @@
+package wireguard_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/DevonTM/wg-rp/internal/wgtest"
+	"github.com/DevonTM/wg-rp/pkg/wireguard"
+)
+
+// dialPair dials the server of pair from its client and discards what it receives
+func dialPair(tb testing.TB, pair *wgtest.Pair) net.Conn {
+	tb.Helper()
+	listener, err := pair.Server.Tnet.ListenTCPAddrPort(netip.MustParseAddrPort(wgtest.ServerIP + ":9000"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	conn, err := pair.Client.Tnet.DialTCPAddrPort(netip.MustParseAddrPort(wgtest.ServerIP + ":9000"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// BenchmarkTCPTuning sends 1MB writes from the client to the server of a tunnel, over loopback
+// and a relay adding 50ms of round-trip time. Once the bandwidth-delay product outgrows the send
+// buffer, throughput is capped at about the buffer size per round trip; run it with the RTT of
+// your link to choose a size.
+func BenchmarkTCPTuning(b *testing.B) {
+	data := make([]byte, 1<<20)
+	for _, rtt := range []time.Duration{0, 50 * time.Millisecond} {
+		for _, size := range []int{0, 1 << 20, 4 << 20, 8 << 20} {
+			name := "default"
+			if size > 0 {
+				name = fmt.Sprintf("%dMB", size>>20)
+			}
+			b.Run(fmt.Sprintf("rtt=%s/%s", rtt, name), func(b *testing.B) {
+				var opts []wireguard.DeviceOption
+				if size > 0 {
+					opts = append(opts, wireguard.WithTCPTuning(wireguard.TCPTuning{SendBuffer: size, ReceiveBuffer: size}))
+				}
+				pair := wgtest.NewDelayedPair(b, rtt, opts...)
+				conn := dialPair(b, pair)
+
+				b.SetBytes(int64(len(data)))
+				for b.Loop() {
+					if _, err := conn.Write(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkBatchSize sends 1MB writes from the client to the server of a tunnel over loopback,
+// with WireGuard moving packets one at a time, in small batches and in wireguard-go's own
+func BenchmarkBatchSize(b *testing.B) {
+	data := make([]byte, 1<<20)
+	for _, size := range []int{1, 8, 0} {
+		name := fmt.Sprintf("batch=%d", size)
+		if size == 0 {
+			name = "batch=default"
+		}
+		b.Run(name, func(b *testing.B) {
+			var opts []wireguard.DeviceOption
+			if size > 0 {
+				opts = append(opts, wireguard.WithBatchSize(size))
+			}
+			conn := dialPair(b, wgtest.NewPair(b, opts...))
+
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				if _, err := conn.Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}